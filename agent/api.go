@@ -20,6 +20,7 @@ import (
 	"io/ioutil"
 	"net/http"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 	"github.com/vma/glog"
@@ -28,9 +29,79 @@ import (
 // MaxAllowedLoad is memory load treshold to reject new snmp requests.
 var MaxAllowedLoad float64
 
+// Routes maps the agent api endpoints to their handler.
+var Routes = map[string]http.HandlerFunc{
+	model.SnmpJobURI:   auth.Handler(HandleSnmpRequest),
+	model.SnmpQueryURI: auth.Handler(HandleSnmpQuery),
+	model.CheckURI:     auth.Handler(HandleCheck),
+	model.OngoingURI:   auth.Handler(HandleOngoing),
+	model.PingJobURI:   auth.Handler(HandlePingRequest),
+
+	model.TrapDevicesURI: auth.Handler(HandleTrapDevices),
+}
+
 // HandleSnmpRequest handles snmp polling job requests.
 func HandleSnmpRequest(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("new poll request from %s", r.RemoteAddr)
+	req, ok := readSnmpRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if AddSnmpRequest(&req) {
+		log.Debugf("%s - request successfully queued", req.UID)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
+		return
+	}
+
+	glog.Warningf("no more workers, rejecting request %s", req.UID)
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
+	return
+}
+
+// HandleSnmpQuery handles on-demand snmp polling job requests. The job is queued
+// like a polling job and the json PollResult is returned with a status 200 at the
+// end of the poll, instead of the report. The result is also pushed to the exporters.
+func HandleSnmpQuery(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("new query request from %s", r.RemoteAddr)
+	req, ok := readSnmpRequest(w, r)
+	if !ok {
+		return
+	}
+
+	reply := make(chan PollResult, 1)
+	req.reply = reply
+	if !AddSnmpRequest(&req) {
+		glog.Warningf("no more workers, rejecting query %s", req.UID)
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
+		return
+	}
+	log.Debugf("%s - query successfully queued", req.UID)
+
+	var stop <-chan struct{}
+	if StopCtx != nil {
+		stop = StopCtx.Done()
+	}
+	select {
+	case res := <-reply:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+	case <-r.Context().Done():
+		log.Debugf("%s - query cancelled by client", req.UID)
+	case <-stop:
+		w.WriteHeader(http.StatusLocked)
+		fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
+	}
+}
+
+// readSnmpRequest reads the snmp request from the http request body. When the
+// request is rejected, the error status and the agent current load are written
+// to w and ok is false.
+func readSnmpRequest(w http.ResponseWriter, r *http.Request) (req SnmpRequest, ok bool) {
 	if MaxSNMPRequests == 0 {
 		log.Debug("snmp polling not enabled, rejecting request")
 		w.WriteHeader(http.StatusTooManyRequests)
@@ -70,25 +141,13 @@ func HandleSnmpRequest(w http.ResponseWriter, r *http.Request) {
 	r.Body.Close()
 	log.Debug3f("new request: %s", b)
 
-	var req SnmpRequest
 	if err := json.Unmarshal(b, &req); err != nil {
 		log.Debugf("invalid json request: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
 		return
 	}
-
-	if AddSnmpRequest(&req) {
-		log.Debugf("%s - request successfully queued", req.UID)
-		w.WriteHeader(http.StatusAccepted)
-		fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
-		return
-	}
-
-	glog.Warningf("no more workers, rejecting request %s", req.UID)
-	w.WriteHeader(http.StatusTooManyRequests)
-	fmt.Fprintf(w, "%.4f", CurrentSNMPLoad())
-	return
+	return req, true
 }
 
 // HandleCheck responds to keep-alive checks.
@@ -155,3 +214,43 @@ func HandlePingRequest(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusTooManyRequests)
 	}
 }
+
+// HandleTrapDevices sets the devices whose traps are accepted by the trap receiver,
+// given as a json trap device list. Invalid devices are skipped. Returns a status 501
+// if the receiver is disabled.
+func HandleTrapDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		log.Debugf("rejecting request from %s with %s method", r.RemoteAddr, r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if trapReceiver == nil {
+		log.Debug("trap receiver not enabled, rejecting trap devices")
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Debug2f("error reading body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.Body.Close()
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		log.Debugf("invalid trap devices: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	devices := make([]model.TrapDevice, 0, len(raws))
+	for _, raw := range raws {
+		var dev model.TrapDevice
+		if err := json.Unmarshal(raw, &dev); err != nil {
+			log.Warningf("skipping invalid trap device: %v", err)
+			continue
+		}
+		devices = append(devices, dev)
+	}
+	trapReceiver.SetDevices(devices)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,144 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+type snmpbatchResult struct {
+	results []Result
+	err     error
+}
+
+// batchSize returns the max number of oids per batched get request.
+func (s *SnmpRequest) batchSize() int {
+	if s.Device.MaxOidsPerGet > 0 {
+		return s.Device.MaxOidsPerGet
+	}
+	return gosnmp.MaxOids
+}
+
+// getMeasureBatched gets a scalar measure with get requests of up to batchSize oids,
+// using all available connections simultaneously.
+// If one of the batches results in an error, the last non-nil error is returned.
+func (s *SnmpRequest) getMeasureBatched(ctx context.Context, meas model.ScalarMeasure) ([]Result, error) {
+	var batches [][]model.Metric
+	size := s.batchSize()
+	for start := 0; start < len(meas.Metrics); start += size {
+		end := start + size
+		if end > len(meas.Metrics) {
+			end = len(meas.Metrics)
+		}
+		batches = append(batches, meas.Metrics[start:end])
+	}
+	batchChan := make(chan []model.Metric, len(batches))
+	defer close(batchChan)
+	for _, batch := range batches {
+		batchChan <- batch
+	}
+
+	batchResults := make(chan snmpbatchResult, len(batches))
+	for i, cli := range s.snmpClis {
+		go func(i int, cli *gosnmp.GoSNMP) {
+			cli.Context = ctx
+			for batch := range batchChan {
+				if meas.UseAlternateCommunity && s.Device.AlternateCommunity != "" {
+					cli.Community = s.Device.AlternateCommunity
+				} else {
+					cli.Community = s.Device.Community
+				}
+				s.Debugf(1, "con#%d: getting %d scalar oids in batch", i, len(batch))
+				res, err := s.getBatch(cli, batch)
+				batchResults <- snmpbatchResult{res, err}
+				if ErrIsUnreachable(err) {
+					// device unrechable, do not continue
+					break
+				}
+			}
+			s.Debugf(3, "con#%d: measure %s: batch loop terminated", i, meas.Name)
+		}(i, cli)
+	}
+
+	var results []Result
+	var snmpErr error
+	for range batches {
+		bres := <-batchResults
+		if bres.err != nil {
+			snmpErr = bres.err
+		}
+		if ErrIsUnreachable(bres.err) {
+			break
+		}
+		results = append(results, bres.results...)
+	}
+	return results, snmpErr
+}
+
+// getBatch gets all the metrics of the batch in a single get request.
+// If the device replies with an error status (noSuchName, genErr...), the batch
+// is split in two halves which are requested again, until the faulty oid is
+// isolated and skipped, so that it does not prevent getting the others.
+func (s *SnmpRequest) getBatch(cli *gosnmp.GoSNMP, batch []model.Metric) ([]Result, error) {
+	oids := make([]string, len(batch))
+	for i, metric := range batch {
+		oids[i] = string(metric.Oid)
+	}
+	pkt, err := cli.Get(oids)
+	s.Debugf(3, ">> pkt=%+v, err=%v", pkt, err)
+	if err != nil {
+		if len(batch) == 1 {
+			return nil, fmt.Errorf("get %s: %v", batch[0].Name, err)
+		}
+		return nil, fmt.Errorf("batch get of %d oids: %v", len(batch), err)
+	}
+	if pkt.Error != gosnmp.NoError {
+		if len(batch) == 1 {
+			s.Warningf("get %s: %v error, skipping result", batch[0].Name, pkt.Error)
+			return nil, nil
+		}
+		s.Debugf(1, "batch get: %v error for %d oids, splitting batch", pkt.Error, len(batch))
+		half := len(batch) / 2
+		results, err := s.getBatch(cli, batch[:half])
+		if ErrIsUnreachable(err) {
+			return results, err
+		}
+		results2, err2 := s.getBatch(cli, batch[half:])
+		if err2 == nil {
+			err2 = err
+		}
+		return append(results, results2...), err2
+	}
+
+	var results []Result
+	for i, pdu := range pkt.Variables {
+		if i >= len(batch) {
+			s.Warningf("batch get: more pdus than requested oids, skipping %s", pdu.Name)
+			break
+		}
+		s.Debugf(2, "pdu = %#v", pdu)
+		res, err := MakeResult(pdu, batch[i])
+		if err != nil {
+			s.Warningf("get %s: make result: %v", batch[i].Name, err)
+			continue
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// makeScalarMib returns count scalar metrics and the corresponding scalar measure
+// with an extra unknown oid at position badPos.
+func makeScalarMib(count, badPos int) ([]gosnmp.SnmpPDU, string) {
+	var mib []gosnmp.SnmpPDU
+	var metrics []string
+	for i := 1; i <= count; i++ {
+		oid := fmt.Sprintf(".1.3.6.1.4.1.9999.1.%d.0", i)
+		mib = append(mib, gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: i})
+		metrics = append(metrics, fmt.Sprintf(`{"Name":"scalar%d", "Oid":"%s", "Active":true}`, i, oid))
+		if i == badPos {
+			metrics = append(metrics, `{"Name":"unknown", "Oid":".1.3.6.1.4.1.9999.2.0", "Active":true}`)
+		}
+	}
+	measure := fmt.Sprintf(`"ScalarMeasures": [{"Name":"scalars", "Metrics":[%s]}]`, strings.Join(metrics, ","))
+	return mib, measure
+}
+
+func TestBatchGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		devParams  string
+		noSuchName bool
+		getSizes   []int
+		batched    bool
+	}{
+		{
+			"single",
+			"",
+			false,
+			[]int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+			false,
+		},
+		{
+			"batched",
+			`, "snmp_batch_get": true, "snmp_max_oids_per_get": 4`,
+			false,
+			[]int{4, 4, 3},
+			true,
+		},
+		{
+			"batched-nosuchname",
+			`, "snmp_batch_get": true, "snmp_max_oids_per_get": 4`,
+			true,
+			[]int{4, 4, 2, 2, 1, 1, 3},
+			true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mib, measure := makeScalarMib(10, 6)
+			resp, err := newMibResponder(mib)
+			if err != nil {
+				t.Fatalf("start responder: %v", err)
+			}
+			defer resp.Close()
+			resp.noSuchName = tt.noSuchName
+
+			res := pollV2(t, resp, 3000+i, tt.devParams, measure)
+			if res.pollErr != nil {
+				t.Fatalf("Poll: %v", res.pollErr)
+			}
+			if len(res.Scalar) != 1 {
+				t.Fatalf("Poll: expected 1 scalar measure, got %d", len(res.Scalar))
+			}
+			if count := len(res.Scalar[0].Results); count != 10 {
+				t.Errorf("Poll: expected 10 results, got %d", count)
+			}
+			for j, r := range res.Scalar[0].Results {
+				if r.Name != fmt.Sprintf("scalar%d", j+1) || r.Value != float64(j+1) {
+					t.Errorf("result#%d: unexpected name or value: %s=%v", j, r.Name, r.Value)
+				}
+			}
+			if res.Scalar[0].Batched != tt.batched {
+				t.Errorf("expected batched=%v, got %v", tt.batched, res.Scalar[0].Batched)
+			}
+			resp.Lock()
+			defer resp.Unlock()
+			if !reflect.DeepEqual(resp.getSizes, tt.getSizes) {
+				t.Errorf("expected get request sizes %v, got %v", tt.getSizes, resp.getSizes)
+			}
+		})
+	}
+}
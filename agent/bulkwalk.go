@@ -0,0 +1,166 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	// defaultMaxRepetitions is the gosnmp default bulk max-repetitions.
+	defaultMaxRepetitions = 50
+
+	// maxRepetitionsLimit is the highest max-repetitions value (encoded on a byte by gosnmp).
+	maxRepetitionsLimit = 255
+)
+
+// fastBulkReply is the max response time of a full bulk reply
+// for the max-repetitions to be increased in adaptive mode.
+var fastBulkReply = 200 * time.Millisecond
+
+// repetitionTuner adapts the bulk max-repetitions of a device to its
+// responses. It is shared by all the snmp connections of a request.
+type repetitionTuner struct {
+	value int
+	sync.Mutex
+}
+
+// newRepetitionTuner returns a tuner starting at initial max-repetitions,
+// or at gosnmp default if 0.
+func newRepetitionTuner(initial int) *repetitionTuner {
+	if initial <= 0 {
+		initial = defaultMaxRepetitions
+	}
+	if initial > maxRepetitionsLimit {
+		initial = maxRepetitionsLimit
+	}
+	return &repetitionTuner{value: initial}
+}
+
+// current returns the current max-repetitions value.
+func (t *repetitionTuner) current() int {
+	t.Lock()
+	defer t.Unlock()
+	return t.value
+}
+
+// shrink halves the max-repetitions value. Returns false if it
+// cannot be reduced anymore.
+func (t *repetitionTuner) shrink() bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.value <= 1 {
+		return false
+	}
+	t.value /= 2
+	return true
+}
+
+// observe increases the max-repetitions value by 25% when a bulk request
+// made with maxRep repetitions got a full reply of count varbinds in less
+// than fastBulkReply.
+func (t *repetitionTuner) observe(rtt time.Duration, count, maxRep int) {
+	t.Lock()
+	defer t.Unlock()
+	if count < maxRep || rtt >= fastBulkReply || maxRep != t.value {
+		return
+	}
+	t.value += t.value/4 + 1
+	if t.value > maxRepetitionsLimit {
+		t.value = maxRepetitionsLimit
+	}
+}
+
+// adaptiveBulkWalk is a gosnmp BulkWalk using the tuned max-repetitions of the
+// request: on a tooBig reply, the max-repetitions is reduced and the bulk request
+// sent again. On timeout, the same is done once per walk before giving up.
+func (s *SnmpRequest) adaptiveBulkWalk(cli *gosnmp.GoSNMP, rootOid string, walkFn gosnmp.WalkFunc) error {
+	if !strings.HasPrefix(rootOid, ".") {
+		rootOid = "." + rootOid
+	}
+	oid := rootOid
+	timeoutRetried := false
+	// received tells if varbinds were already walked, as the tooBig and
+	// timeout retries do not count for the leaf oid fallback
+	received := false
+	for {
+		maxRep := s.reps.current()
+		start := time.Now()
+		resp, err := cli.GetBulk([]string{oid}, 0, uint8(maxRep))
+		if ErrIsTimeout(err) && !timeoutRetried && s.reps.shrink() {
+			s.Debugf(1, "bulk walk %s: timeout with max-repetitions %d, retrying with %d", rootOid, maxRep, s.reps.current())
+			timeoutRetried = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Error == gosnmp.TooBig {
+			if !s.reps.shrink() {
+				return fmt.Errorf("tooBig reply with max-repetitions %d", maxRep)
+			}
+			s.Debugf(1, "bulk walk %s: tooBig with max-repetitions %d, retrying with %d", rootOid, maxRep, s.reps.current())
+			continue
+		}
+		if resp.Error != gosnmp.NoError {
+			return fmt.Errorf("bulk request error: %v", resp.Error)
+		}
+		s.reps.observe(time.Since(start), len(resp.Variables), maxRep)
+		if len(resp.Variables) == 0 {
+			break
+		}
+		for i, pdu := range resp.Variables {
+			if pdu.Type == gosnmp.EndOfMibView || pdu.Type == gosnmp.NoSuchObject || pdu.Type == gosnmp.NoSuchInstance {
+				s.Debugf(2, "bulk walk %s terminated with type 0x%x", rootOid, pdu.Type)
+				return nil
+			}
+			if !strings.HasPrefix(pdu.Name, rootOid+".") {
+				if !received && i == 0 {
+					// nothing under root oid, try it as a leaf oid
+					return getLeaf(cli, rootOid, walkFn)
+				}
+				return nil
+			}
+			if pdu.Name == oid {
+				return fmt.Errorf("OID not increasing: %s", pdu.Name)
+			}
+			if err := walkFn(pdu); err != nil {
+				return err
+			}
+		}
+		received = true
+		oid = resp.Variables[len(resp.Variables)-1].Name
+	}
+	return nil
+}
+
+// getLeaf gets a single leaf oid and calls walkFn with its value if it exists.
+func getLeaf(cli *gosnmp.GoSNMP, oid string, walkFn gosnmp.WalkFunc) error {
+	resp, err := cli.Get([]string{oid})
+	if err != nil {
+		return err
+	}
+	for _, pdu := range resp.Variables {
+		if pdu.Name == oid && pdu.Type != gosnmp.NoSuchObject && pdu.Type != gosnmp.NoSuchInstance {
+			return walkFn(pdu)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const ifDescrMeasure = `"IndexedMeasures": [{
+	"Name":"ifMetrics",
+	"Metrics":[{"Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true}]
+}]`
+
+// bulkParams returns the json max-repetitions params of the device.
+func bulkParams(maxRep int, adaptive bool) string {
+	return fmt.Sprintf(`, "snmp_max_repetitions": %d, "snmp_adaptive_repetitions": %v`, maxRep, adaptive)
+}
+
+// makeIfMib returns an ifDescr table of count interfaces.
+func makeIfMib(count int) []gosnmp.SnmpPDU {
+	var mib []gosnmp.SnmpPDU
+	for i := 1; i <= count; i++ {
+		mib = append(mib, gosnmp.SnmpPDU{
+			Name:  fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i),
+			Type:  gosnmp.OctetString,
+			Value: []byte(fmt.Sprintf("eth%d", i)),
+		})
+	}
+	mib = append(mib, gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.3.1", Type: gosnmp.Integer, Value: 6})
+	return mib
+}
+
+// indexedCount returns the number of indexed results of the poll.
+func indexedCount(res PollResult) int {
+	var count int
+	for _, x := range res.Indexed {
+		for _, row := range x.Results {
+			count += len(row)
+		}
+	}
+	return count
+}
+
+func TestRepetitionTuner(t *testing.T) {
+	defer func(d time.Duration) { fastBulkReply = d }(fastBulkReply)
+	fastBulkReply = 100 * time.Millisecond
+
+	tuner := newRepetitionTuner(0)
+	if v := tuner.current(); v != defaultMaxRepetitions {
+		t.Fatalf("initial value: expected %d, got %d", defaultMaxRepetitions, v)
+	}
+	tuner.observe(10*time.Millisecond, 20, 50)
+	if v := tuner.current(); v != 50 {
+		t.Errorf("partial reply: expected 50, got %d", v)
+	}
+	tuner.observe(time.Second, 50, 50)
+	if v := tuner.current(); v != 50 {
+		t.Errorf("slow reply: expected 50, got %d", v)
+	}
+	tuner.observe(10*time.Millisecond, 50, 50)
+	if v := tuner.current(); v != 63 {
+		t.Errorf("fast full reply: expected 63, got %d", v)
+	}
+	tuner = newRepetitionTuner(250)
+	tuner.observe(10*time.Millisecond, 250, 250)
+	if v := tuner.current(); v != maxRepetitionsLimit {
+		t.Errorf("grow: expected max value %d, got %d", maxRepetitionsLimit, v)
+	}
+	tuner = newRepetitionTuner(5)
+	for _, expected := range []int{2, 1} {
+		if !tuner.shrink() || tuner.current() != expected {
+			t.Errorf("shrink: expected %d, got %d", expected, tuner.current())
+		}
+	}
+	if tuner.shrink() {
+		t.Error("shrink: expected no shrink below 1")
+	}
+}
+
+func TestAdaptiveBulkWalk(t *testing.T) {
+	defer func(d time.Duration) { fastBulkReply = d }(fastBulkReply)
+	fastBulkReply = 0 // no growth
+
+	resp, err := newMibResponder(makeIfMib(100))
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+	resp.maxVarbinds = 30
+
+	res := pollV2(t, resp, 2001, bulkParams(100, true), ifDescrMeasure)
+	if res.pollErr != nil {
+		t.Fatalf("Poll: %v", res.pollErr)
+	}
+	if count := indexedCount(res); count != 100 {
+		t.Fatalf("Poll: expected 100 indexed results, got %d", count)
+	}
+	if res.maxRepetitions != 25 {
+		t.Errorf("expected learned max-repetitions 25, got %d", res.maxRepetitions)
+	}
+	resp.Lock()
+	if resp.bulkSizes[0] != 100 || resp.bulkSizes[1] != 50 || resp.bulkSizes[2] != 25 {
+		t.Errorf("expected bulk sizes 100, 50, 25..., got %v", resp.bulkSizes)
+	}
+	resp.bulkSizes = nil
+	resp.Unlock()
+
+	// not adaptive: the tooBig reply ends the walk without result
+	res = pollV2(t, resp, 2002, bulkParams(100, false), ifDescrMeasure)
+	if count := indexedCount(res); count != 0 || res.maxRepetitions != 0 {
+		t.Errorf("non adaptive: expected no result, got %d results, max-repetitions %d", count, res.maxRepetitions)
+	}
+	resp.Lock()
+	if len(resp.bulkSizes) != 1 || resp.bulkSizes[0] != 100 {
+		t.Errorf("non adaptive: expected a single bulk request of 100, got %v", resp.bulkSizes)
+	}
+	resp.Unlock()
+}
+
+func TestAdaptiveBulkWalkGrow(t *testing.T) {
+	defer func(d time.Duration) { fastBulkReply = d }(fastBulkReply)
+	fastBulkReply = time.Minute
+
+	resp, err := newMibResponder(makeIfMib(100))
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+
+	res := pollV2(t, resp, 2003, bulkParams(10, true), ifDescrMeasure)
+	if res.pollErr != nil {
+		t.Fatalf("Poll: %v", res.pollErr)
+	}
+	if count := indexedCount(res); count != 100 {
+		t.Fatalf("Poll: expected 100 indexed results, got %d", count)
+	}
+	resp.Lock()
+	defer resp.Unlock()
+	for i := 1; i < len(resp.bulkSizes); i++ {
+		if resp.bulkSizes[i] <= resp.bulkSizes[i-1] {
+			t.Errorf("expected increasing bulk sizes, got %v", resp.bulkSizes)
+			break
+		}
+	}
+	if res.maxRepetitions <= 10 {
+		t.Errorf("expected learned max-repetitions > 10, got %d", res.maxRepetitions)
+	}
+}
+
+func TestAdaptiveBulkWalkLeaf(t *testing.T) {
+	defer func(d time.Duration) { fastBulkReply = d }(fastBulkReply)
+	fastBulkReply = 0
+
+	leaf := ".1.3.6.1.2.1.1.3.0"
+	mib := append(makeIfMib(100), gosnmp.SnmpPDU{Name: leaf, Type: gosnmp.TimeTicks, Value: uint32(4200)})
+	resp, err := newMibResponder(mib)
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+	resp.maxVarbinds = 30
+
+	var req SnmpRequest
+	sreq := fmt.Sprintf(v2Req, 2004, 2004, resp.port(), bulkParams(100, true), ifDescrMeasure)
+	if err := json.Unmarshal([]byte(sreq), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := req.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer req.Close()
+
+	// the leaf is walked after two tooBig replies
+	var pdus []gosnmp.SnmpPDU
+	err = req.adaptiveBulkWalk(req.snmpClis[0], leaf, func(pdu gosnmp.SnmpPDU) error {
+		pdus = append(pdus, pdu)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("adaptiveBulkWalk: %v", err)
+	}
+	if len(pdus) != 1 || pdus[0].Name != leaf {
+		t.Errorf("expected the leaf value after shrinking, got %+v", pdus)
+	}
+}
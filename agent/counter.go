@@ -0,0 +1,276 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+)
+
+// sysUpTimeOid is the oid of the device uptime in hundredths of seconds.
+const sysUpTimeOid = ".1.3.6.1.2.1.1.3.0"
+
+const (
+	// counterRate is the post-processor computing the counter per-second rate.
+	counterRate = "rate"
+
+	// counterDelta is the post-processor computing the counter delta since previous poll.
+	counterDelta = "delta"
+)
+
+// counterSample is a counter value kept between two polls.
+type counterSample struct {
+	// value is the raw counter value
+	value uint64
+
+	// fvalue is the counter value when it's not a native snmp counter (parsed from string for example)
+	fvalue float64
+
+	// stamp is the sample time
+	stamp time.Time
+}
+
+// deviceUptime is the last known sysUpTime of a device.
+type deviceUptime struct {
+	// ticks is the sysUpTime in hundredths of seconds
+	ticks uint32
+
+	// stamp is the time at which the uptime was retrieved
+	stamp time.Time
+}
+
+// counterStore keeps the previous counter samples for each device, oid and index
+// to compute the rate and delta between two successive polls.
+type counterStore struct {
+	samples map[string]counterSample
+	uptimes map[int]deviceUptime
+	sync.Mutex
+}
+
+var (
+	// CounterMaxAge is the max time a counter sample is kept in memory
+	// without being updated.
+	CounterMaxAge = time.Hour
+
+	// counters is the global counter state store.
+	counters = &counterStore{
+		samples: make(map[string]counterSample),
+		uptimes: make(map[int]deviceUptime),
+	}
+)
+
+// counterKey returns the key of a counter result for the given device.
+func counterKey(devID int, res Result) string {
+	key := strconv.Itoa(devID) + "|" + res.Name + "|" + res.Oid
+	if res.suffix != "" {
+		key += "." + res.suffix
+	}
+	return key
+}
+
+// setUptime saves the current device uptime and tells whether the device
+// has rebooted since the last call. In this case, all the counter samples
+// of this device are discarded.
+func (c *counterStore) setUptime(devID int, ticks uint32, stamp time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	prev, ok := c.uptimes[devID]
+	c.uptimes[devID] = deviceUptime{ticks: ticks, stamp: stamp}
+	if !ok || ticks >= prev.ticks {
+		return false
+	}
+	// sysUpTime is a 32-bit value wrapping after ~497 days: this is not a reboot
+	// if the elapsed time since last sample is consistent with the wrap.
+	expected := uint64(prev.ticks) + uint64(stamp.Sub(prev.stamp)/(10*time.Millisecond))
+	if expected > math.MaxUint32 {
+		return false
+	}
+	prefix := strconv.Itoa(devID) + "|"
+	for k := range c.samples {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.samples, k)
+		}
+	}
+	return true
+}
+
+// update saves the counter result as the new sample and computes its delta
+// with the previous sample. Returns false if there is no previous sample or
+// if the delta cannot be computed (counter reset). The delta of the native
+// snmp counters is computed from their raw value.
+func (c *counterStore) update(key string, res Result, stamp time.Time) (delta float64, elapsed time.Duration, ok bool) {
+	var curr counterSample
+	switch res.snmpType {
+	case gosnmp.Counter32, gosnmp.Counter64:
+		curr.value = gosnmp.ToBigInt(res.rawValue).Uint64()
+	default:
+		fval, isFloat := res.Value.(float64)
+		if !isFloat {
+			return 0, 0, false
+		}
+		curr.fvalue = fval
+	}
+	curr.stamp = stamp
+
+	c.Lock()
+	prev, found := c.samples[key]
+	c.samples[key] = curr
+	c.Unlock()
+
+	if !found || !stamp.After(prev.stamp) {
+		return 0, 0, false
+	}
+	elapsed = stamp.Sub(prev.stamp)
+	switch res.snmpType {
+	case gosnmp.Counter32:
+		if curr.value >= prev.value {
+			return float64(curr.value - prev.value), elapsed, true
+		}
+		// 32-bit wrap
+		return float64(curr.value + (1 << 32) - prev.value), elapsed, true
+	case gosnmp.Counter64:
+		// unsigned substraction handles the 64-bit wrap, but a drop of less than
+		// half the counter range is a counter reset, not a wrap
+		delta := curr.value - prev.value
+		if curr.value < prev.value && delta >= 1<<63 {
+			return 0, 0, false
+		}
+		return float64(delta), elapsed, true
+	default:
+		if curr.fvalue < prev.fvalue {
+			// counter reset, no way to know its previous max value
+			return 0, 0, false
+		}
+		return curr.fvalue - prev.fvalue, elapsed, true
+	}
+}
+
+// sweep removes all samples older than maxAge.
+func (c *counterStore) sweep(maxAge time.Duration) {
+	minStamp := time.Now().Add(-maxAge)
+	c.Lock()
+	defer c.Unlock()
+	for k, s := range c.samples {
+		if s.stamp.Before(minStamp) {
+			delete(c.samples, k)
+		}
+	}
+	for id, u := range c.uptimes {
+		if u.stamp.Before(minStamp) {
+			delete(c.uptimes, id)
+		}
+	}
+	log.Debug2f("%d counter samples after cleanup", len(c.samples))
+}
+
+// sweepCounters periodically removes outdated counter samples.
+func sweepCounters(ctx context.Context) {
+	if CounterMaxAge <= 0 {
+		return
+	}
+	tick := time.NewTicker(CounterMaxAge / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			counters.sweep(CounterMaxAge)
+		}
+	}
+}
+
+// computeCounters sets the rate or delta of all results with a counter post-processor.
+func (s *SnmpRequest) computeCounters(results []Result, stamp time.Time) {
+	for i, res := range results {
+		if res.counterMode == "" {
+			continue
+		}
+		delta, elapsed, ok := counters.update(counterKey(s.Device.ID, res), res, stamp)
+		if !ok {
+			s.Debugf(3, "%s: no previous sample for counter", res.Name)
+			continue
+		}
+		if res.snmpType == gosnmp.Counter32 || res.snmpType == gosnmp.Counter64 {
+			delta *= res.scale
+		}
+		switch res.counterMode {
+		case counterDelta:
+			results[i].Delta = &delta
+		case counterRate:
+			rate := delta / elapsed.Seconds()
+			results[i].Rate = &rate
+		}
+	}
+}
+
+// hasCounters tells whether at least one metric of the request needs
+// a counter rate or delta computation.
+func (s *SnmpRequest) hasCounters() bool {
+	for _, scalar := range s.ScalarMeasures {
+		for _, m := range scalar.Metrics {
+			if counterModeOf(m.PostProcessors) != "" {
+				return true
+			}
+		}
+	}
+	for _, indexed := range s.IndexedMeasures {
+		for _, m := range indexed.Metrics {
+			if counterModeOf(m.PostProcessors) != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkReboot retrieves the device sysUpTime and resets all the device's counter
+// samples if it has rebooted since the last poll.
+func (s *SnmpRequest) checkReboot(ctx context.Context) error {
+	cli := s.snmpClis[0]
+	cli.Community = s.Device.Community
+	cli.Context = ctx
+	pkt, err := cli.Get([]string{sysUpTimeOid})
+	if err != nil {
+		return fmt.Errorf("get sysUpTime: %v", err)
+	}
+	if len(pkt.Variables) == 0 || pkt.Variables[0].Type != gosnmp.TimeTicks {
+		return fmt.Errorf("get sysUpTime: invalid reply %+v", pkt.Variables)
+	}
+	ticks := uint32(gosnmp.ToBigInt(pkt.Variables[0].Value).Uint64())
+	if counters.setUptime(s.Device.ID, ticks, time.Now()) {
+		s.Warningf("device rebooted (uptime: %ds), counter samples reset", ticks/100)
+	}
+	return nil
+}
+
+// counterModeOf returns the counter post-processor (rate or delta) of the list, if any.
+func counterModeOf(postProcessors []string) string {
+	for _, pp := range postProcessors {
+		if pp == counterRate || pp == counterDelta {
+			return pp
+		}
+	}
+	return ""
+}
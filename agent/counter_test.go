@@ -0,0 +1,119 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestCounterUpdate(t *testing.T) {
+	tests := []struct {
+		typ   gosnmp.Asn1BER
+		prev  interface{}
+		curr  interface{}
+		ok    bool
+		delta float64
+	}{
+		{gosnmp.Counter32, uint(100), uint(250), true, 150},
+		{gosnmp.Counter32, uint(4294967290), uint(10), true, 16},
+		{gosnmp.Counter64, uint64(1000), uint64(1000), true, 0},
+		{gosnmp.Counter64, uint64(18446744073709551610), uint64(5), true, 11},
+		{gosnmp.Counter64, uint64(5000000000), uint64(1200), false, 0},
+		{gosnmp.OctetString, float64(10), float64(12.5), true, 2.5},
+		{gosnmp.OctetString, float64(10), float64(2), false, 0},
+	}
+	store := &counterStore{samples: make(map[string]counterSample), uptimes: make(map[int]deviceUptime)}
+	start := time.Now()
+	for i, tt := range tests {
+		prev := Result{Name: "counter", snmpType: tt.typ, rawValue: tt.prev, Value: tt.prev}
+		curr := Result{Name: "counter", snmpType: tt.typ, rawValue: tt.curr, Value: tt.curr}
+		if _, _, ok := store.update("key", prev, start); ok {
+			t.Errorf("update[%d]: got a delta on first sample", i)
+		}
+		delta, elapsed, ok := store.update("key", curr, start.Add(10*time.Second))
+		if ok != tt.ok {
+			t.Fatalf("update[%d]: ok? expected %v, got %v", i, tt.ok, ok)
+		}
+		if ok && delta != tt.delta {
+			t.Errorf("update[%d]: expected delta %v, got %v", i, tt.delta, delta)
+		}
+		if ok && elapsed != 10*time.Second {
+			t.Errorf("update[%d]: expected elapsed 10s, got %v", i, elapsed)
+		}
+		delete(store.samples, "key")
+	}
+}
+
+func TestCounterReboot(t *testing.T) {
+	store := &counterStore{samples: make(map[string]counterSample), uptimes: make(map[int]deviceUptime)}
+	start := time.Now()
+	res := Result{Name: "ifHCInOctets", Oid: ".1.3.6.1.2.1.31.1.1.1.6", suffix: "1", snmpType: gosnmp.Counter64, rawValue: uint64(42)}
+	if store.setUptime(1, 1000, start) {
+		t.Fatal("setUptime: reboot detected on first call")
+	}
+	store.update(counterKey(1, res), res, start)
+	store.update(counterKey(2, res), res, start)
+	if store.setUptime(1, 2000, start.Add(10*time.Second)) {
+		t.Fatal("setUptime: reboot detected with increasing uptime")
+	}
+	if !store.setUptime(1, 500, start.Add(20*time.Second)) {
+		t.Fatal("setUptime: reboot not detected with decreasing uptime")
+	}
+	if _, ok := store.samples[counterKey(1, res)]; ok {
+		t.Error("setUptime: samples not reset after reboot")
+	}
+	if _, ok := store.samples[counterKey(2, res)]; !ok {
+		t.Error("setUptime: samples of other device reset after reboot")
+	}
+	if store.setUptime(3, 4294967000, start) || store.setUptime(3, 100, start.Add(10*time.Second)) {
+		t.Error("setUptime: sysUpTime wrap detected as reboot")
+	}
+}
+
+func TestComputeScaledCounters(t *testing.T) {
+	defer func(s *counterStore) { counters = s }(counters)
+	counters = &counterStore{samples: make(map[string]counterSample), uptimes: make(map[int]deviceUptime)}
+
+	req := &SnmpRequest{Logger: log.WithPrefix("counters")}
+	req.Device.ID = 1
+	rate := model.Metric{Name: "ifHCInBits", Oid: ".1.3.6.1.2.1.31.1.1.1.6", PostProcessors: []string{"mul:8", "rate"}}
+	delta := model.Metric{Name: "ifHCInKOctets", Oid: ".1.3.6.1.2.1.31.1.1.1.10", PostProcessors: []string{"div:1000", "delta"}}
+	poll := func(value uint64, stamp time.Time) []Result {
+		var results []Result
+		for _, metric := range []model.Metric{rate, delta} {
+			res, err := MakeResult(gosnmp.SnmpPDU{Name: string(metric.Oid) + ".1", Type: gosnmp.Counter64, Value: value}, metric)
+			if err != nil {
+				t.Fatalf("MakeResult: %v", err)
+			}
+			results = append(results, res)
+		}
+		req.computeCounters(results, stamp)
+		return results
+	}
+	start := time.Now()
+	poll(10000, start)
+	res := poll(30000, start.Add(10*time.Second))
+	if res[0].Rate == nil || *res[0].Rate != 16000 {
+		t.Errorf("scaled rate: expected 16000, got %v", res[0].Rate)
+	}
+	if res[1].Delta == nil || *res[1].Delta != 20 {
+		t.Errorf("scaled delta: expected 20, got %v", res[1].Delta)
+	}
+}
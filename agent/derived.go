@@ -0,0 +1,79 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"github.com/kosctelecom/horus/model"
+)
+
+// derive evaluates the derived metrics over the results of a scalar measure or of
+// an indexed measure row and returns the results with the derived ones appended.
+// The counters must already be computed for the rate and delta references.
+// A derived metric whose expression cannot be evaluated (missing or non-numeric
+// value, division by zero...) is skipped.
+func (s *SnmpRequest) derive(derived []model.DerivedMetric, results []Result) []Result {
+	if len(derived) == 0 {
+		return results
+	}
+	var index string
+	for _, res := range results {
+		if res.Index != "" {
+			index = res.Index
+			break
+		}
+	}
+	env := func(ref model.ExprRef) (float64, bool) {
+		for _, res := range results {
+			if res.Name != ref.Name {
+				continue
+			}
+			switch ref.Mode {
+			case counterRate:
+				if res.Rate == nil {
+					return 0, false
+				}
+				return *res.Rate, true
+			case counterDelta:
+				if res.Delta == nil {
+					return 0, false
+				}
+				return *res.Delta, true
+			}
+			v, ok := res.Value.(float64)
+			return v, ok
+		}
+		return 0, false
+	}
+	for _, d := range derived {
+		v, err := d.Expr.Eval(env)
+		if err != nil {
+			s.Debugf(2, "derived metric %s (idx `%s`): %v, skipping", d.Name, index, err)
+			continue
+		}
+		exportedName := d.ExportedName
+		if exportedName == "" {
+			exportedName = d.Name
+		}
+		results = append(results, Result{
+			Name:         d.Name,
+			ExportedName: exportedName,
+			Description:  d.Description,
+			Value:        v,
+			Index:        index,
+			suffix:       index,
+		})
+	}
+	return results
+}
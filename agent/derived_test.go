@@ -0,0 +1,87 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const derivedMeasures = `"ScalarMeasures": [{
+	"Name":"scalars",
+	"Metrics":[
+		{"Name":"scalar1", "Oid":".1.3.6.1.4.1.9999.1.1.0", "Active":true},
+		{"Name":"scalar2", "Oid":".1.3.6.1.4.1.9999.1.2.0", "Active":true}
+	],
+	"DerivedMetrics":[
+		{"Name":"sum", "Expression":"scalar1 + scalar2"},
+		{"Name":"double", "Expression":"sum * 2"}
+	]
+}],
+"IndexedMeasures": [{
+	"Name":"ifTable",
+	"IndexMetricID": 1,
+	"Metrics":[
+		{"ID":1, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true, "ExportAsLabel":true},
+		{"ID":3, "Name":"ifMtu", "Oid":".1.3.6.1.2.1.2.2.1.4", "Active":true}
+	],
+	"DerivedMetrics":[
+		{"Name":"ifMtuBits", "ExportedName":"mtu_bits", "Expression":"ifMtu * 8"},
+		{"Name":"ifDescrNum", "Expression":"ifDescr * 1"}
+	]
+}]`
+
+func TestDerivedMetrics(t *testing.T) {
+	mib, _ := makeScalarMib(2, 0)
+	mib = append(mib, makeIfTable(4)...)
+	resp, err := newMibResponder(mib)
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+
+	res := pollV2(t, resp, 8000, "", derivedMeasures)
+	if res.pollErr != nil {
+		t.Fatalf("poll: %v", res.pollErr)
+	}
+	if len(res.Scalar) != 1 {
+		t.Fatalf("expected 1 scalar measure, got %d", len(res.Scalar))
+	}
+	var scalars []string
+	for _, r := range res.Scalar[0].Results {
+		scalars = append(scalars, fmt.Sprintf("%s=%v", r.Name, r.Value))
+	}
+	if expected := []string{"scalar1=1", "scalar2=2", "sum=3", "double=6"}; !reflect.DeepEqual(scalars, expected) {
+		t.Errorf("scalar: expected %v, got %v", expected, scalars)
+	}
+
+	// ifMtu is only defined on even indexes and ifDescr is not numeric:
+	// ifDescrNum is always skipped
+	expected := []string{
+		"2/ifDescr=eth2", "2/ifMtu=1500", "2/ifMtuBits=12000",
+		"4/ifDescr=eth4", "4/ifMtu=1500", "4/ifMtuBits=12000",
+	}
+	if set := indexedSet(res); !reflect.DeepEqual(set, expected) {
+		t.Errorf("indexed: expected %v, got %v", expected, set)
+	}
+	for _, row := range res.Indexed[0].Results {
+		for _, r := range row {
+			if r.Name == "ifMtuBits" && r.ExportedName != "mtu_bits" {
+				t.Errorf("ifMtuBits: expected exported name mtu_bits, got %s", r.ExportedName)
+			}
+		}
+	}
+}
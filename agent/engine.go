@@ -0,0 +1,142 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// engineParams are the snmpv3 authoritative engine parameters of a device,
+// as learned during the discovery.
+type engineParams struct {
+	// target is the device address the params were retrieved from
+	target string
+
+	// engineID is the authoritative engine id
+	engineID string
+
+	// boots is the authoritative engine boot count
+	boots uint32
+
+	// time is the authoritative engine time in seconds
+	time uint32
+
+	// stamp is the local time at which the engine time was retrieved
+	stamp time.Time
+}
+
+// engineCache keeps the snmpv3 engine params of each device between polls.
+type engineCache struct {
+	entries map[int]engineParams
+	sync.Mutex
+}
+
+var (
+	// EngineCacheTTL is the max time the snmpv3 engine params of a device
+	// are reused before a new discovery. Caching is disabled if 0.
+	EngineCacheTTL = 30 * time.Minute
+
+	// engines is the global snmpv3 engine params cache.
+	engines = &engineCache{entries: make(map[int]engineParams)}
+)
+
+// get returns the cached engine params of the device with its engine time
+// advanced by the elapsed time since it was retrieved. Returns false if there
+// is no entry, if it has expired or if it was retrieved for another target.
+func (c *engineCache) get(devID int, target string, now time.Time) (engineParams, bool) {
+	c.Lock()
+	defer c.Unlock()
+	eng, ok := c.entries[devID]
+	if !ok {
+		return eng, false
+	}
+	if eng.target != target || now.Sub(eng.stamp) > EngineCacheTTL {
+		delete(c.entries, devID)
+		return eng, false
+	}
+	eng.time += uint32(now.Sub(eng.stamp) / time.Second)
+	return eng, true
+}
+
+// set saves the engine params of the device.
+func (c *engineCache) set(devID int, eng engineParams) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[devID] = eng
+}
+
+// invalidate removes the engine params of the device from the cache.
+func (c *engineCache) invalidate(devID int) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, devID)
+}
+
+// target returns the snmp address of the device.
+func (s *SnmpRequest) target() string {
+	return fmt.Sprintf("%s:%d", s.Device.IPAddress, s.Device.Port)
+}
+
+// loadEngine sets the cached engine params of the device on all the new
+// snmpv3 connections so that gosnmp skips the engine discovery.
+func (s *SnmpRequest) loadEngine() {
+	if EngineCacheTTL <= 0 {
+		return
+	}
+	eng, ok := engines.get(s.Device.ID, s.target(), time.Now())
+	if !ok {
+		s.Debug(2, "no cached snmpv3 engine params, discovery needed")
+		return
+	}
+	s.Debugf(2, "using cached snmpv3 engine params: id=%x boots=%d time=%d", eng.engineID, eng.boots, eng.time)
+	for _, cli := range s.snmpClis {
+		usm, ok := cli.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok || usm.AuthoritativeEngineID != "" {
+			// pooled connection, already discovered
+			continue
+		}
+		usm.AuthoritativeEngineID = eng.engineID
+		usm.AuthoritativeEngineBoots = eng.boots
+		usm.AuthoritativeEngineTime = eng.time
+		if cli.ContextEngineID == "" {
+			cli.ContextEngineID = eng.engineID
+		}
+	}
+}
+
+// saveEngine caches the engine params learned during the poll.
+func (s *SnmpRequest) saveEngine() {
+	if EngineCacheTTL <= 0 {
+		return
+	}
+	for _, cli := range s.snmpClis {
+		usm, ok := cli.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok || usm.AuthoritativeEngineID == "" {
+			continue
+		}
+		engines.set(s.Device.ID, engineParams{
+			target:   s.target(),
+			engineID: usm.AuthoritativeEngineID,
+			boots:    usm.AuthoritativeEngineBoots,
+			time:     usm.AuthoritativeEngineTime,
+			stamp:    time.Now(),
+		})
+		return
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEngineCache(t *testing.T) {
+	cache := &engineCache{entries: make(map[int]engineParams)}
+	start := time.Now()
+	cache.set(1, engineParams{target: "10.0.0.1:161", engineID: "engine1", boots: 3, time: 1000, stamp: start})
+
+	if _, ok := cache.get(2, "10.0.0.1:161", start); ok {
+		t.Error("get: found entry for unknown device")
+	}
+	eng, ok := cache.get(1, "10.0.0.1:161", start.Add(90*time.Second))
+	if !ok {
+		t.Fatal("get: entry not found")
+	}
+	if eng.engineID != "engine1" || eng.boots != 3 || eng.time != 1090 {
+		t.Errorf("get: expected engine1/3/1090, got %s/%d/%d", eng.engineID, eng.boots, eng.time)
+	}
+	if _, ok := cache.get(1, "10.0.0.2:161", start); ok {
+		t.Error("get: found entry for another target")
+	}
+	if _, ok := cache.get(1, "10.0.0.1:161", start); ok {
+		t.Error("get: entry not removed after target change")
+	}
+	cache.set(1, engineParams{target: "10.0.0.1:161", engineID: "engine1", stamp: start})
+	if _, ok := cache.get(1, "10.0.0.1:161", start.Add(EngineCacheTTL+time.Second)); ok {
+		t.Error("get: expired entry returned")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+// joinKey returns the join key from the mapping metric value: the integer values
+// are formatted without exponent and the key regex subexpressions, if any, are
+// concatenated like an index pattern. Returns an empty key if the regex doesn't match.
+func joinKey(value interface{}, keyRegex *regexp.Regexp) string {
+	var key string
+	switch v := value.(type) {
+	case float64:
+		key = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		key = fmt.Sprint(v)
+	}
+	if keyRegex == nil {
+		return key
+	}
+	submatches := keyRegex.FindStringSubmatch(key)
+	if len(submatches) < 2 {
+		return ""
+	}
+	return strings.Join(submatches[1:], ".")
+}
+
+// joinIndexes walks the joined tables of the measure and appends to each row the
+// results of the joined row whose index is the row's mapping metric value. The
+// joined results take the index of the row's index metric. Rows without mapping
+// value or joined row are left as is. On walk error, the joins walked so far are
+// still applied.
+func (s *SnmpRequest) joinIndexes(ctx context.Context, measure model.IndexedMeasure, rows [][]Result) error {
+	var joinErr error
+	for _, join := range measure.IndexJoins {
+		var mapping, index model.Metric
+		for _, m := range measure.Metrics {
+			if m.ID == join.MappingMetricID {
+				mapping = m
+			}
+			if int64(m.ID) == measure.IndexMetricID.Int64 {
+				index = m
+			}
+		}
+		if mapping.Name == "" {
+			s.Debugf(1, "join %s: mapping metric %d not polled, skipping", measure.Name, join.MappingMetricID)
+			continue
+		}
+		var tabs []TabularResults
+		for _, grouped := range model.GroupByOid(join.Metrics) {
+			tab, err := s.walkMetric(ctx, grouped, 0, measure.UseAlternateCommunity)
+			if err != nil {
+				joinErr = fmt.Errorf("join %s: walk oid %s: %v", measure.Name, grouped[0].Oid, err)
+				if ErrIsUnreachable(err) {
+					return joinErr
+				}
+			}
+			tabs = append(tabs, tab)
+		}
+		var joined int
+		for i, row := range rows {
+			var key, rowIndex string
+			for _, res := range row {
+				if res.Name == mapping.Name {
+					key = joinKey(res.Value, join.KeyRegex)
+				}
+				if res.Name == index.Name {
+					rowIndex = res.Index
+				}
+			}
+			if key == "" {
+				continue
+			}
+			for _, tab := range tabs {
+				for _, res := range tab[key] {
+					res.Index = rowIndex
+					res.suffix = rowIndex
+					rows[i] = append(rows[i], res)
+				}
+			}
+			joined++
+		}
+		s.Debugf(2, "join %s: %d/%d rows joined on %s", measure.Name, joined, len(rows), mapping.Name)
+	}
+	return joinErr
+}
@@ -0,0 +1,96 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestJoinKey(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		pattern  string
+		expected string
+	}{
+		{float64(3), "", "3"},
+		{float64(1000001), "", "1000001"},
+		{"10.0.0.1", "", "10.0.0.1"},
+		{".1.3.6.1.2.1.2.2.1.1.12", `\.1\.3\.6\.1\.2\.1\.2\.2\.1\.1\.(\d+)$`, "12"},
+		{".1.3.6.1.2.1.31.1.1.1.1.12", `\.1\.3\.6\.1\.2\.1\.2\.2\.1\.1\.(\d+)$`, ""},
+	}
+	for i, tt := range tests {
+		var re *regexp.Regexp
+		if tt.pattern != "" {
+			re = regexp.MustCompile(tt.pattern)
+		}
+		if key := joinKey(tt.value, re); key != tt.expected {
+			t.Errorf("joinKey#%d: expected %q, got %q", i, tt.expected, key)
+		}
+	}
+}
+
+const ipAddrMeasure = `"IndexedMeasures": [{
+	"Name":"ipAddr",
+	"IndexMetricID": 1,
+	"Metrics":[
+		{"ID":1, "Name":"ipAdEntIfIndex", "Oid":".1.3.6.1.2.1.4.20.1.2", "Active":true},
+		{"ID":2, "Name":"ipAdEntBcastAddr", "Oid":".1.3.6.1.2.1.4.20.1.4", "Active":true}
+	],
+	"IndexJoins": [{
+		"ID": 1,
+		"MappingMetricID": 1,
+		"Metrics": [
+			{"ID":3, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true, "ExportAsLabel":true}
+		]
+	}]
+}]`
+
+func TestIndexJoin(t *testing.T) {
+	mib := makeIfTable(5)
+	for _, ifIndex := range []int{2, 4, 9} {
+		ip := fmt.Sprintf("10.0.0.%d", ifIndex)
+		mib = append(mib,
+			gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.4.20.1.2." + ip, Type: gosnmp.Integer, Value: ifIndex},
+			gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.4.20.1.4." + ip, Type: gosnmp.Integer, Value: 1})
+	}
+	resp, err := newMibResponder(mib)
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+
+	res := pollV2(t, resp, 7000, "", ipAddrMeasure)
+	if res.pollErr != nil {
+		t.Fatalf("poll: %v", res.pollErr)
+	}
+	expected := []string{
+		"10.0.0.2/ifDescr=eth2",
+		"10.0.0.2/ipAdEntBcastAddr=1",
+		"10.0.0.2/ipAdEntIfIndex=2",
+		"10.0.0.4/ifDescr=eth4",
+		"10.0.0.4/ipAdEntBcastAddr=1",
+		"10.0.0.4/ipAdEntIfIndex=4",
+		"10.0.0.9/ipAdEntBcastAddr=1",
+		"10.0.0.9/ipAdEntIfIndex=9",
+	}
+	if set := indexedSet(res); !reflect.DeepEqual(set, expected) {
+		t.Errorf("unexpected joined results:\n%v\nexpected:\n%v", set, expected)
+	}
+}
@@ -209,6 +209,7 @@ func (c *InfluxClient) makeBatchPoints(res PollResult) (influxclient.BatchPoints
 		fields := make(map[string]interface{})
 		for _, r := range scalar.Results {
 			fields[r.Name] = r.Value
+			addCounterFields(fields, r)
 		}
 		pt, err := influxclient.NewPoint(scalar.Name, tags, fields, res.PollStart)
 		if err != nil {
@@ -234,6 +235,7 @@ func (c *InfluxClient) makeBatchPoints(res PollResult) (influxclient.BatchPoints
 					tags[r.Name] = fmt.Sprint(r.Value)
 				} else {
 					fields[r.Name] = r.Value
+					addCounterFields(fields, r)
 				}
 			}
 			pt, err := influxclient.NewPoint(indexed.Name, tags, fields, res.PollStart)
@@ -246,3 +248,14 @@ func (c *InfluxClient) makeBatchPoints(res PollResult) (influxclient.BatchPoints
 	}
 	return batchPoints, nil
 }
+
+// addCounterFields adds the rate and delta of a counter result to the
+// point fields, with `_rate` and `_delta` suffixes.
+func addCounterFields(fields map[string]interface{}, r Result) {
+	if r.Rate != nil {
+		fields[r.Name+"_rate"] = *r.Rate
+	}
+	if r.Delta != nil {
+		fields[r.Name+"_delta"] = *r.Delta
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -36,6 +37,9 @@ type KafkaClient struct {
 	// Topic is the kafka topic
 	Topic string
 
+	// TrapTopic is the kafka topic of the snmp traps
+	TrapTopic string
+
 	// Partition is the kafka partition number
 	Partition int32
 
@@ -45,6 +49,9 @@ type KafkaClient struct {
 	// results is the snmp poll results channel
 	results chan PollResult
 
+	// traps is the snmp traps channel
+	traps chan TrapResult
+
 	broker *kafka.Broker
 	kafka.Producer
 }
@@ -52,7 +59,8 @@ type KafkaClient struct {
 var kafkaCli *KafkaClient
 
 // NewKafkaClient creates a new kafka client and connects to the broker.
-func NewKafkaClient(hosts []string, topic string, partition int) error {
+// The traps are written to the results topic if trapTopic is empty.
+func NewKafkaClient(hosts []string, topic, trapTopic string, partition int) error {
 	if len(hosts) == 0 || topic == "" {
 		return errors.New("kafka host and topic must all be defined")
 	}
@@ -66,8 +74,12 @@ func NewKafkaClient(hosts []string, topic string, partition int) error {
 	kafkaCli = &KafkaClient{
 		Hosts:     hosts,
 		Topic:     topic,
+		TrapTopic: trapTopic,
 		Partition: int32(partition),
 	}
+	if kafkaCli.TrapTopic == "" {
+		kafkaCli.TrapTopic = topic
+	}
 	return kafkaCli.dial()
 }
 
@@ -88,6 +100,7 @@ func (c *KafkaClient) dial() error {
 	producerConf.Logger = log.Klogger{}
 	c.Producer = c.broker.Producer(producerConf)
 	c.results = make(chan PollResult)
+	c.traps = make(chan TrapResult)
 	go c.sendData()
 	log.Debug("connected to kafka")
 	return nil
@@ -132,6 +145,15 @@ func (c *KafkaClient) Push(res PollResult) {
 	log.Debug2f("%s: pushed result to kafka queue", res.RequestID)
 }
 
+// PushTrap pushes a snmp trap to the kafka trap channel.
+func (c *KafkaClient) PushTrap(res TrapResult) {
+	if c == nil {
+		return
+	}
+	log.Debug2f("pushing trap of device #%d to kafka queue", res.DeviceID)
+	c.traps <- res
+}
+
 // sendData reads sequentially from kafka channel and writes result to kafka.
 func (c *KafkaClient) sendData() {
 	for c.connected {
@@ -156,6 +178,16 @@ func (c *KafkaClient) sendData() {
 				continue
 			}
 			log.Debug2f("%s: kafka write done in %dms", res.RequestID, time.Since(start)/time.Millisecond)
+		case trap := <-c.traps:
+			payload, err := json.Marshal(trap)
+			if err != nil {
+				log.Errorf("device #%d: trap marshal: %v", trap.DeviceID, err)
+				continue
+			}
+			msg := &proto.Message{Key: []byte(strconv.Itoa(trap.DeviceID)), Value: payload}
+			if _, err := c.Produce(c.TrapTopic, c.Partition, msg); err != nil {
+				log.Errorf("device #%d: kafka trap write: %v", trap.DeviceID, err)
+			}
 		}
 	}
 }
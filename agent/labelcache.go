@@ -0,0 +1,198 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+// labelState is the device state used to detect a change of the cached labels.
+type labelState struct {
+	// uptime is the device sysUpTime
+	uptime uint32
+
+	// change is the value of the measure's label change oid
+	change string
+}
+
+// labelEntry is the cached label results of a measure.
+type labelEntry struct {
+	// def is the label oid list the entry was built for
+	def string
+
+	// tabs is the label results by oid cache key
+	tabs map[string]TabularResults
+
+	// polls is the number of polls the entry was reused
+	polls int
+
+	// state is the device state when the labels were walked
+	state labelState
+}
+
+// labelCache keeps the label results of the indexed measures of each device between
+// polls. It extends the request-scoped resultCache across polls.
+type labelCache struct {
+	entries map[string]labelEntry
+	sync.Mutex
+}
+
+// labels is the global label cache.
+var labels = &labelCache{entries: make(map[string]labelEntry)}
+
+// reuse returns the cached labels for key if they were built for the same label
+// definition, were reused less than maxPolls times and the device state didn't
+// change. The entry's reuse count is incremented. Otherwise, the entry is removed.
+func (c *labelCache) reuse(key, def string, maxPolls int, state labelState) (map[string]TabularResults, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.def != def || entry.polls >= maxPolls || state.uptime < entry.state.uptime || state.change != entry.state.change {
+		delete(c.entries, key)
+		return nil, false
+	}
+	entry.polls++
+	c.entries[key] = entry
+	return entry.tabs, true
+}
+
+// set saves the label results for key.
+func (c *labelCache) set(key string, entry labelEntry) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = entry
+}
+
+// invalidate removes the labels of key from the cache.
+func (c *labelCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+}
+
+// labelMetrics returns the cacheable label metrics of the measure: the non-grouped
+// ones with no index pattern, like in the result cache.
+func labelMetrics(measure model.IndexedMeasure) []model.Metric {
+	var metrics []model.Metric
+	for _, grouped := range model.GroupByOid(measure.Metrics) {
+		if len(grouped) == 1 && grouped[0].ExportAsLabel && grouped[0].IndexRegex == nil {
+			metrics = append(metrics, grouped[0])
+		}
+	}
+	return metrics
+}
+
+// labelDef returns the label definition of the cache entry.
+func labelDef(measure model.IndexedMeasure, metrics []model.Metric) string {
+	oids := make([]string, len(metrics))
+	for i, m := range metrics {
+		oids[i] = m.Oid.CacheKey(measure.UseAlternateCommunity)
+	}
+	return string(measure.LabelChangeOid) + "|" + strings.Join(oids, ",")
+}
+
+// labelState retrieves the device sysUpTime and the value of the measure's
+// label change oid, if any.
+func (s *SnmpRequest) labelState(ctx context.Context, measure model.IndexedMeasure) (labelState, error) {
+	var state labelState
+	cli := s.snmpClis[0]
+	if measure.UseAlternateCommunity && s.Device.AlternateCommunity != "" {
+		cli.Community = s.Device.AlternateCommunity
+	} else {
+		cli.Community = s.Device.Community
+	}
+	cli.Context = ctx
+	oids := []string{sysUpTimeOid}
+	if measure.LabelChangeOid != "" {
+		oids = append(oids, string(measure.LabelChangeOid))
+	}
+	pkt, err := cli.Get(oids)
+	if err != nil {
+		return state, fmt.Errorf("get label state: %v", err)
+	}
+	if pkt.Error != gosnmp.NoError || len(pkt.Variables) != len(oids) || pkt.Variables[0].Type != gosnmp.TimeTicks {
+		return state, fmt.Errorf("get label state: invalid reply: %v %+v", pkt.Error, pkt.Variables)
+	}
+	state.uptime = uint32(gosnmp.ToBigInt(pkt.Variables[0].Value).Uint64())
+	if len(pkt.Variables) > 1 {
+		state.change = fmt.Sprintf("%v", pkt.Variables[1].Value)
+	}
+	return state, nil
+}
+
+// loadLabels puts a copy of the cached labels of the measure in the request result
+// cache so they are not walked again during this poll. Returns true if the cached labels were
+// used; otherwise, the returned device state is to be saved with the walked labels.
+func (s *SnmpRequest) loadLabels(ctx context.Context, measure model.IndexedMeasure) (bool, labelState) {
+	if measure.LabelRefreshPolls <= 0 {
+		return false, labelState{}
+	}
+	metrics := labelMetrics(measure)
+	if len(metrics) == 0 {
+		return false, labelState{}
+	}
+	key := fmt.Sprintf("%d-%d", s.Device.ID, measure.ID)
+	state, err := s.labelState(ctx, measure)
+	if err != nil {
+		s.Warningf("load labels %s: %v", measure.Name, err)
+		labels.invalidate(key)
+		return false, state
+	}
+	tabs, ok := labels.reuse(key, labelDef(measure, metrics), measure.LabelRefreshPolls, state)
+	if !ok {
+		s.Debugf(2, "load labels %s: no valid cache entry, labels will be walked", measure.Name)
+		return false, state
+	}
+	s.rc.Lock()
+	for k, tab := range tabs {
+		s.rc.cache[k] = tab.clone()
+	}
+	s.rc.Unlock()
+	s.Debugf(1, "load labels %s: %d cached label metrics", measure.Name, len(tabs))
+	return true, state
+}
+
+// saveLabels caches a copy of the walked labels of the measure from the request
+// result cache with the device state retrieved before the walk.
+func (s *SnmpRequest) saveLabels(measure model.IndexedMeasure, state labelState) {
+	metrics := labelMetrics(measure)
+	tabs := make(map[string]TabularResults)
+	s.rc.RLock()
+	for _, m := range metrics {
+		k := m.Oid.CacheKey(measure.UseAlternateCommunity)
+		if tab, ok := s.rc.cache[k]; ok && len(tab) > 0 {
+			tabs[k] = tab.clone()
+		}
+	}
+	s.rc.RUnlock()
+	if len(tabs) != len(metrics) {
+		s.Debugf(2, "save labels %s: %d/%d label metrics walked, not cached", measure.Name, len(tabs), len(metrics))
+		return
+	}
+	labels.set(fmt.Sprintf("%d-%d", s.Device.ID, measure.ID), labelEntry{
+		def:   labelDef(measure, metrics),
+		tabs:  tabs,
+		state: state,
+	})
+}
@@ -0,0 +1,94 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const labelCacheMeasure = `"IndexedMeasures": [{
+	"ID": 9,
+	"Name":"ifTable",
+	"IndexMetricID": 1,
+	"LabelRefreshPolls": 2,
+	"LabelChangeOid": ".1.3.6.1.2.1.31.1.5.0",
+	"Metrics":[
+		{"ID":1, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true, "ExportAsLabel":true},
+		{"ID":2, "Name":"ifType", "Oid":".1.3.6.1.2.1.2.2.1.3", "Active":true}
+	]
+}]`
+
+func TestLabelCache(t *testing.T) {
+	mib := append(makeIfTable(10),
+		gosnmp.SnmpPDU{Name: sysUpTimeOid, Type: gosnmp.TimeTicks, Value: uint32(1000)},
+		gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.31.1.5.0", Type: gosnmp.TimeTicks, Value: uint32(10)})
+	resp, err := newMibResponder(mib)
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+
+	tests := []struct {
+		name    string
+		uptime  uint32
+		changed uint32
+		cached  bool
+	}{
+		{"first", 1000, 10, false},
+		{"reuse1", 2000, 10, true},
+		{"reuse2", 3000, 10, true},
+		{"refresh", 4000, 10, false},
+		{"reuse", 5000, 10, true},
+		{"changed", 6000, 20, false},
+		{"reuse-after-change", 7000, 20, true},
+		{"rebooted", 100, 20, false},
+		{"reuse-after-reboot", 200, 20, true},
+	}
+	var expected []string
+	for _, tt := range tests {
+		resp.Lock()
+		resp.bulkSizes = nil
+		for i, pdu := range resp.mib {
+			switch pdu.Name {
+			case sysUpTimeOid:
+				resp.mib[i].Value = tt.uptime
+			case ".1.3.6.1.2.1.31.1.5.0":
+				resp.mib[i].Value = tt.changed
+			}
+		}
+		resp.Unlock()
+
+		res := pollV2(t, resp, 6000, "", labelCacheMeasure)
+		if res.pollErr != nil {
+			t.Fatalf("%s: poll: %v", tt.name, res.pollErr)
+		}
+		set := indexedSet(res)
+		if expected == nil {
+			expected = set
+		}
+		if len(set) != 20 || !reflect.DeepEqual(set, expected) {
+			t.Errorf("%s: unexpected results: %v", tt.name, set)
+		}
+		resp.Lock()
+		bulks := len(resp.bulkSizes)
+		resp.Unlock()
+		if tt.cached && bulks != 1 || !tt.cached && bulks != 2 {
+			t.Errorf("%s: expected cached=%v, got %d bulk requests", tt.name, tt.cached, bulks)
+		}
+	}
+}
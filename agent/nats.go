@@ -18,6 +18,9 @@ type NatsClient struct {
 	// Subject is the NATS subject to use for the metrics
 	Subject string
 
+	// TrapSubject is the NATS subject to use for the snmp traps
+	TrapSubject string
+
 	// Name is the NATS connection name
 	Name string
 
@@ -28,7 +31,8 @@ type NatsClient struct {
 var natsCli *NatsClient
 
 // NewNatsClient creates a new NATS client and connects to server.
-func NewNatsClient(hosts []string, subject, name string, reconnectDelay int) error {
+// The traps are published to the metrics subject if trapSubject is empty.
+func NewNatsClient(hosts []string, subject, trapSubject, name string, reconnectDelay int) error {
 	if len(hosts) == 0 || subject == "" {
 		return fmt.Errorf("NATS host and topic must all be defined")
 	}
@@ -36,9 +40,13 @@ func NewNatsClient(hosts []string, subject, name string, reconnectDelay int) err
 		name = fmt.Sprintf("horus-agent[%d]", os.Getpid())
 	}
 	natsCli = &NatsClient{
-		Hosts:   hosts,
-		Subject: subject,
-		Name:    name,
+		Hosts:       hosts,
+		Subject:     subject,
+		TrapSubject: trapSubject,
+		Name:        name,
+	}
+	if natsCli.TrapSubject == "" {
+		natsCli.TrapSubject = subject
 	}
 	log.Debug2f("connecting to NATS %v", hosts)
 	opts := []nats.Option{nats.Name(name),
@@ -106,3 +114,13 @@ func (c *NatsClient) Push(res PollResult) {
 	}
 	log.Debug2f("NATS publish req %s done in %dms", res.RequestID, time.Since(start)/time.Millisecond)
 }
+
+// PushTrap publishes the snmp trap to NATS
+func (c *NatsClient) PushTrap(res TrapResult) {
+	if c == nil {
+		return
+	}
+	if err := c.ec.Publish(c.TrapSubject, res); err != nil {
+		log.Errorf("device #%d: NATS trap publish: %v", res.DeviceID, err)
+	}
+}
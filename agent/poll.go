@@ -80,6 +80,12 @@ func Init() error {
 		go snmpq.dispatch(StopCtx)
 		log.Debug2("starting results handler")
 		go handlePollResults()
+		log.Debug2("starting counter samples sweeper")
+		go sweepCounters(StopCtx)
+		if PoolMaxSockets > 0 {
+			log.Debug2("starting snmp connection pool sweeper")
+			go sweepPool(StopCtx)
+		}
 	} else {
 		log.Info("snmp polling disabled")
 	}
@@ -147,8 +153,8 @@ func (s *snmpQueue) dispatch(ctx context.Context) {
 	}
 }
 
-// poll polls the snmp device. At the end, pushes the result
-// to the results queue and releases the worker slot.
+// poll polls the snmp device with connections borrowed from the pool.
+// At the end, pushes the result to the results queue and releases the worker slot.
 func (s *snmpQueue) poll(ctx context.Context, req *SnmpRequest) {
 	defer func() {
 		req.Debug(1, "done polling")
@@ -159,15 +165,17 @@ func (s *snmpQueue) poll(ctx context.Context, req *SnmpRequest) {
 	ongoingReqs[req.UID] = true
 	ongoingMu.Unlock()
 	atomic.AddInt64(&waiting, -1)
-	if err := req.Dial(ctx); err != nil {
+	if err := req.Borrow(ctx); err != nil {
 		req.Errorf("unable to connect to snmp device: %v", err)
+		req.Release(false)
 		res := req.MakePollResult() // needed for report
 		res.pollErr = err
 		pollResults <- res
 		return
 	}
-	pollResults <- req.Poll(ctx)
-	req.Close()
+	res := req.Poll(ctx)
+	req.Release(!ErrIsUnreachable(res.pollErr))
+	pollResults <- res
 	return
 }
 
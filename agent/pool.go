@@ -0,0 +1,254 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+// pooledConn is an idle snmp connection kept in the pool.
+type pooledConn struct {
+	cli      *gosnmp.GoSNMP
+	lastUsed time.Time
+}
+
+// connPool keeps the snmp connections open between polls. The idle connections
+// are grouped by device and snmp session params so that a connection is only
+// reused for the same device with the same target and credentials.
+type connPool struct {
+	// idle is the list of idle connections by pool key
+	idle map[string][]pooledConn
+
+	// idleCount is the total number of idle connections
+	idleCount int
+
+	// open is the number of open connections owned by the pool (idle or borrowed)
+	open int
+
+	sync.Mutex
+}
+
+var (
+	// PoolMaxSockets is the max number of snmp sockets kept open by the pool.
+	// When reached, the oldest idle connection is closed to make room for a new one.
+	// If there is no idle connection, the extra connections are dialed for the
+	// poll only. The pool is disabled if 0.
+	PoolMaxSockets int
+
+	// PoolIdleTimeout is the max time an idle connection is kept in the pool.
+	PoolIdleTimeout = 5 * time.Minute
+
+	// pool is the global snmp connection pool.
+	pool = &connPool{idle: make(map[string][]pooledConn)}
+)
+
+// poolKey returns the pool key for the device: the connections are reused
+// only if the snmp params identifying the session are unchanged. The other
+// params, like the timeouts or the max-repetitions tuned between polls, are
+// updated on the reused connections.
+func poolKey(devID int, params model.SnmpParams) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%q|%d|%q|%q|%q|%q|%q|%q|%q|%q", params.IPAddress, params.Port, params.Version, params.Community,
+		params.SecLevel, params.AuthUser, params.AuthProto, params.AuthPasswd, params.PrivProto, params.PrivPasswd)
+	return fmt.Sprintf("%d-%x", devID, h.Sum64())
+}
+
+// acquire returns an idle connection for the given key, if any. Otherwise, tells
+// whether a new connection can be opened and kept in the pool afterwards.
+func (p *connPool) acquire(key string) (cli *gosnmp.GoSNMP, pooled bool) {
+	p.Lock()
+	defer p.Unlock()
+	if conns := p.idle[key]; len(conns) > 0 {
+		cli = conns[len(conns)-1].cli
+		p.removeIdle(key, len(conns)-1)
+		poolHits.Inc()
+		return cli, true
+	}
+	poolMisses.Inc()
+	if p.open < PoolMaxSockets {
+		p.open++
+		p.updateGauges()
+		return nil, true
+	}
+	if p.evictOldest() {
+		// the evicted connection slot is taken over by the new one
+		p.open++
+		p.updateGauges()
+		return nil, true
+	}
+	poolOverflows.Inc()
+	return nil, false
+}
+
+// release puts back a connection in the pool.
+func (p *connPool) release(key string, cli *gosnmp.GoSNMP) {
+	p.Lock()
+	defer p.Unlock()
+	p.idle[key] = append(p.idle[key], pooledConn{cli: cli, lastUsed: time.Now()})
+	p.idleCount++
+	p.updateGauges()
+}
+
+// discard closes a borrowed connection and frees its slot.
+// cli can be nil if the connection could not be opened.
+func (p *connPool) discard(cli *gosnmp.GoSNMP) {
+	if cli != nil && cli.Conn != nil {
+		cli.Conn.Close()
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.open--
+	p.updateGauges()
+}
+
+// sweep closes all connections idle for more than maxIdle.
+func (p *connPool) sweep(maxIdle time.Duration) {
+	minStamp := time.Now().Add(-maxIdle)
+	p.Lock()
+	defer p.Unlock()
+	for key, conns := range p.idle {
+		for i := len(conns) - 1; i >= 0; i-- {
+			if conns[i].lastUsed.Before(minStamp) {
+				conns[i].cli.Conn.Close()
+				p.removeIdle(key, i)
+				p.open--
+				poolEvictions.Inc()
+			}
+		}
+	}
+	p.updateGauges()
+	log.Debug2f("snmp pool: %d open connections, %d idle after cleanup", p.open, p.idleCount)
+}
+
+// evictOldest closes the least recently used idle connection.
+// Returns false if there is no idle connection.
+// Must be called with lock held.
+func (p *connPool) evictOldest() bool {
+	var oldestKey string
+	oldestIdx := -1
+	var oldest time.Time
+	for key, conns := range p.idle {
+		for i, conn := range conns {
+			if oldestIdx == -1 || conn.lastUsed.Before(oldest) {
+				oldestKey, oldestIdx, oldest = key, i, conn.lastUsed
+			}
+		}
+	}
+	if oldestIdx == -1 {
+		return false
+	}
+	p.idle[oldestKey][oldestIdx].cli.Conn.Close()
+	p.removeIdle(oldestKey, oldestIdx)
+	p.open--
+	poolEvictions.Inc()
+	return true
+}
+
+// removeIdle removes the idx-th idle connection of key from the pool without closing it.
+// Must be called with lock held.
+func (p *connPool) removeIdle(key string, idx int) {
+	conns := p.idle[key]
+	conns = append(conns[:idx], conns[idx+1:]...)
+	if len(conns) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns
+	}
+	p.idleCount--
+}
+
+// updateGauges updates the pool prometheus gauges.
+// Must be called with lock held.
+func (p *connPool) updateGauges() {
+	poolOpenSockets.Set(float64(p.open))
+	poolIdleSockets.Set(float64(p.idleCount))
+}
+
+// sweepPool periodically closes the idle connections of the pool.
+func sweepPool(ctx context.Context) {
+	if PoolIdleTimeout <= 0 {
+		return
+	}
+	tick := time.NewTicker(PoolIdleTimeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			pool.sweep(PoolIdleTimeout)
+		}
+	}
+}
+
+// Borrow takes the snmp connections of the request from the pool and
+// dials the missing ones. Same as Dial when the pool is disabled.
+func (s *SnmpRequest) Borrow(ctx context.Context) error {
+	if PoolMaxSockets <= 0 {
+		return s.Dial(ctx)
+	}
+	s.poolKey = poolKey(s.Device.ID, s.Device.SnmpParams)
+	s.pooled = make([]bool, len(s.snmpClis))
+	for i := range s.snmpClis {
+		cli, pooled := pool.acquire(s.poolKey)
+		s.pooled[i] = pooled
+		if cli != nil {
+			s.Debugf(2, "borrow: reusing pooled conn for #%d", i)
+			curr := s.snmpClis[i]
+			cli.Timeout, cli.Retries = curr.Timeout, curr.Retries
+			cli.MaxOids, cli.MaxRepetitions = curr.MaxOids, curr.MaxRepetitions
+			cli.ContextName = curr.ContextName
+			if s.Device.GoSnmpContextEngineID() != "" {
+				// keep the engine id discovered by the pooled conn otherwise
+				cli.ContextEngineID = curr.ContextEngineID
+			}
+			cli.Logger = s.Logger
+			s.snmpClis[i] = cli
+		}
+	}
+	return s.Dial(ctx)
+}
+
+// Release gives back the snmp connections to the pool. The connections
+// are closed instead when the pool is disabled, when they were dialed out
+// of the pool budget or when the device is not healthy.
+func (s *SnmpRequest) Release(healthy bool) {
+	if s.pooled == nil {
+		s.Close()
+		return
+	}
+	for i, cli := range s.snmpClis {
+		switch {
+		case !s.pooled[i]:
+			if cli.Conn != nil {
+				cli.Conn.Close()
+			}
+		case cli.Conn == nil:
+			pool.discard(nil)
+		case healthy:
+			pool.release(s.poolKey, cli)
+		default:
+			pool.discard(cli)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+func newPipeCli() *gosnmp.GoSNMP {
+	conn, _ := net.Pipe()
+	return &gosnmp.GoSNMP{Conn: conn}
+}
+
+func TestConnPool(t *testing.T) {
+	defer func(max int) { PoolMaxSockets = max }(PoolMaxSockets)
+	PoolMaxSockets = 2
+	p := &connPool{idle: make(map[string][]pooledConn)}
+
+	if cli, pooled := p.acquire("dev1"); cli != nil || !pooled {
+		t.Fatalf("acquire#1: expected new pooled conn, got %v, %v", cli, pooled)
+	}
+	if cli, pooled := p.acquire("dev1"); cli != nil || !pooled {
+		t.Fatalf("acquire#2: expected new pooled conn, got %v, %v", cli, pooled)
+	}
+	if _, pooled := p.acquire("dev2"); pooled {
+		t.Fatal("acquire#3: expected overflow conn with full budget")
+	}
+
+	cli1 := newPipeCli()
+	p.release("dev1", cli1)
+	if cli, _ := p.acquire("dev1"); cli != cli1 {
+		t.Fatal("acquire#4: pooled conn not reused")
+	}
+	p.release("dev1", cli1)
+
+	// budget reached, dev1 idle conn must be evicted for dev2
+	if cli, pooled := p.acquire("dev2"); cli != nil || !pooled {
+		t.Fatalf("acquire#5: expected new pooled conn after eviction, got %v, %v", cli, pooled)
+	}
+	if p.open != 2 || p.idleCount != 0 {
+		t.Errorf("after eviction: expected 2 open and 0 idle conns, got %d and %d", p.open, p.idleCount)
+	}
+
+	p.discard(nil)
+	cli2 := newPipeCli()
+	p.release("dev2", cli2)
+	p.idle["dev2"][0].lastUsed = time.Now().Add(-time.Hour)
+	p.sweep(time.Minute)
+	if p.open != 0 || p.idleCount != 0 || len(p.idle) != 0 {
+		t.Errorf("after sweep: expected empty pool, got %d open and %d idle conns", p.open, p.idleCount)
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	params := model.SnmpParams{IPAddress: "10.0.0.1", Port: 161, Version: "2c", Community: "public"}
+	key := poolKey(1, params)
+	if poolKey(2, params) == key {
+		t.Error("same pool key for different devices")
+	}
+	params.Timeout, params.Retries, params.MaxRepetitions = 5, 2, 20
+	if poolKey(1, params) != key {
+		t.Error("pool key changed with the session independent params")
+	}
+	params.Community = "private"
+	if poolKey(1, params) == key {
+		t.Error("same pool key for different snmp params")
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	defer func(max int, ttl time.Duration) { PoolMaxSockets, EngineCacheTTL = max, ttl }(PoolMaxSockets, EngineCacheTTL)
+	PoolMaxSockets = 10
+	EngineCacheTTL = 0
+
+	params := model.SnmpParams{
+		SecLevel:   "AuthPriv",
+		AuthUser:   "horus",
+		AuthProto:  "SHA",
+		AuthPasswd: "horus-auth-passwd",
+		PrivProto:  "AES",
+		PrivPasswd: "horus-priv-passwd",
+	}
+	resp, err := newV3Responder(params, "horus")
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+	for i := 0; i < 3; i++ {
+		req := makeV3Request(t, resp, params)
+		if err := req.Borrow(context.Background()); err != nil {
+			t.Fatalf("Borrow#%d: %v", i, err)
+		}
+		if i > 0 && req.snmpClis[0].ContextEngineID == "" {
+			t.Errorf("Borrow#%d: discovered context engine id of the pooled conn wiped", i)
+		}
+		res := req.Poll(context.Background())
+		req.Release(res.pollErr == nil)
+		if res.pollErr != nil {
+			t.Fatalf("Poll#%d: %v", i, res.pollErr)
+		}
+	}
+	resp.Lock()
+	defer resp.Unlock()
+	if resp.discoveries != 1 {
+		t.Errorf("expected 1 engine discovery with pooled conns, got %d", resp.discoveries)
+	}
+}
@@ -90,6 +90,30 @@ var (
 		Name: "agent_snmp_scrape_duration_seconds",
 		Help: "snmp scrape duration.",
 	})
+	poolOpenSockets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_snmp_pool_open_sockets",
+		Help: "Number of snmp sockets owned by the connection pool.",
+	})
+	poolIdleSockets = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "agent_snmp_pool_idle_sockets",
+		Help: "Number of idle snmp sockets in the connection pool.",
+	})
+	poolHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "agent_snmp_pool_hits_total",
+		Help: "Number of snmp connections reused from the pool.",
+	})
+	poolMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "agent_snmp_pool_misses_total",
+		Help: "Number of snmp connections not found in the pool.",
+	})
+	poolEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "agent_snmp_pool_evictions_total",
+		Help: "Number of idle snmp connections closed by the pool.",
+	})
+	poolOverflows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "agent_snmp_pool_overflows_total",
+		Help: "Number of snmp connections opened out of the pool budget.",
+	})
 )
 
 var (
@@ -113,6 +137,12 @@ func InitCollectors(maxResAge, sweepFreq int) {
 	prometheus.MustRegister(sysMem)
 	prometheus.MustRegister(snmpScrapes)
 	prometheus.MustRegister(snmpScrapeDuration)
+	prometheus.MustRegister(poolOpenSockets)
+	prometheus.MustRegister(poolIdleSockets)
+	prometheus.MustRegister(poolHits)
+	prometheus.MustRegister(poolMisses)
+	prometheus.MustRegister(poolEvictions)
+	prometheus.MustRegister(poolOverflows)
 	http.Handle("/metrics", promhttp.Handler())
 
 	if sc := NewCollector(maxResAge, sweepFreq, "/snmpmetrics"); sc != nil {
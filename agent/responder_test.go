@@ -0,0 +1,215 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+)
+
+const v2Req = `{
+	"uid": "v2-%d",
+	"device": {
+		"id": %d,
+		"hostname": "localhost",
+		"polling_frequency": 300,
+		"category": "ROUTER",
+		"vendor": "TEST",
+		"model": "V2",
+		"ip_address": "127.0.0.1",
+		"snmp_port": %d,
+		"snmp_version": "2c",
+		"snmp_community": "public",
+		"snmp_timeout": 1,
+		"snmp_retries": 0%s
+	},
+	%s
+}`
+
+// mibResponder is a minimal snmp v2c agent listening on localhost and
+// serving get, getnext and getbulk requests from a static mib.
+type mibResponder struct {
+	conn *net.UDPConn
+
+	// mib is the list of pdus sorted by oid
+	mib []gosnmp.SnmpPDU
+
+	// maxVarbinds is the max number of varbinds in a reply before
+	// answering tooBig with the request varbinds, unlimited if 0
+	maxVarbinds int
+
+	// bulkSizes is the list of max-repetitions received in bulk requests
+	bulkSizes []int
+
+	// getSizes is the list of oid counts received in get requests
+	getSizes []int
+
+	// noSuchName makes the responder answer a noSuchName error to get requests
+	// with an unknown oid, like a v1 agent, instead of a noSuchObject value
+	noSuchName bool
+
+	sync.Mutex
+}
+
+// newMibResponder starts a responder serving the given pdus.
+func newMibResponder(mib []gosnmp.SnmpPDU) (*mibResponder, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(mib, func(i, j int) bool { return oidLess(mib[i].Name, mib[j].Name) })
+	r := &mibResponder{conn: conn, mib: mib}
+	go r.serve()
+	return r, nil
+}
+
+// port returns the udp port the responder is listening on.
+func (r *mibResponder) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Close stops the responder.
+func (r *mibResponder) Close() {
+	r.conn.Close()
+}
+
+func (r *mibResponder) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		reply, err := r.reply(buf[:n])
+		if err != nil {
+			log.Warningf("mibresponder: %v", err)
+			continue
+		}
+		r.conn.WriteToUDP(reply, addr)
+	}
+}
+
+// get returns the pdu of oid or a NoSuchObject pdu.
+func (r *mibResponder) get(oid string) gosnmp.SnmpPDU {
+	for _, pdu := range r.mib {
+		if pdu.Name == oid {
+			return pdu
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+}
+
+// next returns the pdu following oid or an EndOfMibView pdu.
+func (r *mibResponder) next(oid string) gosnmp.SnmpPDU {
+	for _, pdu := range r.mib {
+		if oidLess(oid, pdu.Name) {
+			return pdu
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+// reply builds the response to the request packet.
+func (r *mibResponder) reply(data []byte) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+	srv := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Logger: log.WithPrefix("mibresponder")}
+	req, err := srv.SnmpDecodePacket(data)
+	if err != nil {
+		return nil, err
+	}
+	resp := &gosnmp.SnmpPacket{
+		Version:   gosnmp.Version2c,
+		Community: req.Community,
+		PDUType:   gosnmp.GetResponse,
+		RequestID: req.RequestID,
+		Logger:    srv.Logger,
+	}
+	switch req.PDUType {
+	case gosnmp.GetRequest:
+		r.getSizes = append(r.getSizes, len(req.Variables))
+		for i, pdu := range req.Variables {
+			res := r.get(pdu.Name)
+			if res.Type == gosnmp.NoSuchObject && r.noSuchName {
+				resp.Error = gosnmp.NoSuchName
+				resp.ErrorIndex = uint8(i + 1)
+				resp.Variables = req.Variables
+				return resp.MarshalMsg()
+			}
+			resp.Variables = append(resp.Variables, res)
+		}
+	case gosnmp.GetNextRequest:
+		for _, pdu := range req.Variables {
+			resp.Variables = append(resp.Variables, r.next(pdu.Name))
+		}
+	case gosnmp.GetBulkRequest:
+		r.bulkSizes = append(r.bulkSizes, int(req.MaxRepetitions))
+		var repeaters []string
+		for i, pdu := range req.Variables {
+			if i < int(req.NonRepeaters) {
+				resp.Variables = append(resp.Variables, r.next(pdu.Name))
+				continue
+			}
+			repeaters = append(repeaters, pdu.Name)
+		}
+		// the repetitions are interleaved, one row of all repeaters at a time
+		for j := 0; j < int(req.MaxRepetitions) && len(repeaters) > 0; j++ {
+			ended := 0
+			for k, oid := range repeaters {
+				next := r.next(oid)
+				resp.Variables = append(resp.Variables, next)
+				if next.Type == gosnmp.EndOfMibView {
+					ended++
+				}
+				repeaters[k] = next.Name
+			}
+			if ended == len(repeaters) {
+				break
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported pdu type %v", req.PDUType)
+	}
+	if r.maxVarbinds > 0 && len(resp.Variables) > r.maxVarbinds {
+		// like net-snmp, echo the request varbinds as gosnmp ignores empty replies
+		resp.Variables = req.Variables
+		resp.Error = gosnmp.TooBig
+	}
+	return resp.MarshalMsg()
+}
+
+// pollV2 polls the responder with a new v2c SnmpRequest. devParams are additional
+// snmp params of the device and measures the json measure lists of the request.
+func pollV2(t *testing.T, resp *mibResponder, devID int, devParams, measures string) PollResult {
+	t.Helper()
+	var req SnmpRequest
+	sreq := fmt.Sprintf(v2Req, devID, devID, resp.port(), devParams, measures)
+	if err := json.Unmarshal([]byte(sreq), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if err := req.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer req.Close()
+	return req.Poll(context.Background())
+}
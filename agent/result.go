@@ -16,20 +16,21 @@ package agent
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"math"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 	"github.com/mitchellh/copystructure"
 	"github.com/vma/glog"
-	"github.com/vma/gosnmp"
 )
 
 // Result represents a single snmp result
@@ -55,9 +56,20 @@ type Result struct {
 	// Index is the result index as extracted from the oid according to the index_pattern.
 	Index string `json:"index,omitempty"`
 
-	snmpType gosnmp.Asn1BER
-	rawValue interface{}
-	suffix   string
+	// Rate is the per-second rate of a counter since the previous poll, when requested.
+	Rate *float64 `json:"rate,omitempty"`
+
+	// Delta is the counter increase since the previous poll, when requested.
+	Delta *float64 `json:"delta,omitempty"`
+
+	snmpType    gosnmp.Asn1BER
+	rawValue    interface{}
+	suffix      string
+	counterMode string
+
+	// scale is the factor of the div and mul post-processors, applied to the
+	// delta of native counters which is computed from the raw value.
+	scale float64
 }
 
 // TabularResults is a map of Result array containing all values for a given indexed oid.
@@ -69,6 +81,23 @@ type Result struct {
 // {i1=>[res1], i1.i12=>[res11], i1.i13=>[res12], i2=>[res2], i3=>[res3], ...}
 type TabularResults map[string][]Result
 
+// clone returns a deep copy of the tabular results: the result slices and the
+// byte slice values are not shared with t.
+func (t TabularResults) clone() TabularResults {
+	cpy := make(TabularResults, len(t))
+	for idx, results := range t {
+		rs := make([]Result, len(results))
+		copy(rs, results)
+		for i := range rs {
+			if b, ok := rs[i].Value.([]byte); ok {
+				rs[i].Value = append([]byte(nil), b...)
+			}
+		}
+		cpy[idx] = rs
+	}
+	return cpy
+}
+
 // ScalarResults is a scalar measure results.
 type ScalarResults struct {
 	// Name is the name of the result group
@@ -88,6 +117,9 @@ type ScalarResults struct {
 
 	// ToNats tells wether this measure is exported to NATS
 	ToNats bool `json:"to_nats,omitempty"`
+
+	// Batched tells wether the measure was polled with batched get requests
+	Batched bool `json:"batched,omitempty"`
 }
 
 // IndexedResults is an indexed measure results.
@@ -151,35 +183,28 @@ type PollResult struct {
 	reportURL   string
 	metricCount int
 	pollErr     error
+
+	// maxRepetitions is the bulk max-repetitions learned during the poll
+	// in adaptive mode, 0 if unchanged.
+	maxRepetitions int
+
+	// reply receives the result of an on-demand request, sent instead of
+	// the report. Nil for polling jobs.
+	reply chan<- PollResult
 }
 
 var numberPat = regexp.MustCompile(`[-+]?\d*\.?\d+`)
 
 // MakePollResult builds a PollResult from an SnmpRequest.
 func (r SnmpRequest) MakePollResult() PollResult {
-	tags := make(map[string]string)
-	tags["id"] = strconv.Itoa(r.Device.ID)
-	tags["host"] = r.Device.Hostname
-	tags["vendor"] = r.Device.Vendor
-	tags["model"] = r.Device.Model
-	tags["category"] = r.Device.Category
-	if r.Device.Tags != "" {
-		var reqTags map[string]interface{}
-		if err := json.Unmarshal([]byte(r.Device.Tags), &reqTags); err != nil {
-			log.Errorf("json tag unmarshal: %v", err)
-		} else {
-			for k, v := range reqTags {
-				tags[k] = fmt.Sprint(v)
-			}
-		}
-	}
 	return PollResult{
 		RequestID: r.UID,
 		AgentID:   r.AgentID,
 		IPAddr:    r.Device.IPAddress,
 		PollStart: time.Now(),
-		Tags:      tags,
+		Tags:      r.Device.ResultTags(),
 		reportURL: r.ReportURL,
+		reply:     r.reply,
 	}
 }
 
@@ -195,12 +220,18 @@ func (p PollResult) Copy() PollResult {
 	cpy.reportURL = p.reportURL
 	cpy.metricCount = p.metricCount
 	cpy.pollErr = p.pollErr
+	cpy.maxRepetitions = p.maxRepetitions
 	return cpy
 }
 
 // MakeResult builds a Result from a gosnmp PDU. The value is casted to its
 // corresponding Go type when necessary. In particular, Counter64 values
 // are converted to float as influx does not support them out of the box.
+// The `rate` and `delta` post-processors are not applied here, they are
+// computed afterwards from the previous poll's sample. The `map` post-processor
+// replaces the value with its mapping in the metric's lookup table. The
+// textual convention post-processors (mac, inet-address, date-and-time...)
+// decode the octet string values.
 // Returns an error on snmp NoSuchObject reply or nil value.
 func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 	res := Result{
@@ -211,6 +242,8 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 		ExportedName: metric.ExportedName,
 		snmpType:     pdu.Type,
 		rawValue:     pdu.Value,
+		counterMode:  counterModeOf(metric.PostProcessors),
+		scale:        1,
 	}
 	if len(pdu.Name) > len(metric.Oid) {
 		res.suffix = pdu.Name[len(metric.Oid)+1:]
@@ -218,8 +251,16 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 	switch pdu.Type {
 	case gosnmp.NoSuchObject:
 		return res, fmt.Errorf("oid %s: NoSuchObject", pdu.Name)
-	case gosnmp.OctetString, gosnmp.IPAddress:
-		res.Value = pdu.Value.([]byte)
+	case gosnmp.OctetString:
+		res.Value, _ = pdu.Value.([]byte)
+	case gosnmp.IPAddress:
+		// gosnmp decodes the address as a string
+		switch v := pdu.Value.(type) {
+		case string:
+			res.Value = v
+		case []byte:
+			res.Value = net.IP(v).String()
+		}
 	case gosnmp.Counter64:
 		// 64 bit counters are automatically wrapped by 2^53 to avoid precision loss due
 		// to rounding (https://en.wikipedia.org/wiki/Double-precision_floating-point_format)
@@ -241,8 +282,20 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 		metric.PostProcessors = []string{"trim"}
 	}
 	for _, pp := range metric.PostProcessors {
+		if strings.HasPrefix(pp, model.MapPostProcessor) {
+			res.Value = lookupValue(res.Value, metric.LookupTable)
+			continue
+		}
 		switch val := res.Value.(type) {
 		case []byte:
+			decoded, ok, err := decodeOctets(val, pp, metric.LookupTable)
+			if err != nil {
+				return res, fmt.Errorf("%s: %s: %v", res.Name, pp, err)
+			}
+			if ok {
+				res.Value = decoded
+				continue
+			}
 			switch pp {
 			case "parse-hex-be":
 				n, err := bigEndianUint(val)
@@ -277,6 +330,10 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 				}
 				res.Value = v
 			}
+		case string:
+			if pp == "trim" {
+				res.Value = strings.TrimSpace(val)
+			}
 		case float64:
 			switch {
 			case strings.HasPrefix(pp, "div-"), strings.HasPrefix(pp, "div:"):
@@ -285,12 +342,14 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 					return res, fmt.Errorf("invalid post-processor %s: %v", pp, err)
 				}
 				res.Value = val / div
+				res.scale /= div
 			case strings.HasPrefix(pp, "mul-"), strings.HasPrefix(pp, "mul:"):
 				div, err := strconv.ParseFloat(pp[4:], 64)
 				if err != nil {
 					return res, fmt.Errorf("invalid post-processor %s: %v", pp, err)
 				}
 				res.Value = val * div
+				res.scale *= div
 			case pp == "ln":
 				if val < 0 {
 					return res, fmt.Errorf("invalid post-processor %s: negative value %f", pp, val)
@@ -309,6 +368,34 @@ func MakeResult(pdu gosnmp.SnmpPDU, metric model.Metric) (Result, error) {
 	return res, nil
 }
 
+// lookupValue returns the value mapped to val in the lookup table of a `map`
+// post-processor: a float if the mapped value is numeric, a string otherwise.
+// The numeric values are looked up without exponent nor trailing zeros and the
+// strings are trimmed. An unmapped value is returned as is (as string if []byte).
+func lookupValue(val interface{}, table map[string]string) interface{} {
+	var key string
+	switch v := val.(type) {
+	case []byte:
+		key = strings.TrimSpace(string(v))
+		val = key
+	case string:
+		key = v
+	case float64:
+		key = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		key = fmt.Sprint(v)
+	}
+	mapped, ok := table[key]
+	if !ok {
+		log.Debug3f("lookup: no mapping for `%s`", key)
+		return val
+	}
+	if f, err := strconv.ParseFloat(mapped, 64); err == nil {
+		return f
+	}
+	return mapped
+}
+
 // String returns a string representation of a Result.
 func (r Result) String() string {
 	if r.Oid == "" {
@@ -467,6 +554,10 @@ func handlePollResults() {
 		go natsCli.Push(res)
 		go snmpCollector.Push(res)
 		go influxCli.Push(res)
+		if res.reply != nil {
+			res.reply <- res
+			continue
+		}
 		res.sendReport()
 	}
 }
@@ -477,6 +568,7 @@ func handlePollResults() {
 // - poll_duration_ms: the snmp polling duration in ms
 // - poll_error: the polling error if any
 // - current_load: current agent load (current_jobs/total_capacity)
+// - max_repetitions: the learned bulk max-repetitions, only in adaptive mode
 func (p *PollResult) sendReport() {
 	log.Debugf("report: id=%s agent_id=%d poll_err=%q poll_dur=%dms metric_count=%d",
 		p.RequestID, p.AgentID, p.PollErr, p.Duration, p.metricCount)
@@ -496,9 +588,12 @@ func (p *PollResult) sendReport() {
 	q.Add("poll_error", p.PollErr)
 	q.Add("metric_count", strconv.Itoa(p.metricCount))
 	q.Add("current_load", fmt.Sprintf("%.4f", CurrentSNMPLoad()))
+	if p.maxRepetitions > 0 {
+		q.Add("max_repetitions", strconv.Itoa(p.maxRepetitions))
+	}
 	req.URL.RawQuery = q.Encode()
 
-	client := &http.Client{Timeout: 3 * time.Second}
+	client := auth.NewClient(3 * time.Second)
 	for i := 0; i < 3; i++ {
 		if i > 0 {
 			time.Sleep(time.Duration(1<<uint(i-1)) * 3 * time.Second)
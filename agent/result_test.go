@@ -0,0 +1,89 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestMakeResultMap(t *testing.T) {
+	table := map[string]string{"1": "up", "2": "down", "critical": "3", "1500": "1.5e3"}
+	tests := []struct {
+		pdu      gosnmp.SnmpPDU
+		pps      []string
+		expected interface{}
+	}{
+		{gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 1}, []string{"map:t"}, "up"},
+		{gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 7}, []string{"map:t"}, float64(7)},
+		{gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 1500}, []string{"map:t"}, float64(1500)},
+		{gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 2000}, []string{"div:1000", "map:t"}, "down"},
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte(" critical ")}, []string{"map:t"}, float64(3)},
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte(" minor ")}, []string{"map:t"}, "minor"},
+		{gosnmp.SnmpPDU{Type: gosnmp.IPAddress, Value: "10.1.2.3"}, nil, "10.1.2.3"},
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e}}, []string{"mac"}, "00:1a:2b:3c:4d:5e"},
+		{gosnmp.SnmpPDU{Type: gosnmp.OctetString, Value: []byte{0x40}}, []string{"bits:t"}, "up"},
+	}
+	for i, tt := range tests {
+		tt.pdu.Name = ".1.3.6.1.4.1.9999.1.0"
+		metric := model.Metric{Name: "m", Oid: ".1.3.6.1.4.1.9999.1.0", PostProcessors: tt.pps, LookupTable: table}
+		res, err := MakeResult(tt.pdu, metric)
+		if err != nil {
+			t.Errorf("MakeResult#%d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Value, tt.expected) {
+			t.Errorf("MakeResult#%d: expected %v (%[2]T), got %v (%[3]T)", i, tt.expected, res.Value)
+		}
+	}
+}
+
+func TestMakeResultIPAddress(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected interface{}
+		isErr    bool
+	}{
+		{"10.1.2.3", "10.1.2.3", false},
+		{[]byte{10, 1, 2, 3}, "10.1.2.3", false},
+		{nil, nil, true},
+	}
+	for i, tt := range tests {
+		pdu := gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.4.20.1.1.10.1.2.3", Type: gosnmp.IPAddress, Value: tt.value}
+		metric := model.Metric{Name: "ipAdEntAddr", Oid: ".1.3.6.1.2.1.4.20.1.1"}
+		res, err := MakeResult(pdu, metric)
+		if (err != nil) != tt.isErr {
+			t.Errorf("MakeResult#%d: expected error %v, got %v", i, tt.isErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(res.Value, tt.expected) {
+			t.Errorf("MakeResult#%d: expected %v (%[2]T), got %v (%[3]T)", i, tt.expected, res.Value)
+		}
+	}
+}
+
+func TestTabularResultsClone(t *testing.T) {
+	tab := TabularResults{"1": {{Name: "ifDescr", Value: []byte("eth0"), Index: "1", suffix: "1"}}}
+	cpy := tab.clone()
+	cpy["1"][0].Index = "1.2"
+	cpy["1"][0].Value.([]byte)[0] = 'E'
+	cpy["1"] = append(cpy["1"], Result{Name: "ifAlias"})
+	if len(tab["1"]) != 1 || tab["1"][0].Index != "1" || string(tab["1"][0].Value.([]byte)) != "eth0" {
+		t.Errorf("clone: original results modified: %+v", tab)
+	}
+}
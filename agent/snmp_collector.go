@@ -125,6 +125,7 @@ func (c *SnmpCollector) Push(pollRes PollResult) {
 			}
 			sample.Labels["oid"] = res.Oid
 			c.promSamples <- &sample
+			c.pushCounters(sample, res)
 		}
 	}
 
@@ -201,11 +202,29 @@ func (c *SnmpCollector) Push(pollRes PollResult) {
 					Labels: l,
 				}
 				c.promSamples <- &sample
+				c.pushCounters(sample, res)
 			}
 		}
 	}
 }
 
+// pushCounters pushes the rate and delta of a counter result as new samples
+// suffixed with `_rate` and `_delta`, with the same labels as the value sample.
+func (c *SnmpCollector) pushCounters(sample PromSample, res Result) {
+	if res.Rate != nil {
+		rate := sample
+		rate.Name += "_rate"
+		rate.Value = *res.Rate
+		c.promSamples <- &rate
+	}
+	if res.Delta != nil {
+		delta := sample
+		delta.Name += "_delta"
+		delta.Value = *res.Delta
+		c.promSamples <- &delta
+	}
+}
+
 // SnmpScrapeCount returns the number of prometheus snmp scrapes.
 // Returns 0 if the collector is not initialized.
 func SnmpScrapeCount() int {
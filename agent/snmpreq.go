@@ -22,9 +22,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gosnmp/gosnmp"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
-	"github.com/vma/gosnmp"
 )
 
 // resultCache is a cache for walk results to avoid rewalking the same oids (with same community).
@@ -44,6 +44,18 @@ type SnmpRequest struct {
 	// snmpClis is an array of gosnmp connections
 	snmpClis []*gosnmp.GoSNMP
 
+	// poolKey is the connection pool key of the request
+	poolKey string
+
+	// pooled tells for each snmp connection whether it belongs to the pool
+	pooled []bool
+
+	// reps is the bulk max-repetitions tuner, nil if not in adaptive mode
+	reps *repetitionTuner
+
+	// reply receives the poll result of an on-demand request, nil otherwise.
+	reply chan<- PollResult
+
 	// logger is the internal gosnmp compatible glog Logger.
 	log.Logger
 }
@@ -71,58 +83,19 @@ func (s *SnmpRequest) UnmarshalJSON(data []byte) error {
 	s.SnmpRequest = r
 	s.Logger = log.WithPrefix(s.UID)
 
-	var secParams gosnmp.UsmSecurityParameters
+	var secParams *gosnmp.UsmSecurityParameters
 	var msgFlag gosnmp.SnmpV3MsgFlags
-	var authProto gosnmp.SnmpV3AuthProtocol
-	var privProto gosnmp.SnmpV3PrivProtocol
 	if s.Device.Version == model.Version3 {
-		switch s.Device.AuthProto {
-		case "MD5":
-			authProto = gosnmp.MD5
-		case "SHA":
-			authProto = gosnmp.SHA
-		default:
-			authProto = gosnmp.NoAuth
-		}
-		switch s.Device.PrivProto {
-		case "DES":
-			privProto = gosnmp.DES
-		case "AES":
-			privProto = gosnmp.AES
-		default:
-			privProto = gosnmp.NoPriv
-		}
-		switch s.Device.SecLevel {
-		case "NoAuthNoPriv":
-			msgFlag = gosnmp.NoAuthNoPriv
-			secParams = gosnmp.UsmSecurityParameters{
-				UserName:               s.Device.AuthUser,
-				AuthenticationProtocol: gosnmp.NoAuth,
-				PrivacyProtocol:        gosnmp.NoPriv,
-			}
-		case "AuthNoPriv":
-			msgFlag = gosnmp.AuthNoPriv
-			secParams = gosnmp.UsmSecurityParameters{
-				UserName:                 s.Device.AuthUser,
-				AuthenticationProtocol:   authProto,
-				AuthenticationPassphrase: s.Device.AuthPasswd,
-				PrivacyProtocol:          gosnmp.NoPriv,
-			}
-		case "AuthPriv":
-			msgFlag = gosnmp.AuthPriv
-			secParams = gosnmp.UsmSecurityParameters{
-				UserName:                 s.Device.AuthUser,
-				AuthenticationProtocol:   authProto,
-				AuthenticationPassphrase: s.Device.AuthPasswd,
-				PrivacyProtocol:          privProto,
-				PrivacyPassphrase:        s.Device.PrivPasswd,
-			}
-		default:
-			return errors.New("invalid snmpv3 security level")
+		secParams, msgFlag, err = usmParams(s.Device.SnmpParams)
+		if err != nil {
+			return err
 		}
 	}
 
 	s.rc = &resultCache{cache: make(map[string]TabularResults)}
+	if s.Device.AdaptiveRepetitions && !s.Device.DisableBulk {
+		s.reps = newRepetitionTuner(s.Device.MaxRepetitions)
+	}
 	snmpParams := s.Device.SnmpParams
 	s.snmpClis = make([]*gosnmp.GoSNMP, snmpParams.ConnectionCount)
 	for i := 0; i < snmpParams.ConnectionCount; i++ {
@@ -134,11 +107,16 @@ func (s *SnmpRequest) UnmarshalJSON(data []byte) error {
 			Timeout:   time.Duration(snmpParams.Timeout) * time.Second,
 			Retries:   snmpParams.Retries,
 			Logger:    s.Logger,
+
+			MaxOids:        snmpParams.MaxOidsPerGet,
+			MaxRepetitions: uint8(snmpParams.MaxRepetitions),
 		}
 		if snmpParams.Version == model.Version3 {
 			cli.SecurityModel = gosnmp.UserSecurityModel
 			cli.MsgFlags = msgFlag
-			cli.SecurityParameters = &secParams
+			cli.SecurityParameters = secParams.Copy()
+			cli.ContextName = snmpParams.ContextName
+			cli.ContextEngineID = snmpParams.GoSnmpContextEngineID()
 		}
 		s.snmpClis[i] = cli
 	}
@@ -156,16 +134,57 @@ func (s *SnmpRequest) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// Dial opens all the needed snmp connections to the device.
+// usmParams returns the snmpv3 user security parameters and message flags
+// of the given snmp params.
+func usmParams(p model.SnmpParams) (*gosnmp.UsmSecurityParameters, gosnmp.SnmpV3MsgFlags, error) {
+	switch p.SecLevel {
+	case "NoAuthNoPriv":
+		return &gosnmp.UsmSecurityParameters{
+			UserName:               p.AuthUser,
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+		}, gosnmp.NoAuthNoPriv, nil
+	case "AuthNoPriv":
+		return &gosnmp.UsmSecurityParameters{
+			UserName:                 p.AuthUser,
+			AuthenticationProtocol:   p.GoSnmpAuthProto(),
+			AuthenticationPassphrase: p.AuthPasswd,
+			PrivacyProtocol:          gosnmp.NoPriv,
+		}, gosnmp.AuthNoPriv, nil
+	case "AuthPriv":
+		return &gosnmp.UsmSecurityParameters{
+			UserName:                 p.AuthUser,
+			AuthenticationProtocol:   p.GoSnmpAuthProto(),
+			AuthenticationPassphrase: p.AuthPasswd,
+			PrivacyProtocol:          p.GoSnmpPrivProto(),
+			PrivacyPassphrase:        p.PrivPasswd,
+		}, gosnmp.AuthPriv, nil
+	default:
+		return nil, 0, errors.New("invalid snmpv3 security level")
+	}
+}
+
+// Dial opens all the needed snmp connections to the device. Already opened
+// connections (taken from the pool) are kept as is.
+// For snmpv3, the cached engine params of the device are used if still valid.
 func (s *SnmpRequest) Dial(ctx context.Context) error {
+	if s.Device.Version == model.Version3 {
+		s.loadEngine()
+	}
 	var wg sync.WaitGroup
+	var dialCount int
 	errs := make(chan error, len(s.snmpClis))
 	for i, cli := range s.snmpClis {
+		if cli.Conn != nil {
+			continue
+		}
+		dialCount++
 		s.Debugf(2, "dial: initiating conn #%d", i)
 		wg.Add(1)
 		go func(i int, cli *gosnmp.GoSNMP) {
 			defer wg.Done()
-			if err := cli.DialWithCtx(ctx); err != nil {
+			cli.Context = ctx
+			if err := cli.Connect(); err != nil {
 				s.Warningf("dial: snmp cli #%d: %v", i, err)
 				errs <- err
 			}
@@ -173,7 +192,7 @@ func (s *SnmpRequest) Dial(ctx context.Context) error {
 	}
 	wg.Wait()
 	s.Debug(2, "dial: done with all connections")
-	if len(errs) == len(s.snmpClis) {
+	if dialCount > 0 && len(errs) == len(s.snmpClis) {
 		return fmt.Errorf("dial: unable to get any snmp conn: %v", <-errs)
 	}
 	return nil
@@ -183,11 +202,13 @@ func (s *SnmpRequest) Dial(ctx context.Context) error {
 func (s *SnmpRequest) Close() {
 	s.Debugf(2, "closing all snmp cons...")
 	for _, cli := range s.snmpClis {
-		cli.Conn.Close()
+		if cli.Conn != nil {
+			cli.Conn.Close()
+		}
 	}
 }
 
-// Get fetches all the scalar measures results.
+// Get fetches all the scalar measures results, with their derived metrics.
 // Returns the last non-nil error from gosnmp.
 func (s *SnmpRequest) Get(ctx context.Context) (results []ScalarResults, err error) {
 	for _, scalar := range s.ScalarMeasures {
@@ -202,6 +223,9 @@ func (s *SnmpRequest) Get(ctx context.Context) (results []ScalarResults, err err
 			s.Warningf("Get %s: %v, skipping result", scalar.Name, err)
 			continue
 		}
+		s.computeCounters(res, time.Now())
+		res = s.typeInetAddresses(scalar.Metrics, res)
+		res = s.derive(scalar.DerivedMetrics, res)
 		sres := ScalarResults{
 			Name:     scalar.Name,
 			Results:  res,
@@ -209,6 +233,7 @@ func (s *SnmpRequest) Get(ctx context.Context) (results []ScalarResults, err err
 			ToKafka:  scalar.ToKafka,
 			ToInflux: scalar.ToInflux,
 			ToNats:   scalar.ToNats,
+			Batched:  s.Device.BatchGet,
 		}
 		results = append(results, sres)
 	}
@@ -216,9 +241,13 @@ func (s *SnmpRequest) Get(ctx context.Context) (results []ScalarResults, err err
 }
 
 // getMeasure gets a scalar measure using all available connections simultaneously.
-// Each oid is fetched in a separate gosnmp Get call to avoid cascading errors.
+// Each oid is fetched in a separate gosnmp Get call to avoid cascading errors,
+// unless batched gets are enabled for the device.
 // If one of the Get call results in an error, the last non-nil error is returned.
 func (s *SnmpRequest) getMeasure(ctx context.Context, meas model.ScalarMeasure) ([]Result, error) {
+	if s.Device.BatchGet {
+		return s.getMeasureBatched(ctx, meas)
+	}
 	metrics := make(chan model.Metric, len(meas.Metrics))
 	defer close(metrics) // needed for async range loop below
 	for _, metric := range meas.Metrics {
@@ -228,6 +257,7 @@ func (s *SnmpRequest) getMeasure(ctx context.Context, meas model.ScalarMeasure)
 	snmpResults := make(chan snmpgetResult)
 	for i, cli := range s.snmpClis {
 		go func(i int, cli *gosnmp.GoSNMP) {
+			cli.Context = ctx
 			for metric := range metrics {
 				if meas.UseAlternateCommunity && s.Device.AlternateCommunity != "" {
 					cli.Community = s.Device.AlternateCommunity
@@ -236,7 +266,7 @@ func (s *SnmpRequest) getMeasure(ctx context.Context, meas model.ScalarMeasure)
 				}
 				oid := string(metric.Oid)
 				s.Debugf(1, "con#%d: getting scalar oid %s (%s)", i, oid, metric.Name)
-				pkt, err := cli.GetWithCtx(ctx, []string{oid})
+				pkt, err := cli.Get([]string{oid})
 				s.Debugf(2, "con#%d oid %s: got snmp reply, pushing...", i, oid)
 				s.Debugf(3, ">> pkt=%+v, err=%v", pkt, err)
 				snmpResults <- snmpgetResult{metric, pkt, err}
@@ -295,10 +325,48 @@ func (s *SnmpRequest) walkMetric(ctx context.Context, grouped []model.Metric, co
 	}
 
 	tabResult := make(TabularResults)
-	pduWalker := func(pdu gosnmp.SnmpPDU) error {
+	pduWalker := s.pduWalker(grouped, conIdx, tabResult)
+	s.Debugf(2, "con#%d: walking indexed metric %s, alternate community: %v", conIdx, oid, useAltCommunity)
+	cli := s.snmpClis[conIdx]
+	if useAltCommunity && s.Device.AlternateCommunity != "" {
+		cli.Community = s.Device.AlternateCommunity
+	} else {
+		cli.Community = s.Device.Community
+	}
+	cli.Context = ctx
+	var err error
+	if s.Device.Version == model.Version1 || s.Device.DisableBulk {
+		err = cli.Walk(string(oid), pduWalker)
+	} else if s.reps != nil {
+		err = s.adaptiveBulkWalk(cli, string(oid), pduWalker)
+	} else {
+		err = cli.BulkWalk(string(oid), pduWalker)
+	}
+	if err != nil {
+		return tabResult, fmt.Errorf("Walk: %v", err)
+	}
+	s.rc.Lock()
+	if _, ok := s.rc.cache[oid.CacheKey(useAltCommunity)]; !ok && len(grouped) == 1 && grouped[0].IndexRegex == nil {
+		// cache only non-grouped metrics with no index-pattern
+		s.rc.cache[oid.CacheKey(useAltCommunity)] = tabResult
+	}
+	s.rc.Unlock()
+	s.Debugf(3, "con#%d: res map for group indexed oid %s: %d metrics", conIdx, oid, len(tabResult))
+	return tabResult, nil
+}
+
+// pduWalker returns the gosnmp walk func extracting the results of the grouped
+// metrics from the walked pdus into tabResult.
+func (s *SnmpRequest) pduWalker(grouped []model.Metric, conIdx int, tabResult TabularResults) gosnmp.WalkFunc {
+	oid := grouped[0].Oid
+	return func(pdu gosnmp.SnmpPDU) error {
 		if len(pdu.Name) < len(oid) {
 			return fmt.Errorf("child oid (%s) smaller than base oid (%s)", pdu.Name, oid)
 		}
+		if len(pdu.Name) == len(oid) {
+			// leaf oid returned by the walk, no index to extract
+			return nil
+		}
 		if pdu.Value != nil {
 			for _, metric := range grouped {
 				res, err := MakeResult(pdu, metric)
@@ -322,30 +390,6 @@ func (s *SnmpRequest) walkMetric(ctx context.Context, grouped []model.Metric, co
 		}
 		return nil
 	}
-	s.Debugf(2, "con#%d: walking indexed metric %s, alternate community: %v", conIdx, oid, useAltCommunity)
-	cli := s.snmpClis[conIdx]
-	if useAltCommunity && s.Device.AlternateCommunity != "" {
-		cli.Community = s.Device.AlternateCommunity
-	} else {
-		cli.Community = s.Device.Community
-	}
-	var err error
-	if s.Device.Version == model.Version1 || s.Device.DisableBulk {
-		err = cli.WalkWithCtx(ctx, string(oid), pduWalker)
-	} else {
-		err = cli.BulkWalkWithCtx(ctx, string(oid), pduWalker)
-	}
-	if err != nil {
-		return tabResult, fmt.Errorf("Walk: %v", err)
-	}
-	s.rc.Lock()
-	if _, ok := s.rc.cache[oid.CacheKey(useAltCommunity)]; !ok && len(grouped) == 1 && grouped[0].IndexRegex == nil {
-		// cache only non-grouped metrics with no index-pattern
-		s.rc.cache[oid.CacheKey(useAltCommunity)] = tabResult
-	}
-	s.rc.Unlock()
-	s.Debugf(3, "con#%d: res map for group indexed oid %s: %d metrics", conIdx, oid, len(tabResult))
-	return tabResult, nil
 }
 
 // walkSingleMetric is a simplified walkMetric when there is only one metric and
@@ -355,7 +399,8 @@ func (s *SnmpRequest) walkSingleMetric(ctx context.Context, metr model.Metric) (
 }
 
 // walkMeasure queries an indexed measure and returns the corresponding indexed results.
-// Makes multiple parallel snmp queries and gathers the results at the end.
+// Makes multiple parallel snmp queries and gathers the results at the end, unless
+// the measure is walked with the table or targeted strategy.
 // If one or more of the walk requests resulted in an error, the last one is returned.
 func (s *SnmpRequest) walkMeasure(ctx context.Context, measure model.IndexedMeasure) (IndexedResults, error) {
 	var tabResults []TabularResults
@@ -366,6 +411,12 @@ func (s *SnmpRequest) walkMeasure(ctx context.Context, measure model.IndexedMeas
 	}
 
 	byOid := model.GroupByOid(measure.Metrics)
+	switch measure.WalkStrategy {
+	case model.WalkTable:
+		return s.walkTableMeasure(ctx, measure, byOid)
+	case model.WalkTargeted:
+		return s.walkTargetedMeasure(ctx, measure, byOid)
+	}
 	groupedMetrics := make(chan []model.Metric, len(byOid))
 	defer close(groupedMetrics)
 	walkResults := make(chan snmpwalkResult)
@@ -411,23 +462,64 @@ func (s *SnmpRequest) walkMeasure(ctx context.Context, measure model.IndexedMeas
 	return indexed, walkErr
 }
 
+// indexedFromTabs builds the filtered indexed results of the measure from the
+// tabular results of each grouped metric, in the same order as byOid.
+// Empty tabular results are skipped.
+func (s *SnmpRequest) indexedFromTabs(measure model.IndexedMeasure, byOid [][]model.Metric, tabs []TabularResults) IndexedResults {
+	var tabResults []TabularResults
+	for i, tab := range tabs {
+		if len(tab) == 0 {
+			s.Debugf(2, "indexed %s: skipping empty tabular result", byOid[i][0].Oid)
+			continue
+		}
+		if measure.IndexMetricID.Valid && int64(byOid[i][0].ID) == measure.IndexMetricID.Int64 {
+			// recompute index result position on tabResults
+			measure.IndexPos = len(tabResults)
+		}
+		tabResults = append(tabResults, tab)
+	}
+	indexed := MakeIndexed(s.UID, measure, tabResults)
+	s.Debugf(2, "indexedFromTabs: full index results count: %d", len(indexed.Results))
+	indexed.Filter(measure)
+	s.Debugf(2, "indexedFromTabs: filtered index results count: %d", len(indexed.Results))
+	return indexed
+}
+
 // Walk polls all the indexed measures and returns an array of IndexedResults
 // in the same order as each indexed measure.
-// On error, a partial result is still returned.
+// On error, a partial result is still returned. The label metrics are taken from
+// the label cache when available and cached after a successful walk otherwise.
+// The joined tables of each measure are then merged into its rows, and the
+// derived metrics computed on each row.
 func (s *SnmpRequest) Walk(ctx context.Context) ([]IndexedResults, error) {
 	var results []IndexedResults
 	var err error
 
 	for _, meas := range s.IndexedMeasures {
 		var indexed IndexedResults
+		cached, state := s.loadLabels(ctx, meas)
 		indexed, err = s.walkMeasure(ctx, meas)
 		if err != nil {
 			s.Errorf("Walk %s: %v", meas.Name, err)
+		} else if meas.LabelRefreshPolls > 0 && !cached {
+			s.saveLabels(meas, state)
 		}
 		if len(indexed.Results) == 0 {
 			s.Debugf(2, "skipping indexed measure %s with no result", meas.Name)
 			continue
 		}
+		if len(meas.IndexJoins) > 0 {
+			if joinErr := s.joinIndexes(ctx, meas, indexed.Results); joinErr != nil {
+				s.Errorf("Walk %s: %v", meas.Name, joinErr)
+				err = joinErr
+			}
+		}
+		stamp := time.Now()
+		for i, row := range indexed.Results {
+			s.computeCounters(row, stamp)
+			row = s.typeInetAddresses(meas.Metrics, row)
+			indexed.Results[i] = s.derive(meas.DerivedMetrics, row)
+		}
 		results = append(results, indexed)
 	}
 	return results, err
@@ -435,15 +527,25 @@ func (s *SnmpRequest) Walk(ctx context.Context) ([]IndexedResults, error) {
 
 // Poll queries all metrics of the request and returns them in a PollResult.
 // If there was a timeout while getting scalar results, we stop there, there is
-// no Walk attempted to get the indexed results.
+// no Walk attempted to get the indexed results. When some metrics need a counter
+// rate or delta, the device uptime is checked first to detect a reboot.
+// For snmpv3 devices, the engine params are cached at the end of the poll,
+// or removed from cache if the device didn't respond. In adaptive mode, the
+// learned max-repetitions is set on the result to be reported to the dispatcher.
 func (s *SnmpRequest) Poll(ctx context.Context) PollResult {
 	res := s.MakePollResult()
+	if s.hasCounters() {
+		if err := s.checkReboot(ctx); err != nil {
+			s.Warningf("poll: %v", err)
+		}
+	}
 	res.Scalar, res.pollErr = s.Get(ctx)
 	if ErrIsUnreachable(res.pollErr) {
 		res.PollErr = res.pollErr.Error()
 		res.Duration = int64(time.Since(res.PollStart) / time.Millisecond)
 		s.Warningf("poll: %v", res.pollErr)
 		res.IsPartial = len(res.Scalar) > 0
+		engines.invalidate(s.Device.ID)
 		return res
 	}
 	res.Indexed, res.pollErr = s.Walk(ctx)
@@ -453,6 +555,19 @@ func (s *SnmpRequest) Poll(ctx context.Context) PollResult {
 		res.PollErr = res.pollErr.Error()
 		res.IsPartial = len(res.Scalar)+len(res.Indexed) > 0
 	}
+	if s.Device.Version == model.Version3 {
+		if res.pollErr == nil || res.IsPartial {
+			s.saveEngine()
+		} else {
+			engines.invalidate(s.Device.ID)
+		}
+	}
+	if s.reps != nil && (res.pollErr == nil || res.IsPartial) {
+		if maxRep := s.reps.current(); maxRep != s.Device.MaxRepetitions {
+			s.Debugf(1, "poll: max-repetitions tuned from %d to %d", s.Device.MaxRepetitions, maxRep)
+			res.maxRepetitions = maxRep
+		}
+	}
 	return res
 }
 
@@ -90,7 +90,7 @@ func TestDial(t *testing.T) {
 	}
 	defer req.Close()
 	if testing.Verbose() {
-		t.Logf("snmpclis: %+v, first: %+v", req.snmpClis, *req.snmpClis[0])
+		t.Logf("snmpclis: %+v, first: %+v", req.snmpClis, req.snmpClis[0])
 	}
 }
 
@@ -0,0 +1,296 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+const v3Req = `{
+	"uid": "v3-%s-%s",
+	"device": {
+		"id": 1002,
+		"hostname": "localhost",
+		"polling_frequency": 300,
+		"category": "ROUTER",
+		"vendor": "TEST",
+		"model": "V3",
+		"ip_address": "127.0.0.1",
+		"snmp_port": %d,
+		"snmp_version": "3",
+		"snmp_community": "public",
+		"snmp_timeout": 2,
+		"snmp_retries": 0,
+		"snmpv3_security_level": "%s",
+		"snmpv3_auth_user": "horus",
+		"snmpv3_auth_proto": "%s",
+		"snmpv3_auth_passwd": "horus-auth-passwd",
+		"snmpv3_privacy_proto": "%s",
+		"snmpv3_privacy_passwd": "horus-priv-passwd",
+		"snmpv3_context_name": "%s"
+	},
+	"ScalarMeasures": [{
+		"Name":"sysUsage",
+		"Metrics":[{"Name":"sysName", "Oid":".1.3.6.1.2.1.1.5.0", "Active":true}]
+	}]
+}`
+
+// v3Responder is a minimal snmpv3 agent listening on localhost and replying
+// to all get requests with the same string value.
+type v3Responder struct {
+	conn        *net.UDPConn
+	usm         *gosnmp.UsmSecurityParameters
+	flags       gosnmp.SnmpV3MsgFlags
+	value       string
+	salt        uint64
+	discoveries int
+	contexts    []string
+	sync.Mutex
+}
+
+// newV3Responder starts a responder for the given snmpv3 credentials.
+func newV3Responder(params model.SnmpParams, value string) (*v3Responder, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	r := &v3Responder{
+		conn: conn,
+		usm: &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    "\x80\x00\x1f\x88\x04horus-test",
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  42,
+			UserName:                 params.AuthUser,
+			AuthenticationProtocol:   params.GoSnmpAuthProto(),
+			AuthenticationPassphrase: params.AuthPasswd,
+			PrivacyProtocol:          params.GoSnmpPrivProto(),
+			PrivacyPassphrase:        params.PrivPasswd,
+			Logger:                   log.WithPrefix("v3responder"),
+		},
+		value: value,
+	}
+	switch params.SecLevel {
+	case "AuthNoPriv":
+		r.flags = gosnmp.AuthNoPriv
+	case "AuthPriv":
+		r.flags = gosnmp.AuthPriv
+	default:
+		r.flags = gosnmp.NoAuthNoPriv
+	}
+	go r.serve()
+	return r, nil
+}
+
+// port returns the udp port the responder is listening on.
+func (r *v3Responder) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Close stops the responder.
+func (r *v3Responder) Close() {
+	r.conn.Close()
+}
+
+func (r *v3Responder) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		reply, err := r.reply(buf[:n])
+		if err != nil {
+			log.Warningf("v3responder: %v", err)
+			continue
+		}
+		r.conn.WriteToUDP(reply, addr)
+	}
+}
+
+// reply builds the response to the request packet: a report with the engine
+// parameters for discovery requests or a get response otherwise.
+func (r *v3Responder) reply(data []byte) ([]byte, error) {
+	r.Lock()
+	defer r.Unlock()
+	srv := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           r.flags,
+		SecurityParameters: r.usm,
+		Logger:             r.usm.Logger,
+	}
+	req := srv.UnmarshalTrap(data, true)
+	if req == nil {
+		return nil, errors.New("unable to decode or authenticate request")
+	}
+	reqParams := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	resp := &gosnmp.SnmpPacket{
+		Version:         gosnmp.Version3,
+		SecurityModel:   gosnmp.UserSecurityModel,
+		MsgID:           req.MsgID,
+		RequestID:       req.RequestID,
+		ContextEngineID: r.usm.AuthoritativeEngineID,
+		ContextName:     req.ContextName,
+		Logger:          r.usm.Logger,
+	}
+	if reqParams.AuthoritativeEngineID == "" {
+		r.discoveries++
+		resp.MsgFlags = gosnmp.NoAuthNoPriv
+		resp.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    r.usm.AuthoritativeEngineID,
+			AuthoritativeEngineBoots: r.usm.AuthoritativeEngineBoots,
+			AuthoritativeEngineTime:  r.usm.AuthoritativeEngineTime,
+			Logger:                   r.usm.Logger,
+		}
+		resp.PDUType = gosnmp.Report
+		resp.Variables = []gosnmp.SnmpPDU{{Name: ".1.3.6.1.6.3.15.1.1.4.0", Type: gosnmp.Counter32, Value: uint32(1)}}
+		return resp.MarshalMsg()
+	}
+	if reqParams.UserName != r.usm.UserName {
+		return nil, fmt.Errorf("unknown user %q", reqParams.UserName)
+	}
+	if req.ContextEngineID != r.usm.AuthoritativeEngineID {
+		return nil, fmt.Errorf("unknown context engine id %x", req.ContextEngineID)
+	}
+	r.contexts = append(r.contexts, req.ContextName)
+	secParams := r.usm.Copy().(*gosnmp.UsmSecurityParameters)
+	r.salt++
+	secParams.PrivacyParameters = make([]byte, 8)
+	binary.BigEndian.PutUint64(secParams.PrivacyParameters, r.salt)
+	resp.MsgFlags = r.flags
+	resp.SecurityParameters = secParams
+	resp.PDUType = gosnmp.GetResponse
+	for _, pdu := range req.Variables {
+		resp.Variables = append(resp.Variables, gosnmp.SnmpPDU{Name: pdu.Name, Type: gosnmp.OctetString, Value: r.value})
+	}
+	return resp.MarshalMsg()
+}
+
+// makeV3Request returns a new SnmpRequest to poll the responder.
+func makeV3Request(t *testing.T, resp *v3Responder, params model.SnmpParams) *SnmpRequest {
+	t.Helper()
+	var req SnmpRequest
+	sreq := fmt.Sprintf(v3Req, params.AuthProto, params.PrivProto, resp.port(), params.SecLevel, params.AuthProto, params.PrivProto, params.ContextName)
+	if err := json.Unmarshal([]byte(sreq), &req); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	return &req
+}
+
+// pollV3 polls the responder with a new SnmpRequest.
+func pollV3(t *testing.T, resp *v3Responder, params model.SnmpParams) PollResult {
+	t.Helper()
+	req := makeV3Request(t, resp, params)
+	if err := req.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer req.Close()
+	return req.Poll(context.Background())
+}
+
+func TestSnmpV3Protocols(t *testing.T) {
+	tests := []struct {
+		secLevel  string
+		authProto string
+		privProto string
+	}{
+		{"NoAuthNoPriv", "", ""},
+		{"AuthNoPriv", "MD5", ""},
+		{"AuthNoPriv", "SHA", ""},
+		{"AuthNoPriv", "SHA224", ""},
+		{"AuthNoPriv", "SHA256", ""},
+		{"AuthNoPriv", "SHA384", ""},
+		{"AuthNoPriv", "SHA512", ""},
+		{"AuthPriv", "MD5", "DES"},
+		{"AuthPriv", "SHA", "AES"},
+		{"AuthPriv", "SHA256", "AES"},
+		{"AuthPriv", "SHA256", "AES192"},
+		{"AuthPriv", "SHA256", "AES256"},
+		{"AuthPriv", "SHA512", "AES192C"},
+		{"AuthPriv", "SHA512", "AES256C"},
+		{"AuthPriv", "SHA", "AES256C"},
+	}
+	for _, tt := range tests {
+		name := tt.secLevel + "-" + tt.authProto + "-" + tt.privProto
+		t.Run(name, func(t *testing.T) {
+			params := model.SnmpParams{
+				SecLevel:   tt.secLevel,
+				AuthUser:   "horus",
+				AuthProto:  tt.authProto,
+				AuthPasswd: "horus-auth-passwd",
+				PrivProto:  tt.privProto,
+				PrivPasswd: "horus-priv-passwd",
+			}
+			resp, err := newV3Responder(params, "horus-"+name)
+			if err != nil {
+				t.Fatalf("start responder: %v", err)
+			}
+			defer resp.Close()
+			res := pollV3(t, resp, params)
+			if res.pollErr != nil {
+				t.Fatalf("Poll: %v", res.pollErr)
+			}
+			if len(res.Scalar) != 1 || len(res.Scalar[0].Results) != 1 {
+				t.Fatalf("Poll: expected 1 result, got %+v", res.Scalar)
+			}
+			if val := res.Scalar[0].Results[0].Value; val != "horus-"+name {
+				t.Errorf("Poll: expected sysName %q, got %v", "horus-"+name, val)
+			}
+		})
+	}
+}
+
+func TestSnmpV3EngineCache(t *testing.T) {
+	params := model.SnmpParams{
+		SecLevel:    "AuthPriv",
+		AuthUser:    "horus",
+		AuthProto:   "SHA256",
+		AuthPasswd:  "horus-auth-passwd",
+		PrivProto:   "AES256",
+		PrivPasswd:  "horus-priv-passwd",
+		ContextName: "vrf-test",
+	}
+	resp, err := newV3Responder(params, "horus")
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+	for i := 0; i < 3; i++ {
+		if res := pollV3(t, resp, params); res.pollErr != nil {
+			t.Fatalf("Poll#%d: %v", i, res.pollErr)
+		}
+	}
+	resp.Lock()
+	defer resp.Unlock()
+	if resp.discoveries != 1 {
+		t.Errorf("expected 1 engine discovery, got %d", resp.discoveries)
+	}
+	for i, ctxName := range resp.contexts {
+		if ctxName != params.ContextName {
+			t.Errorf("request#%d: expected context name %q, got %q", i, params.ContextName, ctxName)
+		}
+	}
+}
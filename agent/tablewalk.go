@@ -0,0 +1,213 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+// tableColumn is the walk state of a column of a table walk.
+type tableColumn struct {
+	// grouped is the list of metrics with the column oid
+	grouped []model.Metric
+
+	// root is the column base oid
+	root string
+
+	// last is the last oid retrieved for this column
+	last string
+
+	// walker extracts the results from the column pdus
+	walker gosnmp.WalkFunc
+
+	// done tells whether the end of the column was reached
+	done bool
+}
+
+// walkTableMeasure queries an indexed measure with the table walk strategy and
+// returns the corresponding indexed results. On error, a partial result is returned.
+func (s *SnmpRequest) walkTableMeasure(ctx context.Context, measure model.IndexedMeasure, byOid [][]model.Metric) (IndexedResults, error) {
+	s.Debugf(2, "table walk of %d grouped metrics", len(byOid))
+	tabs, walkErr := s.walkTable(ctx, byOid, measure.UseAlternateCommunity)
+	return s.indexedFromTabs(measure, byOid, tabs), walkErr
+}
+
+// walkTable walks all the grouped metrics of an indexed measure together, with
+// getbulk (or getnext) requests containing the next oid of each column, like
+// net-snmp's snmptable. The returned TabularResults are in the same order as byOid.
+// Columns already in cache are not walked again. All requests are made on the first
+// connection as the columns are advanced together.
+func (s *SnmpRequest) walkTable(ctx context.Context, byOid [][]model.Metric, useAltCommunity bool) ([]TabularResults, error) {
+	const conIdx = 0
+	tabResults := make([]TabularResults, len(byOid))
+	var cols []*tableColumn
+	for i, grouped := range byOid {
+		oid := grouped[0].Oid
+		s.rc.RLock()
+		cached, ok := s.rc.cache[oid.CacheKey(useAltCommunity)]
+		s.rc.RUnlock()
+		if ok {
+			s.Debugf(1, "con#%d: returning cached res map for oid %s", conIdx, oid)
+			tabResults[i] = cached
+			continue
+		}
+		tabResults[i] = make(TabularResults)
+		root := string(oid)
+		if !strings.HasPrefix(root, ".") {
+			root = "." + root
+		}
+		cols = append(cols, &tableColumn{
+			grouped: grouped,
+			root:    root,
+			last:    root,
+			walker:  s.pduWalker(grouped, conIdx, tabResults[i]),
+		})
+	}
+
+	cli := s.snmpClis[conIdx]
+	if useAltCommunity && s.Device.AlternateCommunity != "" {
+		cli.Community = s.Device.AlternateCommunity
+	} else {
+		cli.Community = s.Device.Community
+	}
+	cli.Context = ctx
+	size := s.batchSize()
+	for start := 0; start < len(cols); start += size {
+		end := start + size
+		if end > len(cols) {
+			end = len(cols)
+		}
+		if err := s.advanceColumns(cli, cols[start:end]); err != nil {
+			return tabResults, fmt.Errorf("table walk: %v", err)
+		}
+	}
+
+	s.rc.Lock()
+	for i, grouped := range byOid {
+		oid := grouped[0].Oid
+		if _, ok := s.rc.cache[oid.CacheKey(useAltCommunity)]; !ok && len(grouped) == 1 && grouped[0].IndexRegex == nil {
+			// cache only non-grouped metrics with no index-pattern
+			s.rc.cache[oid.CacheKey(useAltCommunity)] = tabResults[i]
+		}
+	}
+	s.rc.Unlock()
+	return tabResults, nil
+}
+
+// advanceColumns advances all the columns together until the end of each one.
+// The bulk max-repetitions is divided among the columns to keep the reply size
+// close to a single column walk.
+func (s *SnmpRequest) advanceColumns(cli *gosnmp.GoSNMP, cols []*tableColumn) error {
+	useBulk := s.Device.Version != model.Version1 && !s.Device.DisableBulk
+	for {
+		var active []*tableColumn
+		var oids []string
+		for _, col := range cols {
+			if !col.done {
+				active = append(active, col)
+				oids = append(oids, col.last)
+			}
+		}
+		if len(active) == 0 {
+			return nil
+		}
+
+		var pkt *gosnmp.SnmpPacket
+		var err error
+		if useBulk {
+			reps := s.tableRepetitions(len(active))
+			s.Debugf(2, "table walk: getbulk of %d columns, max-repetitions %d", len(active), reps)
+			pkt, err = cli.GetBulk(oids, 0, uint8(reps))
+		} else {
+			s.Debugf(2, "table walk: getnext of %d columns", len(active))
+			pkt, err = cli.GetNext(oids)
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case pkt.Error == gosnmp.NoError:
+		case pkt.Error == gosnmp.TooBig && useBulk && s.reps != nil && s.reps.shrink():
+			s.Debugf(1, "table walk: tooBig, retrying with max-repetitions %d", s.reps.current())
+			continue
+		case pkt.Error == gosnmp.NoSuchName && pkt.ErrorIndex > 0 && int(pkt.ErrorIndex) <= len(active):
+			// snmp v1 end of mib on one of the columns
+			active[pkt.ErrorIndex-1].done = true
+			continue
+		default:
+			return fmt.Errorf("request error: %v", pkt.Error)
+		}
+		if len(pkt.Variables) == 0 {
+			return nil
+		}
+
+		// the varbinds are interleaved: one row of all active columns at a time
+		for i, pdu := range pkt.Variables {
+			col := active[i%len(active)]
+			if col.done {
+				continue
+			}
+			if pdu.Type == gosnmp.EndOfMibView || pdu.Type == gosnmp.NoSuchObject || pdu.Type == gosnmp.NoSuchInstance ||
+				!strings.HasPrefix(pdu.Name, col.root+".") {
+				col.done = true
+				continue
+			}
+			if !oidLess(col.last, pdu.Name) {
+				return fmt.Errorf("OID not increasing: %s", pdu.Name)
+			}
+			if err := col.walker(pdu); err != nil {
+				return err
+			}
+			col.last = pdu.Name
+		}
+	}
+}
+
+// tableRepetitions returns the max-repetitions of a table getbulk request of
+// colCount columns.
+func (s *SnmpRequest) tableRepetitions(colCount int) int {
+	reps := s.Device.MaxRepetitions
+	if s.reps != nil {
+		reps = s.reps.current()
+	}
+	if reps == 0 {
+		reps = defaultMaxRepetitions
+	}
+	reps /= colCount
+	if reps < 1 {
+		reps = 1
+	}
+	return reps
+}
+
+// oidLess tells whether oid a is lexicographically before oid b.
+func oidLess(a, b string) bool {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,110 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+const ifTableMeasure = `"IndexedMeasures": [{
+	"Name":"ifTable",
+	"IndexMetricID": 1,
+	"WalkStrategy": "%s",
+	"Metrics":[
+		{"ID":1, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true},
+		{"ID":2, "Name":"ifType", "Oid":".1.3.6.1.2.1.2.2.1.3", "Active":true},
+		{"ID":3, "Name":"ifMtu", "Oid":".1.3.6.1.2.1.2.2.1.4", "Active":true}
+	]
+}]`
+
+// makeIfTable returns an ifTable of count interfaces with an ifMtu
+// column defined only on even indexes.
+func makeIfTable(count int) []gosnmp.SnmpPDU {
+	var mib []gosnmp.SnmpPDU
+	for i := 1; i <= count; i++ {
+		mib = append(mib,
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.2.%d", i), Type: gosnmp.OctetString, Value: []byte(fmt.Sprintf("eth%d", i))},
+			gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.3.%d", i), Type: gosnmp.Integer, Value: 6})
+		if i%2 == 0 {
+			mib = append(mib, gosnmp.SnmpPDU{Name: fmt.Sprintf(".1.3.6.1.2.1.2.2.1.4.%d", i), Type: gosnmp.Integer, Value: 1500})
+		}
+	}
+	mib = append(mib, gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.5.1", Type: gosnmp.Gauge32, Value: uint(1e9)})
+	return mib
+}
+
+// indexedSet returns the sorted list of all indexed results as index/name=value.
+func indexedSet(res PollResult) []string {
+	var set []string
+	for _, x := range res.Indexed {
+		for _, row := range x.Results {
+			for _, r := range row {
+				set = append(set, fmt.Sprintf("%s/%s=%v", r.Index, r.Name, r.Value))
+			}
+		}
+	}
+	sort.Strings(set)
+	return set
+}
+
+func TestTableWalk(t *testing.T) {
+	tests := []struct {
+		name      string
+		devParams string
+	}{
+		{"bulk", ""},
+		{"getnext", `, "snmp_disable_bulk": true`},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newMibResponder(makeIfTable(20))
+			if err != nil {
+				t.Fatalf("start responder: %v", err)
+			}
+			defer resp.Close()
+
+			colRes := pollV2(t, resp, 4000+2*i, tt.devParams, fmt.Sprintf(ifTableMeasure, "column"))
+			resp.Lock()
+			colBulks := len(resp.bulkSizes)
+			resp.bulkSizes = nil
+			resp.Unlock()
+			tabRes := pollV2(t, resp, 4001+2*i, tt.devParams, fmt.Sprintf(ifTableMeasure, "table"))
+			if tabRes.pollErr != nil {
+				t.Fatalf("table walk: %v", tabRes.pollErr)
+			}
+
+			colSet, tabSet := indexedSet(colRes), indexedSet(tabRes)
+			if len(tabSet) != 50 {
+				t.Errorf("table walk: expected 50 results, got %d", len(tabSet))
+			}
+			if !reflect.DeepEqual(colSet, tabSet) {
+				t.Errorf("table walk results differ from column walk:\n%v\n%v", colSet, tabSet)
+			}
+			if len(tabRes.Indexed) == 1 && len(tabRes.Indexed[0].Results) != 20 {
+				t.Errorf("table walk: expected 20 rows, got %d", len(tabRes.Indexed[0].Results))
+			}
+			resp.Lock()
+			defer resp.Unlock()
+			if tt.devParams == "" && len(resp.bulkSizes) >= colBulks {
+				t.Errorf("table walk: expected less than %d bulk requests, got %d", colBulks, len(resp.bulkSizes))
+			}
+		})
+	}
+}
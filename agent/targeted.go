@@ -0,0 +1,218 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+// matchedIndexes is the list of indexes matching the filter of a targeted measure.
+type matchedIndexes struct {
+	// filter is the filter definition the indexes were computed with
+	filter string
+
+	// indexes is the list of matching indexes
+	indexes []string
+
+	// stamp is the time the filter metric was walked
+	stamp time.Time
+}
+
+// indexCache keeps the indexes matching the filter of the targeted
+// measures of each device between polls.
+type indexCache struct {
+	entries map[string]matchedIndexes
+	sync.Mutex
+}
+
+// targetedIndexes is the global matching indexes cache.
+var targetedIndexes = &indexCache{entries: make(map[string]matchedIndexes)}
+
+// get returns the cached matching indexes for key if they were computed with the
+// same filter less than maxAge ago.
+func (c *indexCache) get(key, filter string, maxAge time.Duration, now time.Time) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	m, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if m.filter != filter || now.Sub(m.stamp) > maxAge {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return m.indexes, true
+}
+
+// set saves the matching indexes for key.
+func (c *indexCache) set(key string, m matchedIndexes) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = m
+}
+
+// invalidate removes the matching indexes of key from the cache.
+func (c *indexCache) invalidate(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+}
+
+// filterMetric returns the filter metric of the measure and the position
+// of its group in byOid, or -1 if not found.
+func filterMetric(measure model.IndexedMeasure, byOid [][]model.Metric) (model.Metric, int) {
+	for i, grouped := range byOid {
+		for _, metric := range grouped {
+			if int64(metric.ID) == measure.FilterMetricID.Int64 {
+				return metric, i
+			}
+		}
+	}
+	return model.Metric{}, -1
+}
+
+// matchFilter returns the indexes of tab whose filter metric value
+// matches the measure filter.
+func matchFilter(measure model.IndexedMeasure, filter model.Metric, tab TabularResults) []string {
+	var indexes []string
+	for idx, results := range tab {
+		for _, res := range results {
+			if res.Name != filter.Name {
+				continue
+			}
+			match := measure.FilterRegex.MatchString(fmt.Sprint(res.Value))
+			if match != measure.InvertFilterMatch {
+				indexes = append(indexes, idx)
+			}
+			break
+		}
+	}
+	return indexes
+}
+
+// walkTargetedMeasure queries an indexed measure with the targeted walk strategy:
+// the filter and index metrics are walked first to find the indexes matching the
+// filter, then the other metrics are fetched for these indexes only with batched
+// gets. The matching indexes are cached for FilterRefreshInterval, during which
+// all metrics, including the filter and index ones, are fetched with gets.
+// Metrics with an index pattern are always walked.
+func (s *SnmpRequest) walkTargetedMeasure(ctx context.Context, measure model.IndexedMeasure, byOid [][]model.Metric) (IndexedResults, error) {
+	filter, filterPos := filterMetric(measure, byOid)
+	if filterPos == -1 {
+		return IndexedResults{}, fmt.Errorf("targeted walk %s: filter metric not found", measure.Name)
+	}
+	key := fmt.Sprintf("%d-%d", s.Device.ID, measure.ID)
+	filterDef := fmt.Sprintf("%d:%s:%v", measure.FilterMetricID.Int64, measure.FilterPattern, measure.InvertFilterMatch)
+	maxAge := time.Duration(measure.FilterRefreshInterval) * time.Second
+	indexes, cached := targetedIndexes.get(key, filterDef, maxAge, time.Now())
+
+	var walkErr error
+	var targeted []int
+	tabs := make([]TabularResults, len(byOid))
+	for i, grouped := range byOid {
+		walked := grouped[0].IndexRegex != nil
+		if !cached && (i == filterPos || (measure.IndexMetricID.Valid && int64(grouped[0].ID) == measure.IndexMetricID.Int64)) {
+			walked = true
+		}
+		if !walked {
+			targeted = append(targeted, i)
+			continue
+		}
+		tab, err := s.walkMetric(ctx, grouped, 0, measure.UseAlternateCommunity)
+		if err != nil {
+			walkErr = fmt.Errorf("walk oid %s: %v", grouped[0].Oid, err)
+			if i == filterPos || ErrIsUnreachable(err) {
+				return IndexedResults{}, walkErr
+			}
+		}
+		tabs[i] = tab
+	}
+	if !cached {
+		indexes = matchFilter(measure, filter, tabs[filterPos])
+		s.Debugf(1, "targeted walk %s: %d indexes matching filter", measure.Name, len(indexes))
+		if maxAge > 0 {
+			targetedIndexes.set(key, matchedIndexes{filter: filterDef, indexes: indexes, stamp: time.Now()})
+		}
+	} else {
+		s.Debugf(1, "targeted walk %s: using %d cached matching indexes", measure.Name, len(indexes))
+	}
+
+	if len(indexes) > 0 && len(targeted) > 0 {
+		if err := s.getIndexes(ctx, measure, byOid, targeted, indexes, tabs); err != nil {
+			walkErr = fmt.Errorf("targeted get: %v", err)
+		}
+	}
+	if cached {
+		// indexes removed since the filter walk: drop them and refresh at next poll
+		for _, idx := range indexes {
+			if _, ok := tabs[filterPos][idx]; ok {
+				continue
+			}
+			s.Debugf(1, "targeted walk %s: index %s not found, invalidating cache", measure.Name, idx)
+			targetedIndexes.invalidate(key)
+			for _, tab := range tabs {
+				delete(tab, idx)
+			}
+		}
+	}
+	return s.indexedFromTabs(measure, byOid, tabs), walkErr
+}
+
+// getIndexes gets the grouped metrics at the targeted positions of byOid for the
+// given indexes with batched gets and puts the results in tabs, with the same
+// shape as walked results.
+func (s *SnmpRequest) getIndexes(ctx context.Context, measure model.IndexedMeasure, byOid [][]model.Metric, targeted []int, indexes []string, tabs []TabularResults) error {
+	type target struct {
+		pos   int
+		index string
+		oid   model.OID
+	}
+	targets := make(map[string]target)
+	var metrics []model.Metric
+	for _, pos := range targeted {
+		tabs[pos] = make(TabularResults)
+		for _, metric := range byOid[pos] {
+			for _, idx := range indexes {
+				m := metric
+				m.Oid = model.OID(fmt.Sprintf("%s.%s", metric.Oid, idx))
+				targets[string(m.Oid)] = target{pos, idx, metric.Oid}
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	s.Debugf(2, "targeted get %s: %d oids", measure.Name, len(metrics))
+	scalar := model.ScalarMeasure{
+		Name:                  measure.Name,
+		Metrics:               metrics,
+		UseAlternateCommunity: measure.UseAlternateCommunity,
+	}
+	results, err := s.getMeasureBatched(ctx, scalar)
+	for _, res := range results {
+		t, ok := targets[res.Oid]
+		if !ok {
+			continue
+		}
+		res.Oid = string(t.oid)
+		res.suffix = t.index
+		res.Index = t.index
+		tabs[t.pos][t.index] = append(tabs[t.pos][t.index], res)
+	}
+	return err
+}
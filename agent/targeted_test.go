@@ -0,0 +1,75 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const filteredIfTableMeasure = `"IndexedMeasures": [{
+	"ID": 7,
+	"Name":"ifTable",
+	"IndexMetricID": 1,
+	"FilterMetricID": 1,
+	"FilterPattern": "^eth1\\d$",
+	"FilterRefreshInterval": 60,
+	"WalkStrategy": "%s",
+	"Metrics":[
+		{"ID":1, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true},
+		{"ID":2, "Name":"ifType", "Oid":".1.3.6.1.2.1.2.2.1.3", "Active":true},
+		{"ID":3, "Name":"ifMtu", "Oid":".1.3.6.1.2.1.2.2.1.4", "Active":true}
+	]
+}]`
+
+func TestTargetedWalk(t *testing.T) {
+	resp, err := newMibResponder(makeIfTable(20))
+	if err != nil {
+		t.Fatalf("start responder: %v", err)
+	}
+	defer resp.Close()
+
+	colRes := pollV2(t, resp, 5000, "", fmt.Sprintf(filteredIfTableMeasure, "column"))
+	colSet := indexedSet(colRes)
+	if len(colSet) != 25 {
+		t.Fatalf("column walk: expected 25 results, got %d", len(colSet))
+	}
+
+	for i := 0; i < 2; i++ {
+		resp.Lock()
+		resp.bulkSizes, resp.getSizes = nil, nil
+		resp.Unlock()
+		res := pollV2(t, resp, 5001, "", fmt.Sprintf(filteredIfTableMeasure, "targeted"))
+		if res.pollErr != nil {
+			t.Fatalf("targeted walk#%d: %v", i, res.pollErr)
+		}
+		if set := indexedSet(res); !reflect.DeepEqual(colSet, set) {
+			t.Errorf("targeted walk#%d: results differ from column walk:\n%v\n%v", i, colSet, set)
+		}
+		resp.Lock()
+		bulks, gets := len(resp.bulkSizes), len(resp.getSizes)
+		resp.Unlock()
+		if i == 0 && bulks == 0 {
+			t.Errorf("targeted walk#%d: expected filter walk", i)
+		}
+		if i == 1 && bulks != 0 {
+			t.Errorf("targeted walk#%d: expected no walk with cached indexes, got %d bulk requests", i, bulks)
+		}
+		if gets == 0 {
+			t.Errorf("targeted walk#%d: expected get requests", i)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+// Textual convention post-processors decoding octet string values.
+const (
+	ppMAC          = "mac"
+	ppInetAddress  = "inet-address"
+	ppDateTime     = "date-and-time"
+	ppDateTimeUnix = "date-and-time-epoch"
+	ppBits         = "bits"
+	ppHex          = "hex"
+	ppCharset      = "charset:"
+)
+
+// formatMAC returns the MacAddress as colon separated lowercase hex bytes.
+func formatMAC(val []byte) (string, error) {
+	if len(val) != 6 && len(val) != 8 {
+		return "", fmt.Errorf("invalid mac address length %d", len(val))
+	}
+	parts := make([]string, len(val))
+	for i, b := range val {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
+
+// InetAddressType values (RFC 4001).
+const (
+	inetUnknown = 0
+	inetIPv4    = 1
+	inetIPv6    = 2
+	inetIPv4z   = 3
+	inetIPv6z   = 4
+	inetDNS     = 16
+)
+
+// formatInetAddress returns the InetAddress in canonical form. The address type
+// is deduced from the length, like the InetAddressType values: ipv4 (4 bytes),
+// ipv6 (16 bytes), ipv4z (8 bytes) and ipv6z (20 bytes) with the zone index
+// appended after a `%`. Other values are taken as dns names. As a dns name can
+// have any of these lengths, the `inet-address:<metric>` post-processor should
+// be used when the address type is known.
+func formatInetAddress(val []byte) string {
+	switch len(val) {
+	case net.IPv4len, net.IPv6len:
+		return net.IP(val).String()
+	case net.IPv4len + 4, net.IPv6len + 4:
+		return formatZonedIP(val)
+	default:
+		return strings.TrimSpace(string(val))
+	}
+}
+
+// formatZonedIP returns an ipv4z or ipv6z address with its zone index appended
+// after a `%`.
+func formatZonedIP(val []byte) string {
+	ipLen := len(val) - 4
+	zone := binary.BigEndian.Uint32(val[ipLen:])
+	return fmt.Sprintf("%s%%%d", net.IP(val[:ipLen]), zone)
+}
+
+// formatTypedInetAddress returns the InetAddress of the given InetAddressType in
+// canonical form. Returns an error if the length does not match the type.
+func formatTypedInetAddress(val []byte, addrType int) (string, error) {
+	lengths := map[int]int{
+		inetUnknown: 0,
+		inetIPv4:    net.IPv4len,
+		inetIPv6:    net.IPv6len,
+		inetIPv4z:   net.IPv4len + 4,
+		inetIPv6z:   net.IPv6len + 4,
+	}
+	if addrType == inetDNS {
+		return strings.TrimSpace(string(val)), nil
+	}
+	length, ok := lengths[addrType]
+	if !ok {
+		return "", fmt.Errorf("unsupported address type %d", addrType)
+	}
+	if len(val) != length {
+		return "", fmt.Errorf("invalid length %d for address type %d", len(val), addrType)
+	}
+	switch addrType {
+	case inetUnknown:
+		return "", nil
+	case inetIPv4, inetIPv6:
+		return net.IP(val).String(), nil
+	default:
+		return formatZonedIP(val), nil
+	}
+}
+
+// typeInetAddresses decodes the values of the results of the metrics with an
+// `inet-address:<metric>` post-processor with the address type given by the
+// named metric in the same results, a scalar measure or an indexed measure row.
+// Without address type, the value decoded from its length is kept. The results
+// whose length does not match their address type are dropped.
+func (s *SnmpRequest) typeInetAddresses(metrics []model.Metric, results []Result) []Result {
+	typeMetrics := make(map[string]string)
+	for _, m := range metrics {
+		for _, pp := range m.PostProcessors {
+			if strings.HasPrefix(pp, model.InetAddressPostProcessor) {
+				typeMetrics[m.Name] = strings.TrimPrefix(pp, model.InetAddressPostProcessor)
+			}
+		}
+	}
+	if len(typeMetrics) == 0 {
+		return results
+	}
+	types := make(map[string]float64)
+	for _, res := range results {
+		if v, ok := res.Value.(float64); ok {
+			types[res.Name] = v
+		}
+	}
+	kept := results[:0]
+	for _, res := range results {
+		typeName, ok := typeMetrics[res.Name]
+		raw, isBytes := res.rawValue.([]byte)
+		addrType, hasType := types[typeName]
+		if !ok || !isBytes || !hasType {
+			kept = append(kept, res)
+			continue
+		}
+		addr, err := formatTypedInetAddress(raw, int(addrType))
+		if err != nil {
+			s.Debugf(2, "%s (idx `%s`): %v, skipping", res.Name, res.Index, err)
+			continue
+		}
+		res.Value = addr
+		kept = append(kept, res)
+	}
+	return kept
+}
+
+// parseDateAndTime decodes a DateAndTime (RFC 2579): year on 2 bytes, month, day,
+// hour, minutes, seconds, deci-seconds and optionally the direction from UTC ('+'
+// or '-'), hours and minutes from UTC. The time is local to the agent without
+// UTC offset.
+func parseDateAndTime(val []byte) (time.Time, error) {
+	if len(val) != 8 && len(val) != 11 {
+		return time.Time{}, fmt.Errorf("invalid DateAndTime length %d", len(val))
+	}
+	year := int(binary.BigEndian.Uint16(val[:2]))
+	month, day, hour, min, sec, dsec := int(val[2]), int(val[3]), int(val[4]), int(val[5]), int(val[6]), int(val[7])
+	if month < 1 || month > 12 || day < 1 || day > 31 || hour > 23 || min > 59 || sec > 60 || dsec > 9 {
+		return time.Time{}, fmt.Errorf("invalid DateAndTime %x", val)
+	}
+	loc := time.Local
+	if len(val) == 11 {
+		if val[8] != '+' && val[8] != '-' || val[9] > 14 || val[10] > 59 {
+			return time.Time{}, fmt.Errorf("invalid DateAndTime UTC offset %x", val[8:])
+		}
+		offset := int(val[9])*3600 + int(val[10])*60
+		if val[8] == '-' {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	return time.Date(year, time.Month(month), day, hour, min, sec, dsec*1e8, loc), nil
+}
+
+// setBits returns the list of the bit numbers set in a BITS value, where the bit 0
+// is the most significant bit of the first byte.
+func setBits(val []byte) []int {
+	var bits []int
+	for i, b := range val {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>uint(j)) != 0 {
+				bits = append(bits, i*8+j)
+			}
+		}
+	}
+	return bits
+}
+
+// bitsMask returns the BITS value as the bitmask of its set bit numbers,
+// bit n having the value 2^n.
+func bitsMask(val []byte) (float64, error) {
+	var mask uint64
+	for _, n := range setBits(val) {
+		if n > 52 {
+			return 0, fmt.Errorf("bit %d overflows the float bitmask", n)
+		}
+		mask |= 1 << uint(n)
+	}
+	return float64(mask), nil
+}
+
+// bitsNames returns the names of the bits set in a BITS value, in bit order and
+// separated by commas. The names are taken from the lookup table by bit number,
+// the unnamed bits being named by their number.
+func bitsNames(val []byte, table map[string]string) string {
+	var names []string
+	for _, n := range setBits(val) {
+		name, ok := table[strconv.Itoa(n)]
+		if !ok {
+			name = strconv.Itoa(n)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// decodeCharset converts a string in the given charset to utf-8. Supported
+// charsets are latin1 (or iso-8859-1), utf-16be, utf-16le and utf-8, whose
+// invalid sequences are replaced.
+func decodeCharset(val []byte, charset string) (string, error) {
+	switch charset {
+	case "latin1", "iso-8859-1":
+		runes := make([]rune, len(val))
+		for i, b := range val {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	case "utf-16be", "utf-16le":
+		if len(val)%2 != 0 {
+			return "", fmt.Errorf("odd length %d for %s string", len(val), charset)
+		}
+		units := make([]uint16, len(val)/2)
+		for i := range units {
+			if charset == "utf-16be" {
+				units[i] = binary.BigEndian.Uint16(val[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(val[2*i:])
+			}
+		}
+		return string(utf16.Decode(units)), nil
+	case "utf8", "utf-8":
+		if utf8.Valid(val) {
+			return string(val), nil
+		}
+		return strings.ToValidUTF8(string(val), string(utf8.RuneError)), nil
+	default:
+		return "", fmt.Errorf("unsupported charset %s", charset)
+	}
+}
+
+// decodeOctets applies a textual convention post-processor to an octet string value.
+// Returns false if pp is not such a post-processor.
+func decodeOctets(val []byte, pp string, table map[string]string) (interface{}, bool, error) {
+	switch {
+	case pp == ppMAC:
+		mac, err := formatMAC(val)
+		return mac, true, err
+	case pp == ppInetAddress, strings.HasPrefix(pp, model.InetAddressPostProcessor):
+		// the typed address is decoded on the whole row by typeInetAddresses
+		return formatInetAddress(val), true, nil
+	case pp == ppDateTime:
+		t, err := parseDateAndTime(val)
+		if err != nil {
+			return nil, true, err
+		}
+		return t.Format(time.RFC3339Nano), true, nil
+	case pp == ppDateTimeUnix:
+		t, err := parseDateAndTime(val)
+		if err != nil {
+			return nil, true, err
+		}
+		return float64(t.UnixNano()) / 1e9, true, nil
+	case pp == ppBits:
+		mask, err := bitsMask(val)
+		return mask, true, err
+	case strings.HasPrefix(pp, ppBits+":"):
+		return bitsNames(val, table), true, nil
+	case pp == ppHex:
+		return hex.EncodeToString(val), true, nil
+	case strings.HasPrefix(pp, ppCharset):
+		str, err := decodeCharset(val, strings.TrimPrefix(pp, ppCharset))
+		return strings.TrimSpace(str), true, err
+	}
+	return nil, false, nil
+}
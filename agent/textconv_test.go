@@ -0,0 +1,135 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestDecodeOctets(t *testing.T) {
+	table := map[string]string{"0": "lowerLayerDown", "2": "notPresent"}
+	tests := []struct {
+		pp       string
+		in       []byte
+		expected interface{}
+		valid    bool
+	}{
+		{"mac", []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e}, "00:1a:2b:3c:4d:5e", true},
+		{"mac", []byte{0x00, 0x1a}, nil, false},
+		{"inet-address", []byte{10, 0, 0, 1}, "10.0.0.1", true},
+		{"inet-address", []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, "2001:db8::1", true},
+		{"inet-address", []byte{0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 3}, "fe80::1%3", true},
+		{"inet-address", []byte("ns1.example.com"), "ns1.example.com", true},
+		{"inet-address:peerAddrType", []byte{10, 0, 0, 1}, "10.0.0.1", true},
+		{"date-and-time", []byte{0x07, 0xe4, 5, 26, 13, 30, 15, 0, '+', 2, 0}, "2020-05-26T13:30:15+02:00", true},
+		{"date-and-time-epoch", []byte{0x07, 0xe4, 5, 26, 13, 30, 15, 5, '-', 1, 30}, float64(1590505215.5), true},
+		{"date-and-time", []byte{0x07, 0xe4, 13, 26, 13, 30, 15, 0}, nil, false},
+		{"date-and-time", []byte{0x07, 0xe4}, nil, false},
+		{"bits", []byte{0xa0, 0x01}, float64(1<<0 | 1<<2 | 1<<15), true},
+		{"bits:t", []byte{0xa0, 0x01}, "lowerLayerDown,notPresent,15", true},
+		{"hex", []byte{0x0a, 0xff}, "0aff", true},
+		{"charset:latin1", []byte{'c', 'a', 'f', 0xe9, ' '}, "café", true},
+		{"charset:utf-16be", []byte{0, 'o', 0, 'k'}, "ok", true},
+		{"charset:utf-16le", []byte{'o', 0, 'k'}, nil, false},
+		{"charset:utf-8", []byte{'o', 0xff, 'k'}, "o�k", true},
+	}
+	for i, tt := range tests {
+		res, ok, err := decodeOctets(tt.in, tt.pp, table)
+		if !ok {
+			t.Errorf("decode#%d %s: not handled", i, tt.pp)
+			continue
+		}
+		if (err == nil) != tt.valid {
+			t.Errorf("decode#%d %s: expected validity %v, got err %v", i, tt.pp, tt.valid, err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(res, tt.expected) {
+			t.Errorf("decode#%d %s: expected %v (%[3]T), got %v (%[4]T)", i, tt.pp, tt.expected, res)
+		}
+	}
+	if _, ok, _ := decodeOctets([]byte("x"), "trim", nil); ok {
+		t.Errorf("decode: trim should not be handled")
+	}
+}
+
+func TestFormatTypedInetAddress(t *testing.T) {
+	tests := []struct {
+		in       []byte
+		addrType int
+		expected string
+		valid    bool
+	}{
+		{[]byte{10, 0, 0, 1}, 1, "10.0.0.1", true},
+		{[]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 2, "2001:db8::1", true},
+		{[]byte{10, 0, 0, 1, 0, 0, 0, 3}, 3, "10.0.0.1%3", true},
+		{[]byte("a.bc"), 16, "a.bc", true},
+		{[]byte("ns1.example.org."), 16, "ns1.example.org.", true},
+		{[]byte{}, 0, "", true},
+		{[]byte{10, 0, 0, 1}, 2, "", false},
+		{[]byte("a.bc"), 25, "", false},
+	}
+	for i, tt := range tests {
+		res, err := formatTypedInetAddress(tt.in, tt.addrType)
+		if (err == nil) != tt.valid {
+			t.Errorf("format#%d: expected validity %v, got err %v", i, tt.valid, err)
+			continue
+		}
+		if res != tt.expected {
+			t.Errorf("format#%d: expected %q, got %q", i, tt.expected, res)
+		}
+	}
+}
+
+func TestTypeInetAddresses(t *testing.T) {
+	addrType := model.Metric{Name: "peerAddrType", Oid: ".1.3.6.1.4.1.9999.1.1"}
+	addr := model.Metric{Name: "peerAddr", Oid: ".1.3.6.1.4.1.9999.1.2", PostProcessors: []string{"inet-address:peerAddrType"}}
+	metrics := []model.Metric{addrType, addr}
+	tests := []struct {
+		typ      int
+		in       []byte
+		expected interface{}
+	}{
+		{1, []byte{10, 0, 0, 1}, "10.0.0.1"},
+		{16, []byte("a.bc"), "a.bc"},
+		{16, []byte("ns1.example.org."), "ns1.example.org."},
+		{2, []byte{10, 0, 0, 1}, nil},
+	}
+	req := &SnmpRequest{Logger: log.WithPrefix("inet-address")}
+	for i, tt := range tests {
+		typeRes, err := MakeResult(gosnmp.SnmpPDU{Name: string(addrType.Oid) + ".1", Type: gosnmp.Integer, Value: tt.typ}, addrType)
+		if err != nil {
+			t.Fatalf("row#%d: type result: %v", i, err)
+		}
+		addrRes, err := MakeResult(gosnmp.SnmpPDU{Name: string(addr.Oid) + ".1", Type: gosnmp.OctetString, Value: tt.in}, addr)
+		if err != nil {
+			t.Fatalf("row#%d: address result: %v", i, err)
+		}
+		row := req.typeInetAddresses(metrics, []Result{typeRes, addrRes})
+		var value interface{}
+		for _, res := range row {
+			if res.Name == addr.Name {
+				value = res.Value
+			}
+		}
+		if !reflect.DeepEqual(value, tt.expected) {
+			t.Errorf("row#%d: expected address %v, got %v", i, tt.expected, value)
+		}
+	}
+}
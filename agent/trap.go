@@ -0,0 +1,550 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+const (
+	// TrapMessageType is the type of the trap messages sent to kafka and NATS.
+	TrapMessageType = "trap"
+
+	// sysUpTimeOID is the oid of the uptime varbind of snmpv2 notifications.
+	sysUpTimeOID = ".1.3.6.1.2.1.1.3.0"
+
+	// snmpTrapOID is the oid of the notification id varbind of snmpv2 notifications.
+	snmpTrapOID = ".1.3.6.1.6.3.1.1.4.1.0"
+
+	// genericTrapPrefix is the prefix of the snmpv2 oids of the snmpv1 generic traps (RFC 3584).
+	genericTrapPrefix = ".1.3.6.1.6.3.1.1.5."
+
+	// usmStatsUnknownEngineIDs is the oid of the report counter sent on snmpv3 engine discovery.
+	usmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+)
+
+// authParamsLen is the length of the snmpv3 authentication parameters by protocol.
+// gosnmp only compares the received digest prefix, so its length is checked here.
+var authParamsLen = map[gosnmp.SnmpV3AuthProtocol]int{
+	gosnmp.MD5:    12,
+	gosnmp.SHA:    12,
+	gosnmp.SHA224: 16,
+	gosnmp.SHA256: 24,
+	gosnmp.SHA384: 32,
+	gosnmp.SHA512: 48,
+}
+
+// TrapRepollURL is the dispatcher url forcing the poll of a device, requested on
+// the repollTrapOIDs notifications. No poll is requested if empty.
+var TrapRepollURL string
+
+// repollTrapOIDs are the notifications requesting a poll of the device: coldStart,
+// warmStart, linkDown and linkUp.
+var repollTrapOIDs = map[string]bool{
+	genericTrapPrefix + "1": true,
+	genericTrapPrefix + "2": true,
+	genericTrapPrefix + "3": true,
+	genericTrapPrefix + "4": true,
+}
+
+// TrapResult is a snmp trap or inform received from a device.
+type TrapResult struct {
+	// Type is the message type, always TrapMessageType.
+	Type string `json:"type"`
+
+	// DeviceID is the id of the sending device.
+	DeviceID int `json:"device_id"`
+
+	// Hostname is the sending device hostname.
+	Hostname string `json:"device_hostname"`
+
+	// IPAddr is the sending device IP address.
+	IPAddr string `json:"device_ipaddr"`
+
+	// Version is the snmp version of the notification (1, 2c or 3).
+	Version string `json:"snmp_version"`
+
+	// Inform tells whether the notification is an acknowledged inform.
+	Inform bool `json:"inform,omitempty"`
+
+	// TrapOID is the notification oid. Snmpv1 traps are converted as in RFC 3584.
+	TrapOID string `json:"trap_oid"`
+
+	// Uptime is the device uptime in hundredths of second.
+	Uptime uint32 `json:"uptime"`
+
+	// Varbinds is the list of the notification variables, without the uptime and
+	// trap oid of snmpv2 notifications.
+	Varbinds []Result `json:"varbinds"`
+
+	// ReceivedAt is the reception time.
+	ReceivedAt time.Time `json:"received_at"`
+
+	// Tags is the tag map of the sending device.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// trapDevice is a device known by the trap receiver.
+type trapDevice struct {
+	model.TrapDevice
+
+	// usm is the device snmpv3 user with keys localized to its engine id.
+	usm *gosnmp.UsmSecurityParameters
+
+	// msgFlags is the device snmpv3 security level.
+	msgFlags gosnmp.SnmpV3MsgFlags
+
+	// mu guards usm
+	mu sync.Mutex
+}
+
+// TrapReceiver listens for the snmp traps and informs of the known devices
+// and publishes them. Snmpv1 and v2c notifications are accepted from the
+// address of a v1 or v2c device with one of its communities, checked by their
+// hash, and snmpv3 ones must have the device user
+// and security level. Informs are sent to the local engine, as well as the
+// engine discoveries preceding them, whereas snmpv3 traps are authenticated
+// with the device engine id. The snmpv3 time window is not checked.
+type TrapReceiver struct {
+	// EngineID is the local snmpv3 engine id, authoritative for the informs.
+	EngineID string
+
+	conn      *net.UDPConn
+	done      chan struct{}
+	startTime time.Time
+	logger    log.Logger
+
+	// devices maps the device IP addresses to the devices.
+	devices   map[string]*trapDevice
+	devicesMu sync.RWMutex
+
+	// unknownEngineIDs is the usmStatsUnknownEngineIDs counter.
+	unknownEngineIDs uint32
+
+	// publish is called with each received trap.
+	publish func(TrapResult)
+}
+
+var trapReceiver *TrapReceiver
+
+// NewTrapReceiver starts the trap receiver on the given udp address. The default
+// snmpv3 engine id is built from the hostname if engineID is empty. Received traps
+// are pushed to kafka and NATS.
+func NewTrapReceiver(addr, engineID string) error {
+	if engineID == "" {
+		engineID = defaultEngineID()
+	}
+	r, err := listenTraps(addr, engineID, pushTrap)
+	if err != nil {
+		return err
+	}
+	trapReceiver = r
+	if StopCtx != nil {
+		go func() {
+			<-StopCtx.Done()
+			r.Close()
+		}()
+	}
+	return nil
+}
+
+// listenTraps creates a trap receiver listening on addr and calling publish
+// with each received trap.
+func listenTraps(addr, engineID string, publish func(TrapResult)) (*TrapReceiver, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("trap receiver: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("trap receiver: %v", err)
+	}
+	r := &TrapReceiver{
+		EngineID:  engineID,
+		conn:      conn,
+		done:      make(chan struct{}),
+		startTime: time.Now(),
+		logger:    log.WithPrefix("trap"),
+		devices:   make(map[string]*trapDevice),
+		publish:   publish,
+	}
+	log.Infof("listening for snmp traps on %s", conn.LocalAddr())
+	go r.serve()
+	return r, nil
+}
+
+// defaultEngineID returns a text format snmpv3 engine id (RFC 3411) made of
+// the local hostname, under the net-snmp enterprise number.
+func defaultEngineID() string {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "horus-agent"
+	}
+	if len(host) > 27 {
+		host = host[:27]
+	}
+	return "\x80\x00\x1f\x88\x04" + host
+}
+
+// Close stops the trap receiver.
+func (r *TrapReceiver) Close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+		r.conn.Close()
+	}
+}
+
+// SetDevices replaces the devices known by the receiver. Notifications from
+// other addresses are dropped.
+func (r *TrapReceiver) SetDevices(devices []model.TrapDevice) {
+	devs := make(map[string]*trapDevice, len(devices))
+	for _, dev := range devices {
+		td := &trapDevice{TrapDevice: dev}
+		if u := dev.User; u != nil {
+			usm, flags, err := usmParams(model.SnmpParams{
+				SecLevel:   u.SecLevel,
+				AuthUser:   u.AuthUser,
+				AuthProto:  u.AuthProto,
+				AuthPasswd: u.AuthPasswd,
+				PrivProto:  u.PrivProto,
+				PrivPasswd: u.PrivPasswd,
+			})
+			if err != nil {
+				log.Warningf("trap receiver: device #%d: %v", dev.ID, err)
+				continue
+			}
+			usm.AuthoritativeEngineID = r.EngineID
+			usm.Logger = r.logger
+			td.usm, td.msgFlags = usm, flags
+		}
+		devs[dev.IPAddress] = td
+	}
+	r.devicesMu.Lock()
+	r.devices = devs
+	r.devicesMu.Unlock()
+	log.Debugf("trap receiver: got %d devices", len(devs))
+}
+
+// device returns the device with the given IP address.
+func (r *TrapReceiver) device(ip string) (*trapDevice, bool) {
+	r.devicesMu.RLock()
+	defer r.devicesMu.RUnlock()
+	dev, ok := r.devices[ip]
+	return dev, ok
+}
+
+// serve handles the incoming notifications until the receiver is closed.
+func (r *TrapReceiver) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-r.done:
+				log.Info("trap receiver stopped")
+				return
+			default:
+			}
+			log.Warningf("trap receiver: read: %v", err)
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		r.handle(msg, from)
+	}
+}
+
+// handle decodes a notification, answers it if it is an inform or a snmpv3
+// engine discovery and publishes it.
+func (r *TrapReceiver) handle(msg []byte, from *net.UDPAddr) {
+	dev, ok := r.device(from.IP.String())
+	if !ok {
+		log.Debugf("trap receiver: dropping notification from unknown host %s", from.IP)
+		return
+	}
+
+	// the first decoding without credentials gives the version and the community
+	// or the snmpv3 discovery request. It is done on a copy as the authentication
+	// parameters are zeroed in the decoded message.
+	probe := &gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+			Logger:                 r.logger,
+		},
+		Logger: r.logger,
+	}
+	pkt := unmarshalTrap(probe, append([]byte(nil), msg...))
+	switch {
+	case pkt != nil && pkt.Version != gosnmp.Version3:
+		if dev.Version == model.Version3 {
+			log.Warningf("trap receiver: dropping notification from %s (#%d): version %s notification from a snmpv3 device", from.IP, dev.ID, pkt.Version)
+			return
+		}
+		if !dev.communityMatch(pkt.Community) {
+			log.Warningf("trap receiver: dropping notification from %s (#%d): invalid community", from.IP, dev.ID)
+			return
+		}
+	case pkt != nil && pkt.PDUType == gosnmp.GetRequest && pkt.MsgFlags&gosnmp.AuthNoPriv == 0 && packetUSM(pkt).AuthoritativeEngineID != r.EngineID:
+		if pkt.MsgFlags&gosnmp.Reportable != 0 {
+			r.reportUnknownEngine(pkt, from)
+		}
+		return
+	default:
+		var err error
+		if pkt, err = r.unmarshalV3(msg, dev); err != nil {
+			log.Warningf("trap receiver: dropping notification from %s (#%d): %v", from.IP, dev.ID, err)
+			return
+		}
+	}
+
+	switch pkt.PDUType {
+	case gosnmp.Trap, gosnmp.SNMPv2Trap, gosnmp.InformRequest:
+	default:
+		log.Debugf("trap receiver: dropping pdu type %#x from %s (#%d)", byte(pkt.PDUType), from.IP, dev.ID)
+		return
+	}
+	res := dev.makeTrapResult(pkt)
+	if res.Inform {
+		r.acknowledge(pkt, from)
+	}
+	log.Debug2f("trap receiver: got %s from %s (#%d)", res.TrapOID, from.IP, dev.ID)
+	r.publish(res)
+}
+
+// unmarshalV3 decodes a snmpv3 notification with the device user. As gosnmp
+// follows the message flags, the security level must be the device one.
+func (r *TrapReceiver) unmarshalV3(msg []byte, dev *trapDevice) (*gosnmp.SnmpPacket, error) {
+	if dev.usm == nil {
+		return nil, errors.New("no snmpv3 user for the device")
+	}
+	dev.mu.Lock()
+	x := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: dev.usm,
+		Logger:             r.logger,
+	}
+	pkt := unmarshalTrap(x, msg)
+	dev.mu.Unlock()
+	if pkt == nil || pkt.Version != gosnmp.Version3 {
+		return nil, errors.New("invalid snmpv3 message or authentication failure")
+	}
+	usm := packetUSM(pkt)
+	switch {
+	case pkt.MsgFlags&gosnmp.AuthPriv != dev.msgFlags:
+		return nil, fmt.Errorf("security level %#x differs from the device one", byte(pkt.MsgFlags&gosnmp.AuthPriv))
+	case usm.UserName != dev.User.AuthUser:
+		return nil, fmt.Errorf("unknown user %q", usm.UserName)
+	case dev.msgFlags&gosnmp.AuthNoPriv != 0 && len(usm.AuthenticationParameters) != authParamsLen[usm.AuthenticationProtocol]:
+		return nil, errors.New("invalid authentication parameters")
+	case pkt.PDUType == gosnmp.InformRequest && usm.AuthoritativeEngineID != r.EngineID:
+		return nil, errors.New("inform sent to another engine id")
+	}
+
+	// keep the keys localized to the last engine id
+	dev.mu.Lock()
+	if dev.usm.AuthoritativeEngineID != usm.AuthoritativeEngineID {
+		dev.usm.AuthoritativeEngineID = usm.AuthoritativeEngineID
+		dev.usm.SecretKey, dev.usm.PrivacyKey = usm.SecretKey, usm.PrivacyKey
+	}
+	dev.mu.Unlock()
+	return pkt, nil
+}
+
+// unmarshalTrap decodes msg with the given connection params. The snmpv3 keys
+// are localized to the message engine id and the message is authenticated if
+// its flags say so. Returns nil if the message is invalid.
+func unmarshalTrap(x *gosnmp.GoSNMP, msg []byte) (pkt *gosnmp.SnmpPacket) {
+	defer func() {
+		// gosnmp panics on some encrypted payloads with missing keys
+		if e := recover(); e != nil {
+			log.Debugf("trap receiver: unmarshal: %v", e)
+			pkt = nil
+		}
+	}()
+	return x.UnmarshalTrap(msg, true)
+}
+
+// reportUnknownEngine answers a snmpv3 engine discovery with the local engine
+// id, boots and time.
+func (r *TrapReceiver) reportUnknownEngine(req *gosnmp.SnmpPacket, to *net.UDPAddr) {
+	count := atomic.AddUint32(&r.unknownEngineIDs, 1)
+	report := &gosnmp.SnmpPacket{
+		Version:       gosnmp.Version3,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    r.EngineID,
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  uint32(time.Since(r.startTime) / time.Second),
+			UserName:                 packetUSM(req).UserName,
+			Logger:                   r.logger,
+		},
+		MsgID:           req.MsgID,
+		MsgMaxSize:      req.MsgMaxSize,
+		RequestID:       req.RequestID,
+		ContextEngineID: r.EngineID,
+		ContextName:     req.ContextName,
+		PDUType:         gosnmp.Report,
+		Variables:       []gosnmp.SnmpPDU{{Name: usmStatsUnknownEngineIDs, Type: gosnmp.Counter32, Value: count}},
+		Logger:          r.logger,
+	}
+	log.Debug2f("trap receiver: engine discovery from %s", to.IP)
+	r.send(report, to)
+}
+
+// acknowledge sends the response to an inform.
+func (r *TrapReceiver) acknowledge(inform *gosnmp.SnmpPacket, to *net.UDPAddr) {
+	inform.PDUType = gosnmp.GetResponse
+	inform.MsgFlags &^= gosnmp.Reportable
+	inform.Error = gosnmp.NoError
+	inform.ErrorIndex = 0
+	r.send(inform, to)
+}
+
+// send writes a snmp message to the given address.
+func (r *TrapReceiver) send(pkt *gosnmp.SnmpPacket, to *net.UDPAddr) {
+	b, err := pkt.MarshalMsg()
+	if err != nil {
+		log.Warningf("trap receiver: marshal pdu type %#x to %s: %v", byte(pkt.PDUType), to.IP, err)
+		return
+	}
+	if _, err := r.conn.WriteToUDP(b, to); err != nil {
+		log.Warningf("trap receiver: send pdu type %#x to %s: %v", byte(pkt.PDUType), to.IP, err)
+	}
+}
+
+// communityMatch tells if the community hash is one of the device ones.
+func (dev *trapDevice) communityMatch(community string) bool {
+	hash := []byte(model.CommunityHash(dev.ID, community))
+	for _, h := range dev.CommunityHashes {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// makeTrapResult builds a TrapResult from a decoded notification of the device.
+func (dev *trapDevice) makeTrapResult(pkt *gosnmp.SnmpPacket) TrapResult {
+	res := TrapResult{
+		Type:       TrapMessageType,
+		DeviceID:   dev.ID,
+		Hostname:   dev.Tags["host"],
+		IPAddr:     dev.IPAddress,
+		Version:    pkt.Version.String(),
+		Inform:     pkt.PDUType == gosnmp.InformRequest,
+		ReceivedAt: time.Now(),
+		Tags:       dev.Tags,
+		Varbinds:   []Result{},
+	}
+	if pkt.PDUType == gosnmp.Trap {
+		res.TrapOID = v1TrapOID(pkt.Enterprise, pkt.GenericTrap, pkt.SpecificTrap)
+		res.Uptime = uint32(pkt.Timestamp)
+	}
+	for _, pdu := range pkt.Variables {
+		switch {
+		case pdu.Name == sysUpTimeOID && pkt.PDUType != gosnmp.Trap:
+			res.Uptime = uint32(gosnmp.ToBigInt(pdu.Value).Uint64())
+		case pdu.Name == snmpTrapOID && pkt.PDUType != gosnmp.Trap:
+			res.TrapOID, _ = pdu.Value.(string)
+		default:
+			varbind, err := MakeResult(pdu, model.Metric{Name: pdu.Name, Oid: model.OID(pdu.Name)})
+			if err != nil {
+				log.Debugf("trap receiver: device #%d: %v", dev.ID, err)
+				continue
+			}
+			res.Varbinds = append(res.Varbinds, varbind)
+		}
+	}
+	return res
+}
+
+// v1TrapOID converts a snmpv1 trap identification to a snmpv2 notification oid
+// as in RFC 3584.
+func v1TrapOID(enterprise string, generic, specific int) string {
+	if generic >= 0 && generic < 6 {
+		return fmt.Sprintf("%s%d", genericTrapPrefix, generic+1)
+	}
+	if !strings.HasPrefix(enterprise, ".") {
+		enterprise = "." + enterprise
+	}
+	return fmt.Sprintf("%s.0.%d", enterprise, specific)
+}
+
+// packetUSM returns the user security parameters of a snmpv3 packet, empty
+// ones if not set.
+func packetUSM(pkt *gosnmp.SnmpPacket) *gosnmp.UsmSecurityParameters {
+	if usm, ok := pkt.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+		return usm
+	}
+	return &gosnmp.UsmSecurityParameters{}
+}
+
+// pushTrap publishes a trap to kafka and NATS and requests the poll of the
+// device if needed.
+func pushTrap(res TrapResult) {
+	kafkaCli.PushTrap(res)
+	natsCli.PushTrap(res)
+	if TrapRepollURL != "" && repollTrapOIDs[res.TrapOID] {
+		go requestRepoll(res.DeviceID, res.TrapOID)
+	}
+}
+
+// requestRepoll asks the dispatcher to poll the device right away. The request
+// is ignored by the dispatcher if the device is already being polled.
+func requestRepoll(devID int, trapOID string) {
+	req, err := http.NewRequest("POST", TrapRepollURL, nil)
+	if err != nil {
+		log.Errorf("trap repoll: %v", err)
+		return
+	}
+	req.URL.RawQuery = url.Values{"id": {strconv.Itoa(devID)}}.Encode()
+	resp, err := auth.NewClient(3 * time.Second).Do(req)
+	if err != nil {
+		log.Warningf("trap repoll: device #%d: %v", devID, err)
+		return
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		log.Debugf("trap repoll: device #%d poll requested on %s", devID, trapOID)
+	case http.StatusConflict:
+		log.Debug2f("trap repoll: device #%d is already being polled", devID)
+	default:
+		log.Warningf("trap repoll: device #%d: dispatcher replied %s", devID, resp.Status)
+	}
+}
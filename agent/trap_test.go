@@ -0,0 +1,254 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestTrapReceiver(t *testing.T) {
+	traps := make(chan TrapResult, 1)
+	r, err := listenTraps("127.0.0.1:0", "\x80\x00\x1f\x88\x04test", func(res TrapResult) { traps <- res })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	port := uint16(r.conn.LocalAddr().(*net.UDPAddr).Port)
+
+	tags := map[string]string{"id": "42", "host": "router"}
+	v2Dev := model.TrapDevice{
+		ID:              42,
+		IPAddress:       "127.0.0.1",
+		Version:         model.Version2c,
+		Tags:            tags,
+		CommunityHashes: []string{model.CommunityHash(42, "public"), model.CommunityHash(42, "private")},
+	}
+	v3Dev := model.TrapDevice{
+		ID:        42,
+		IPAddress: "127.0.0.1",
+		Version:   model.Version3,
+		Tags:      tags,
+		User: &model.TrapUser{
+			SecLevel:   "AuthPriv",
+			AuthUser:   "horus",
+			AuthProto:  "SHA",
+			AuthPasswd: "horus-auth-passwd",
+			PrivProto:  "AES",
+			PrivPasswd: "horus-priv-passwd",
+		},
+	}
+	v3NoUser := v3Dev
+	v3NoUser.User = nil
+	usm := func(engineID, authPasswd string) *gosnmp.UsmSecurityParameters {
+		return &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    engineID,
+			AuthoritativeEngineBoots: 1,
+			UserName:                 "horus",
+			AuthenticationProtocol:   gosnmp.SHA,
+			AuthenticationPassphrase: authPasswd,
+			PrivacyProtocol:          gosnmp.AES,
+			PrivacyPassphrase:        "horus-priv-passwd",
+		}
+	}
+	linkDown := []gosnmp.SnmpPDU{
+		{Name: sysUpTimeOID, Type: gosnmp.TimeTicks, Value: uint32(4200)},
+		{Name: snmpTrapOID, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+		{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: gosnmp.Integer, Value: 3},
+		{Name: ".1.3.6.1.2.1.2.2.1.2.3", Type: gosnmp.OctetString, Value: []byte("eth2")},
+	}
+
+	tests := []struct {
+		name    string
+		device  model.TrapDevice
+		sender  *gosnmp.GoSNMP
+		trap    gosnmp.SnmpTrap
+		trapOID string
+		uptime  uint32
+	}{
+		{
+			"v2c trap",
+			v2Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			".1.3.6.1.6.3.1.1.5.3", 4200,
+		},
+		{
+			"v2c inform",
+			v2Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "private"},
+			gosnmp.SnmpTrap{Variables: linkDown, IsInform: true},
+			".1.3.6.1.6.3.1.1.5.3", 4200,
+		},
+		{
+			"v2c trap with invalid community",
+			v2Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "secret"},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			"", 0,
+		},
+		{
+			"v1 generic trap",
+			v2Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version1, Community: "public"},
+			gosnmp.SnmpTrap{Variables: linkDown[2:], Enterprise: ".1.3.6.1.4.1.8072", AgentAddress: "127.0.0.1", GenericTrap: 2, Timestamp: 300},
+			".1.3.6.1.6.3.1.1.5.3", 300,
+		},
+		{
+			"v1 specific trap",
+			v2Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version1, Community: "public"},
+			gosnmp.SnmpTrap{Variables: linkDown[2:], Enterprise: ".1.3.6.1.4.1.8072", AgentAddress: "127.0.0.1", GenericTrap: 6, SpecificTrap: 12, Timestamp: 300},
+			".1.3.6.1.4.1.8072.0.12", 300,
+		},
+		{
+			"v3 inform with engine discovery",
+			v3Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version3, MsgFlags: gosnmp.AuthPriv, SecurityModel: gosnmp.UserSecurityModel, SecurityParameters: usm("", "horus-auth-passwd")},
+			gosnmp.SnmpTrap{Variables: linkDown, IsInform: true},
+			".1.3.6.1.6.3.1.1.5.3", 4200,
+		},
+		{
+			"v3 trap from the device engine",
+			v3Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version3, MsgFlags: gosnmp.AuthPriv, SecurityModel: gosnmp.UserSecurityModel, SecurityParameters: usm("\x80\x00\x1f\x88\x04device", "horus-auth-passwd")},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			".1.3.6.1.6.3.1.1.5.3", 4200,
+		},
+		{
+			"v3 trap with invalid password",
+			v3Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version3, MsgFlags: gosnmp.AuthPriv, SecurityModel: gosnmp.UserSecurityModel, SecurityParameters: usm("\x80\x00\x1f\x88\x04device", "invalid-passwd")},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			"", 0,
+		},
+		{
+			"v3 trap with lower security level",
+			v3Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version3, MsgFlags: gosnmp.NoAuthNoPriv, SecurityModel: gosnmp.UserSecurityModel,
+				SecurityParameters: &gosnmp.UsmSecurityParameters{AuthoritativeEngineID: "\x80\x00\x1f\x88\x04device", UserName: "horus"}},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			"", 0,
+		},
+		{
+			"v3 trap from a device without user",
+			v3NoUser,
+			&gosnmp.GoSNMP{Version: gosnmp.Version3, MsgFlags: gosnmp.AuthPriv, SecurityModel: gosnmp.UserSecurityModel, SecurityParameters: usm("\x80\x00\x1f\x88\x04device", "horus-auth-passwd")},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			"", 0,
+		},
+		{
+			"v2c trap to v3 device",
+			v3Dev,
+			&gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"},
+			gosnmp.SnmpTrap{Variables: linkDown},
+			"", 0,
+		},
+	}
+	for _, tt := range tests {
+		r.SetDevices([]model.TrapDevice{tt.device})
+		sender := tt.sender
+		sender.Target = "127.0.0.1"
+		sender.Port = port
+		sender.Timeout = time.Second
+		if err := sender.Connect(); err != nil {
+			t.Fatalf("%s: connect: %v", tt.name, err)
+		}
+		_, err := sender.SendTrap(tt.trap)
+		sender.Conn.Close()
+		if tt.trapOID == "" {
+			select {
+			case res := <-traps:
+				t.Errorf("%s: expected trap to be dropped, got %+v", tt.name, res)
+			case <-time.After(200 * time.Millisecond):
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: send: %v", tt.name, err)
+			continue
+		}
+		var res TrapResult
+		select {
+		case res = <-traps:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: no trap received", tt.name)
+			continue
+		}
+		if res.Type != TrapMessageType || res.DeviceID != 42 || res.Tags["host"] != "router" {
+			t.Errorf("%s: invalid device: %+v", tt.name, res)
+		}
+		if res.TrapOID != tt.trapOID || res.Uptime != tt.uptime || res.Inform != tt.trap.IsInform {
+			t.Errorf("%s: expected trap %s at %d (inform: %v), got %s at %d (inform: %v)",
+				tt.name, tt.trapOID, tt.uptime, tt.trap.IsInform, res.TrapOID, res.Uptime, res.Inform)
+		}
+		if len(res.Varbinds) != 2 || res.Varbinds[0].Value != float64(3) || res.Varbinds[1].Value != "eth2" {
+			t.Errorf("%s: invalid varbinds: %+v", tt.name, res.Varbinds)
+		}
+	}
+
+	r.SetDevices([]model.TrapDevice{{ID: 43, IPAddress: "10.0.0.1", Version: model.Version2c, Tags: map[string]string{"host": "other"}}})
+	sender := &gosnmp.GoSNMP{Target: "127.0.0.1", Port: port, Version: gosnmp.Version2c, Community: "public", Timeout: time.Second}
+	if err := sender.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Conn.Close()
+	sender.SendTrap(gosnmp.SnmpTrap{Variables: linkDown})
+	select {
+	case res := <-traps:
+		t.Errorf("unknown host: expected trap to be dropped, got %+v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestV1TrapOID(t *testing.T) {
+	tests := []struct {
+		enterprise        string
+		generic, specific int
+		expected          string
+	}{
+		{".1.3.6.1.4.1.8072", 0, 0, ".1.3.6.1.6.3.1.1.5.1"},
+		{".1.3.6.1.4.1.8072", 3, 0, ".1.3.6.1.6.3.1.1.5.4"},
+		{".1.3.6.1.4.1.8072", 6, 5, ".1.3.6.1.4.1.8072.0.5"},
+		{"1.3.6.1.4.1.9", 6, 1, ".1.3.6.1.4.1.9.0.1"},
+	}
+	for _, tt := range tests {
+		if oid := v1TrapOID(tt.enterprise, tt.generic, tt.specific); oid != tt.expected {
+			t.Errorf("v1TrapOID(%s, %d, %d): expected %s, got %s", tt.enterprise, tt.generic, tt.specific, tt.expected, oid)
+		}
+	}
+}
+
+func TestRequestRepoll(t *testing.T) {
+	var method, uri string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, uri = r.Method, r.URL.RequestURI()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	defer func(u string) { TrapRepollURL = u }(TrapRepollURL)
+
+	TrapRepollURL = srv.URL + "/d/repoll"
+	requestRepoll(42, genericTrapPrefix+"3")
+	if method != "POST" || uri != "/d/repoll?id=42" {
+		t.Errorf("requestRepoll: expected POST /d/repoll?id=42, got %s %s", method, uri)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auth secures the http requests between the dispatcher and the agents
+// with HMAC signatures from a shared secret and with (mutual) TLS.
+//
+// A signed request has a `X-Horus-Timestamp` header with the unix time of the
+// signature and a `X-Horus-Signature` header with the hex encoded HMAC-SHA256
+// of the method, the request uri (path and query), the timestamp and the body,
+// separated by newlines.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kosctelecom/horus/log"
+)
+
+const (
+	// TimestampHeader is the header of the signature unix timestamp.
+	TimestampHeader = "X-Horus-Timestamp"
+
+	// SignatureHeader is the header of the request signature.
+	SignatureHeader = "X-Horus-Signature"
+)
+
+var (
+	// Secret is the shared secret of the request signatures. Requests are
+	// neither signed nor verified if empty.
+	Secret []byte
+
+	// MaxClockSkew is the max difference allowed between the signature
+	// timestamp and the local time.
+	MaxClockSkew = 5 * time.Minute
+
+	// ServerTLS is the tls config of the web servers, nil if TLS is disabled.
+	ServerTLS *tls.Config
+
+	// ClientTLS is the tls config of the http clients, nil if TLS is disabled.
+	ClientTLS *tls.Config
+
+	// clientTransport is the signing transport shared by all the http clients,
+	// so that their keep-alive connections are reused.
+	clientTransport = newTransport(nil)
+)
+
+// LoadSecret reads the shared secret from the given file. Leading and trailing
+// white spaces are ignored.
+func LoadSecret(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read secret: %v", err)
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) == 0 {
+		return fmt.Errorf("secret file %s is empty", filename)
+	}
+	Secret = secret
+	return nil
+}
+
+// LoadTLS enables TLS with the given certificate and key files, used both by the
+// web server and as client certificate. When caFile is not empty, its certificates
+// are the only ones trusted to verify the peers and the web server requires a
+// valid client certificate (mutual TLS). The system roots are used otherwise.
+func LoadTLS(certFile, keyFile, caFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %v", err)
+	}
+	server := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	client := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificate found in %s", caFile)
+		}
+		server.ClientCAs = pool
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		client.RootCAs = pool
+	}
+	ServerTLS, ClientTLS = server, client
+	clientTransport = newTransport(client)
+	return nil
+}
+
+// Scheme returns the url scheme of the peers: https if TLS is enabled,
+// http otherwise.
+func Scheme() string {
+	if ClientTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// ListenAndServe starts a web server on addr, with TLS if enabled.
+func ListenAndServe(addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: ServerTLS}
+	if ServerTLS != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// NewClient returns an http client with the given timeout which signs its
+// requests and uses the TLS client config. All the clients share the same
+// transport and its connection pool.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: clientTransport}
+}
+
+// newTransport returns a signing transport with the given tls config. As the
+// dispatcher sends many concurrent requests to few agents, more idle connections
+// are kept per host than with the default transport.
+func newTransport(tlsConfig *tls.Config) transport {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = tlsConfig
+	base.MaxIdleConnsPerHost = base.MaxIdleConns
+	return transport{base}
+}
+
+// Handler returns a handler verifying the request signature before calling h.
+// Rejects the request with a 401 status if the signature is invalid.
+func Handler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(Secret) > 0 {
+			if err := Verify(r); err != nil {
+				log.Warningf("rejecting %s request from %s: %v", r.URL.Path, r.RemoteAddr, err)
+				http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// Sign sets the signature headers of the request with the given body at time t.
+func Sign(req *http.Request, body []byte, t time.Time) {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, signature(req.Method, req.URL.RequestURI(), ts, body))
+}
+
+// Verify checks the signature of the request. The body is read and restored.
+func Verify(r *http.Request) error {
+	ts, sig := r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader)
+	if ts == "" || sig == "" {
+		return errors.New("missing signature")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", ts)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return fmt.Errorf("signature timestamp too far from local time (%v)", skew.Round(time.Second))
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read body: %v", err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	expected := signature(r.Method, r.URL.RequestURI(), ts, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// signature returns the hex encoded HMAC-SHA256 of the request elements.
+func signature(method, uri, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, uri, ts)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// transport is an http RoundTripper signing the requests.
+type transport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http RoundTripper interface.
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(Secret) == 0 {
+		return t.base.RoundTrip(req)
+	}
+	signed := req.Clone(req.Context())
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read body: %v", err)
+		}
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	Sign(signed, body, time.Now())
+	return t.base.RoundTrip(signed)
+}
@@ -0,0 +1,198 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	defer func(s []byte) { Secret = s }(Secret)
+	Secret = []byte("s3cret")
+
+	now := time.Now()
+	tests := []struct {
+		method, target, body string
+		signedTarget         string
+		signedBody           string
+		secret               string
+		at                   time.Time
+		valid                bool
+	}{
+		{"POST", "/r/poll", `{"uid":"a"}`, "/r/poll", `{"uid":"a"}`, "s3cret", now, true},
+		{"GET", "/r/report?request_id=a&agent_id=1", "", "/r/report?request_id=a&agent_id=1", "", "s3cret", now.Add(-time.Minute), true},
+		{"POST", "/r/poll", `{"uid":"b"}`, "/r/poll", `{"uid":"a"}`, "s3cret", now, false},
+		{"GET", "/r/report?request_id=a&agent_id=2", "", "/r/report?request_id=a&agent_id=1", "", "s3cret", now, false},
+		{"POST", "/r/poll", `{"uid":"a"}`, "/r/poll", `{"uid":"a"}`, "other", now, false},
+		{"POST", "/r/poll", `{"uid":"a"}`, "/r/poll", `{"uid":"a"}`, "s3cret", now.Add(-time.Hour), false},
+		{"POST", "/r/poll", `{"uid":"a"}`, "/r/poll", `{"uid":"a"}`, "s3cret", now.Add(time.Hour), false},
+	}
+	for i, tt := range tests {
+		signed := httptest.NewRequest(tt.method, tt.signedTarget, nil)
+		Secret = []byte(tt.secret)
+		Sign(signed, []byte(tt.signedBody), tt.at)
+		Secret = []byte("s3cret")
+
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header = signed.Header
+		err := Verify(req)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("Verify#%d: expected validity %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+		if b, _ := ioutil.ReadAll(req.Body); string(b) != tt.body {
+			t.Errorf("Verify#%d: body not restored, got `%s`", i, b)
+		}
+	}
+	if err := Verify(httptest.NewRequest("GET", "/r/check", nil)); err == nil {
+		t.Errorf("Verify: expected error on unsigned request")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	defer func(s []byte) { Secret = s }(Secret)
+	Secret = []byte("s3cret")
+
+	srv := httptest.NewServer(Handler(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	resp, err := NewClient(time.Second).Post(srv.URL+"/r/poll?x=1", "application/json", strings.NewReader(`{"uid":"a"}`))
+	if err != nil {
+		t.Fatalf("signed post: %v", err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != `{"uid":"a"}` {
+		t.Errorf("signed post: expected 200 with body, got %d `%s`", resp.StatusCode, b)
+	}
+
+	resp, err = http.Post(srv.URL+"/r/poll", "application/json", strings.NewReader(`{"uid":"a"}`))
+	if err != nil {
+		t.Fatalf("unsigned post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned post: expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestClientTransport(t *testing.T) {
+	if NewClient(time.Second).Transport != NewClient(0).Transport {
+		t.Errorf("clients do not share the same transport")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	defer func() { ServerTLS, ClientTLS, clientTransport = nil, nil, newTransport(nil) }()
+
+	dir, err := ioutil.TempDir("", "horus-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := writeCerts(t, dir)
+
+	if err := LoadTLS(certFile, keyFile, caFile); err != nil {
+		t.Fatalf("load tls: %v", err)
+	}
+	if Scheme() != "https" {
+		t.Errorf("expected https scheme, got %s", Scheme())
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = ServerTLS
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := NewClient(time.Second).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("get with client cert: %v", err)
+	}
+	resp.Body.Close()
+
+	// the server certificate is valid but no client certificate is given
+	noCert := srv.Client()
+	noCert.Transport.(*http.Transport).TLSClientConfig.RootCAs = ClientTLS.RootCAs
+	if resp, err := noCert.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("get without client cert: expected error")
+	}
+}
+
+// writeCerts writes a CA and a certificate signed by it for 127.0.0.1 in dir.
+// Returns the certificate, key and CA file names.
+func writeCerts(t *testing.T, dir string) (string, string, string) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "horus test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "horus"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	files := []struct {
+		name, typ string
+		der       []byte
+	}{
+		{"cert.pem", "CERTIFICATE", certDER},
+		{"key.pem", "EC PRIVATE KEY", keyDER},
+		{"ca.pem", "CERTIFICATE", caDER},
+	}
+	for _, f := range files {
+		data := pem.EncodeToMemory(&pem.Block{Type: f.typ, Bytes: f.der})
+		if err := ioutil.WriteFile(filepath.Join(dir, f.name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+}
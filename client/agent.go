@@ -0,0 +1,97 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kosctelecom/horus/agent"
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/model"
+)
+
+// Agent is a client of the agent api.
+type Agent struct {
+	// URL is the agent base url, like `http://10.0.0.1:8000`.
+	URL string
+
+	// HTTPClient is the client used for the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// NewAgent returns a client of the agent at the given base url. Its requests
+// are signed and use TLS as configured in the auth package.
+func NewAgent(url string) *Agent {
+	return &Agent{URL: url, HTTPClient: auth.NewClient(0)}
+}
+
+// Poll posts a snmp polling job to the agent. Returns the agent current load,
+// also on rejection when the returned error is an *Error with the reply status.
+func (a *Agent) Poll(ctx context.Context, req model.SnmpRequest) (float64, error) {
+	status, b, err := send(ctx, a.HTTPClient, "POST", a.URL, model.SnmpJobURI, nil, req)
+	if err != nil {
+		return 0, err
+	}
+	load, _ := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if status != http.StatusAccepted {
+		return load, &Error{StatusCode: status, Message: http.StatusText(status)}
+	}
+	return load, nil
+}
+
+// Query posts an on-demand snmp polling job to the agent and returns the poll
+// result at the end of the poll.
+func (a *Agent) Query(ctx context.Context, req model.SnmpRequest) (agent.PollResult, error) {
+	var res agent.PollResult
+	err := call(ctx, a.HTTPClient, "POST", a.URL, model.SnmpQueryURI, nil, req, &res, http.StatusOK)
+	return res, err
+}
+
+// Ping posts a ping job to the agent.
+func (a *Agent) Ping(ctx context.Context, req model.PingRequest) error {
+	return call(ctx, a.HTTPClient, "POST", a.URL, model.PingJobURI, nil, req, nil, http.StatusAccepted)
+}
+
+// Check runs a keep-alive check on the agent and returns its current load.
+func (a *Agent) Check(ctx context.Context) (float64, error) {
+	status, b, err := send(ctx, a.HTTPClient, "GET", a.URL, model.CheckURI, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if status != http.StatusOK {
+		return 0, replyError(status, b)
+	}
+	load, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse load: %v", err)
+	}
+	return load, nil
+}
+
+// Ongoing returns the ongoing polling requests of the agent and its load.
+func (a *Agent) Ongoing(ctx context.Context) (model.OngoingPolls, error) {
+	var ongoing model.OngoingPolls
+	err := call(ctx, a.HTTPClient, "GET", a.URL, model.OngoingURI, nil, nil, &ongoing, http.StatusOK)
+	return ongoing, err
+}
+
+// SetTrapDevices replaces the devices of the agent trap receiver.
+func (a *Agent) SetTrapDevices(ctx context.Context, devices []model.TrapDevice) error {
+	return call(ctx, a.HTTPClient, "POST", a.URL, model.TrapDevicesURI, nil, devices, nil, http.StatusOK)
+}
@@ -0,0 +1,123 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client implements typed clients of the dispatcher and agent http api
+// described in doc/openapi.yaml.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error is an api reply with an unexpected status code.
+type Error struct {
+	// StatusCode is the http status code of the reply.
+	StatusCode int
+
+	// Message is the `error` field of the json reply body, the raw
+	// body or the status text otherwise.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound tells whether err is an api reply with a 404 status.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// send sends a request with the given method to the baseURL+uri url with the
+// query params and the json encoded body in, if not nil. Returns the reply
+// status code and body.
+func send(ctx context.Context, hc *http.Client, method, baseURL, uri string, params url.Values, in interface{}) (int, []byte, error) {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, fmt.Errorf("marshal: %v", err)
+		}
+		body = bytes.NewReader(buf)
+	}
+	u := strings.TrimRight(baseURL, "/") + uri
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("new http request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("read reply: %v", err)
+	}
+	return resp.StatusCode, b, nil
+}
+
+// call sends the request like send and decodes the json reply body to out,
+// if not nil. Returns an *Error if the reply status is not the expected one.
+func call(ctx context.Context, hc *http.Client, method, baseURL, uri string, params url.Values, in, out interface{}, expected int) error {
+	status, b, err := send(ctx, hc, method, baseURL, uri, params, in)
+	if err != nil {
+		return err
+	}
+	if status != expected {
+		return replyError(status, b)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("unmarshal reply: %v", err)
+	}
+	return nil
+}
+
+// replyError builds an *Error from the reply status and body.
+func replyError(status int, body []byte) *Error {
+	var reply struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &reply) == nil && reply.Error != "" {
+		msg = reply.Error
+	}
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &Error{StatusCode: status, Message: msg}
+}
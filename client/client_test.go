@@ -0,0 +1,163 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kosctelecom/horus/agent"
+	"github.com/kosctelecom/horus/dispatcher"
+	"github.com/kosctelecom/horus/model"
+)
+
+// TestDispatcherRequests checks the requests sent by the dispatcher client
+// against a fake server.
+func TestDispatcherRequests(t *testing.T) {
+	var method, uri, body string
+	var reply string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		method, uri, body = r.Method, r.URL.RequestURI(), string(b)
+		if r.URL.Path == dispatcher.DeviceRepollURI || r.FormValue("async") != "" {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	d := NewDispatcher(srv.URL + "/")
+	dev := model.Device{ID: 1, Hostname: "sw1", SnmpParams: model.SnmpParams{IPAddress: "10.0.0.1", Community: "public"}}
+	dev.Category, dev.Vendor, dev.Model = "switch", "cisco", "c2960"
+	devJSON, _ := json.Marshal(dev)
+	metric := model.MetricDef{Name: "ifDescr", Oid: ".1.3.6.1.2.1.2.2.1.2", Active: true}
+	metricJSON, _ := json.Marshal(metric)
+
+	tests := []struct {
+		call   func() error
+		reply  string
+		method string
+		uri    string
+		body   string
+	}{
+		{func() error { _, err := d.Devices(ctx); return err }, "[" + string(devJSON) + "]", "GET", "/d/list", ""},
+		{func() error { _, err := d.Device(ctx, 1); return err }, string(devJSON), "GET", "/d/list?id=1", ""},
+		{func() error { return d.CreateDevice(ctx, dev) }, "", "POST", "/d/create", string(devJSON)},
+		{func() error { return d.UpsertDevice(ctx, dev) }, "", "POST", "/d/upsert", string(devJSON)},
+		{func() error { return d.DeleteDevice(ctx, 1) }, "", "POST", "/d/delete?id=1", ""},
+		{func() error { _, err := d.RepollDevice(ctx, 1, 7); return err }, `{"request_id": "abc@1", "device_id": 1, "agent_id": 2}`, "POST", "/d/repoll?id=1&measure=7", ""},
+		{func() error { _, err := d.PollDevice(ctx, 1, 0); return err }, `{"request_id": "abc@1", "agent_id": 2, "poll_duration": 1500}`, "POST", "/d/poll?id=1", ""},
+		{func() error { _, err := d.PollDeviceAsync(ctx, 1, 7); return err }, `{"request_id": "abc@1", "device_id": 1}`, "POST", "/d/poll?async=true&id=1&measure=7", ""},
+		{func() error {
+			if _, done, err := d.PollResult(ctx, "abc@1"); err != nil || !done {
+				return fmt.Errorf("expected done poll, got %v (err: %v)", done, err)
+			}
+			return nil
+		}, `{"request_id": "abc@1", "agent_id": 2}`, "GET", "/d/poll-result?id=abc%401", ""},
+		{func() error { _, err := d.Agent(ctx, 2); return err }, `{"ip_address": "10.0.0.2", "port": 8000}`, "GET", "/a/list?id=2", ""},
+		{func() error { return d.LinkProfileMeasure(ctx, 3, 4) }, "", "POST", "/p/link?measure_id=4&profile_id=3", ""},
+		{func() error { return d.UnlinkMeasureMetric(ctx, 4, 5) }, "", "POST", "/ms/unlink?measure_id=4&metric_id=5", ""},
+		{func() error { _, err := d.CreateMetric(ctx, metric); return err }, string(metricJSON), "POST", "/mt/create", string(metricJSON)},
+		{func() error { _, err := d.Credential(ctx, 6); return err }, `{"name": "core", "snmp_community": "********"}`, "GET", "/c/list?id=6", ""},
+		{func() error {
+			return d.Report(ctx, Report{RequestID: "abc", AgentID: 1, PollDuration: 1500 * time.Millisecond, MetricCount: 12, CurrentLoad: 0.25})
+		}, "", "GET", "/r/report?agent_id=1&current_load=0.2500&metric_count=12&poll_duration_ms=1500&poll_error=&request_id=abc", ""},
+	}
+	for i, tt := range tests {
+		reply = tt.reply
+		if err := tt.call(); err != nil {
+			t.Errorf("Dispatcher#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if method != tt.method || uri != tt.uri || body != tt.body {
+			t.Errorf("Dispatcher#%d: expected %s %s `%s`, got %s %s `%s`", i, tt.method, tt.uri, tt.body, method, uri, body)
+		}
+	}
+}
+
+// TestDispatcherErrors checks the errors returned by the dispatcher handlers.
+func TestDispatcherErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	for uri, handler := range dispatcher.Routes {
+		mux.HandleFunc(uri, handler)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	d := NewDispatcher(srv.URL)
+	tests := []struct {
+		call   func() error
+		status int
+	}{
+		{func() error { _, err := d.CreateAgent(ctx, model.AgentDef{Port: 8000}); return err }, http.StatusBadRequest},
+		{func() error { return d.CreateDevice(ctx, model.Device{}) }, http.StatusBadRequest},
+		{func() error { _, err := d.CreateMeasure(ctx, model.MeasureDef{}); return err }, http.StatusBadRequest},
+		{func() error { _, err := d.UpdateProfile(ctx, model.ProfileDef{Category: "switch"}); return err }, http.StatusBadRequest},
+		{func() error { _, err := d.CreateCredential(ctx, model.CredentialDef{Name: "core"}); return err }, http.StatusBadRequest},
+		{func() error { _, _, err := d.PollResult(ctx, "abc@1"); return err }, http.StatusNotFound},
+	}
+	for i, tt := range tests {
+		err := tt.call()
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("DispatcherError#%d: expected *Error, got %v", i, err)
+			continue
+		}
+		if e.StatusCode != tt.status || e.Message == "" {
+			t.Errorf("DispatcherError#%d: expected status %d with message, got %v", i, tt.status, e)
+		}
+	}
+}
+
+// TestAgent checks the agent client against the agent handlers.
+func TestAgent(t *testing.T) {
+	mux := http.NewServeMux()
+	for uri, handler := range agent.Routes {
+		mux.HandleFunc(uri, handler)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	a := NewAgent(srv.URL)
+	if load, err := a.Check(ctx); err != nil || load != 0 {
+		t.Errorf("check: expected load 0, got %v (err: %v)", load, err)
+	}
+	if ongoing, err := a.Ongoing(ctx); err != nil || len(ongoing.Requests) != 0 {
+		t.Errorf("ongoing: expected no request, got %+v (err: %v)", ongoing, err)
+	}
+	// snmp polling not enabled
+	if _, err := a.Poll(ctx, model.SnmpRequest{UID: "abc"}); err == nil || err.(*Error).StatusCode != http.StatusTooManyRequests {
+		t.Errorf("poll: expected status 429, got %v", err)
+	}
+	if _, err := a.Query(ctx, model.SnmpRequest{UID: "abc"}); err == nil || err.(*Error).StatusCode != http.StatusTooManyRequests {
+		t.Errorf("query: expected status 429, got %v", err)
+	}
+	if err := a.Ping(ctx, model.PingRequest{UID: "abc"}); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Errorf("ping: expected status 400, got %v", err)
+	}
+	// trap receiver not enabled
+	if err := a.SetTrapDevices(ctx, nil); err == nil || err.(*Error).StatusCode != http.StatusNotImplemented {
+		t.Errorf("trap devices: expected status 501, got %v", err)
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/kosctelecom/horus/agent"
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/dispatcher"
+	"github.com/kosctelecom/horus/model"
+)
+
+// Dispatcher is a client of the dispatcher api.
+type Dispatcher struct {
+	// URL is the dispatcher base url, like `http://localhost:8080`.
+	URL string
+
+	// HTTPClient is the client used for the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Report is a polling job report sent by an agent to the dispatcher.
+type Report struct {
+	// RequestID is the polling request uid.
+	RequestID string
+
+	// AgentID is the db id of the agent.
+	AgentID int
+
+	// PollDuration is the polling duration.
+	PollDuration time.Duration
+
+	// PollError is the polling error, empty on success.
+	PollError string
+
+	// MetricCount is the number of polled metrics.
+	MetricCount int
+
+	// CurrentLoad is the agent current load.
+	CurrentLoad float64
+
+	// MaxRepetitions is the bulk max-repetitions learned for the device, ignored if 0.
+	MaxRepetitions int
+}
+
+// NewDispatcher returns a client of the dispatcher at the given base url. Its
+// requests are signed and use TLS as configured in the auth package.
+func NewDispatcher(url string) *Dispatcher {
+	return &Dispatcher{URL: url, HTTPClient: auth.NewClient(0)}
+}
+
+// Devices returns all devices ordered by id.
+func (d *Dispatcher) Devices(ctx context.Context) ([]model.Device, error) {
+	var devs []model.Device
+	err := d.list(ctx, dispatcher.DeviceListURI, &devs)
+	return devs, err
+}
+
+// Device returns the device with the given id.
+func (d *Dispatcher) Device(ctx context.Context, id int) (model.Device, error) {
+	var dev model.Device
+	err := d.get(ctx, dispatcher.DeviceListURI, id, &dev)
+	return dev, err
+}
+
+// CreateDevice creates a new device. Its profile must exist.
+func (d *Dispatcher) CreateDevice(ctx context.Context, dev model.Device) error {
+	return d.post(ctx, dispatcher.DeviceCreateURI, dev, nil)
+}
+
+// UpdateDevice updates an existing device.
+func (d *Dispatcher) UpdateDevice(ctx context.Context, dev model.Device) error {
+	return d.post(ctx, dispatcher.DeviceUpdateURI, dev, nil)
+}
+
+// UpsertDevice creates the device or updates it if it exists.
+func (d *Dispatcher) UpsertDevice(ctx context.Context, dev model.Device) error {
+	return d.post(ctx, dispatcher.DeviceUpsertURI, dev, nil)
+}
+
+// DeleteDevice deletes the device with the given id.
+func (d *Dispatcher) DeleteDevice(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.DeviceDeleteURI, id)
+}
+
+// RepollDevice forces the poll of the device with the given id, or only of the
+// given measure if measureID is not 0. Returns the job sent to the agent.
+func (d *Dispatcher) RepollDevice(ctx context.Context, id, measureID int) (model.PollJob, error) {
+	var job model.PollJob
+	err := call(ctx, d.HTTPClient, "POST", d.URL, dispatcher.DeviceRepollURI, pollParams(id, measureID), nil, &job, http.StatusAccepted)
+	return job, err
+}
+
+// PollDevice polls the device with the given id right away, or only the given
+// measure if measureID is not 0, and returns the agent poll result.
+func (d *Dispatcher) PollDevice(ctx context.Context, id, measureID int) (agent.PollResult, error) {
+	var res agent.PollResult
+	err := call(ctx, d.HTTPClient, "POST", d.URL, dispatcher.DevicePollURI, pollParams(id, measureID), nil, &res, http.StatusOK)
+	return res, err
+}
+
+// PollDeviceAsync starts the poll of the device with the given id like PollDevice
+// and returns its job, whose result is given by PollResult.
+func (d *Dispatcher) PollDeviceAsync(ctx context.Context, id, measureID int) (model.PollJob, error) {
+	var job model.PollJob
+	params := pollParams(id, measureID)
+	params.Set("async", "true")
+	err := call(ctx, d.HTTPClient, "POST", d.URL, dispatcher.DevicePollURI, params, nil, &job, http.StatusAccepted)
+	return job, err
+}
+
+// PollResult returns the result of the asynchronous poll with the given request
+// id. done is false while the poll is ongoing.
+func (d *Dispatcher) PollResult(ctx context.Context, requestID string) (res agent.PollResult, done bool, err error) {
+	params := url.Values{"id": {requestID}}
+	status, b, err := send(ctx, d.HTTPClient, "GET", d.URL, dispatcher.PollResultURI, params, nil)
+	if err != nil {
+		return res, false, err
+	}
+	switch status {
+	case http.StatusAccepted:
+		return res, false, nil
+	case http.StatusOK:
+		if err := json.Unmarshal(b, &res); err != nil {
+			return res, false, fmt.Errorf("unmarshal reply: %v", err)
+		}
+		return res, true, nil
+	default:
+		return res, false, replyError(status, b)
+	}
+}
+
+// Agents returns all agents ordered by id.
+func (d *Dispatcher) Agents(ctx context.Context) ([]model.AgentDef, error) {
+	var agents []model.AgentDef
+	err := d.list(ctx, dispatcher.AgentListURI, &agents)
+	return agents, err
+}
+
+// Agent returns the agent with the given id.
+func (d *Dispatcher) Agent(ctx context.Context, id int) (model.AgentDef, error) {
+	var agent model.AgentDef
+	err := d.get(ctx, dispatcher.AgentListURI, id, &agent)
+	return agent, err
+}
+
+// CreateAgent creates a new agent, with a generated id if 0. Returns the created agent.
+func (d *Dispatcher) CreateAgent(ctx context.Context, agent model.AgentDef) (model.AgentDef, error) {
+	var res model.AgentDef
+	err := d.post(ctx, dispatcher.AgentCreateURI, agent, &res)
+	return res, err
+}
+
+// UpdateAgent updates an existing agent. Returns the updated agent.
+func (d *Dispatcher) UpdateAgent(ctx context.Context, agent model.AgentDef) (model.AgentDef, error) {
+	var res model.AgentDef
+	err := d.post(ctx, dispatcher.AgentUpdateURI, agent, &res)
+	return res, err
+}
+
+// DeleteAgent deletes the agent with the given id.
+func (d *Dispatcher) DeleteAgent(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.AgentDeleteURI, id)
+}
+
+// Profiles returns all profiles ordered by id.
+func (d *Dispatcher) Profiles(ctx context.Context) ([]model.ProfileDef, error) {
+	var profiles []model.ProfileDef
+	err := d.list(ctx, dispatcher.ProfileListURI, &profiles)
+	return profiles, err
+}
+
+// Profile returns the profile with the given id.
+func (d *Dispatcher) Profile(ctx context.Context, id int) (model.ProfileDef, error) {
+	var prof model.ProfileDef
+	err := d.get(ctx, dispatcher.ProfileListURI, id, &prof)
+	return prof, err
+}
+
+// CreateProfile creates a new profile with its measures. Returns the created profile.
+func (d *Dispatcher) CreateProfile(ctx context.Context, prof model.ProfileDef) (model.ProfileDef, error) {
+	var res model.ProfileDef
+	err := d.post(ctx, dispatcher.ProfileCreateURI, prof, &res)
+	return res, err
+}
+
+// UpdateProfile updates an existing profile. Its measure list is left unchanged
+// if MeasureIDs is nil. Returns the updated profile.
+func (d *Dispatcher) UpdateProfile(ctx context.Context, prof model.ProfileDef) (model.ProfileDef, error) {
+	var res model.ProfileDef
+	err := d.post(ctx, dispatcher.ProfileUpdateURI, prof, &res)
+	return res, err
+}
+
+// DeleteProfile deletes the profile with the given id.
+func (d *Dispatcher) DeleteProfile(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.ProfileDeleteURI, id)
+}
+
+// LinkProfileMeasure adds a measure to a profile.
+func (d *Dispatcher) LinkProfileMeasure(ctx context.Context, profileID, measureID int) error {
+	return d.link(ctx, dispatcher.ProfileLinkURI, "profile_id", profileID, "measure_id", measureID)
+}
+
+// UnlinkProfileMeasure removes a measure from a profile.
+func (d *Dispatcher) UnlinkProfileMeasure(ctx context.Context, profileID, measureID int) error {
+	return d.link(ctx, dispatcher.ProfileUnlinkURI, "profile_id", profileID, "measure_id", measureID)
+}
+
+// Measures returns all measures ordered by id.
+func (d *Dispatcher) Measures(ctx context.Context) ([]model.MeasureDef, error) {
+	var measures []model.MeasureDef
+	err := d.list(ctx, dispatcher.MeasureListURI, &measures)
+	return measures, err
+}
+
+// Measure returns the measure with the given id.
+func (d *Dispatcher) Measure(ctx context.Context, id int) (model.MeasureDef, error) {
+	var meas model.MeasureDef
+	err := d.get(ctx, dispatcher.MeasureListURI, id, &meas)
+	return meas, err
+}
+
+// CreateMeasure creates a new measure with its metrics. Returns the created measure.
+func (d *Dispatcher) CreateMeasure(ctx context.Context, meas model.MeasureDef) (model.MeasureDef, error) {
+	var res model.MeasureDef
+	err := d.post(ctx, dispatcher.MeasureCreateURI, meas, &res)
+	return res, err
+}
+
+// UpdateMeasure updates an existing measure. Its metric list is left unchanged
+// if MetricIDs is nil. Returns the updated measure.
+func (d *Dispatcher) UpdateMeasure(ctx context.Context, meas model.MeasureDef) (model.MeasureDef, error) {
+	var res model.MeasureDef
+	err := d.post(ctx, dispatcher.MeasureUpdateURI, meas, &res)
+	return res, err
+}
+
+// DeleteMeasure deletes the measure with the given id.
+func (d *Dispatcher) DeleteMeasure(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.MeasureDeleteURI, id)
+}
+
+// LinkMeasureMetric adds a metric to a measure.
+func (d *Dispatcher) LinkMeasureMetric(ctx context.Context, measureID, metricID int) error {
+	return d.link(ctx, dispatcher.MeasureLinkURI, "measure_id", measureID, "metric_id", metricID)
+}
+
+// UnlinkMeasureMetric removes a metric from a measure.
+func (d *Dispatcher) UnlinkMeasureMetric(ctx context.Context, measureID, metricID int) error {
+	return d.link(ctx, dispatcher.MeasureUnlinkURI, "measure_id", measureID, "metric_id", metricID)
+}
+
+// Metrics returns all metrics ordered by id.
+func (d *Dispatcher) Metrics(ctx context.Context) ([]model.MetricDef, error) {
+	var metrics []model.MetricDef
+	err := d.list(ctx, dispatcher.MetricListURI, &metrics)
+	return metrics, err
+}
+
+// Metric returns the metric with the given id.
+func (d *Dispatcher) Metric(ctx context.Context, id int) (model.MetricDef, error) {
+	var metric model.MetricDef
+	err := d.get(ctx, dispatcher.MetricListURI, id, &metric)
+	return metric, err
+}
+
+// CreateMetric creates a new metric. Returns the created metric.
+func (d *Dispatcher) CreateMetric(ctx context.Context, metric model.MetricDef) (model.MetricDef, error) {
+	var res model.MetricDef
+	err := d.post(ctx, dispatcher.MetricCreateURI, metric, &res)
+	return res, err
+}
+
+// UpdateMetric updates an existing metric. Returns the updated metric.
+func (d *Dispatcher) UpdateMetric(ctx context.Context, metric model.MetricDef) (model.MetricDef, error) {
+	var res model.MetricDef
+	err := d.post(ctx, dispatcher.MetricUpdateURI, metric, &res)
+	return res, err
+}
+
+// DeleteMetric deletes the metric with the given id.
+func (d *Dispatcher) DeleteMetric(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.MetricDeleteURI, id)
+}
+
+// Credentials returns all credential sets ordered by id, with masked secrets.
+func (d *Dispatcher) Credentials(ctx context.Context) ([]model.CredentialDef, error) {
+	var creds []model.CredentialDef
+	err := d.list(ctx, dispatcher.CredentialListURI, &creds)
+	return creds, err
+}
+
+// Credential returns the credential set with the given id, with masked secrets.
+func (d *Dispatcher) Credential(ctx context.Context, id int) (model.CredentialDef, error) {
+	var cred model.CredentialDef
+	err := d.get(ctx, dispatcher.CredentialListURI, id, &cred)
+	return cred, err
+}
+
+// CreateCredential creates a new credential set. Returns the created set.
+func (d *Dispatcher) CreateCredential(ctx context.Context, cred model.CredentialDef) (model.CredentialDef, error) {
+	var res model.CredentialDef
+	err := d.post(ctx, dispatcher.CredentialCreateURI, cred, &res)
+	return res, err
+}
+
+// UpdateCredential updates an existing credential set, masked secrets are left
+// unchanged. Returns the updated set.
+func (d *Dispatcher) UpdateCredential(ctx context.Context, cred model.CredentialDef) (model.CredentialDef, error) {
+	var res model.CredentialDef
+	err := d.post(ctx, dispatcher.CredentialUpdateURI, cred, &res)
+	return res, err
+}
+
+// DeleteCredential deletes the credential set with the given id.
+func (d *Dispatcher) DeleteCredential(ctx context.Context, id int) error {
+	return d.remove(ctx, dispatcher.CredentialDeleteURI, id)
+}
+
+// Report sends a polling job report, as done by the agents.
+func (d *Dispatcher) Report(ctx context.Context, rep Report) error {
+	params := url.Values{}
+	params.Set("request_id", rep.RequestID)
+	params.Set("agent_id", strconv.Itoa(rep.AgentID))
+	params.Set("poll_duration_ms", strconv.FormatInt(int64(rep.PollDuration/time.Millisecond), 10))
+	params.Set("poll_error", rep.PollError)
+	params.Set("metric_count", strconv.Itoa(rep.MetricCount))
+	params.Set("current_load", fmt.Sprintf("%.4f", rep.CurrentLoad))
+	if rep.MaxRepetitions > 0 {
+		params.Set("max_repetitions", strconv.Itoa(rep.MaxRepetitions))
+	}
+	return call(ctx, d.HTTPClient, "GET", d.URL, model.ReportURI, params, nil, nil, http.StatusOK)
+}
+
+// pollParams returns the query params of a device poll request.
+func pollParams(id, measureID int) url.Values {
+	params := url.Values{"id": {strconv.Itoa(id)}}
+	if measureID != 0 {
+		params.Set("measure", strconv.Itoa(measureID))
+	}
+	return params
+}
+
+// list gets all the objects of the list uri into out.
+func (d *Dispatcher) list(ctx context.Context, uri string, out interface{}) error {
+	return call(ctx, d.HTTPClient, "GET", d.URL, uri, nil, nil, out, http.StatusOK)
+}
+
+// get gets the object with the given id of the list uri into out.
+func (d *Dispatcher) get(ctx context.Context, uri string, id int, out interface{}) error {
+	params := url.Values{"id": {strconv.Itoa(id)}}
+	return call(ctx, d.HTTPClient, "GET", d.URL, uri, params, nil, out, http.StatusOK)
+}
+
+// post posts the json object in to the uri and decodes the reply to out if not nil.
+func (d *Dispatcher) post(ctx context.Context, uri string, in, out interface{}) error {
+	return call(ctx, d.HTTPClient, "POST", d.URL, uri, nil, in, out, http.StatusOK)
+}
+
+// remove posts a delete request of the object with the given id to the uri.
+func (d *Dispatcher) remove(ctx context.Context, uri string, id int) error {
+	params := url.Values{"id": {strconv.Itoa(id)}}
+	return call(ctx, d.HTTPClient, "POST", d.URL, uri, params, nil, nil, http.StatusOK)
+}
+
+// link posts a link or unlink request of the parent and child ids to the uri.
+func (d *Dispatcher) link(ctx context.Context, uri, parentParam string, parentID int, childParam string, childID int) error {
+	params := url.Values{
+		parentParam: {strconv.Itoa(parentID)},
+		childParam:  {strconv.Itoa(childID)},
+	}
+	return call(ctx, d.HTTPClient, "POST", d.URL, uri, params, nil, nil, http.StatusOK)
+}
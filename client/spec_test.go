@@ -0,0 +1,187 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kosctelecom/horus/agent"
+	"github.com/kosctelecom/horus/dispatcher"
+	"github.com/kosctelecom/horus/model"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const specFile = "../doc/openapi.yaml"
+
+// spec is the part of the openapi spec checked against the code.
+type spec struct {
+	Paths      map[string]map[string]interface{} `yaml:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]interface{} `yaml:"properties"`
+		} `yaml:"schemas"`
+	} `yaml:"components"`
+}
+
+func loadSpec(t *testing.T) spec {
+	b, err := ioutil.ReadFile(specFile)
+	if err != nil {
+		t.Fatalf("read spec: %v", err)
+	}
+	var s spec
+	if err := yaml.Unmarshal(b, &s); err != nil {
+		t.Fatalf("parse spec: %v", err)
+	}
+	return s
+}
+
+// routes returns the agent and dispatcher routes.
+func routes(t *testing.T) map[string]http.HandlerFunc {
+	all := make(map[string]http.HandlerFunc)
+	for uri, handler := range agent.Routes {
+		all[uri] = handler
+	}
+	for uri, handler := range dispatcher.Routes {
+		if _, ok := all[uri]; ok {
+			t.Errorf("%s: served by both the agent and the dispatcher", uri)
+		}
+		all[uri] = handler
+	}
+	return all
+}
+
+// TestSpecPaths checks that every served endpoint is in the spec and vice versa.
+func TestSpecPaths(t *testing.T) {
+	s := loadSpec(t)
+	all := routes(t)
+	for uri := range all {
+		if _, ok := s.Paths[uri]; !ok {
+			t.Errorf("%s: missing in spec", uri)
+		}
+	}
+	for path := range s.Paths {
+		if _, ok := all[path]; !ok {
+			t.Errorf("%s: in spec but not served", path)
+		}
+	}
+}
+
+// TestSpecMethods checks that the handlers reject the methods absent from the spec.
+func TestSpecMethods(t *testing.T) {
+	// these handlers accept any method
+	anyMethod := map[string]bool{
+		model.CheckURI:   true,
+		model.OngoingURI: true,
+		model.ReportURI:  true,
+	}
+	// the poll handler checks the method only when polling is enabled
+	defer func(max int) { agent.MaxSNMPRequests = max }(agent.MaxSNMPRequests)
+	agent.MaxSNMPRequests = 1
+
+	s := loadSpec(t)
+	for uri, handler := range routes(t) {
+		ops := s.Paths[uri]
+		if len(ops) != 1 {
+			t.Errorf("%s: expected a single method in spec, got %d", uri, len(ops))
+			continue
+		}
+		if anyMethod[uri] {
+			continue
+		}
+		for method := range ops {
+			other := "GET"
+			if strings.ToUpper(method) == "GET" {
+				other = "POST"
+			}
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest(other, uri, nil))
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Errorf("%s: spec method is %s but %s got status %d", uri, method, other, w.Code)
+			}
+		}
+	}
+}
+
+// TestSpecSchemas checks that the spec schemas have the same properties as the
+// json documents of their model type.
+func TestSpecSchemas(t *testing.T) {
+	types := map[string]interface{}{
+		"Device":         model.Device{},
+		"AgentDef":       model.AgentDef{},
+		"ProfileDef":     model.ProfileDef{},
+		"MeasureDef":     model.MeasureDef{},
+		"MetricDef":      model.MetricDef{},
+		"CredentialDef":  model.CredentialDef{},
+		"OngoingPolls":   model.OngoingPolls{},
+		"PollJob":        model.PollJob{},
+		"PollResult":     agent.PollResult{},
+		"PingHost":       model.PingHost{},
+		"PingRequest":    model.PingRequest{},
+		"TrapDevice":     model.TrapDevice{},
+		"TrapUser":       model.TrapUser{},
+		"SnmpRequest":    model.SnmpRequest{},
+		"ScalarMeasure":  model.ScalarMeasure{},
+		"IndexedMeasure": model.IndexedMeasure{},
+		"Metric":         model.Metric{},
+		"DerivedMetric":  model.DerivedMetric{},
+		"IndexJoin":      model.IndexJoin{},
+	}
+	s := loadSpec(t)
+	for name, v := range types {
+		schema, ok := s.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s: missing in spec", name)
+			continue
+		}
+		var props []string
+		for prop := range schema.Properties {
+			props = append(props, prop)
+		}
+		sort.Strings(props)
+		fields := jsonFields(reflect.TypeOf(v))
+		sort.Strings(fields)
+		if !reflect.DeepEqual(props, fields) {
+			t.Errorf("schema %s: spec properties %v, expected %v", name, props, fields)
+		}
+	}
+}
+
+// jsonFields returns the json names of the exported fields of the struct type,
+// with the fields of the embedded structs.
+func jsonFields(typ reflect.Type) []string {
+	var fields []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && name == "" {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"github.com/kosctelecom/horus/agent"
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 	"github.com/vma/getopt"
@@ -53,6 +55,16 @@ var (
 	statUpdFreq    = getopt.IntLong("stat-frequency", 's', 0, "Agent stats update frequency (disabled if 0)", "sec")
 	interPollDelay = getopt.IntLong("inter-poll-delay", 't', 100, "time to wait between successive poll start", "msec")
 	logDir         = getopt.StringLong("log", 0, "", "directory for log files, disabled if empty (all log goes to stderr)", "dir")
+	counterMaxAge  = getopt.IntLong("counter-max-age", 0, 3600, "Maximum time to keep counter samples for rate and delta computation", "sec")
+	engineCacheTTL = getopt.IntLong("snmpv3-engine-ttl", 0, 1800, "Maximum time to reuse the snmpv3 engine params of a device without rediscovery, disabled if 0", "sec")
+	poolMaxSockets = getopt.IntLong("snmp-pool-max-sockets", 0, 0, "Max number of snmp sockets kept open between polls, pool disabled if 0", "count")
+	poolIdleTime   = getopt.IntLong("snmp-pool-idle-timeout", 0, 300, "Max time an snmp socket is kept idle in the pool", "sec")
+
+	// security conf
+	secretFile = getopt.StringLong("secret-file", 0, "", "file with the secret shared with the dispatcher to sign the requests, disabled if empty", "file")
+	tlsCert    = getopt.StringLong("tls-cert", 0, "", "TLS certificate file of the web server and the dispatcher requests, TLS disabled if empty", "file")
+	tlsKey     = getopt.StringLong("tls-key", 0, "", "TLS private key file", "file")
+	tlsCA      = getopt.StringLong("tls-ca", 0, "", "CA certificate file verifying the dispatcher certificate, enables mutual TLS", "file")
 
 	// prometheus conf
 	maxResAge = getopt.IntLong("prom-max-age", 0, 0, "Maximum time to keep prometheus samples in mem, disabled if 0", "sec")
@@ -70,14 +82,21 @@ var (
 	// kafka conf
 	kafkaHosts     = getopt.ListLong("kafka-hosts", 'k', "kafka broker hosts list (push to kafka disabled if empty)", "host1,host2,...")
 	kafkaTopic     = getopt.StringLong("kafka-topic", 0, "", "kafka snmp results topic")
+	kafkaTrapTopic = getopt.StringLong("kafka-trap-topic", 0, "", "kafka snmp traps topic, same as results if empty")
 	kafkaPartition = getopt.IntLong("kafka-partition", 0, 0, "kafka write partition")
 
 	// NATS conf
 	natsHosts          = getopt.ListLong("nats-hosts", 'n', "NATS hosts list (push to NATS disabled if empty)", "host1,host2,...")
 	natsSubject        = getopt.StringLong("nats-subject", 0, "horus.metrics", "NATS subject for snmp results")
+	natsTrapSubject    = getopt.StringLong("nats-trap-subject", 0, "", "NATS subject for snmp traps, same as results if empty")
 	natsName           = getopt.StringLong("nats-name", 0, "", "NATS connection name")
 	natsReconnectDelay = getopt.IntLong("nats-reconnect-delay", 0, 10, "NATS delay before reconnecting", "seconds")
 
+	// trap receiver conf
+	trapAddr      = getopt.StringLong("trap-addr", 0, "", "snmp trap receiver listen address like :162, disabled if empty", "address")
+	trapEngineID  = getopt.StringLong("trap-engine-id", 0, "", "hex encoded snmpv3 engine id of the trap receiver, built from hostname if empty", "hex")
+	trapRepollURL = getopt.StringLong("trap-repoll-url", 0, "", "dispatcher url polling a device on its link and restart traps, disabled if empty", "url")
+
 	// fping conf
 	pingPacketCount = getopt.IntLong("fping-packet-count", 0, 15, "number of ping requests sent to each host")
 	maxPingProcs    = getopt.IntLong("fping-max-procs", 0, 5, "max number of simultaneous fping processes")
@@ -111,6 +130,17 @@ func main() {
 		}
 	}()
 
+	if *secretFile != "" {
+		if err := auth.LoadSecret(*secretFile); err != nil {
+			glog.Exitf("load secret: %v", err)
+		}
+	}
+	if *tlsCert != "" {
+		if err := auth.LoadTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			glog.Exitf("load tls config: %v", err)
+		}
+	}
+
 	if *maxPingProcs > 0 {
 		if _, err := exec.LookPath("fping"); err != nil {
 			glog.Exit("fping binary not found in PATH. Please install fping and/or set $PATH accordingly.")
@@ -132,7 +162,12 @@ func main() {
 	agent.InterPollDelay = time.Duration(*interPollDelay) * time.Millisecond
 	agent.PingPacketCount = *pingPacketCount
 	agent.MaxPingProcs = *maxPingProcs
+	agent.CounterMaxAge = time.Duration(*counterMaxAge) * time.Second
+	agent.EngineCacheTTL = time.Duration(*engineCacheTTL) * time.Second
+	agent.PoolMaxSockets = *poolMaxSockets
+	agent.PoolIdleTimeout = time.Duration(*poolIdleTime) * time.Second
 	agent.StopCtx = ctx
+	model.StrictOIDs = true
 
 	if err := agent.Init(); err != nil {
 		glog.Exitf("init agent: %v", err)
@@ -148,26 +183,39 @@ func main() {
 	}
 
 	if len(*kafkaHosts) != 0 {
-		if err := agent.NewKafkaClient(*kafkaHosts, *kafkaTopic, *kafkaPartition); err != nil {
+		if err := agent.NewKafkaClient(*kafkaHosts, *kafkaTopic, *kafkaTrapTopic, *kafkaPartition); err != nil {
 			glog.Exitf("init kafka client: %v", err)
 		}
 	}
 
 	if len(*natsHosts) != 0 {
-		if err := agent.NewNatsClient(*natsHosts, *natsSubject, *natsName, *natsReconnectDelay); err != nil {
+		if err := agent.NewNatsClient(*natsHosts, *natsSubject, *natsTrapSubject, *natsName, *natsReconnectDelay); err != nil {
 			glog.Exitf("init NATS client: %v", err)
 		}
 	}
 
-	http.HandleFunc(model.SnmpJobURI, agent.HandleSnmpRequest)
-	http.HandleFunc(model.CheckURI, agent.HandleCheck)
-	http.HandleFunc(model.OngoingURI, agent.HandleOngoing)
-	http.HandleFunc(model.PingJobURI, agent.HandlePingRequest)
-	http.HandleFunc("/-/stop", handleStop)
-	http.HandleFunc("/-/debug", handleDebugLevel)
+	if *trapAddr != "" {
+		if len(*kafkaHosts) == 0 && len(*natsHosts) == 0 {
+			glog.Exit("trap receiver needs kafka-hosts or nats-hosts")
+		}
+		engineID, err := hex.DecodeString(*trapEngineID)
+		if err != nil {
+			glog.Exitf("invalid trap engine id: %v", err)
+		}
+		agent.TrapRepollURL = *trapRepollURL
+		if err := agent.NewTrapReceiver(*trapAddr, string(engineID)); err != nil {
+			glog.Exitf("init trap receiver: %v", err)
+		}
+	}
+
+	for uri, handler := range agent.Routes {
+		http.HandleFunc(uri, handler)
+	}
+	http.HandleFunc("/-/stop", auth.Handler(handleStop))
+	http.HandleFunc("/-/debug", auth.Handler(handleDebugLevel))
 	logger := httplogger.CommonLogger(log.Writer{})
 	log.Infof("starting web server on port %d", *port)
-	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), logger(http.DefaultServeMux)))
+	glog.Fatal(auth.ListenAndServe(fmt.Sprintf(":%d", *port), logger(http.DefaultServeMux)))
 }
 
 // handleStop handles agent graceful stop. Waits for all polling
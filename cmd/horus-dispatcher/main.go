@@ -26,9 +26,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/dispatcher"
 	"github.com/kosctelecom/horus/log"
-	"github.com/kosctelecom/horus/model"
+	"github.com/kosctelecom/horus/mib"
 	_ "github.com/lib/pq"
 	"github.com/vma/getopt"
 	"github.com/vma/glog"
@@ -52,14 +53,21 @@ var (
 	dsn             = getopt.StringLong("dsn", 'c', "", "postgres db DSN", "url")
 	unlockFreq      = getopt.IntLong("device-unlock-freq", 'u', 600, "device unlocker frequency (resets the db is_polling flag)", "seconds")
 	keepAliveFreq   = getopt.IntLong("agent-keepalive-freq", 'k', 30, "agent keep-alive frequency", "seconds")
-	dbSnmpQueryFreq = getopt.IntLong("db-snmp-freq", 'q', 30, "db query frequency for available polling jobs (0 to disable snmp)", "seconds")
+	dbSnmpQueryFreq = getopt.IntLong("db-snmp-freq", 'q', 30, "db reload frequency of the snmp polling schedule (0 to disable snmp)", "seconds")
 	dbPingQueryFreq = getopt.IntLong("db-ping-freq", 'g', 10, "db query frequency for available ping jobs (0 to disable ping)", "seconds")
+	trapDevicesFreq = getopt.IntLong("trap-devices-freq", 0, 0, "frequency of the device list push to the agent trap receivers (0 to disable)", "seconds")
 	pingBatchCount  = getopt.IntLong("ping-batch-count", 0, 100, "number of hosts per fping process")
 	dbPollErrRP     = getopt.IntLong("error-flush-freq", 'r', 4, "how long to keep poll errors in reports table (0 is forever)", "hours")
 	dbFlusherFreq   = getopt.IntLong("report-flush-freq", 0, 2, "db reports table flush frequency (all entries with report_received_at=null older than this period are deleted)", "hours")
 	logDir          = getopt.StringLong("log", 0, "", "directory for log files. If empty, all log goes to stderr", "dir")
 	snmpLoadAvgWin  = getopt.IntLong("load-avg-window", 'w', 30, "SNMP load avg calculation window", "sec")
 	lockID          = getopt.IntLong("lock-id", 'l', 0, "pg advisory lock id to ensure single running process (0 to disable)")
+	mibDir          = getopt.StringLong("mib-dir", 'm', "", "directory of the MIB files used to resolve symbolic metric oids", "dir")
+	secretFile      = getopt.StringLong("secret-file", 0, "", "file with the secret shared with the agents to sign the requests, disabled if empty", "file")
+	tlsCert         = getopt.StringLong("tls-cert", 0, "", "TLS certificate file of the web server and the agent requests, TLS disabled if empty", "file")
+	tlsKey          = getopt.StringLong("tls-key", 0, "", "TLS private key file", "file")
+	tlsCA           = getopt.StringLong("tls-ca", 0, "", "CA certificate file verifying the agent and api client certificates, enables mutual TLS", "file")
+	credentialsKey  = getopt.StringLong("credentials-key-file", 0, "", "file with the hex encoded AES-256 key encrypting the snmp credentials in db, stored in clear if empty", "file")
 )
 
 func main() {
@@ -99,6 +107,31 @@ func main() {
 		}
 	}()
 
+	if *secretFile != "" {
+		if err := auth.LoadSecret(*secretFile); err != nil {
+			glog.Exitf("load secret: %v", err)
+		}
+	}
+	if *tlsCert != "" {
+		if err := auth.LoadTLS(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			glog.Exitf("load tls config: %v", err)
+		}
+	}
+
+	if *credentialsKey != "" {
+		if err := dispatcher.LoadCredentialsKey(*credentialsKey); err != nil {
+			glog.Exitf("load credentials key: %v", err)
+		}
+	}
+
+	if *mibDir != "" {
+		m, err := mib.Load(*mibDir)
+		if err != nil {
+			glog.Exitf("load mibs: %v", err)
+		}
+		dispatcher.OIDResolver = m
+	}
+
 	dispatcher.LocalIP, dispatcher.Port = *localIP, *port
 	if err := dispatcher.ConnectDB(*dsn); err != nil {
 		glog.Exitf("connect db: %v", err)
@@ -118,6 +151,10 @@ func main() {
 		glog.Exitf("prepare queries: %v", err)
 	}
 
+	if err := dispatcher.EncryptStoredSecrets(); err != nil {
+		glog.Exitf("encrypt stored secrets: %v", err)
+	}
+
 	dispatcher.LoadAvgWindow = time.Duration(*snmpLoadAvgWin) * time.Second
 
 	if err := dispatcher.LoadAgents(); err != nil {
@@ -142,17 +179,23 @@ func main() {
 	}
 
 	if *dbSnmpQueryFreq > 0 {
+		if err := dispatcher.LoadSchedule(); err != nil {
+			glog.Exitf("load polling schedule: %v", err)
+		}
 		log.Debug("starting poller goroutine")
+		go dispatcher.SchedulePollingJobs(ctx)
 		go func() {
-			pollTick := time.NewTicker(time.Duration(*dbSnmpQueryFreq) * time.Second)
-			defer pollTick.Stop()
+			reloadTick := time.NewTicker(time.Duration(*dbSnmpQueryFreq) * time.Second)
+			defer reloadTick.Stop()
 			for {
-				dispatcher.SendPollingJobs(ctx)
 				select {
 				case <-ctx.Done():
 					log.Debugf("interrupted, exiting")
 					os.Exit(0)
-				case <-pollTick.C:
+				case <-reloadTick.C:
+					if err := dispatcher.LoadSchedule(); err != nil {
+						log.Errorf("reload polling schedule: %v", err)
+					}
 				}
 			}
 		}()
@@ -180,6 +223,22 @@ func main() {
 		log.Info("ping requests disabled")
 	}
 
+	if *trapDevicesFreq > 0 {
+		log.Debug("starting trap devices pusher goroutine")
+		go func() {
+			trapTick := time.NewTicker(time.Duration(*trapDevicesFreq) * time.Second)
+			defer trapTick.Stop()
+			for {
+				dispatcher.PushTrapDevices(ctx)
+				select {
+				case <-ctx.Done():
+					return
+				case <-trapTick.C:
+				}
+			}
+		}()
+	}
+
 	if *unlockFreq > 0 {
 		log.Debug("starting device unlocker goroutine")
 		go func() {
@@ -203,15 +262,12 @@ func main() {
 	}
 
 	log.Debugf("starting report web server on %s:%d", *localIP, *port)
-	http.HandleFunc(model.ReportURI, dispatcher.HandleReport)
-	http.HandleFunc(dispatcher.DeviceListURI, dispatcher.HandleDeviceList)
-	http.HandleFunc(dispatcher.DeviceCreateURI, dispatcher.HandleDeviceCreate)
-	http.HandleFunc(dispatcher.DeviceUpdateURI, dispatcher.HandleDeviceUpdate)
-	http.HandleFunc(dispatcher.DeviceUpsertURI, dispatcher.HandleDeviceUpsert)
-	http.HandleFunc(dispatcher.DeviceDeleteURI, dispatcher.HandleDeviceDelete)
-	http.HandleFunc("/-/debug", handleDebugLevel)
+	for uri, handler := range dispatcher.Routes {
+		http.HandleFunc(uri, handler)
+	}
+	http.HandleFunc("/-/debug", auth.Handler(handleDebugLevel))
 	logger := httplogger.CommonLogger(log.Writer{})
-	glog.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", *localIP, *port), logger(http.DefaultServeMux)))
+	glog.Fatal(auth.ListenAndServe(fmt.Sprintf("%s:%d", *localIP, *port), logger(http.DefaultServeMux)))
 }
 
 func handleDebugLevel(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,96 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kosctelecom/horus/mib"
+	"github.com/vma/getopt"
+	"github.com/vma/glog"
+)
+
+var (
+	// Revision is the git revision, set at compilation
+	Revision string
+
+	// Build is the build time, set at compilation
+	Build string
+
+	// Branch is the git branch, set at compilation
+	Branch string
+
+	showVersion = getopt.BoolLong("version", 'v', "Print version and build date")
+	debug       = getopt.IntLong("debug", 'd', 0, "debug level")
+	mibDir      = getopt.StringLong("mib-dir", 'm', "", "directory of the MIB files to load", "dir")
+	format      = getopt.EnumLong("format", 'f', []string{"sql", "json"}, "sql", "output format", "sql|json")
+	startID     = getopt.IntLong("start-id", 'i', 1, "first id of the generated metrics and measures")
+	profileID   = getopt.IntLong("profile-id", 'p', 0, "id of the profile to attach the measures to (sql output only)")
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	getopt.SetParameters("module|object...")
+	getopt.Parse()
+
+	if len(os.Args) == 1 {
+		getopt.PrintUsage(os.Stderr)
+		os.Exit(1)
+	}
+
+	glog.WithConf(glog.Conf{Verbosity: *debug})
+
+	if *showVersion {
+		fmt.Printf("Revision:%s Branch:%s Build:%s\n", Revision, Branch, Build)
+		return
+	}
+
+	if *mibDir == "" {
+		log.Fatalf("ERR: mib dir required")
+	}
+	if getopt.NArgs() == 0 {
+		log.Fatalf("ERR: at least one module or object name required")
+	}
+	if *startID < 1 {
+		log.Fatalf("ERR: start id must be positive")
+	}
+
+	m, err := mib.Load(*mibDir)
+	if err != nil {
+		log.Fatalf("ERR: load mibs: %v", err)
+	}
+	defs, err := m.Generate(getopt.Args(), *startID)
+	if err != nil {
+		log.Fatalf("ERR: generate: %v", err)
+	}
+	if len(defs.ScalarMeasures) == 0 && len(defs.IndexedMeasures) == 0 {
+		log.Fatalf("ERR: no readable object found")
+	}
+
+	if *format == "json" {
+		data, err := json.MarshalIndent(defs, "", "  ")
+		if err != nil {
+			log.Fatalf("ERR: marshal definitions: %v", err)
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if err := defs.WriteSQL(os.Stdout, *profileID); err != nil {
+		log.Fatalf("ERR: write sql: %v", err)
+	}
+}
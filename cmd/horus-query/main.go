@@ -27,6 +27,7 @@ import (
 
 	"github.com/kosctelecom/horus/agent"
 	"github.com/kosctelecom/horus/dispatcher"
+	"github.com/kosctelecom/horus/mib"
 	"github.com/kosctelecom/horus/model"
 	_ "github.com/lib/pq"
 	"github.com/vma/getopt"
@@ -52,6 +53,7 @@ var (
 	printQuery  = getopt.BoolLong("print-query", 'p', "print the json query before executing it")
 	scalarMeas  = getopt.ListLong("scalar", 's', "id of scalar measures to query: all if empty, none if 0", "id,...")
 	indexedMeas = getopt.ListLong("indexed", 't', "id of indexed measures to query: all if empty, none if 0", "id,...")
+	mibDir      = getopt.StringLong("mib-dir", 'm', "", "directory of the MIB files used to resolve symbolic metric oids", "dir")
 )
 
 func main() {
@@ -99,6 +101,13 @@ func main() {
 	}
 
 	if *devID != 0 {
+		if *mibDir != "" {
+			m, err := mib.Load(*mibDir)
+			if err != nil {
+				log.Fatalf("ERR: load mibs: %v", err)
+			}
+			dispatcher.OIDResolver = m
+		}
 		if err = dispatcher.ConnectDB(*dsn); err != nil {
 			log.Fatalf("ERR: connect db: %v", err)
 		}
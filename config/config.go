@@ -0,0 +1,404 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config implements the declarative description of the polling
+// configuration (profiles, measures and metrics) as a YAML or JSON document,
+// its export from the dispatcher db and its application to it.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/kosctelecom/horus/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the polling configuration. The metrics are referenced by name from
+// the measures, and the measures by name from the profiles.
+type Config struct {
+	// Metrics is the list of snmp metrics.
+	Metrics []Metric `json:"metrics" yaml:"metrics"`
+
+	// Measures is the list of scalar and indexed measures.
+	Measures []Measure `json:"measures" yaml:"measures"`
+
+	// Profiles is the list of device profiles.
+	Profiles []Profile `json:"profiles,omitempty" yaml:"profiles,omitempty"`
+}
+
+// Metric is the definition of a snmp metric. It is identified in the db by its
+// oid and index pattern.
+type Metric struct {
+	// Name is the metric name, unique within the config.
+	Name string `json:"name" yaml:"name"`
+
+	// Oid is the metric oid, numeric or symbolic.
+	Oid string `json:"oid" yaml:"oid"`
+
+	// Description is the metric description.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// Active tells whether the metric is polled. Defaults to true.
+	Active *bool `json:"active,omitempty" yaml:"active,omitempty"`
+
+	// ExportAsLabel tells if the metric is exported as a label.
+	ExportAsLabel bool `json:"export_as_label,omitempty" yaml:"export_as_label,omitempty"`
+
+	// ExportedName is the exported metric or label name, defaults to Name.
+	ExportedName string `json:"exported_name,omitempty" yaml:"exported_name,omitempty"`
+
+	// IndexPattern is the regex extracting the index from the tabular oids.
+	IndexPattern string `json:"index_pattern,omitempty" yaml:"index_pattern,omitempty"`
+
+	// PostProcessors is the list of post processors applied to the metric value.
+	PostProcessors []string `json:"post_processors,omitempty" yaml:"post_processors,omitempty"`
+}
+
+// Measure is the definition of a scalar or indexed measure, identified by its name.
+type Measure struct {
+	// Name is the measure name.
+	Name string `json:"name" yaml:"name"`
+
+	// Description is the measure description.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// Indexed tells whether this is an indexed measure.
+	Indexed bool `json:"indexed,omitempty" yaml:"indexed,omitempty"`
+
+	// Metrics is the name list of the measure metrics.
+	Metrics []string `json:"metrics" yaml:"metrics"`
+
+	// IndexMetric is the name of the index metric (indexed measure only).
+	IndexMetric string `json:"index_metric,omitempty" yaml:"index_metric,omitempty"`
+
+	// FilterMetric is the name of the metric the filter is applied on (indexed measure only).
+	FilterMetric string `json:"filter_metric,omitempty" yaml:"filter_metric,omitempty"`
+
+	// FilterPattern is the regex filtering the rows on the filter metric value.
+	FilterPattern string `json:"filter_pattern,omitempty" yaml:"filter_pattern,omitempty"`
+
+	// InvertFilterMatch negates the filter match.
+	InvertFilterMatch bool `json:"invert_filter_match,omitempty" yaml:"invert_filter_match,omitempty"`
+
+	// FilterRefreshInterval is the filter refresh interval with the targeted walk strategy.
+	FilterRefreshInterval int `json:"filter_refresh_interval,omitempty" yaml:"filter_refresh_interval,omitempty"`
+
+	// LabelRefreshPolls is the number of polls the cached labels are reused.
+	LabelRefreshPolls int `json:"label_refresh_polls,omitempty" yaml:"label_refresh_polls,omitempty"`
+
+	// LabelChangeOid is the scalar oid whose change forces the label refresh.
+	LabelChangeOid string `json:"label_change_oid,omitempty" yaml:"label_change_oid,omitempty"`
+
+	// WalkStrategy is the walk strategy of the indexed measure, `column` if empty.
+	WalkStrategy string `json:"walk_strategy,omitempty" yaml:"walk_strategy,omitempty"`
+
+	// UseAlternateCommunity tells whether to use the device alternate community.
+	UseAlternateCommunity bool `json:"use_alternate_community,omitempty" yaml:"use_alternate_community,omitempty"`
+
+	// PollingFrequency is the measure polling frequency in seconds, the device one if 0.
+	PollingFrequency int `json:"polling_frequency,omitempty" yaml:"polling_frequency,omitempty"`
+
+	// ToKafka tells if the results are exported to Kafka. Defaults to true.
+	ToKafka *bool `json:"to_kafka,omitempty" yaml:"to_kafka,omitempty"`
+
+	// ToProm tells if the results are exported to Prometheus. Defaults to true.
+	ToProm *bool `json:"to_prometheus,omitempty" yaml:"to_prometheus,omitempty"`
+
+	// ToInflux tells if the results are exported to InfluxDB. Defaults to false.
+	ToInflux *bool `json:"to_influx,omitempty" yaml:"to_influx,omitempty"`
+
+	// ToNats tells if the results are exported to NATS. Defaults to true.
+	ToNats *bool `json:"to_nats,omitempty" yaml:"to_nats,omitempty"`
+
+	// DerivedMetrics is the list of metrics computed from the measure metrics.
+	DerivedMetrics []DerivedMetric `json:"derived_metrics,omitempty" yaml:"derived_metrics,omitempty"`
+}
+
+// DerivedMetric is the definition of a derived metric of a measure.
+type DerivedMetric struct {
+	// Name is the derived metric name, unique within its measure.
+	Name string `json:"name" yaml:"name"`
+
+	// Expression is the arithmetic expression computing the metric value.
+	Expression string `json:"expression" yaml:"expression"`
+
+	// Description is the derived metric description.
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+
+	// ExportedName is the exported metric name, defaults to Name.
+	ExportedName string `json:"exported_name,omitempty" yaml:"exported_name,omitempty"`
+}
+
+// Profile is a device profile, identified by its category, vendor and model.
+type Profile struct {
+	// Category is the device category.
+	Category string `json:"category" yaml:"category"`
+
+	// Vendor is the device vendor.
+	Vendor string `json:"vendor" yaml:"vendor"`
+
+	// Model is the device model.
+	Model string `json:"model" yaml:"model"`
+
+	// Measures is the name list of the measures polled on this profile.
+	Measures []string `json:"measures" yaml:"measures"`
+
+	// PollingFrequencies overrides the polling frequency of some measures of
+	// this profile, by measure name.
+	PollingFrequencies map[string]int `json:"polling_frequencies,omitempty" yaml:"polling_frequencies,omitempty"`
+}
+
+// IsActive returns the Active flag value, true if unset.
+func (m Metric) IsActive() bool {
+	return boolOr(m.Active, true)
+}
+
+// key returns the unique db key of the metric.
+func (m Metric) key() string {
+	return m.Oid + " " + m.IndexPattern
+}
+
+// String returns the profile full name.
+func (p Profile) String() string {
+	return p.Category + "/" + p.Vendor + "/" + p.Model
+}
+
+// boolOr returns the value of b or def if b is nil.
+func boolOr(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+// boolPtr returns a pointer to b, or nil if b is the default value def.
+func boolPtr(b, def bool) *bool {
+	if b == def {
+		return nil
+	}
+	return &b
+}
+
+// Load reads a config file. The format is JSON if the file extension is
+// `.json`, YAML otherwise.
+func Load(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		err = json.Unmarshal(data, &conf)
+	} else {
+		err = yaml.UnmarshalStrict(data, &conf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", filename, err)
+	}
+	return &conf, nil
+}
+
+// Marshal serializes the config in the given format, `json` or `yaml`.
+func (conf *Config) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.MarshalIndent(conf, "", "  ")
+	case "yaml":
+		return yaml.Marshal(conf)
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+}
+
+// Validate checks the consistency of the config: the names must be unique and
+// all references must be defined. The metrics and measures are also checked
+// with the same rules as the agent, by unmarshaling them to their model type.
+func (conf *Config) Validate() error {
+	metrics := make(map[string]model.Metric)
+	keys := make(map[string]string)
+	for i, m := range conf.Metrics {
+		if m.Name == "" {
+			return fmt.Errorf("metric #%d: name cannot be empty", i+1)
+		}
+		if _, ok := metrics[m.Name]; ok {
+			return fmt.Errorf("metric %s: duplicate name", m.Name)
+		}
+		if other, ok := keys[m.key()]; ok {
+			return fmt.Errorf("metric %s: same oid and index pattern as %s", m.Name, other)
+		}
+		metric, err := m.toModel(i + 1)
+		if err != nil {
+			return err
+		}
+		metrics[m.Name] = metric
+		keys[m.key()] = m.Name
+	}
+
+	measures := make(map[string]bool)
+	for i, meas := range conf.Measures {
+		if meas.Name == "" {
+			return fmt.Errorf("measure #%d: name cannot be empty", i+1)
+		}
+		if measures[meas.Name] {
+			return fmt.Errorf("measure %s: duplicate name", meas.Name)
+		}
+		if err := meas.validate(metrics); err != nil {
+			return err
+		}
+		measures[meas.Name] = true
+	}
+
+	profiles := make(map[string]bool)
+	for _, prof := range conf.Profiles {
+		data, _ := json.Marshal(prof)
+		if err := json.Unmarshal(data, &model.Profile{}); err != nil {
+			return err
+		}
+		if profiles[prof.String()] {
+			return fmt.Errorf("profile %s: duplicate profile", prof)
+		}
+		seen := make(map[string]bool)
+		for _, name := range prof.Measures {
+			if !measures[name] {
+				return fmt.Errorf("profile %s: undefined measure %s", prof, name)
+			}
+			if seen[name] {
+				return fmt.Errorf("profile %s: duplicate measure %s", prof, name)
+			}
+			seen[name] = true
+		}
+		for name, freq := range prof.PollingFrequencies {
+			if !seen[name] {
+				return fmt.Errorf("profile %s: polling frequency of measure %s not in profile", prof, name)
+			}
+			if freq < 0 {
+				return fmt.Errorf("profile %s: negative polling frequency for measure %s", prof, name)
+			}
+		}
+		profiles[prof.String()] = true
+	}
+	return nil
+}
+
+// toModel converts the metric to a model.Metric with the given id, validated
+// by its json unmarshaler.
+func (m Metric) toModel(id int) (model.Metric, error) {
+	metric := model.Metric{
+		ID:             id,
+		Name:           m.Name,
+		Oid:            model.OID(m.Oid),
+		Description:    m.Description,
+		Active:         m.IsActive(),
+		ExportAsLabel:  m.ExportAsLabel,
+		ExportedName:   m.ExportedName,
+		PostProcessors: m.PostProcessors,
+		IndexPattern:   m.IndexPattern,
+	}
+	if metric.ExportedName == "" {
+		metric.ExportedName = m.Name
+	}
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return metric, fmt.Errorf("metric %s: %v", m.Name, err)
+	}
+	var res model.Metric
+	if err := json.Unmarshal(data, &res); err != nil {
+		return metric, fmt.Errorf("metric %s: %v", m.Name, err)
+	}
+	return metric, nil
+}
+
+// validate checks the measure references and its model validation rules.
+func (meas Measure) validate(metrics map[string]model.Metric) error {
+	var list []model.Metric
+	seen := make(map[string]bool)
+	for _, name := range meas.Metrics {
+		metric, ok := metrics[name]
+		if !ok {
+			return fmt.Errorf("measure %s: undefined metric %s", meas.Name, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("measure %s: duplicate metric %s", meas.Name, name)
+		}
+		seen[name] = true
+		list = append(list, metric)
+	}
+	for _, metric := range list {
+		for _, pp := range metric.PostProcessors {
+			if typeName := strings.TrimPrefix(pp, model.InetAddressPostProcessor); typeName != pp && !seen[typeName] {
+				return fmt.Errorf("measure %s: address type metric %s of %s not in measure", meas.Name, typeName, metric.Name)
+			}
+		}
+	}
+	derived := make([]model.DerivedMetric, len(meas.DerivedMetrics))
+	for i, d := range meas.DerivedMetrics {
+		derived[i] = model.DerivedMetric{
+			ID:           i + 1,
+			Name:         d.Name,
+			Description:  d.Description,
+			ExportedName: d.ExportedName,
+			Expression:   d.Expression,
+		}
+	}
+	if meas.PollingFrequency < 0 {
+		return fmt.Errorf("measure %s: polling_frequency cannot be negative", meas.Name)
+	}
+
+	if !meas.Indexed {
+		if meas.IndexMetric != "" || meas.FilterMetric != "" || meas.FilterPattern != "" || meas.WalkStrategy != "" ||
+			meas.LabelChangeOid != "" || meas.LabelRefreshPolls != 0 || meas.FilterRefreshInterval != 0 || meas.InvertFilterMatch {
+			return fmt.Errorf("measure %s: index, filter, walk and label settings are only allowed on indexed measures", meas.Name)
+		}
+		data, err := json.Marshal(model.ScalarMeasure{Name: meas.Name, Metrics: list, DerivedMetrics: derived})
+		if err != nil {
+			return fmt.Errorf("measure %s: %v", meas.Name, err)
+		}
+		return json.Unmarshal(data, &model.ScalarMeasure{})
+	}
+
+	im := model.IndexedMeasure{
+		Name:                  meas.Name,
+		Metrics:               list,
+		FilterPattern:         meas.FilterPattern,
+		InvertFilterMatch:     meas.InvertFilterMatch,
+		FilterRefreshInterval: meas.FilterRefreshInterval,
+		LabelRefreshPolls:     meas.LabelRefreshPolls,
+		LabelChangeOid:        model.OID(meas.LabelChangeOid),
+		WalkStrategy:          meas.WalkStrategy,
+		DerivedMetrics:        derived,
+	}
+	if meas.IndexMetric != "" {
+		metric, ok := metrics[meas.IndexMetric]
+		if !ok {
+			return fmt.Errorf("measure %s: undefined index metric %s", meas.Name, meas.IndexMetric)
+		}
+		im.IndexMetricID = model.NullInt64{Int64: int64(metric.ID), Valid: true}
+	}
+	if meas.FilterMetric != "" {
+		metric, ok := metrics[meas.FilterMetric]
+		if !ok {
+			return fmt.Errorf("measure %s: undefined filter metric %s", meas.Name, meas.FilterMetric)
+		}
+		im.FilterMetricID = model.NullInt64{Int64: int64(metric.ID), Valid: true}
+	}
+	data, err := json.Marshal(im)
+	if err != nil {
+		return fmt.Errorf("measure %s: %v", meas.Name, err)
+	}
+	return json.Unmarshal(data, &model.IndexedMeasure{})
+}
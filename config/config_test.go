@@ -0,0 +1,188 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	conf, err := Load("testdata/switch.yaml")
+	if err != nil {
+		t.Fatalf("load yaml: %v", err)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+	if len(conf.Metrics) != 5 || len(conf.Measures) != 2 || len(conf.Profiles) != 1 {
+		t.Fatalf("expected 5 metrics, 2 measures and 1 profile, got %d, %d and %d", len(conf.Metrics), len(conf.Measures), len(conf.Profiles))
+	}
+	if conf.Metrics[4].IsActive() || !conf.Metrics[0].IsActive() {
+		t.Errorf("invalid active flags")
+	}
+	ifStats := conf.Measures[1]
+	if !ifStats.Indexed || ifStats.IndexMetric != "ifName" || len(ifStats.DerivedMetrics) != 1 {
+		t.Errorf("invalid indexed measure %+v", ifStats)
+	}
+	if boolOr(ifStats.ToKafka, true) != true || boolOr(ifStats.ToInflux, false) != true || boolOr(ifStats.ToNats, true) != false {
+		t.Errorf("invalid export flags %+v", ifStats)
+	}
+
+	jconf, err := Load("testdata/switch.json")
+	if err != nil {
+		t.Fatalf("load json: %v", err)
+	}
+	if !reflect.DeepEqual(conf, jconf) {
+		t.Errorf("yaml and json configs differ:\n%+v\n%+v", conf, jconf)
+	}
+
+	for _, format := range []string{"yaml", "json"} {
+		if _, err := conf.Marshal(format); err != nil {
+			t.Errorf("marshal %s: %v", format, err)
+		}
+	}
+	if _, err := conf.Marshal("xml"); err == nil {
+		t.Errorf("marshal xml: expected error")
+	}
+	if _, err := Load("testdata/none.yaml"); err == nil {
+		t.Errorf("load missing file: expected error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	metrics := func() []Metric {
+		return []Metric{
+			{Name: "ifName", Oid: ".1.3.6.1.2.1.31.1.1.1.1", ExportAsLabel: true},
+			{Name: "ifHCInOctets", Oid: ".1.3.6.1.2.1.31.1.1.1.6"},
+			{Name: "sysUpTime", Oid: ".1.3.6.1.2.1.1.3.0"},
+		}
+	}
+	tests := []struct {
+		conf  Config
+		valid bool
+	}{
+		{
+			Config{
+				Metrics: metrics(),
+				Measures: []Measure{
+					{Name: "sys", Metrics: []string{"sysUpTime"}, PollingFrequency: 3600},
+					{Name: "if", Indexed: true, Metrics: []string{"ifName", "ifHCInOctets"}, IndexMetric: "ifName",
+						FilterMetric: "ifName", FilterPattern: "^Gi", WalkStrategy: "targeted"},
+				},
+				Profiles: []Profile{{Category: "switch", Vendor: "cisco", Model: "c2960", Measures: []string{"sys", "if"},
+					PollingFrequencies: map[string]int{"if": 60}}},
+			},
+			true,
+		},
+		{
+			// duplicate metric name
+			Config{Metrics: append(metrics(), Metric{Name: "ifName", Oid: ".1.3.6.1.2.1.2.2.1.2"})},
+			false,
+		},
+		{
+			// duplicate oid and index pattern
+			Config{Metrics: append(metrics(), Metric{Name: "ifDescr", Oid: ".1.3.6.1.2.1.31.1.1.1.1"})},
+			false,
+		},
+		{
+			// invalid post processor
+			Config{Metrics: []Metric{{Name: "m", Oid: ".1.2.3", PostProcessors: []string{"foo"}}}},
+			false,
+		},
+		{
+			// index pattern not starting with oid
+			Config{Metrics: []Metric{{Name: "m", Oid: ".1.2.3", IndexPattern: `.1.2.4.(\d+)`}}},
+			false,
+		},
+		{
+			// undefined measure metric
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysDescr"}}}},
+			false,
+		},
+		{
+			// index metric not in measure
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "if", Indexed: true, Metrics: []string{"ifHCInOctets"}, IndexMetric: "ifName"}}},
+			false,
+		},
+		{
+			// filter pattern without filter metric
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "if", Indexed: true, Metrics: []string{"ifName"}, FilterPattern: "^Gi"}}},
+			false,
+		},
+		{
+			// address type metric not in measure
+			Config{
+				Metrics: append(metrics(), Metric{Name: "peerAddrType", Oid: ".1.3.6.1.4.1.9999.1.1"},
+					Metric{Name: "peerAddr", Oid: ".1.3.6.1.4.1.9999.1.2", PostProcessors: []string{"inet-address:peerAddrType"}}),
+				Measures: []Measure{{Name: "peer", Indexed: true, Metrics: []string{"peerAddr"}}},
+			},
+			false,
+		},
+		{
+			// invalid walk strategy
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "if", Indexed: true, Metrics: []string{"ifName"}, WalkStrategy: "row"}}},
+			false,
+		},
+		{
+			// filter on scalar measure
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysUpTime"}, FilterPattern: "^1"}}},
+			false,
+		},
+		{
+			// derived metric with unknown variable
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysUpTime"},
+				DerivedMetrics: []DerivedMetric{{Name: "d", Expression: "sysDescr * 2"}}}}},
+			false,
+		},
+		{
+			// duplicate measure
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysUpTime"}}, {Name: "sys"}}},
+			false,
+		},
+		{
+			// negative measure polling frequency
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysUpTime"}, PollingFrequency: -1}}},
+			false,
+		},
+		{
+			// polling frequency of a measure not in profile
+			Config{Metrics: metrics(), Measures: []Measure{{Name: "sys", Metrics: []string{"sysUpTime"}}},
+				Profiles: []Profile{{Category: "switch", Vendor: "cisco", Model: "c2960", Measures: []string{"sys"},
+					PollingFrequencies: map[string]int{"if": 60}}}},
+			false,
+		},
+		{
+			// undefined profile measure
+			Config{Metrics: metrics(), Profiles: []Profile{{Category: "switch", Vendor: "cisco", Model: "c2960", Measures: []string{"sys"}}}},
+			false,
+		},
+		{
+			// incomplete profile
+			Config{Metrics: metrics(), Profiles: []Profile{{Category: "switch", Vendor: "cisco"}}},
+			false,
+		},
+	}
+	for i, tt := range tests {
+		err := tt.conf.Validate()
+		valid := err == nil
+		if !valid && testing.Verbose() {
+			t.Logf("Validate#%d: %v", i, err)
+		}
+		if valid != tt.valid {
+			t.Errorf("Validate#%d: expected validity: %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+	"github.com/lib/pq"
+)
+
+type metricRow struct {
+	ID             int            `db:"id"`
+	Name           string         `db:"name"`
+	Oid            string         `db:"oid"`
+	Description    string         `db:"description"`
+	Active         bool           `db:"active"`
+	ExportAsLabel  bool           `db:"export_as_label"`
+	ExportedName   string         `db:"exported_name"`
+	IndexPattern   string         `db:"index_pattern"`
+	PostProcessors pq.StringArray `db:"post_processors"`
+}
+
+type measureRow struct {
+	ID                    int             `db:"id"`
+	Name                  string          `db:"name"`
+	Description           string          `db:"description"`
+	IsIndexed             bool            `db:"is_indexed"`
+	IndexMetricID         model.NullInt64 `db:"index_metric_id"`
+	FilterMetricID        model.NullInt64 `db:"filter_metric_id"`
+	FilterPattern         string          `db:"filter_pattern"`
+	InvertFilterMatch     bool            `db:"invert_filter_match"`
+	FilterRefreshInterval int             `db:"filter_refresh_interval"`
+	LabelRefreshPolls     int             `db:"label_refresh_polls"`
+	LabelChangeOid        string          `db:"label_change_oid"`
+	WalkStrategy          string          `db:"walk_strategy"`
+	UseAlternateCommunity bool            `db:"use_alternate_community"`
+	PollingFrequency      int             `db:"polling_frequency"`
+	ToKafka               bool            `db:"to_kafka"`
+	ToProm                bool            `db:"to_prometheus"`
+	ToInflux              bool            `db:"to_influx"`
+	ToNats                bool            `db:"to_nats"`
+}
+
+type derivedRow struct {
+	MeasureID    int    `db:"measure_id"`
+	Name         string `db:"name"`
+	Expression   string `db:"expression"`
+	Description  string `db:"description"`
+	ExportedName string `db:"exported_name"`
+}
+
+type profileRow struct {
+	ID       int    `db:"id"`
+	Category string `db:"category"`
+	Vendor   string `db:"vendor"`
+	Model    string `db:"model"`
+}
+
+type linkRow struct {
+	ParentID int `db:"parent_id"`
+	ChildID  int `db:"child_id"`
+}
+
+type profileMeasureRow struct {
+	ProfileID        int             `db:"profile_id"`
+	MeasureID        int             `db:"measure_id"`
+	PollingFrequency model.NullInt64 `db:"polling_frequency"`
+}
+
+// Export reads the whole polling configuration from the db. The metric names
+// must be unique as they are used as references by the measures.
+func Export(q sqlx.Queryer) (*Config, error) {
+	var metrics []metricRow
+	err := sqlx.Select(q, &metrics, `SELECT id, name, oid, description, active, export_as_label,
+                                            COALESCE(exported_name, '') AS exported_name,
+                                            index_pattern, post_processors
+                                       FROM metrics
+                                   ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select metrics: %v", err)
+	}
+	var conf Config
+	metricNames := make(map[int]string)
+	ids := make(map[string]int)
+	for _, m := range metrics {
+		if id, ok := ids[m.Name]; ok {
+			return nil, fmt.Errorf("metrics #%d and #%d have the same name %s", id, m.ID, m.Name)
+		}
+		ids[m.Name] = m.ID
+		metricNames[m.ID] = m.Name
+		metric := Metric{
+			Name:           m.Name,
+			Oid:            m.Oid,
+			Description:    m.Description,
+			Active:         boolPtr(m.Active, true),
+			ExportAsLabel:  m.ExportAsLabel,
+			ExportedName:   m.ExportedName,
+			IndexPattern:   m.IndexPattern,
+			PostProcessors: m.PostProcessors,
+		}
+		conf.Metrics = append(conf.Metrics, metric.normalized())
+	}
+
+	var measures []measureRow
+	err = sqlx.Select(q, &measures, `SELECT id, name, description, is_indexed, index_metric_id, filter_metric_id,
+                                            filter_pattern, invert_filter_match, filter_refresh_interval,
+                                            label_refresh_polls, label_change_oid, walk_strategy,
+                                            use_alternate_community, polling_frequency,
+                                            to_kafka, to_prometheus, to_influx, to_nats
+                                       FROM measures
+                                   ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select measures: %v", err)
+	}
+	var measMetrics []linkRow
+	err = sqlx.Select(q, &measMetrics, `SELECT measure_id AS parent_id, metric_id AS child_id
+                                          FROM measure_metrics
+                                      ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select measure metrics: %v", err)
+	}
+	var derived []derivedRow
+	err = sqlx.Select(q, &derived, `SELECT measure_id, name, expression, description,
+                                           COALESCE(exported_name, '') AS exported_name
+                                      FROM derived_metrics
+                                  ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select derived metrics: %v", err)
+	}
+	measureNames := make(map[int]string)
+	for _, m := range measures {
+		measureNames[m.ID] = m.Name
+		meas := Measure{
+			Name:                  m.Name,
+			Description:           m.Description,
+			Indexed:               m.IsIndexed,
+			IndexMetric:           metricNames[int(m.IndexMetricID.Int64)],
+			FilterMetric:          metricNames[int(m.FilterMetricID.Int64)],
+			FilterPattern:         m.FilterPattern,
+			InvertFilterMatch:     m.InvertFilterMatch,
+			FilterRefreshInterval: m.FilterRefreshInterval,
+			LabelRefreshPolls:     m.LabelRefreshPolls,
+			LabelChangeOid:        m.LabelChangeOid,
+			WalkStrategy:          m.WalkStrategy,
+			UseAlternateCommunity: m.UseAlternateCommunity,
+			PollingFrequency:      m.PollingFrequency,
+			ToKafka:               boolPtr(m.ToKafka, true),
+			ToProm:                boolPtr(m.ToProm, true),
+			ToInflux:              boolPtr(m.ToInflux, false),
+			ToNats:                boolPtr(m.ToNats, true),
+			Metrics:               []string{},
+		}
+		for _, link := range measMetrics {
+			if link.ParentID == m.ID {
+				meas.Metrics = append(meas.Metrics, metricNames[link.ChildID])
+			}
+		}
+		for _, d := range derived {
+			if d.MeasureID == m.ID {
+				meas.DerivedMetrics = append(meas.DerivedMetrics, DerivedMetric{
+					Name:         d.Name,
+					Expression:   d.Expression,
+					Description:  d.Description,
+					ExportedName: d.ExportedName,
+				})
+			}
+		}
+		conf.Measures = append(conf.Measures, meas.normalized())
+	}
+
+	var profiles []profileRow
+	err = sqlx.Select(q, &profiles, `SELECT id, category, vendor, model
+                                       FROM profiles
+                                   ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select profiles: %v", err)
+	}
+	var profMeasures []profileMeasureRow
+	err = sqlx.Select(q, &profMeasures, `SELECT profile_id, measure_id, polling_frequency
+                                           FROM profile_measures
+                                       ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("select profile measures: %v", err)
+	}
+	for _, p := range profiles {
+		prof := Profile{
+			Category: p.Category,
+			Vendor:   p.Vendor,
+			Model:    p.Model,
+			Measures: []string{},
+		}
+		for _, link := range profMeasures {
+			if link.ProfileID != p.ID {
+				continue
+			}
+			prof.Measures = append(prof.Measures, measureNames[link.MeasureID])
+			if link.PollingFrequency.Valid {
+				if prof.PollingFrequencies == nil {
+					prof.PollingFrequencies = make(map[string]int)
+				}
+				prof.PollingFrequencies[measureNames[link.MeasureID]] = int(link.PollingFrequency.Int64)
+			}
+		}
+		conf.Profiles = append(conf.Profiles, prof)
+	}
+	return &conf, nil
+}
+
+// Apply validates conf and applies it to the db in a single transaction: the
+// metrics, measures and profiles are created or updated, and the metric list
+// and derived metrics of each measure as well as the measure list of each profile
+// with their polling frequencies are replaced by the config ones. The objects of the db absent from the config
+// are left untouched. The metrics are matched by name, as in Diff. Returns the list of changes made, as given by Diff.
+func Apply(db *sqlx.DB, conf *Config) ([]string, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	current, err := Export(tx)
+	if err != nil {
+		return nil, err
+	}
+	changes := Diff(current, conf)
+	if len(changes) == 0 {
+		log.Debugf("config already up to date")
+		return nil, nil
+	}
+
+	var rows []metricRow
+	if err := tx.Select(&rows, `SELECT id, name FROM metrics`); err != nil {
+		return nil, fmt.Errorf("select metrics: %v", err)
+	}
+	existing := make(map[string]int64)
+	for _, m := range rows {
+		existing[m.Name] = int64(m.ID)
+	}
+	metricIDs := make(map[string]int64)
+	for _, m := range conf.Metrics {
+		id, err := upsertMetric(tx, m, existing)
+		if err != nil {
+			return nil, fmt.Errorf("upsert metric %s: %v", m.Name, err)
+		}
+		metricIDs[m.Name] = id
+	}
+
+	measureIDs := make(map[string]int64)
+	for _, meas := range conf.Measures {
+		walk := meas.WalkStrategy
+		if walk == "" {
+			walk = model.WalkColumns
+		}
+		var id int64
+		err := tx.QueryRow(`INSERT INTO measures
+                                        (name, description, is_indexed, index_metric_id, filter_metric_id,
+                                         filter_pattern, invert_filter_match, filter_refresh_interval,
+                                         label_refresh_polls, label_change_oid, walk_strategy,
+                                         use_alternate_community, polling_frequency,
+                                         to_kafka, to_prometheus, to_influx, to_nats)
+                                 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+                            ON CONFLICT (name)
+                              DO UPDATE
+                                    SET description = EXCLUDED.description,
+                                        is_indexed = EXCLUDED.is_indexed,
+                                        index_metric_id = EXCLUDED.index_metric_id,
+                                        filter_metric_id = EXCLUDED.filter_metric_id,
+                                        filter_pattern = EXCLUDED.filter_pattern,
+                                        invert_filter_match = EXCLUDED.invert_filter_match,
+                                        filter_refresh_interval = EXCLUDED.filter_refresh_interval,
+                                        label_refresh_polls = EXCLUDED.label_refresh_polls,
+                                        label_change_oid = EXCLUDED.label_change_oid,
+                                        walk_strategy = EXCLUDED.walk_strategy,
+                                        use_alternate_community = EXCLUDED.use_alternate_community,
+                                        polling_frequency = EXCLUDED.polling_frequency,
+                                        to_kafka = EXCLUDED.to_kafka,
+                                        to_prometheus = EXCLUDED.to_prometheus,
+                                        to_influx = EXCLUDED.to_influx,
+                                        to_nats = EXCLUDED.to_nats
+                              RETURNING id`,
+			meas.Name, meas.Description, meas.Indexed, nullID(metricIDs, meas.IndexMetric), nullID(metricIDs, meas.FilterMetric),
+			meas.FilterPattern, meas.InvertFilterMatch, meas.FilterRefreshInterval,
+			meas.LabelRefreshPolls, meas.LabelChangeOid, walk, meas.UseAlternateCommunity, meas.PollingFrequency,
+			boolOr(meas.ToKafka, true), boolOr(meas.ToProm, true), boolOr(meas.ToInflux, false), boolOr(meas.ToNats, true)).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("upsert measure %s: %v", meas.Name, err)
+		}
+		measureIDs[meas.Name] = id
+
+		var ids []int64
+		for _, name := range meas.Metrics {
+			ids = append(ids, metricIDs[name])
+		}
+		if err := syncLinks(tx, "measure_metrics", "measure_id", "metric_id", id, ids); err != nil {
+			return nil, fmt.Errorf("measure %s: %v", meas.Name, err)
+		}
+
+		names := []string{}
+		for _, d := range meas.DerivedMetrics {
+			names = append(names, d.Name)
+		}
+		_, err = tx.Exec(`DELETE FROM derived_metrics
+                                WHERE measure_id = $1
+                                  AND NOT (name = ANY($2))`, id, pq.StringArray(names))
+		if err != nil {
+			return nil, fmt.Errorf("measure %s: delete derived metrics: %v", meas.Name, err)
+		}
+		for _, d := range meas.DerivedMetrics {
+			_, err := tx.Exec(`INSERT INTO derived_metrics
+                                           (measure_id, name, expression, description, exported_name)
+                                    VALUES ($1, $2, $3, $4, $5)
+                               ON CONFLICT (measure_id, name)
+                                 DO UPDATE
+                                       SET expression = EXCLUDED.expression,
+                                           description = EXCLUDED.description,
+                                           exported_name = EXCLUDED.exported_name`,
+				id, d.Name, d.Expression, d.Description, nullString(d.ExportedName))
+			if err != nil {
+				return nil, fmt.Errorf("measure %s: upsert derived metric %s: %v", meas.Name, d.Name, err)
+			}
+		}
+	}
+
+	for _, prof := range conf.Profiles {
+		var id int64
+		err := tx.QueryRow(`INSERT INTO profiles
+                                        (category, vendor, model)
+                                 VALUES ($1, $2, $3)
+                            ON CONFLICT (category, vendor, model)
+                              DO UPDATE
+                                    SET category = EXCLUDED.category
+                              RETURNING id`, prof.Category, prof.Vendor, prof.Model).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("upsert profile %s: %v", prof, err)
+		}
+		var ids []int64
+		for _, name := range prof.Measures {
+			ids = append(ids, measureIDs[name])
+		}
+		if err := syncLinks(tx, "profile_measures", "profile_id", "measure_id", id, ids); err != nil {
+			return nil, fmt.Errorf("profile %s: %v", prof, err)
+		}
+		for _, name := range prof.Measures {
+			f, ok := prof.PollingFrequencies[name]
+			freq := sql.NullInt64{Int64: int64(f), Valid: ok}
+			_, err := tx.Exec(`UPDATE profile_measures
+                                  SET polling_frequency = $3
+                                WHERE profile_id = $1
+                                  AND measure_id = $2`, id, measureIDs[name], freq)
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: measure %s: update polling frequency: %v", prof, name, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit: %v", err)
+	}
+	return changes, nil
+}
+
+// upsertMetric updates the metric with the same name as m, or creates it. As for
+// Export and Diff, the metrics are matched by name: a metric whose oid or index
+// pattern changed is updated in place. A new metric with the oid and index pattern
+// of an existing one renames it. existing maps the names of the db metrics to their
+// id and is kept up to date.
+func upsertMetric(tx *sqlx.Tx, m Metric, existing map[string]int64) (int64, error) {
+	args := []interface{}{m.Name, m.Oid, m.Description, m.IsActive(), m.ExportAsLabel, nullString(m.ExportedName),
+		m.IndexPattern, pq.StringArray(append([]string{}, m.PostProcessors...))}
+	if id, ok := existing[m.Name]; ok {
+		_, err := tx.Exec(`UPDATE metrics
+                              SET oid = $2,
+                                  description = $3,
+                                  active = $4,
+                                  export_as_label = $5,
+                                  exported_name = $6,
+                                  index_pattern = $7,
+                                  post_processors = $8
+                            WHERE id = $9
+                              AND name = $1`, append(args, id)...)
+		return id, err
+	}
+	var id int64
+	err := tx.QueryRow(`INSERT INTO metrics
+                                    (name, oid, description, active, export_as_label, exported_name,
+                                     index_pattern, post_processors)
+                             VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+                        ON CONFLICT (oid, index_pattern)
+                          DO UPDATE
+                                SET name = EXCLUDED.name,
+                                    description = EXCLUDED.description,
+                                    active = EXCLUDED.active,
+                                    export_as_label = EXCLUDED.export_as_label,
+                                    exported_name = EXCLUDED.exported_name,
+                                    post_processors = EXCLUDED.post_processors
+                          RETURNING id`, args...).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	for name, other := range existing {
+		if other == id {
+			// renamed
+			delete(existing, name)
+		}
+	}
+	existing[m.Name] = id
+	return id, nil
+}
+
+// syncLinks replaces the children of parentID in the relation table by childIDs.
+func syncLinks(tx *sqlx.Tx, table, parentCol, childCol string, parentID int64, childIDs []int64) error {
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s
+                                         WHERE %s = $1
+                                           AND NOT (%s = ANY($2))`, table, parentCol, childCol),
+		parentID, pq.Int64Array(append([]int64{}, childIDs...)))
+	if err != nil {
+		return fmt.Errorf("delete %s: %v", table, err)
+	}
+	for _, childID := range childIDs {
+		_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s
+                                                   (%s, %s)
+                                            VALUES ($1, $2)
+                                       ON CONFLICT (%s, %s)
+                                        DO NOTHING`, table, parentCol, childCol, parentCol, childCol),
+			parentID, childID)
+		if err != nil {
+			return fmt.Errorf("insert %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// nullString returns a null string if s is empty.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullID returns the id of the named metric, or null if name is empty.
+func nullID(ids map[string]int64, name string) model.NullInt64 {
+	if name == "" {
+		return model.NullInt64{}
+	}
+	return model.NullInt64{Int64: ids[name], Valid: true}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// testDSN is the dsn of a test db with the horus.sql schema.
+var testDSN = os.Getenv("HORUS_TEST_DSN")
+
+func TestApplyMetricOid(t *testing.T) {
+	if testDSN == "" {
+		t.Skip("HORUS_TEST_DSN env var not defined, skipping")
+	}
+	db, err := sqlx.Connect("postgres", testDSN)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer db.Close()
+	cleanup := func() {
+		db.MustExec(`DELETE FROM measures WHERE name = 'horusTestMeasure'`)
+		db.MustExec(`DELETE FROM metrics WHERE name = 'horusTestMetric'`)
+	}
+	cleanup()
+	defer cleanup()
+
+	conf := &Config{
+		Metrics:  []Metric{{Name: "horusTestMetric", Oid: ".1.3.6.1.4.1.9999.1.1.0", Description: "test metric"}},
+		Measures: []Measure{{Name: "horusTestMeasure", Metrics: []string{"horusTestMetric"}}},
+	}
+	if _, err := Apply(db, conf); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	conf.Metrics[0].Oid = ".1.3.6.1.4.1.9999.1.2.0"
+	for i := 1; i <= 2; i++ {
+		changes, err := Apply(db, conf)
+		if err != nil {
+			t.Fatalf("apply #%d with new oid: %v", i, err)
+		}
+		if i == 2 && len(changes) != 0 {
+			t.Errorf("apply #%d: expected no change, got %v", i, changes)
+		}
+	}
+	var oids []string
+	if err := db.Select(&oids, `SELECT oid FROM metrics WHERE name = 'horusTestMetric'`); err != nil {
+		t.Fatal(err)
+	}
+	if len(oids) != 1 || oids[0] != ".1.3.6.1.4.1.9999.1.2.0" {
+		t.Errorf("expected a single metric with the new oid, got %v", oids)
+	}
+	if _, err := Export(db); err != nil {
+		t.Errorf("export: %v", err)
+	}
+}
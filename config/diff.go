@@ -0,0 +1,178 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+// Diff returns the list of changes to make to the current config to apply the
+// target one, one per line. The lines are prefixed by `+` for a creation and
+// `~` for an update, like `~ metric ifDescr: description, post_processors` or
+// `~ measure ifStats: + metric ifHCInOctets`. As with Apply, the objects of the
+// current config absent from the target one are not considered.
+func Diff(current, target *Config) []string {
+	var changes []string
+
+	metrics := make(map[string]Metric)
+	for _, m := range current.Metrics {
+		metrics[m.key()] = m.normalized()
+	}
+	for _, m := range target.Metrics {
+		cur, ok := metrics[m.key()]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("+ metric %s (%s)", m.Name, m.Oid))
+			continue
+		}
+		if fields := changedFields(cur, m.normalized()); len(fields) > 0 {
+			changes = append(changes, fmt.Sprintf("~ metric %s: %s", m.Name, strings.Join(fields, ", ")))
+		}
+	}
+
+	measures := make(map[string]Measure)
+	for _, meas := range current.Measures {
+		measures[meas.Name] = meas.normalized()
+	}
+	for _, meas := range target.Measures {
+		cur, ok := measures[meas.Name]
+		if !ok {
+			changes = append(changes, "+ measure "+meas.Name)
+			continue
+		}
+		meas = meas.normalized()
+		if fields := changedFields(cur, meas); len(fields) > 0 {
+			changes = append(changes, fmt.Sprintf("~ measure %s: %s", meas.Name, strings.Join(fields, ", ")))
+		}
+		for _, change := range diffNames(cur.Metrics, meas.Metrics) {
+			changes = append(changes, fmt.Sprintf("~ measure %s: %s metric %s", meas.Name, change[:1], change[1:]))
+		}
+		derived := make(map[string]DerivedMetric)
+		for _, d := range cur.DerivedMetrics {
+			derived[d.Name] = d
+		}
+		for _, d := range meas.DerivedMetrics {
+			curd, ok := derived[d.Name]
+			if !ok {
+				changes = append(changes, fmt.Sprintf("~ measure %s: + derived_metric %s", meas.Name, d.Name))
+			} else if fields := changedFields(curd, d); len(fields) > 0 {
+				changes = append(changes, fmt.Sprintf("~ measure %s: ~ derived_metric %s: %s", meas.Name, d.Name, strings.Join(fields, ", ")))
+			}
+			delete(derived, d.Name)
+		}
+		for _, d := range cur.DerivedMetrics {
+			if _, ok := derived[d.Name]; ok {
+				changes = append(changes, fmt.Sprintf("~ measure %s: - derived_metric %s", meas.Name, d.Name))
+			}
+		}
+	}
+
+	profiles := make(map[string]Profile)
+	for _, prof := range current.Profiles {
+		profiles[prof.String()] = prof
+	}
+	for _, prof := range target.Profiles {
+		cur, ok := profiles[prof.String()]
+		if !ok {
+			changes = append(changes, "+ profile "+prof.String())
+			continue
+		}
+		for _, change := range diffNames(cur.Measures, prof.Measures) {
+			changes = append(changes, fmt.Sprintf("~ profile %s: %s measure %s", prof, change[:1], change[1:]))
+		}
+		if len(cur.PollingFrequencies) > 0 || len(prof.PollingFrequencies) > 0 {
+			if !reflect.DeepEqual(cur.PollingFrequencies, prof.PollingFrequencies) {
+				changes = append(changes, fmt.Sprintf("~ profile %s: polling_frequencies", prof))
+			}
+		}
+	}
+	return changes
+}
+
+// normalized returns the metric with its default values unset.
+func (m Metric) normalized() Metric {
+	m.Active = boolPtr(m.IsActive(), true)
+	if m.ExportedName == m.Name {
+		m.ExportedName = ""
+	}
+	if len(m.PostProcessors) == 0 {
+		m.PostProcessors = nil
+	}
+	return m
+}
+
+// normalized returns the measure with its default values unset.
+func (meas Measure) normalized() Measure {
+	if meas.WalkStrategy == model.WalkColumns {
+		meas.WalkStrategy = ""
+	}
+	meas.ToKafka = boolPtr(boolOr(meas.ToKafka, true), true)
+	meas.ToProm = boolPtr(boolOr(meas.ToProm, true), true)
+	meas.ToInflux = boolPtr(boolOr(meas.ToInflux, false), false)
+	meas.ToNats = boolPtr(boolOr(meas.ToNats, true), true)
+	derived := make([]DerivedMetric, len(meas.DerivedMetrics))
+	for i, d := range meas.DerivedMetrics {
+		if d.ExportedName == d.Name {
+			d.ExportedName = ""
+		}
+		derived[i] = d
+	}
+	meas.DerivedMetrics = derived
+	return meas
+}
+
+// changedFields returns the json names of the scalar fields that differ
+// between the structs a and b of the same type. The name list fields are
+// ignored.
+func changedFields(a, b interface{}) []string {
+	var fields []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if field.Type.Kind() == reflect.Slice && field.Type != reflect.TypeOf([]string(nil)) ||
+			field.Name == "Metrics" || field.Name == "Measures" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+	return fields
+}
+
+// diffNames returns the names added to and removed from the current list in
+// the target one, prefixed by `+` and `-` respectively.
+func diffNames(current, target []string) []string {
+	var res []string
+	cur := make(map[string]bool)
+	for _, name := range current {
+		cur[name] = true
+	}
+	for _, name := range target {
+		if !cur[name] {
+			res = append(res, "+"+name)
+		}
+		delete(cur, name)
+	}
+	for _, name := range current {
+		if cur[name] {
+			res = append(res, "-"+name)
+		}
+	}
+	return res
+}
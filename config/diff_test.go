@@ -0,0 +1,66 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	target, err := Load("testdata/switch.yaml")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if changes := Diff(target, target); len(changes) != 0 {
+		t.Errorf("diff with itself: expected no change, got %v", changes)
+	}
+
+	yes, no := true, false
+	current := &Config{
+		Metrics: []Metric{
+			{Name: "sysName", Oid: ".1.3.6.1.2.1.1.5.0", Description: "An administratively-assigned name for this managed node.",
+				ExportAsLabel: true, ExportedName: "sysName", Active: &yes, PostProcessors: []string{}},
+			{Name: "ifName", Oid: ".1.3.6.1.2.1.31.1.1.1.1", Description: "The name of the interface.", ExportAsLabel: true},
+			{Name: "ifHCInOctets", Oid: ".1.3.6.1.2.1.31.1.1.1.6", Description: "The total number of octets received on the interface.",
+				ExportedName: "ifInOctets", PostProcessors: []string{"rate"}},
+			{Name: "ifInErrors", Oid: ".1.3.6.1.2.1.2.2.1.14"},
+		},
+		Measures: []Measure{
+			{Name: "ifStats", Description: "Interface counters", Indexed: true, Metrics: []string{"ifName", "ifHCInOctets", "ifInErrors"},
+				IndexMetric: "ifName", FilterMetric: "ifName", FilterPattern: "^(Gi|Te)", WalkStrategy: "column", ToKafka: &yes, ToNats: &no,
+				DerivedMetrics: []DerivedMetric{{Name: "ifInBps", Expression: "ifHCInOctets"}, {Name: "ifErrRate", Expression: "ifInErrors / 2"}}},
+		},
+		Profiles: []Profile{
+			{Category: "switch", Vendor: "cisco", Model: "c2960", Measures: []string{"ifStats"}},
+		},
+	}
+	expected := []string{
+		"+ metric sysUpTime (SNMPv2-MIB::sysUpTime.0)",
+		"~ metric ifName: description",
+		"+ metric ifHCOutOctets (.1.3.6.1.2.1.31.1.1.1.10)",
+		"+ measure sysInfo",
+		"~ measure ifStats: to_influx",
+		"~ measure ifStats: + metric ifHCOutOctets",
+		"~ measure ifStats: - metric ifInErrors",
+		"~ measure ifStats: ~ derived_metric ifInBps: expression",
+		"~ measure ifStats: - derived_metric ifErrRate",
+		"~ profile switch/cisco/c2960: + measure sysInfo",
+		"~ profile switch/cisco/c2960: polling_frequencies",
+	}
+	if changes := Diff(current, target); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes:\n%q\ngot:\n%q", expected, changes)
+	}
+}
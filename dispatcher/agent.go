@@ -23,6 +23,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 )
@@ -55,12 +56,18 @@ type Agent struct {
 	// snmpJobURL is the full url for posting agent's snmp jobs
 	snmpJobURL string
 
+	// snmpQueryURL is the full url for posting agent's on-demand snmp jobs
+	snmpQueryURL string
+
 	// checkURL is the full url for pinging this agent
 	checkURL string
 
 	// pingJobURL is the full url for posting agent's ping jobs
 	pingJobURL string
 
+	// trapDevicesURL is the full url for posting agent's trap receiver devices
+	trapDevicesURL string
+
 	// lh is the agent load history
 	lh *loadHistory
 
@@ -180,7 +187,7 @@ func CheckAgents() error {
 // the current load in body when it is healthy.
 func (a Agent) Check() (bool, float64) {
 	log.Debug2f("checking agent #%d", a.ID)
-	client := &http.Client{Timeout: time.Duration(HTTPTimeout) * time.Second}
+	client := auth.NewClient(time.Duration(HTTPTimeout) * time.Second)
 	resp, err := client.Get(a.checkURL)
 	if err != nil {
 		log.Debug2f("check agent %s: %v", a.name, err)
@@ -237,9 +244,11 @@ func LoadAgents() error {
 	newAgents := make(Agents)
 	for _, a := range agents {
 		a := a // !!shadowing needed for last assignment
-		a.snmpJobURL = fmt.Sprintf("http://%s:%d%s", a.Host, a.Port, model.SnmpJobURI)
-		a.checkURL = fmt.Sprintf("http://%s:%d%s", a.Host, a.Port, model.CheckURI)
-		a.pingJobURL = fmt.Sprintf("http://%s:%d%s", a.Host, a.Port, model.PingJobURI)
+		a.snmpJobURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), a.Host, a.Port, model.SnmpJobURI)
+		a.snmpQueryURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), a.Host, a.Port, model.SnmpQueryURI)
+		a.checkURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), a.Host, a.Port, model.CheckURI)
+		a.pingJobURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), a.Host, a.Port, model.PingJobURI)
+		a.trapDevicesURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), a.Host, a.Port, model.TrapDevicesURI)
 		a.name = fmt.Sprintf("%s:%d", a.Host, a.Port)
 		a.lh = &loadHistory{loads: map[int64]float64{}}
 		newAgents[a.name] = &a
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 )
@@ -42,19 +43,73 @@ const (
 
 	// DeviceDeleteURI is the api endpoint for deleting a device
 	DeviceDeleteURI = "/d/delete"
+
+	// DeviceRepollURI is the api endpoint for forcing the poll of a device
+	DeviceRepollURI = "/d/repoll"
+
+	// DevicePollURI is the api endpoint for polling a device on demand
+	DevicePollURI = "/d/poll"
+
+	// PollResultURI is the api endpoint for the result of an asynchronous on-demand poll
+	PollResultURI = "/d/poll-result"
 )
 
+// Routes maps the dispatcher api endpoints to their handler. All the requests
+// must be signed when a shared secret is set, as the endpoints return or change
+// the devices and their credentials, or trigger polls.
+var Routes = map[string]http.HandlerFunc{
+	model.ReportURI:     auth.Handler(HandleReport),
+	DeviceListURI:       auth.Handler(HandleDeviceList),
+	DeviceCreateURI:     auth.Handler(HandleDeviceCreate),
+	DeviceUpdateURI:     auth.Handler(HandleDeviceUpdate),
+	DeviceUpsertURI:     auth.Handler(HandleDeviceUpsert),
+	DeviceDeleteURI:     auth.Handler(HandleDeviceDelete),
+	DeviceRepollURI:     auth.Handler(HandleDeviceRepoll),
+	DevicePollURI:       auth.Handler(HandleDevicePoll),
+	PollResultURI:       auth.Handler(HandlePollResult),
+	AgentListURI:        auth.Handler(HandleAgentList),
+	AgentCreateURI:      auth.Handler(HandleAgentCreate),
+	AgentUpdateURI:      auth.Handler(HandleAgentUpdate),
+	AgentDeleteURI:      auth.Handler(HandleAgentDelete),
+	ProfileListURI:      auth.Handler(HandleProfileList),
+	ProfileCreateURI:    auth.Handler(HandleProfileCreate),
+	ProfileUpdateURI:    auth.Handler(HandleProfileUpdate),
+	ProfileDeleteURI:    auth.Handler(HandleProfileDelete),
+	ProfileLinkURI:      auth.Handler(HandleProfileLink),
+	ProfileUnlinkURI:    auth.Handler(HandleProfileUnlink),
+	MeasureListURI:      auth.Handler(HandleMeasureList),
+	MeasureCreateURI:    auth.Handler(HandleMeasureCreate),
+	MeasureUpdateURI:    auth.Handler(HandleMeasureUpdate),
+	MeasureDeleteURI:    auth.Handler(HandleMeasureDelete),
+	MeasureLinkURI:      auth.Handler(HandleMeasureLink),
+	MeasureUnlinkURI:    auth.Handler(HandleMeasureUnlink),
+	MetricListURI:       auth.Handler(HandleMetricList),
+	MetricCreateURI:     auth.Handler(HandleMetricCreate),
+	MetricUpdateURI:     auth.Handler(HandleMetricUpdate),
+	MetricDeleteURI:     auth.Handler(HandleMetricDelete),
+	CredentialListURI:   auth.Handler(HandleCredentialList),
+	CredentialCreateURI: auth.Handler(HandleCredentialCreate),
+	CredentialUpdateURI: auth.Handler(HandleCredentialUpdate),
+	CredentialDeleteURI: auth.Handler(HandleCredentialDelete),
+}
+
 // HandleDeviceList implements the CRUD list handler. When `id` parameter is given
 // to the GET request, returns a json body with the device with this id. Otherwise,
-// returns a json array with all devices ordered by id.
+// returns a json array with all devices ordered by id. The communities and snmpv3
+// passwords are masked, unless asked otherwise with the `unmask=true` parameter.
 func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
 		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
 		return
 	}
+	unmask, ok := unmaskParam(w, r)
+	if !ok {
+		return
+	}
 	if id := r.FormValue("id"); id != "" {
 		var dev model.Device
 		err := db.Get(&dev, `SELECT d.active,
+                                    d.credential_id,
                                     d.hostname,
                                     d.id,
                                     d.ip_address,
@@ -64,6 +119,10 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
                                     d.snmp_community,
                                     d.snmp_connection_count,
                                     d.snmp_disable_bulk,
+                                    d.snmp_max_repetitions,
+                                    d.snmp_max_oids_per_get,
+                                    d.snmp_batch_get,
+                                    d.snmp_adaptive_repetitions,
                                     d.snmp_port,
                                     d.snmp_retries,
                                     d.snmp_timeout,
@@ -71,6 +130,8 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
                                     d.snmpv3_auth_passwd,
                                     d.snmpv3_auth_proto,
                                     d.snmpv3_auth_user,
+                                    d.snmpv3_context_engine_id,
+                                    d.snmpv3_context_name,
                                     d.snmpv3_privacy_passwd,
                                     d.snmpv3_privacy_proto,
                                     d.snmpv3_security_level,
@@ -91,6 +152,11 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
 			jsonBadRequest(w, err)
 			return
 		}
+		if err := listedSecrets(&dev, unmask); err != nil {
+			log.Warningf("HandleDeviceList: device #%s: %v", id, err)
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
 		buf, _ := json.MarshalIndent(dev, "", "  ")
 		fmt.Fprintf(w, "%s", buf)
 		return
@@ -98,6 +164,7 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
 
 	var devs []model.Device
 	err := db.Select(&devs, `SELECT d.active,
+                                    d.credential_id,
                                     d.hostname,
                                     d.id,
                                     d.ip_address,
@@ -107,6 +174,10 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
                                     d.snmp_community,
                                     d.snmp_connection_count,
                                     d.snmp_disable_bulk,
+                                    d.snmp_max_repetitions,
+                                    d.snmp_max_oids_per_get,
+                                    d.snmp_batch_get,
+                                    d.snmp_adaptive_repetitions,
                                     d.snmp_port,
                                     d.snmp_retries,
                                     d.snmp_timeout,
@@ -114,6 +185,8 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
                                     d.snmpv3_auth_passwd,
                                     d.snmpv3_auth_proto,
                                     d.snmpv3_auth_user,
+                                    d.snmpv3_context_engine_id,
+                                    d.snmpv3_context_name,
                                     d.snmpv3_privacy_passwd,
                                     d.snmpv3_privacy_proto,
                                     d.snmpv3_security_level,
@@ -130,10 +203,27 @@ func HandleDeviceList(w http.ResponseWriter, r *http.Request) {
 		jsonBadRequest(w, err)
 		return
 	}
+	for i := range devs {
+		if err := listedSecrets(&devs[i], unmask); err != nil {
+			log.Warningf("HandleDeviceList: device #%d: %v", devs[i].ID, err)
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
 	buf, _ := json.MarshalIndent(devs, "", "  ")
 	fmt.Fprintf(w, "%s", buf)
 }
 
+// listedSecrets decrypts the device secrets if unmask is set, masks them otherwise.
+func listedSecrets(dev *model.Device, unmask bool) error {
+	if !unmask {
+		dev.MaskSecrets()
+		return nil
+	}
+	s := &dev.SnmpParams
+	return openSecrets(&s.Community, &s.AlternateCommunity, &s.AuthPasswd, &s.PrivPasswd)
+}
+
 // HandleDeviceCreate implements the CRUD create handler
 func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -167,6 +257,11 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
 		jsonBadRequest(w, fmt.Errorf("device #%d already exists", dev.ID))
 		return
 	}
+	if err := storeDeviceSecrets(&dev); err != nil {
+		log.Warningf("HandleCreate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
 
 	err = db.Get(&dev, `SELECT id AS profile_id
                           FROM profiles
@@ -179,6 +274,7 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	_, err = db.NamedExec(`INSERT INTO devices (active,
+                                                credential_id,
                                                 hostname,
                                                 id,
                                                 ip_address,
@@ -189,6 +285,10 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
                                                 snmp_connection_count,
                                                 snmp_community,
                                                 snmp_disable_bulk,
+                                                snmp_max_repetitions,
+                                                snmp_max_oids_per_get,
+                                                snmp_batch_get,
+                                                snmp_adaptive_repetitions,
                                                 snmp_port,
                                                 snmp_retries,
                                                 snmp_timeout,
@@ -196,11 +296,14 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
                                                 snmpv3_auth_passwd,
                                                 snmpv3_auth_proto,
                                                 snmpv3_auth_user,
+                                                snmpv3_context_engine_id,
+                                                snmpv3_context_name,
                                                 snmpv3_privacy_passwd,
                                                 snmpv3_privacy_proto,
                                                 snmpv3_security_level,
                                                 tags)
                                         VALUES (:active,
+                                                :credential_id,
                                                 :hostname,
                                                 :id,
                                                 :ip_address,
@@ -211,6 +314,10 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
                                                 :snmp_connection_count,
                                                 :snmp_community,
                                                 :snmp_disable_bulk,
+                                                :snmp_max_repetitions,
+                                                :snmp_max_oids_per_get,
+                                                :snmp_batch_get,
+                                                :snmp_adaptive_repetitions,
                                                 :snmp_port,
                                                 :snmp_retries,
                                                 :snmp_timeout,
@@ -218,6 +325,8 @@ func HandleDeviceCreate(w http.ResponseWriter, r *http.Request) {
                                                 :snmpv3_auth_passwd,
                                                 :snmpv3_auth_proto,
                                                 :snmpv3_auth_user,
+                                                :snmpv3_context_engine_id,
+                                                :snmpv3_context_name,
                                                 :snmpv3_privacy_passwd,
                                                 :snmpv3_privacy_proto,
                                                 :snmpv3_security_level,
@@ -270,8 +379,14 @@ func HandleDeviceUpdate(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, http.StatusNotFound, fmt.Errorf("Device with id %d Not Found", dev.ID))
 		return
 	}
+	if err := storeDeviceSecrets(&dev); err != nil {
+		log.Warningf("HandleUpdate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
 	_, err = db.NamedExec(`UPDATE devices
                               SET active = :active,
+                                  credential_id = :credential_id,
                                   hostname = :hostname,
                                   ip_address = :ip_address,
                                   ping_frequency = :ping_frequency,
@@ -281,6 +396,10 @@ func HandleDeviceUpdate(w http.ResponseWriter, r *http.Request) {
                                   snmp_community = :snmp_community,
                                   snmp_connection_count = :snmp_connection_count,
                                   snmp_disable_bulk = :snmp_disable_bulk,
+                                  snmp_max_repetitions = :snmp_max_repetitions,
+                                  snmp_max_oids_per_get = :snmp_max_oids_per_get,
+                                  snmp_batch_get = :snmp_batch_get,
+                                  snmp_adaptive_repetitions = :snmp_adaptive_repetitions,
                                   snmp_port = :snmp_port,
                                   snmp_retries = :snmp_retries,
                                   snmp_timeout = :snmp_timeout,
@@ -288,6 +407,8 @@ func HandleDeviceUpdate(w http.ResponseWriter, r *http.Request) {
                                   snmpv3_auth_passwd = :snmpv3_auth_passwd,
                                   snmpv3_auth_proto = :snmpv3_auth_proto,
                                   snmpv3_auth_user = :snmpv3_auth_user,
+                                  snmpv3_context_engine_id = :snmpv3_context_engine_id,
+                                  snmpv3_context_name = :snmpv3_context_name,
                                   snmpv3_privacy_passwd = :snmpv3_privacy_passwd,
                                   snmpv3_privacy_proto = :snmpv3_privacy_proto,
                                   snmpv3_security_level = :snmpv3_security_level,
@@ -332,7 +453,13 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
 		jsonBadRequest(w, fmt.Errorf("invalid profile (%q,%q,%q)", dev.Category, dev.Vendor, dev.Model))
 		return
 	}
+	if err := storeDeviceSecrets(&dev); err != nil {
+		log.Errorf("ERR: upsert dev#%d: %v", dev.ID, err)
+		jsonBadRequest(w, err)
+		return
+	}
 	_, err = db.NamedExec(`INSERT INTO devices (active,
+                                                credential_id,
                                                 hostname,
                                                 id,
                                                 ip_address,
@@ -343,6 +470,10 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                 snmp_connection_count,
                                                 snmp_community,
                                                 snmp_disable_bulk,
+                                                snmp_max_repetitions,
+                                                snmp_max_oids_per_get,
+                                                snmp_batch_get,
+                                                snmp_adaptive_repetitions,
                                                 snmp_port,
                                                 snmp_retries,
                                                 snmp_timeout,
@@ -350,11 +481,14 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                 snmpv3_auth_passwd,
                                                 snmpv3_auth_proto,
                                                 snmpv3_auth_user,
+                                                snmpv3_context_engine_id,
+                                                snmpv3_context_name,
                                                 snmpv3_privacy_passwd,
                                                 snmpv3_privacy_proto,
                                                 snmpv3_security_level,
                                                 tags)
                                         VALUES (:active,
+                                                :credential_id,
                                                 :hostname,
                                                 :id,
                                                 :ip_address,
@@ -365,6 +499,10 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                 :snmp_connection_count,
                                                 :snmp_community,
                                                 :snmp_disable_bulk,
+                                                :snmp_max_repetitions,
+                                                :snmp_max_oids_per_get,
+                                                :snmp_batch_get,
+                                                :snmp_adaptive_repetitions,
                                                 :snmp_port,
                                                 :snmp_retries,
                                                 :snmp_timeout,
@@ -372,6 +510,8 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                 :snmpv3_auth_passwd,
                                                 :snmpv3_auth_proto,
                                                 :snmpv3_auth_user,
+                                                :snmpv3_context_engine_id,
+                                                :snmpv3_context_name,
                                                 :snmpv3_privacy_passwd,
                                                 :snmpv3_privacy_proto,
                                                 :snmpv3_security_level,
@@ -379,6 +519,7 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                ON CONFLICT(id)
                                      DO UPDATE
                                            SET active = :active,
+                                               credential_id = :credential_id,
                                                hostname = :hostname,
                                                ip_address = :ip_address,
                                                ping_frequency = :ping_frequency,
@@ -388,6 +529,10 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                snmp_community = :snmp_community,
                                                snmp_connection_count = :snmp_connection_count,
                                                snmp_disable_bulk = :snmp_disable_bulk,
+                                               snmp_max_repetitions = :snmp_max_repetitions,
+                                               snmp_max_oids_per_get = :snmp_max_oids_per_get,
+                                               snmp_batch_get = :snmp_batch_get,
+                                               snmp_adaptive_repetitions = :snmp_adaptive_repetitions,
                                                snmp_port = :snmp_port,
                                                snmp_retries = :snmp_retries,
                                                snmp_timeout = :snmp_timeout,
@@ -395,6 +540,8 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
                                                snmpv3_auth_passwd = :snmpv3_auth_passwd,
                                                snmpv3_auth_proto = :snmpv3_auth_proto,
                                                snmpv3_auth_user = :snmpv3_auth_user,
+                                               snmpv3_context_engine_id = :snmpv3_context_engine_id,
+                                               snmpv3_context_name = :snmpv3_context_name,
                                                snmpv3_privacy_passwd = :snmpv3_privacy_passwd,
                                                snmpv3_privacy_proto = :snmpv3_privacy_proto,
                                                snmpv3_security_level = :snmpv3_security_level,
@@ -407,6 +554,13 @@ func HandleDeviceUpsert(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// storeDeviceSecrets prepares the device communities and passwords for their
+// storage in db.
+func storeDeviceSecrets(dev *model.Device) error {
+	s := &dev.SnmpParams
+	return storeSecrets("devices", dev.ID, &s.Community, &s.AlternateCommunity, &s.AuthPasswd, &s.PrivPasswd)
+}
+
 // HandleDeviceDelete implements the CRUD delete handler. The id of the device
 // to delete must be given in `id` param to the POST request.
 func HandleDeviceDelete(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,38 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kosctelecom/horus/auth"
+)
+
+// TestRoutesSigned checks that all the api endpoints reject the unsigned requests
+// when a shared secret is set.
+func TestRoutesSigned(t *testing.T) {
+	defer func() { auth.Secret = nil }()
+	auth.Secret = []byte("secret")
+
+	for uri, handler := range Routes {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", uri, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status %d on unsigned request, got %d", uri, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
@@ -0,0 +1,1020 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+	"github.com/lib/pq"
+)
+
+const (
+	// AgentListURI is the api endpoint for agent listing
+	AgentListURI = "/a/list"
+
+	// AgentCreateURI is the api endpoint for creating a new agent
+	AgentCreateURI = "/a/create"
+
+	// AgentUpdateURI is the api endpoint for updating an agent
+	AgentUpdateURI = "/a/update"
+
+	// AgentDeleteURI is the api endpoint for deleting an agent
+	AgentDeleteURI = "/a/delete"
+
+	// ProfileListURI is the api endpoint for profile listing
+	ProfileListURI = "/p/list"
+
+	// ProfileCreateURI is the api endpoint for creating a new profile
+	ProfileCreateURI = "/p/create"
+
+	// ProfileUpdateURI is the api endpoint for updating a profile
+	ProfileUpdateURI = "/p/update"
+
+	// ProfileDeleteURI is the api endpoint for deleting a profile
+	ProfileDeleteURI = "/p/delete"
+
+	// ProfileLinkURI is the api endpoint for adding a measure to a profile
+	ProfileLinkURI = "/p/link"
+
+	// ProfileUnlinkURI is the api endpoint for removing a measure from a profile
+	ProfileUnlinkURI = "/p/unlink"
+
+	// MeasureListURI is the api endpoint for measure listing
+	MeasureListURI = "/ms/list"
+
+	// MeasureCreateURI is the api endpoint for creating a new measure
+	MeasureCreateURI = "/ms/create"
+
+	// MeasureUpdateURI is the api endpoint for updating a measure
+	MeasureUpdateURI = "/ms/update"
+
+	// MeasureDeleteURI is the api endpoint for deleting a measure
+	MeasureDeleteURI = "/ms/delete"
+
+	// MeasureLinkURI is the api endpoint for adding a metric to a measure
+	MeasureLinkURI = "/ms/link"
+
+	// MeasureUnlinkURI is the api endpoint for removing a metric from a measure
+	MeasureUnlinkURI = "/ms/unlink"
+
+	// MetricListURI is the api endpoint for metric listing
+	MetricListURI = "/mt/list"
+
+	// MetricCreateURI is the api endpoint for creating a new metric
+	MetricCreateURI = "/mt/create"
+
+	// MetricUpdateURI is the api endpoint for updating a metric
+	MetricUpdateURI = "/mt/update"
+
+	// MetricDeleteURI is the api endpoint for deleting a metric
+	MetricDeleteURI = "/mt/delete"
+
+	// CredentialListURI is the api endpoint for credential set listing
+	CredentialListURI = "/c/list"
+
+	// CredentialCreateURI is the api endpoint for creating a new credential set
+	CredentialCreateURI = "/c/create"
+
+	// CredentialUpdateURI is the api endpoint for updating a credential set
+	CredentialUpdateURI = "/c/update"
+
+	// CredentialDeleteURI is the api endpoint for deleting a credential set
+	CredentialDeleteURI = "/c/delete"
+)
+
+const (
+	selectAgents = `SELECT id,
+                           ip_address,
+                           port,
+                           active,
+                           is_alive,
+                           load,
+                           last_checked_at
+                      FROM agents`
+
+	selectProfiles = `SELECT id,
+                             category,
+                             vendor,
+                             model
+                        FROM profiles`
+
+	selectMeasures = `SELECT id,
+                             name,
+                             description,
+                             is_indexed,
+                             index_metric_id,
+                             filter_metric_id,
+                             filter_pattern,
+                             invert_filter_match,
+                             filter_refresh_interval,
+                             label_refresh_polls,
+                             label_change_oid,
+                             walk_strategy,
+                             use_alternate_community,
+                             polling_frequency,
+                             to_kafka,
+                             to_prometheus,
+                             to_influx,
+                             to_nats
+                        FROM measures`
+
+	selectMetrics = `SELECT id,
+                            name,
+                            oid,
+                            description,
+                            active,
+                            export_as_label,
+                            COALESCE(exported_name, '') AS exported_name,
+                            index_pattern,
+                            post_processors
+                       FROM metrics`
+
+	selectCredentials = `SELECT id,
+                                name,
+                                snmp_community,
+                                snmp_alternate_community,
+                                snmpv3_auth_user,
+                                snmpv3_auth_passwd,
+                                snmpv3_privacy_passwd
+                           FROM credentials`
+)
+
+// HandleAgentList implements the agent CRUD list handler. Returns the agent with
+// the `id` parameter if given, all agents ordered by id otherwise.
+func HandleAgentList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	var agents []model.AgentDef
+	if !listRows(w, r, "Agent", &agents, selectAgents) {
+		return
+	}
+	if r.FormValue("id") != "" {
+		writeJSON(w, agents[0])
+		return
+	}
+	writeJSON(w, agents)
+}
+
+// HandleAgentCreate implements the agent CRUD create handler. The agent id is
+// generated if not given. Returns the created agent.
+func HandleAgentCreate(w http.ResponseWriter, r *http.Request) {
+	var agent model.AgentDef
+	if !readBody(w, r, "HandleAgentCreate", &agent) {
+		return
+	}
+	rows, err := db.NamedQuery(`INSERT INTO agents (id, ip_address, port, active)
+                                     VALUES (COALESCE(NULLIF(:id, 0), nextval('agents_id_seq')),
+                                             :ip_address,
+                                             :port,
+                                             :active)
+                                  RETURNING id`, agent)
+	if err == nil {
+		err = scanID(rows, &agent.ID)
+	}
+	if err != nil {
+		log.Warningf("HandleAgentCreate: agent insert: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, agent)
+}
+
+// HandleAgentUpdate implements the agent CRUD update handler.
+func HandleAgentUpdate(w http.ResponseWriter, r *http.Request) {
+	var agent model.AgentDef
+	if !readBody(w, r, "HandleAgentUpdate", &agent) {
+		return
+	}
+	res, err := db.NamedExec(`UPDATE agents
+                                 SET ip_address = :ip_address,
+                                     port = :port,
+                                     active = :active
+                               WHERE id = :id`, agent)
+	if err != nil {
+		log.Warningf("HandleAgentUpdate: agent update: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		jsonError(w, http.StatusNotFound, errors.New("Agent not found"))
+		return
+	}
+	writeJSON(w, agent)
+}
+
+// HandleAgentDelete implements the agent CRUD delete handler. The id of the agent
+// to delete must be given in `id` param to the POST request.
+func HandleAgentDelete(w http.ResponseWriter, r *http.Request) {
+	deleteRow(w, r, "agents", "Agent")
+}
+
+// HandleProfileList implements the profile CRUD list handler. Returns the profile
+// with the `id` parameter if given, all profiles ordered by id otherwise.
+func HandleProfileList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	var profiles []model.ProfileDef
+	if !listRows(w, r, "Profile", &profiles, selectProfiles) {
+		return
+	}
+	var links []struct {
+		ProfileID        int             `db:"profile_id"`
+		MeasureID        int             `db:"measure_id"`
+		PollingFrequency model.NullInt64 `db:"polling_frequency"`
+	}
+	if err := db.Select(&links, `SELECT profile_id, measure_id, polling_frequency FROM profile_measures ORDER BY id`); err != nil {
+		log.Warningf("HandleProfileList: select profile measures: %v", err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range profiles {
+		profiles[i].MeasureIDs = []int{}
+		profiles[i].PollingFrequencies = map[int]int{}
+		for _, link := range links {
+			if link.ProfileID == profiles[i].ID {
+				profiles[i].MeasureIDs = append(profiles[i].MeasureIDs, link.MeasureID)
+				if link.PollingFrequency.Valid {
+					profiles[i].PollingFrequencies[link.MeasureID] = int(link.PollingFrequency.Int64)
+				}
+			}
+		}
+	}
+	if r.FormValue("id") != "" {
+		writeJSON(w, profiles[0])
+		return
+	}
+	writeJSON(w, profiles)
+}
+
+// HandleProfileCreate implements the profile CRUD create handler. The profile,
+// its measure list and their polling frequencies are inserted in the same
+// transaction. Returns the created profile.
+func HandleProfileCreate(w http.ResponseWriter, r *http.Request) {
+	var prof model.ProfileDef
+	if !readBody(w, r, "HandleProfileCreate", &prof) {
+		return
+	}
+	err := inTx(func(tx *sqlx.Tx) error {
+		rows, err := tx.NamedQuery(`INSERT INTO profiles (id, category, vendor, model)
+                                         VALUES (COALESCE(NULLIF(:id, 0), nextval('profiles_id_seq')),
+                                                 :category,
+                                                 :vendor,
+                                                 :model)
+                                      RETURNING id`, prof)
+		if err == nil {
+			err = scanID(rows, &prof.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("profile insert: %v", err)
+		}
+		if err := syncLinks(tx, "profile_measures", "profile_id", "measure_id", prof.ID, prof.MeasureIDs); err != nil {
+			return err
+		}
+		return syncPollingFrequencies(tx, prof.ID, prof.PollingFrequencies)
+	})
+	if err != nil {
+		log.Warningf("HandleProfileCreate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, prof)
+}
+
+// HandleProfileUpdate implements the profile CRUD update handler. The measure
+// list is replaced if `measure_ids` is not null, and the measure polling frequencies
+// if `polling_frequencies` is not null.
+func HandleProfileUpdate(w http.ResponseWriter, r *http.Request) {
+	var prof model.ProfileDef
+	if !readBody(w, r, "HandleProfileUpdate", &prof) {
+		return
+	}
+	err := inTx(func(tx *sqlx.Tx) error {
+		res, err := tx.NamedExec(`UPDATE profiles
+                                     SET category = :category,
+                                         vendor = :vendor,
+                                         model = :model
+                                   WHERE id = :id`, prof)
+		if err != nil {
+			return fmt.Errorf("profile update: %v", err)
+		}
+		if count, _ := res.RowsAffected(); count == 0 {
+			return sql.ErrNoRows
+		}
+		if err := syncLinks(tx, "profile_measures", "profile_id", "measure_id", prof.ID, prof.MeasureIDs); err != nil {
+			return err
+		}
+		return syncPollingFrequencies(tx, prof.ID, prof.PollingFrequencies)
+	})
+	if err == sql.ErrNoRows {
+		jsonError(w, http.StatusNotFound, errors.New("Profile not found"))
+		return
+	}
+	if err != nil {
+		log.Warningf("HandleProfileUpdate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, prof)
+}
+
+// HandleProfileDelete implements the profile CRUD delete handler. The id of the
+// profile to delete must be given in `id` param to the POST request.
+func HandleProfileDelete(w http.ResponseWriter, r *http.Request) {
+	deleteRow(w, r, "profiles", "Profile")
+}
+
+// HandleProfileLink adds the measure with the `measure_id` parameter to the profile
+// with the `profile_id` parameter.
+func HandleProfileLink(w http.ResponseWriter, r *http.Request) {
+	handleLink(w, r, "profile_measures", "profile_id", "measure_id", true, nil)
+}
+
+// HandleProfileUnlink removes the measure with the `measure_id` parameter from the
+// profile with the `profile_id` parameter.
+func HandleProfileUnlink(w http.ResponseWriter, r *http.Request) {
+	handleLink(w, r, "profile_measures", "profile_id", "measure_id", false, nil)
+}
+
+// HandleMeasureList implements the measure CRUD list handler. Returns the measure
+// with the `id` parameter if given, all measures ordered by id otherwise.
+func HandleMeasureList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	var measures []model.MeasureDef
+	if !listRows(w, r, "Measure", &measures, selectMeasures) {
+		return
+	}
+	var links []struct {
+		MeasureID int `db:"measure_id"`
+		MetricID  int `db:"metric_id"`
+	}
+	if err := db.Select(&links, `SELECT measure_id, metric_id FROM measure_metrics ORDER BY id`); err != nil {
+		log.Warningf("HandleMeasureList: select measure metrics: %v", err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for i := range measures {
+		measures[i].MetricIDs = []int{}
+		for _, link := range links {
+			if link.MeasureID == measures[i].ID {
+				measures[i].MetricIDs = append(measures[i].MetricIDs, link.MetricID)
+			}
+		}
+	}
+	if r.FormValue("id") != "" {
+		writeJSON(w, measures[0])
+		return
+	}
+	writeJSON(w, measures)
+}
+
+// HandleMeasureCreate implements the measure CRUD create handler. The measure
+// is checked with its metrics given by `metric_ids` like a request measure, and
+// inserted with its metric list in the same transaction. Returns the created
+// measure.
+func HandleMeasureCreate(w http.ResponseWriter, r *http.Request) {
+	var meas model.MeasureDef
+	if !readBody(w, r, "HandleMeasureCreate", &meas) {
+		return
+	}
+	err := inTx(func(tx *sqlx.Tx) error {
+		rows, err := tx.NamedQuery(`INSERT INTO measures (id,
+                                                          name,
+                                                          description,
+                                                          is_indexed,
+                                                          index_metric_id,
+                                                          filter_metric_id,
+                                                          filter_pattern,
+                                                          invert_filter_match,
+                                                          filter_refresh_interval,
+                                                          label_refresh_polls,
+                                                          label_change_oid,
+                                                          walk_strategy,
+                                                          use_alternate_community,
+                                                          polling_frequency,
+                                                          to_kafka,
+                                                          to_prometheus,
+                                                          to_influx,
+                                                          to_nats)
+                                                  VALUES (COALESCE(NULLIF(:id, 0), nextval('measures_id_seq')),
+                                                          :name,
+                                                          :description,
+                                                          :is_indexed,
+                                                          :index_metric_id,
+                                                          :filter_metric_id,
+                                                          :filter_pattern,
+                                                          :invert_filter_match,
+                                                          :filter_refresh_interval,
+                                                          :label_refresh_polls,
+                                                          :label_change_oid,
+                                                          :walk_strategy,
+                                                          :use_alternate_community,
+                                                          :polling_frequency,
+                                                          :to_kafka,
+                                                          :to_prometheus,
+                                                          :to_influx,
+                                                          :to_nats)
+                                               RETURNING id`, meas)
+		if err == nil {
+			err = scanID(rows, &meas.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("measure insert: %v", err)
+		}
+		if err := syncLinks(tx, "measure_metrics", "measure_id", "metric_id", meas.ID, meas.MetricIDs); err != nil {
+			return err
+		}
+		return checkMeasure(tx, meas.ID)
+	})
+	if err != nil {
+		log.Warningf("HandleMeasureCreate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, meas)
+}
+
+// HandleMeasureUpdate implements the measure CRUD update handler. The metric list
+// is replaced if `metric_ids` is not null. The update is rolled back if the measure
+// is not valid anymore.
+func HandleMeasureUpdate(w http.ResponseWriter, r *http.Request) {
+	var meas model.MeasureDef
+	if !readBody(w, r, "HandleMeasureUpdate", &meas) {
+		return
+	}
+	err := inTx(func(tx *sqlx.Tx) error {
+		res, err := tx.NamedExec(`UPDATE measures
+                                     SET name = :name,
+                                         description = :description,
+                                         is_indexed = :is_indexed,
+                                         index_metric_id = :index_metric_id,
+                                         filter_metric_id = :filter_metric_id,
+                                         filter_pattern = :filter_pattern,
+                                         invert_filter_match = :invert_filter_match,
+                                         filter_refresh_interval = :filter_refresh_interval,
+                                         label_refresh_polls = :label_refresh_polls,
+                                         label_change_oid = :label_change_oid,
+                                         walk_strategy = :walk_strategy,
+                                         use_alternate_community = :use_alternate_community,
+                                         polling_frequency = :polling_frequency,
+                                         to_kafka = :to_kafka,
+                                         to_prometheus = :to_prometheus,
+                                         to_influx = :to_influx,
+                                         to_nats = :to_nats
+                                   WHERE id = :id`, meas)
+		if err != nil {
+			return fmt.Errorf("measure update: %v", err)
+		}
+		if count, _ := res.RowsAffected(); count == 0 {
+			return sql.ErrNoRows
+		}
+		if err := syncLinks(tx, "measure_metrics", "measure_id", "metric_id", meas.ID, meas.MetricIDs); err != nil {
+			return err
+		}
+		return checkMeasure(tx, meas.ID)
+	})
+	if err == sql.ErrNoRows {
+		jsonError(w, http.StatusNotFound, errors.New("Measure not found"))
+		return
+	}
+	if err != nil {
+		log.Warningf("HandleMeasureUpdate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, meas)
+}
+
+// HandleMeasureDelete implements the measure CRUD delete handler. The id of the
+// measure to delete must be given in `id` param to the POST request.
+func HandleMeasureDelete(w http.ResponseWriter, r *http.Request) {
+	deleteRow(w, r, "measures", "Measure")
+}
+
+// HandleMeasureLink adds the metric with the `metric_id` parameter to the measure
+// with the `measure_id` parameter. The measure is checked in the same transaction.
+func HandleMeasureLink(w http.ResponseWriter, r *http.Request) {
+	handleLink(w, r, "measure_metrics", "measure_id", "metric_id", true, checkMeasure)
+}
+
+// HandleMeasureUnlink removes the metric with the `metric_id` parameter from the
+// measure with the `measure_id` parameter. The removal is rolled back if the measure
+// is not valid anymore, for example if the metric is its index.
+func HandleMeasureUnlink(w http.ResponseWriter, r *http.Request) {
+	handleLink(w, r, "measure_metrics", "measure_id", "metric_id", false, checkMeasure)
+}
+
+// HandleMetricList implements the metric CRUD list handler. Returns the metric
+// with the `id` parameter if given, all metrics ordered by id otherwise.
+func HandleMetricList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	var metrics []model.MetricDef
+	if !listRows(w, r, "Metric", &metrics, selectMetrics) {
+		return
+	}
+	if r.FormValue("id") != "" {
+		writeJSON(w, metrics[0])
+		return
+	}
+	writeJSON(w, metrics)
+}
+
+// HandleMetricCreate implements the metric CRUD create handler. The metric is
+// checked like a request metric. Returns the created metric.
+func HandleMetricCreate(w http.ResponseWriter, r *http.Request) {
+	var metric model.MetricDef
+	if !readBody(w, r, "HandleMetricCreate", &metric) {
+		return
+	}
+	rows, err := db.NamedQuery(`INSERT INTO metrics (id,
+                                                     name,
+                                                     oid,
+                                                     description,
+                                                     active,
+                                                     export_as_label,
+                                                     exported_name,
+                                                     index_pattern,
+                                                     post_processors)
+                                             VALUES (COALESCE(NULLIF(:id, 0), nextval('metrics_id_seq')),
+                                                     :name,
+                                                     :oid,
+                                                     :description,
+                                                     :active,
+                                                     :export_as_label,
+                                                     NULLIF(:exported_name, ''),
+                                                     :index_pattern,
+                                                     :post_processors)
+                                          RETURNING id`, metric)
+	if err == nil {
+		err = scanID(rows, &metric.ID)
+	}
+	if err != nil {
+		log.Warningf("HandleMetricCreate: metric insert: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, metric)
+}
+
+// HandleMetricUpdate implements the metric CRUD update handler. The update is
+// rolled back if a measure of the metric is not valid anymore.
+func HandleMetricUpdate(w http.ResponseWriter, r *http.Request) {
+	var metric model.MetricDef
+	if !readBody(w, r, "HandleMetricUpdate", &metric) {
+		return
+	}
+	err := inTx(func(tx *sqlx.Tx) error {
+		res, err := tx.NamedExec(`UPDATE metrics
+                                     SET name = :name,
+                                         oid = :oid,
+                                         description = :description,
+                                         active = :active,
+                                         export_as_label = :export_as_label,
+                                         exported_name = NULLIF(:exported_name, ''),
+                                         index_pattern = :index_pattern,
+                                         post_processors = :post_processors
+                                   WHERE id = :id`, metric)
+		if err != nil {
+			return fmt.Errorf("metric update: %v", err)
+		}
+		if count, _ := res.RowsAffected(); count == 0 {
+			return sql.ErrNoRows
+		}
+		var measureIDs []int
+		if err := tx.Select(&measureIDs, `SELECT measure_id FROM measure_metrics WHERE metric_id = $1`, metric.ID); err != nil {
+			return fmt.Errorf("select metric measures: %v", err)
+		}
+		for _, id := range measureIDs {
+			if err := checkMeasure(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		jsonError(w, http.StatusNotFound, errors.New("Metric not found"))
+		return
+	}
+	if err != nil {
+		log.Warningf("HandleMetricUpdate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	writeJSON(w, metric)
+}
+
+// HandleMetricDelete implements the metric CRUD delete handler. The id of the
+// metric to delete must be given in `id` param to the POST request.
+func HandleMetricDelete(w http.ResponseWriter, r *http.Request) {
+	deleteRow(w, r, "metrics", "Metric")
+}
+
+// HandleCredentialList implements the credential set CRUD list handler. Returns
+// the set with the `id` parameter if given, all sets ordered by id otherwise.
+// The communities and passwords are masked, unless asked otherwise with the
+// `unmask=true` parameter.
+func HandleCredentialList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	unmask, ok := unmaskParam(w, r)
+	if !ok {
+		return
+	}
+	var creds []model.CredentialDef
+	if !listRows(w, r, "Credential set", &creds, selectCredentials) {
+		return
+	}
+	for i := range creds {
+		c := &creds[i]
+		if !unmask {
+			c.MaskSecrets()
+			continue
+		}
+		if err := openSecrets(&c.Community, &c.AlternateCommunity, &c.AuthPasswd, &c.PrivPasswd); err != nil {
+			log.Warningf("HandleCredentialList: credential set #%d: %v", c.ID, err)
+			jsonError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if r.FormValue("id") != "" {
+		writeJSON(w, creds[0])
+		return
+	}
+	writeJSON(w, creds)
+}
+
+// HandleCredentialCreate implements the credential set CRUD create handler. The
+// id is generated if not given. Returns the created set with masked secrets.
+func HandleCredentialCreate(w http.ResponseWriter, r *http.Request) {
+	var cred model.CredentialDef
+	if !readBody(w, r, "HandleCredentialCreate", &cred) {
+		return
+	}
+	err := storeSecrets("credentials", cred.ID, &cred.Community, &cred.AlternateCommunity, &cred.AuthPasswd, &cred.PrivPasswd)
+	if err == nil {
+		var rows *sqlx.Rows
+		rows, err = db.NamedQuery(`INSERT INTO credentials (id,
+                                                            name,
+                                                            snmp_community,
+                                                            snmp_alternate_community,
+                                                            snmpv3_auth_user,
+                                                            snmpv3_auth_passwd,
+                                                            snmpv3_privacy_passwd)
+                                        VALUES (COALESCE(NULLIF(:id, 0), nextval('credentials_id_seq')),
+                                                :name,
+                                                :snmp_community,
+                                                :snmp_alternate_community,
+                                                :snmpv3_auth_user,
+                                                :snmpv3_auth_passwd,
+                                                :snmpv3_privacy_passwd)
+                                     RETURNING id`, cred)
+		if err == nil {
+			err = scanID(rows, &cred.ID)
+		}
+	}
+	if err != nil {
+		log.Warningf("HandleCredentialCreate: credential insert: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	cred.MaskSecrets()
+	writeJSON(w, cred)
+}
+
+// HandleCredentialUpdate implements the credential set CRUD update handler. All
+// the devices of the set use the new credentials from their next poll. Masked
+// secrets are left unchanged.
+func HandleCredentialUpdate(w http.ResponseWriter, r *http.Request) {
+	var cred model.CredentialDef
+	if !readBody(w, r, "HandleCredentialUpdate", &cred) {
+		return
+	}
+	if err := storeSecrets("credentials", cred.ID, &cred.Community, &cred.AlternateCommunity, &cred.AuthPasswd, &cred.PrivPasswd); err != nil {
+		log.Warningf("HandleCredentialUpdate: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	res, err := db.NamedExec(`UPDATE credentials
+                                 SET name = :name,
+                                     snmp_community = :snmp_community,
+                                     snmp_alternate_community = :snmp_alternate_community,
+                                     snmpv3_auth_user = :snmpv3_auth_user,
+                                     snmpv3_auth_passwd = :snmpv3_auth_passwd,
+                                     snmpv3_privacy_passwd = :snmpv3_privacy_passwd
+                               WHERE id = :id`, cred)
+	if err != nil {
+		log.Warningf("HandleCredentialUpdate: credential update: %v", err)
+		jsonBadRequest(w, err)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		jsonError(w, http.StatusNotFound, errors.New("Credential set not found"))
+		return
+	}
+	cred.MaskSecrets()
+	writeJSON(w, cred)
+}
+
+// HandleCredentialDelete implements the credential set CRUD delete handler. The id
+// of the set to delete must be given in `id` param to the POST request. A set still
+// used by devices cannot be deleted.
+func HandleCredentialDelete(w http.ResponseWriter, r *http.Request) {
+	deleteRow(w, r, "credentials", "Credential set")
+}
+
+// readBody checks that the request is a POST and unserializes its json body to v.
+// Writes the json error and returns false on failure.
+func readBody(w http.ResponseWriter, r *http.Request, handler string, v interface{}) bool {
+	if r.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use POST"))
+		return false
+	}
+	log.Debugf("%s: new request from %s", handler, r.RemoteAddr)
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warningf("%s: error reading body: %v", handler, err)
+		jsonBadRequest(w, err)
+		return false
+	}
+	defer r.Body.Close()
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Warningf("%s: bad request: %v", handler, err)
+		jsonBadRequest(w, err)
+		return false
+	}
+	return true
+}
+
+// unmaskParam returns the `unmask` parameter of a list request, asking for the
+// communities and passwords in clear. As it is only allowed on signed requests,
+// it is rejected with a 403 status when request signing is disabled. Writes the
+// json error and returns false on failure.
+func unmaskParam(w http.ResponseWriter, r *http.Request) (unmask bool, ok bool) {
+	param := r.FormValue("unmask")
+	if param == "" {
+		return false, true
+	}
+	unmask, err := strconv.ParseBool(param)
+	if err != nil {
+		jsonBadRequest(w, errors.New("`unmask` parameter invalid"))
+		return false, false
+	}
+	if unmask && len(auth.Secret) == 0 {
+		jsonError(w, http.StatusForbidden, errors.New("`unmask` requires signed requests"))
+		return false, false
+	}
+	return unmask, true
+}
+
+// listRows selects the rows of the query into dest, restricted to the `id` request
+// parameter if given. Writes the json error and returns false on failure or if
+// the requested row is not found.
+func listRows(w http.ResponseWriter, r *http.Request, what string, dest interface{}, query string) bool {
+	var err error
+	if id := r.FormValue("id"); id != "" {
+		if _, err := strconv.Atoi(id); err != nil {
+			jsonBadRequest(w, errors.New("`id` parameter invalid"))
+			return false
+		}
+		err = db.Select(dest, query+` WHERE id = $1`, id)
+	} else {
+		err = db.Select(dest, query+` ORDER BY id`)
+	}
+	if err != nil {
+		log.Warningf("list %s: %v", what, err)
+		jsonError(w, http.StatusInternalServerError, err)
+		return false
+	}
+	if r.FormValue("id") != "" && reflect.ValueOf(dest).Elem().Len() == 0 {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("%s not found", what))
+		return false
+	}
+	return true
+}
+
+// deleteRow deletes the row of table with the `id` parameter of the POST request.
+func deleteRow(w http.ResponseWriter, r *http.Request, table, what string) {
+	if r.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use POST"))
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		jsonBadRequest(w, errors.New("`id` parameter missing or invalid"))
+		return
+	}
+	log.Infof("deleting %s #%d", what, id)
+	res, err := db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, table), id)
+	if err != nil {
+		log.Warningf("delete %s #%d: %v", what, id, err)
+		jsonBadRequest(w, err)
+		return
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		jsonError(w, http.StatusNotFound, fmt.Errorf("%s not found", what))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleLink adds (or removes if add is false) the relation between the parent
+// and child ids given by their column name parameters in the POST request. The
+// parent is checked with check, if not nil, in the same transaction.
+func handleLink(w http.ResponseWriter, r *http.Request, table, parentCol, childCol string, add bool, check func(sqlx.Queryer, int) error) {
+	if r.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use POST"))
+		return
+	}
+	parentID, err := strconv.Atoi(r.FormValue(parentCol))
+	if err != nil {
+		jsonBadRequest(w, fmt.Errorf("`%s` parameter missing or invalid", parentCol))
+		return
+	}
+	childID, err := strconv.Atoi(r.FormValue(childCol))
+	if err != nil {
+		jsonBadRequest(w, fmt.Errorf("`%s` parameter missing or invalid", childCol))
+		return
+	}
+	err = inTx(func(tx *sqlx.Tx) error {
+		var query string
+		if add {
+			query = fmt.Sprintf(`INSERT INTO %s (%s, %s) VALUES ($1, $2) ON CONFLICT DO NOTHING`, table, parentCol, childCol)
+		} else {
+			query = fmt.Sprintf(`DELETE FROM %s WHERE %s = $1 AND %s = $2`, table, parentCol, childCol)
+		}
+		res, err := tx.Exec(query, parentID, childID)
+		if err != nil {
+			return err
+		}
+		if count, _ := res.RowsAffected(); count == 0 && !add {
+			return sql.ErrNoRows
+		}
+		if check != nil {
+			return check(tx, parentID)
+		}
+		return nil
+	})
+	if err == sql.ErrNoRows {
+		jsonError(w, http.StatusNotFound, errors.New("Link not found"))
+		return
+	}
+	if err != nil {
+		log.Warningf("%s: link #%d/#%d (add=%v): %v", table, parentID, childID, add, err)
+		jsonBadRequest(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// syncLinks replaces the children of parentID in the relation table by childIDs.
+// Does nothing if childIDs is nil.
+func syncLinks(tx *sqlx.Tx, table, parentCol, childCol string, parentID int, childIDs []int) error {
+	if childIDs == nil {
+		return nil
+	}
+	ids := make(pq.Int64Array, len(childIDs))
+	for i, id := range childIDs {
+		ids[i] = int64(id)
+	}
+	_, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = $1 AND NOT (%s = ANY($2))`, table, parentCol, childCol), parentID, ids)
+	if err != nil {
+		return fmt.Errorf("delete %s: %v", table, err)
+	}
+	for _, id := range childIDs {
+		_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (%s, %s) VALUES ($1, $2) ON CONFLICT DO NOTHING`, table, parentCol, childCol), parentID, id)
+		if err != nil {
+			return fmt.Errorf("insert %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// syncPollingFrequencies replaces the measure polling frequency overrides of the
+// profile by freqs, whose measures must be in the profile. Does nothing if freqs
+// is nil.
+func syncPollingFrequencies(tx *sqlx.Tx, profileID int, freqs map[int]int) error {
+	if freqs == nil {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE profile_measures SET polling_frequency = NULL WHERE profile_id = $1`, profileID); err != nil {
+		return fmt.Errorf("reset polling frequencies: %v", err)
+	}
+	for measureID, freq := range freqs {
+		res, err := tx.Exec(`UPDATE profile_measures
+                                SET polling_frequency = $3
+                              WHERE profile_id = $1
+                                AND measure_id = $2`, profileID, measureID, freq)
+		if err != nil {
+			return fmt.Errorf("update polling frequency: %v", err)
+		}
+		if count, _ := res.RowsAffected(); count == 0 {
+			return fmt.Errorf("polling frequency: measure #%d is not in profile", measureID)
+		}
+	}
+	return nil
+}
+
+// checkMeasure loads the measure with the given id, its metrics and active derived
+// metrics, and checks them like a request measure.
+func checkMeasure(q sqlx.Queryer, id int) error {
+	var meas model.MeasureDef
+	if err := sqlx.Get(q, &meas, selectMeasures+` WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("select measure #%d: %v", id, err)
+	}
+	var defs []model.MetricDef
+	err := sqlx.Select(q, &defs, selectMetrics+` WHERE id IN (SELECT metric_id
+                                                                FROM measure_metrics
+                                                               WHERE measure_id = $1)
+                                               ORDER BY id`, id)
+	if err != nil {
+		return fmt.Errorf("select measure #%d metrics: %v", id, err)
+	}
+	var metrics []model.Metric
+	for _, def := range defs {
+		metric, err := def.Metric()
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, metric)
+	}
+	var derived []model.DerivedMetric
+	err = sqlx.Select(q, &derived, `SELECT description,
+                                           COALESCE(exported_name, name) AS exported_name,
+                                           expression,
+                                           id,
+                                           name
+                                      FROM derived_metrics
+                                     WHERE active = TRUE
+                                       AND measure_id = $1
+                                  ORDER BY id`, id)
+	if err != nil {
+		return fmt.Errorf("select measure #%d derived metrics: %v", id, err)
+	}
+	return meas.Check(metrics, derived)
+}
+
+// inTx runs fn in a transaction, committed if fn returns no error.
+func inTx(fn func(*sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("begin tx: %v", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanID scans the id returned by an insert query and closes the rows.
+func scanID(rows *sqlx.Rows, id *int) error {
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	return rows.Scan(id)
+}
+
+// writeJSON writes the indented json of v to w.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	buf, _ := json.MarshalIndent(v, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,70 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCrudBadRequests checks the requests rejected before any db access.
+func TestCrudBadRequests(t *testing.T) {
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+	}{
+		{HandleAgentList, "POST", AgentListURI, "", http.StatusMethodNotAllowed},
+		{HandleAgentCreate, "GET", AgentCreateURI, "", http.StatusMethodNotAllowed},
+		{HandleAgentCreate, "POST", AgentCreateURI, `{"ip_address": "10.0.0.1"}`, http.StatusBadRequest},
+		{HandleAgentUpdate, "POST", AgentUpdateURI, `{`, http.StatusBadRequest},
+		{HandleAgentDelete, "POST", AgentDeleteURI + "?id=x", "", http.StatusBadRequest},
+		{HandleProfileList, "GET", ProfileListURI + "?id=x", "", http.StatusBadRequest},
+		{HandleProfileCreate, "POST", ProfileCreateURI, `{"category": "switch"}`, http.StatusBadRequest},
+		{HandleProfileLink, "POST", ProfileLinkURI + "?profile_id=1", "", http.StatusBadRequest},
+		{HandleProfileUnlink, "GET", ProfileUnlinkURI + "?profile_id=1&measure_id=2", "", http.StatusMethodNotAllowed},
+		{HandleMeasureCreate, "POST", MeasureCreateURI, `{"description": "no name"}`, http.StatusBadRequest},
+		{HandleMeasureUpdate, "PUT", MeasureUpdateURI, "", http.StatusMethodNotAllowed},
+		{HandleMeasureLink, "POST", MeasureLinkURI + "?measure_id=1&metric_id=", "", http.StatusBadRequest},
+		{HandleMetricCreate, "POST", MetricCreateURI, `{"name": "ifDescr", "oid": "1..2"}`, http.StatusBadRequest},
+		{HandleMetricUpdate, "POST", MetricUpdateURI, `{"name": "ifDescr", "oid": ".1.2.3", "post_processors": ["rate", "delta"]}`, http.StatusBadRequest},
+		{HandleMetricDelete, "GET", MetricDeleteURI + "?id=1", "", http.StatusMethodNotAllowed},
+		{HandleCredentialList, "GET", CredentialListURI + "?id=x", "", http.StatusBadRequest},
+		{HandleCredentialList, "GET", CredentialListURI + "?unmask=yes", "", http.StatusBadRequest},
+		{HandleCredentialList, "GET", CredentialListURI + "?unmask=true", "", http.StatusForbidden},
+		{HandleDeviceList, "GET", DeviceListURI + "?unmask=true", "", http.StatusForbidden},
+		{HandleCredentialCreate, "POST", CredentialCreateURI, `{"name": "core"}`, http.StatusBadRequest},
+		{HandleCredentialUpdate, "POST", CredentialUpdateURI, `{"snmp_community": "public"}`, http.StatusBadRequest},
+		{HandleCredentialDelete, "GET", CredentialDeleteURI + "?id=1", "", http.StatusMethodNotAllowed},
+	}
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("Crud#%d %s %s: expected status %d, got %d", i, tt.method, tt.target, tt.status, w.Code)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("Crud#%d %s %s: invalid json error body `%s`", i, tt.method, tt.target, w.Body)
+		}
+	}
+}
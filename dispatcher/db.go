@@ -27,7 +27,7 @@ import (
 var (
 	db                       *sqlx.DB
 	appLockConn              *sql.Conn
-	lockDevStmt              *sql.Stmt
+	lockIdleDevStmt          *sql.Stmt
 	unlockDevStmt            *sql.Stmt
 	unlockAllDevStmt         *sql.Stmt
 	unlockDevFromReportStmt  *sql.Stmt
@@ -35,9 +35,12 @@ var (
 	unlockFromAgentStmt      *sql.Stmt
 	setDevLastPolledAt       *sql.Stmt
 	setDevLastPingedAt       *sql.Stmt
-	insertMetricLastPolledAt *sql.Stmt
+	setMeasuresLastPolledAt  *sql.Stmt
+	setDevsPollTimesStmt     *sql.Stmt
+	setMeasuresPollTimesStmt *sql.Stmt
 	insertReportStmt         *sql.Stmt
 	updReportStmt            *sql.Stmt
+	updMaxRepetitionsStmt    *sql.Stmt
 	checkAgentStmt           *sql.Stmt
 )
 
@@ -82,11 +85,13 @@ func AcquireLock(ctx context.Context, lockID int) error {
 func PrepareQueries() error {
 	var err error
 
-	lockDevStmt, err = db.Prepare(`UPDATE devices
-                                      SET is_polling = true
-                                    WHERE id = $1`)
+	lockIdleDevStmt, err = db.Prepare(`UPDATE devices
+                                          SET is_polling = true
+                                        WHERE id = $1
+                                          AND active = true
+                                          AND is_polling = false`)
 	if err != nil {
-		return fmt.Errorf("prepare lockDevStmt: %v", err)
+		return fmt.Errorf("prepare lockIdleDevStmt: %v", err)
 	}
 	unlockDevStmt, err = db.Prepare(`UPDATE devices
                                         SET is_polling = false
@@ -126,7 +131,7 @@ func PrepareQueries() error {
 		return fmt.Errorf("prepare unlockFromOngoingStmt: %v", err)
 	}
 	setDevLastPolledAt, err = db.Prepare(`UPDATE devices
-                                             SET last_polled_at = NOW()
+                                             SET last_polled_at = $2
                                            WHERE id = $1`)
 	if err != nil {
 		return fmt.Errorf("prepare setLastPollDate: %v", err)
@@ -137,14 +142,33 @@ func PrepareQueries() error {
 	if err != nil {
 		return fmt.Errorf("prepare setLastPingDate: %v", err)
 	}
-	insertMetricLastPolledAt, err = db.Prepare(`INSERT INTO metric_poll_times
-                                                            (device_id, metric_id, last_polled_at)
-                                                     VALUES ($1, $2, NOW())
-                                                ON CONFLICT (device_id, metric_id)
+	setMeasuresLastPolledAt, err = db.Prepare(`INSERT INTO measure_poll_times
+                                                           (device_id, measure_id, last_polled_at)
+                                                    SELECT $1, UNNEST($2::INTEGER[]), $3
+                                               ON CONFLICT (device_id, measure_id)
+                                                 DO UPDATE
+                                                       SET last_polled_at = EXCLUDED.last_polled_at`)
+	if err != nil {
+		return fmt.Errorf("prepare setMeasuresLastPolledAt: %v", err)
+	}
+	setDevsPollTimesStmt, err = db.Prepare(`UPDATE devices d
+                                               SET last_polled_at = GREATEST(d.last_polled_at, to_timestamp(t.polled_at))
+                                              FROM UNNEST($1::INTEGER[], $2::FLOAT8[]) AS t(id, polled_at)
+                                             WHERE d.id = t.id`)
+	if err != nil {
+		return fmt.Errorf("prepare setDevsPollTimesStmt: %v", err)
+	}
+	setMeasuresPollTimesStmt, err = db.Prepare(`INSERT INTO measure_poll_times
+                                                            (device_id, measure_id, last_polled_at)
+                                                     SELECT t.device_id, t.measure_id, to_timestamp(t.polled_at)
+                                                       FROM UNNEST($1::INTEGER[], $2::INTEGER[], $3::FLOAT8[]) AS t(device_id, measure_id, polled_at)
+                                                       JOIN devices d ON d.id = t.device_id
+                                                       JOIN measures m ON m.id = t.measure_id
+                                                ON CONFLICT (device_id, measure_id)
                                                   DO UPDATE
-                                                        SET last_polled_at = NOW()`)
+                                                        SET last_polled_at = GREATEST(measure_poll_times.last_polled_at, EXCLUDED.last_polled_at)`)
 	if err != nil {
-		return fmt.Errorf("prepare insertMetricLastPolledAt: %v", err)
+		return fmt.Errorf("prepare setMeasuresPollTimesStmt: %v", err)
 	}
 	insertReportStmt, err = db.Prepare(`INSERT INTO reports
                                                     (uuid, device_id, agent_id, post_status, requested_at)
@@ -160,6 +184,15 @@ func PrepareQueries() error {
 	if err != nil {
 		return fmt.Errorf("prepare updReportStmt: %v", err)
 	}
+	updMaxRepetitionsStmt, err = db.Prepare(`UPDATE devices
+                                                SET snmp_max_repetitions = $2
+                                              WHERE id = (SELECT device_id
+                                                            FROM reports
+                                                           WHERE uuid = $1)
+                                                AND snmp_adaptive_repetitions = true`)
+	if err != nil {
+		return fmt.Errorf("prepare updMaxRepetitionsStmt: %v", err)
+	}
 	checkAgentStmt, err = db.Prepare(`UPDATE agents
                                          SET last_checked_at = NOW(),
                                              is_alive = $2,
@@ -0,0 +1,288 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+var (
+	// QueryTimeout is the maximum duration of an on-demand poll, until the
+	// agent replies with the result.
+	QueryTimeout = 5 * time.Minute
+
+	// QueryResultTTL is how long the result of an asynchronous on-demand poll
+	// is kept once the poll is done.
+	QueryResultTTL = 10 * time.Minute
+
+	// ErrPollNotFound is returned for an unknown or expired asynchronous on-demand poll.
+	ErrPollNotFound = errors.New("poll not found")
+
+	// queries maps the request uid of the asynchronous on-demand polls to their state.
+	queries   = make(map[string]*query)
+	queriesMu sync.Mutex
+)
+
+// query is the state of an asynchronous on-demand poll.
+type query struct {
+	job model.PollJob
+
+	// result is the json poll result of the agent, nil until the poll is done.
+	result json.RawMessage
+
+	// err is the error of the poll if it failed.
+	err error
+
+	// doneAt is the end time of the poll, zero while ongoing.
+	doneAt time.Time
+}
+
+// PollDevice polls the device right away on an agent and returns the job and the
+// json poll result of the agent. The device is locked and polled as with ForcePoll,
+// but the agent replies with the result instead of the report.
+func PollDevice(ctx context.Context, devID, measureID int) (model.PollJob, json.RawMessage, error) {
+	req, err := lockedRequest(devID, measureID)
+	if err != nil {
+		return model.PollJob{DeviceID: devID}, nil, err
+	}
+	log.Debugf("%s - on-demand poll of device #%d (measure #%d)", req.UID, devID, measureID)
+	return queryRequest(ctx, req, measureID)
+}
+
+// PollDeviceAsync starts the on-demand poll of the device like PollDevice and
+// returns its job right away. Its result is then given by PollDeviceResult.
+func PollDeviceAsync(devID, measureID int) (model.PollJob, error) {
+	job := model.PollJob{DeviceID: devID}
+	req, err := lockedRequest(devID, measureID)
+	if err != nil {
+		return job, err
+	}
+	log.Debugf("%s - async on-demand poll of device #%d (measure #%d)", req.UID, devID, measureID)
+	job.RequestID = req.UID
+	q := &query{job: job}
+	queriesMu.Lock()
+	sweepQueries()
+	queries[job.RequestID] = q
+	queriesMu.Unlock()
+	go func() {
+		job, res, err := queryRequest(context.Background(), req, measureID)
+		queriesMu.Lock()
+		q.job, q.result, q.err, q.doneAt = job, res, err, time.Now()
+		queriesMu.Unlock()
+	}()
+	return job, nil
+}
+
+// PollDeviceResult returns the job of the asynchronous on-demand poll with the
+// given request uid, and its json result once done. Returns ErrPollNotFound if
+// there is no such poll or if its result has expired.
+func PollDeviceResult(uid string) (model.PollJob, json.RawMessage, error) {
+	queriesMu.Lock()
+	defer queriesMu.Unlock()
+	sweepQueries()
+	q, ok := queries[uid]
+	if !ok {
+		return model.PollJob{}, nil, ErrPollNotFound
+	}
+	return q.job, q.result, q.err
+}
+
+// sweepQueries removes the asynchronous on-demand polls whose result has expired.
+// queriesMu must be held.
+func sweepQueries() {
+	for id, q := range queries {
+		if !q.doneAt.IsZero() && time.Since(q.doneAt) > QueryResultTTL {
+			delete(queries, id)
+		}
+	}
+}
+
+// queryRequest sends the locked request to the agents of its device until one of
+// them replies with the poll result, which is returned. A report entry is kept if
+// the poll failed. The device is unlocked at the end of the poll or if no agent
+// accepted the job. If ctx is cancelled or the query times out, the ctx error is
+// returned and the device is left locked, as the agent may still be polling it:
+// it is unlocked by UnlockDevices once the agent is done.
+func queryRequest(ctx context.Context, req model.SnmpRequest, measureID int) (model.PollJob, json.RawMessage, error) {
+	job := model.PollJob{RequestID: req.UID, DeviceID: req.Device.ID}
+	unlock := true
+	defer func() {
+		if unlock {
+			unlockRequest(req)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+	req.ReportURL = ""
+	for i, agent := range AgentsForDevice(req.Device.ID) {
+		log.Debug2f("%s - try #%d: sending query to agent #%d (%s)", req.UID, i, agent.ID, agent.name)
+		code, body, err := sendQuery(ctx, req, *agent)
+		if err != nil {
+			log.Errorf("%s - try #%d: send query: %v", req.UID, i, err)
+			if ctx.Err() != nil {
+				job.AgentID = agent.ID
+				unlock = false
+				return job, nil, ctx.Err()
+			}
+			continue
+		}
+		switch code {
+		case http.StatusOK:
+			job.AgentID = agent.ID
+			var res struct {
+				Duration int64  `json:"poll_duration"`
+				PollErr  string `json:"poll_error"`
+			}
+			if err := json.Unmarshal(body, &res); err != nil {
+				return job, nil, fmt.Errorf("agent #%d: invalid poll result: %v", agent.ID, err)
+			}
+			if res.PollErr != "" {
+				// keep only errors, as for the polling job reports
+				sqlExec(req.UID, "insertReportStmt", insertReportStmt, req.UID, req.Device.ID, agent.ID, http.StatusText(code))
+				sqlExec(req.UID, "updReportStmt", updReportStmt, req.UID, res.Duration, res.PollErr)
+			}
+			updatePollTimes(req, measureID)
+			log.Debug2f("%s - query result received from agent #%d", req.UID, agent.ID)
+			return job, body, nil
+		case http.StatusTooManyRequests:
+			log.Debugf("%s - agent #%d is full", req.UID, agent.ID)
+		case http.StatusLocked:
+			log.Debugf("%s - agent #%d is terminating", req.UID, agent.ID)
+		default:
+			log.Warningf("%s - agent #%d replied `%s`", req.UID, agent.ID, http.StatusText(code))
+		}
+	}
+	log.Warningf("%s - on-demand poll discarded (no worker found)", req.UID)
+	return job, nil, ErrNoAgent
+}
+
+// sendQuery posts the on-demand request to the agent and returns the reply status
+// code and body.
+func sendQuery(ctx context.Context, req model.SnmpRequest, agent Agent) (int, []byte, error) {
+	req.AgentID = agent.ID
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	htReq, err := http.NewRequest("POST", agent.snmpQueryURL, bytes.NewBuffer(buf))
+	if err != nil {
+		return 0, nil, fmt.Errorf("http request: %v", err)
+	}
+	htReq = htReq.WithContext(ctx)
+	htReq.Header.Set("Content-Type", "application/json")
+	resp, err := auth.NewClient(0).Do(htReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// HandleDevicePoll handles the on-demand poll requests of a device, given by its
+// `id` parameter, or of one of its measures with the `measure` parameter. Replies
+// with status 200 and the json poll result of the agent, or with status 202 and
+// the json model.PollJob right away if the `async` parameter is true. Fails as
+// HandleDeviceRepoll.
+func HandleDevicePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use POST"))
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		log.Warningf("HandleDevicePoll: invalid id: %v", err)
+		jsonBadRequest(w, errors.New("`id` parameter missing or invalid"))
+		return
+	}
+	var measureID int
+	if measure := r.FormValue("measure"); measure != "" {
+		if measureID, err = strconv.Atoi(measure); err != nil {
+			jsonBadRequest(w, errors.New("invalid `measure` parameter"))
+			return
+		}
+	}
+	var async bool
+	if a := r.FormValue("async"); a != "" {
+		if async, err = strconv.ParseBool(a); err != nil {
+			jsonBadRequest(w, errors.New("invalid `async` parameter"))
+			return
+		}
+	}
+	log.Infof("HandleDevicePoll: on-demand poll of device #%d (measure #%d) from %s", id, measureID, r.RemoteAddr)
+	if async {
+		job, err := PollDeviceAsync(id, measureID)
+		if err != nil {
+			log.Warningf("HandleDevicePoll: device #%d: %v", id, err)
+			jsonPollError(w, err)
+			return
+		}
+		buf, _ := json.Marshal(job)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s", buf)
+		return
+	}
+	_, res, err := PollDevice(r.Context(), id, measureID)
+	if err != nil {
+		log.Warningf("HandleDevicePoll: device #%d: %v", id, err)
+		jsonPollError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", res)
+}
+
+// HandlePollResult returns the result of the asynchronous on-demand poll with the
+// request uid given by the `id` parameter: a status 202 with its json model.PollJob
+// while ongoing, then a status 200 with the json poll result of the agent, or the
+// poll error.
+func HandlePollResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use GET"))
+		return
+	}
+	uid := r.FormValue("id")
+	if uid == "" {
+		jsonBadRequest(w, errors.New("`id` parameter missing"))
+		return
+	}
+	job, res, err := PollDeviceResult(uid)
+	switch {
+	case err != nil:
+		jsonPollError(w, err)
+	case res == nil:
+		buf, _ := json.Marshal(job)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "%s", buf)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "%s", res)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestPollResult(t *testing.T) {
+	queriesMu.Lock()
+	queries["ongoing@1"] = &query{job: model.PollJob{RequestID: "ongoing@1", DeviceID: 1}}
+	queries["done@2"] = &query{job: model.PollJob{RequestID: "done@2", DeviceID: 2, AgentID: 3}, result: json.RawMessage(`{"request_id":"done@2"}`), doneAt: time.Now()}
+	queries["failed@3"] = &query{job: model.PollJob{RequestID: "failed@3", DeviceID: 3}, err: ErrNoAgent, doneAt: time.Now()}
+	queries["expired@4"] = &query{job: model.PollJob{RequestID: "expired@4", DeviceID: 4}, result: json.RawMessage(`{}`), doneAt: time.Now().Add(-QueryResultTTL - time.Second)}
+	queriesMu.Unlock()
+	defer func() {
+		queriesMu.Lock()
+		queries = make(map[string]*query)
+		queriesMu.Unlock()
+	}()
+
+	tests := []struct {
+		uid    string
+		status int
+		body   string
+	}{
+		{"ongoing@1", http.StatusAccepted, `{"request_id":"ongoing@1","device_id":1,"agent_id":0}`},
+		{"done@2", http.StatusOK, `{"request_id":"done@2"}`},
+		{"failed@3", http.StatusServiceUnavailable, `{"error":"no agent available"}`},
+		{"expired@4", http.StatusNotFound, `{"error":"poll not found"}`},
+		{"unknown@5", http.StatusNotFound, `{"error":"poll not found"}`},
+		{"", http.StatusBadRequest, "{\"error\":\"`id` parameter missing\"}"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		HandlePollResult(w, httptest.NewRequest("GET", PollResultURI+"?id="+tt.uid, nil))
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("poll result %q: expected %d `%s`, got %d `%s`", tt.uid, tt.status, tt.body, w.Code, w.Body.String())
+		}
+	}
+	if _, ok := queries["expired@4"]; ok {
+		t.Errorf("expired poll result not removed")
+	}
+}
+
+// TestQueryRequestCancel checks that a cancelled on-demand poll returns the ctx
+// error and leaves the device locked while the agent may still be polling it.
+func TestQueryRequestCancel(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+	defer func() { currentAgents = make(Agents) }()
+	currentAgents = Agents{"a1": {ID: 1, Alive: true, name: "a1", snmpQueryURL: srv.URL}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := model.SnmpRequest{UID: "cancelled@42", Device: model.Device{ID: 42}}
+	// unlockDevStmt is nil: an unlock would panic
+	job, res, err := queryRequest(ctx, req, 0)
+	if err != context.DeadlineExceeded || res != nil || job.AgentID != 1 {
+		t.Errorf("cancelled query: expected agent #1 and %v, got agent #%d, %s, %v", context.DeadlineExceeded, job.AgentID, res, err)
+	}
+}
+
+func TestHandleDevicePollBadRequests(t *testing.T) {
+	for _, query := range []string{"", "?id=abc", "?id=1&measure=abc", "?id=1&async=maybe"} {
+		w := httptest.NewRecorder()
+		HandleDevicePoll(w, httptest.NewRequest("POST", DevicePollURI+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("poll %q: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+var (
+	// ErrDeviceNotFound is returned when forcing the poll of an unknown or inactive device.
+	ErrDeviceNotFound = errors.New("device not found or inactive")
+
+	// ErrDevicePolling is returned when forcing the poll of a device already being polled.
+	ErrDevicePolling = errors.New("device is already being polled")
+
+	// ErrMeasureNotFound is returned when forcing the poll of a measure absent
+	// from the device profile or without active metric.
+	ErrMeasureNotFound = errors.New("measure not found for device")
+
+	// ErrNoAgent is returned when no agent accepted a forced poll.
+	ErrNoAgent = errors.New("no agent available")
+)
+
+// ForcePoll sends a polling job for the device to an agent right away, outside of
+// the polling schedule. All the metrics of the device are polled, or only those
+// of the given measure if measureID is not 0. The device must not be already
+// polling and is locked until the agent report, as for a scheduled job. The polled
+// measures with a polling frequency are then skipped by the scheduled jobs until
+// due again.
+func ForcePoll(ctx context.Context, devID, measureID int) (model.PollJob, error) {
+	job := model.PollJob{DeviceID: devID}
+	req, err := lockedRequest(devID, measureID)
+	if err != nil {
+		return job, err
+	}
+	log.Debugf("%s - forced poll of device #%d (measure #%d)", req.UID, devID, measureID)
+	job.RequestID = req.UID
+	if job.AgentID = dispatchRequest(ctx, req); job.AgentID == 0 {
+		unlockRequest(req)
+		return job, ErrNoAgent
+	}
+	updatePollTimes(req, measureID)
+	return job, nil
+}
+
+// lockedRequest locks the device if it is not already polling and builds its
+// request with all its metrics, or only those of the given measure if measureID
+// is not 0. The device is locked in db and in the polling schedule, so that it
+// does not collide with a scheduled job, and is unlocked on error.
+func lockedRequest(devID, measureID int) (model.SnmpRequest, error) {
+	res, err := lockIdleDevStmt.Exec(devID)
+	if err != nil {
+		return model.SnmpRequest{}, fmt.Errorf("lock device: %v", err)
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		var polling bool
+		err := db.Get(&polling, `SELECT is_polling FROM devices WHERE id = $1 AND active = true`, devID)
+		if err == sql.ErrNoRows {
+			return model.SnmpRequest{}, ErrDeviceNotFound
+		}
+		if err != nil {
+			return model.SnmpRequest{}, fmt.Errorf("select device: %v", err)
+		}
+		return model.SnmpRequest{}, ErrDevicePolling
+	}
+	req, err := requestFromDB(devID, true)
+	if err != nil {
+		err = fmt.Errorf("request from db: %v", err)
+	} else if measureID != 0 {
+		keepMeasure(&req, measureID)
+		if req.ScalarMeasures == nil && req.IndexedMeasures == nil {
+			err = ErrMeasureNotFound
+		}
+	} else if req.ScalarMeasures == nil && req.IndexedMeasures == nil {
+		err = errors.New("no measure defined for device")
+	}
+	if err != nil {
+		sqlExec("dev#"+strconv.Itoa(devID), "unlockDevStmt", unlockDevStmt, devID)
+		return req, err
+	}
+	if !schedule.lock(devID, req.UID) {
+		sqlExec(req.UID, "unlockDevStmt", unlockDevStmt, devID)
+		return req, ErrDevicePolling
+	}
+	return req, nil
+}
+
+// unlockRequest unlocks the device of a request built by lockedRequest.
+func unlockRequest(req model.SnmpRequest) {
+	sqlExec(req.UID, "unlockDevStmt", unlockDevStmt, req.Device.ID)
+	schedule.unlock(req.UID)
+}
+
+// updatePollTimes updates the last poll time of the measures of a forced request,
+// in db and in the polling schedule, and of its device if all its measures were polled.
+func updatePollTimes(req model.SnmpRequest, measureID int) {
+	now := time.Now()
+	if measureID != 0 {
+		updateMeasuresLastPolledAt(req, now)
+	} else {
+		updateLastPolledAt(req, now)
+	}
+	schedule.setPolled(req, now)
+}
+
+// keepMeasure removes from the request all measures but the one with the given id.
+func keepMeasure(req *model.SnmpRequest, measureID int) {
+	var scalars []model.ScalarMeasure
+	for _, m := range req.ScalarMeasures {
+		if m.ID == measureID {
+			scalars = append(scalars, m)
+		}
+	}
+	var indexed []model.IndexedMeasure
+	for _, m := range req.IndexedMeasures {
+		if m.ID == measureID {
+			indexed = append(indexed, m)
+		}
+	}
+	req.ScalarMeasures, req.IndexedMeasures = scalars, indexed
+}
+
+// HandleDeviceRepoll handles the forced poll requests of a device, given by its `id`
+// parameter, or of one of its measures with the `measure` parameter. Replies with
+// status 202 and the json model.PollJob once an agent accepted the job, 409 if the
+// device is already being polled and 503 if no agent is available.
+func HandleDeviceRepoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("Method Not Allowed, use POST"))
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		log.Warningf("HandleDeviceRepoll: invalid id: %v", err)
+		jsonBadRequest(w, errors.New("`id` parameter missing or invalid"))
+		return
+	}
+	var measureID int
+	if measure := r.FormValue("measure"); measure != "" {
+		if measureID, err = strconv.Atoi(measure); err != nil {
+			jsonBadRequest(w, errors.New("invalid `measure` parameter"))
+			return
+		}
+	}
+	log.Infof("HandleDeviceRepoll: forced poll of device #%d (measure #%d) from %s", id, measureID, r.RemoteAddr)
+	job, err := ForcePoll(r.Context(), id, measureID)
+	if err != nil {
+		log.Warningf("HandleDeviceRepoll: device #%d: %v", id, err)
+		jsonPollError(w, err)
+		return
+	}
+	buf, _ := json.Marshal(job)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// jsonPollError returns the error of a forced poll with its http status.
+func jsonPollError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrDeviceNotFound, ErrMeasureNotFound, ErrPollNotFound:
+		jsonError(w, http.StatusNotFound, err)
+	case ErrDevicePolling:
+		jsonError(w, http.StatusConflict, err)
+	case ErrNoAgent:
+		jsonError(w, http.StatusServiceUnavailable, err)
+	case context.DeadlineExceeded:
+		jsonError(w, http.StatusGatewayTimeout, err)
+	default:
+		jsonBadRequest(w, err)
+	}
+}
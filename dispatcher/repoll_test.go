@@ -0,0 +1,76 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestKeepMeasure(t *testing.T) {
+	newReq := func() model.SnmpRequest {
+		var req model.SnmpRequest
+		for _, id := range []int{1, 2} {
+			var m model.ScalarMeasure
+			m.ID = id
+			req.ScalarMeasures = append(req.ScalarMeasures, m)
+		}
+		for _, id := range []int{3, 4} {
+			var m model.IndexedMeasure
+			m.ID = id
+			req.IndexedMeasures = append(req.IndexedMeasures, m)
+		}
+		return req
+	}
+	tests := []struct {
+		measureID       int
+		scalar, indexed int
+	}{
+		{2, 1, 0},
+		{3, 0, 1},
+		{5, 0, 0},
+	}
+	for _, tt := range tests {
+		req := newReq()
+		keepMeasure(&req, tt.measureID)
+		if len(req.ScalarMeasures) != tt.scalar || len(req.IndexedMeasures) != tt.indexed {
+			t.Errorf("keepMeasure(%d): expected %d scalar and %d indexed measures, got %+v", tt.measureID, tt.scalar, tt.indexed, req)
+			continue
+		}
+		for _, m := range req.ScalarMeasures {
+			if m.ID != tt.measureID {
+				t.Errorf("keepMeasure(%d): got scalar measure #%d", tt.measureID, m.ID)
+			}
+		}
+		for _, m := range req.IndexedMeasures {
+			if m.ID != tt.measureID {
+				t.Errorf("keepMeasure(%d): got indexed measure #%d", tt.measureID, m.ID)
+			}
+		}
+	}
+}
+
+func TestHandleDeviceRepollBadRequests(t *testing.T) {
+	for _, query := range []string{"", "?id=abc", "?id=1&measure=abc"} {
+		w := httptest.NewRecorder()
+		HandleDeviceRepoll(w, httptest.NewRequest("POST", DeviceRepollURI+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("repoll %q: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
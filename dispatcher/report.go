@@ -24,6 +24,7 @@ import (
 )
 
 // HandleReport saves the polling report to db and unlocks the device.
+// The bulk max-repetitions learned by the agent is saved on the device if reported.
 func HandleReport(w http.ResponseWriter, r *http.Request) {
 	reqUID := r.FormValue("request_id")
 	agentID := r.FormValue("agent_id")
@@ -35,18 +36,25 @@ func HandleReport(w http.ResponseWriter, r *http.Request) {
 	log.Debug2f(">>%s - new report received, poll duration=%s", reqUID, pollDur)
 	if dur, _ := strconv.Atoi(pollDur); dur <= 500 {
 		// sleep some time if the request was executed too quickly to avoid a race
-		// where the request entry is deleted before it is inserted in poll.go:SendPollingJobs()
+		// where the request entry is deleted before it is inserted in poll.go:dispatchRequest()
 		time.Sleep(500 * time.Millisecond)
 	}
 	currLoad := r.FormValue("current_load")
 	metricCount := r.FormValue("metric_count")
 	log.Debugf("report: req_uid=%s agent_id=%s snmp_dur=%s snmp_err=`%s` metric_count=%s curr_load=%s",
 		reqUID, agentID, pollDur, pollErr, metricCount, currLoad)
+	schedule.unlock(reqUID)
 	if err := sqlExec(reqUID, "unlockDevFromReportStmt", unlockDevFromReportStmt, reqUID); err != nil {
 		log.Errorf("%s - unlock dev from request: %v", reqUID, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if maxRep := r.FormValue("max_repetitions"); maxRep != "" {
+		log.Debugf("%s - saving learned max-repetitions %s", reqUID, maxRep)
+		if err := sqlExec(reqUID, "updMaxRepetitionsStmt", updMaxRepetitionsStmt, reqUID, maxRep); err != nil {
+			log.Errorf("%s - update max repetitions: %v", reqUID, err)
+		}
+	}
 	var err error
 	if pollErr == "" {
 		log.Debugf("%s - removing terminated report entry", reqUID)
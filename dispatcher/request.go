@@ -17,7 +17,6 @@ package dispatcher
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -27,8 +26,10 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
+	"github.com/lib/pq"
 	"github.com/teris-io/shortid"
 )
 
@@ -43,96 +44,154 @@ var (
 	// HTTPTimeout is the timeout in seconds for posting poll requests
 	HTTPTimeout = 3
 
+	// OIDResolver resolves the symbolic metric oids like `IF-MIB::ifHCInOctets`.
+	// Metrics with a symbolic oid are skipped if nil.
+	OIDResolver model.OIDResolver
+
 	sid = shortid.MustNew(0, "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ$.", 1373)
 )
 
-// RequestFromDB returns the request with the given device id from db.
+// selectSnmpDevices selects the devices with their profile. The snmp community
+// and v3 credentials are taken from the device credential set if any and are
+// still encrypted.
+const selectSnmpDevices = `SELECT active,
+                                  d.credential_id,
+                                  d.id,
+                                  d.profile_id,
+                                  hostname,
+                                  COALESCE(ip_address, '') AS ip_address,
+                                  p.category,
+                                  p.vendor,
+                                  p.model,
+                                  polling_frequency,
+                                  COALESCE(c.snmp_alternate_community, d.snmp_alternate_community) AS snmp_alternate_community,
+                                  COALESCE(c.snmp_community, d.snmp_community) AS snmp_community,
+                                  snmp_connection_count,
+                                  snmp_disable_bulk,
+                                  snmp_max_repetitions,
+                                  snmp_max_oids_per_get,
+                                  snmp_batch_get,
+                                  snmp_adaptive_repetitions,
+                                  snmp_port,
+                                  snmp_retries,
+                                  snmp_timeout,
+                                  snmp_version,
+                                  COALESCE(c.snmpv3_auth_passwd, d.snmpv3_auth_passwd) AS snmpv3_auth_passwd,
+                                  snmpv3_auth_proto,
+                                  COALESCE(c.snmpv3_auth_user, d.snmpv3_auth_user) AS snmpv3_auth_user,
+                                  snmpv3_context_engine_id,
+                                  snmpv3_context_name,
+                                  COALESCE(c.snmpv3_privacy_passwd, d.snmpv3_privacy_passwd) AS snmpv3_privacy_passwd,
+                                  snmpv3_privacy_proto,
+                                  snmpv3_security_level,
+                                  tags
+                             FROM devices d
+                             JOIN profiles p ON p.id = d.profile_id
+                        LEFT JOIN credentials c ON c.id = d.credential_id`
+
+// selectScalarMeasures selects the scalar measures of the profiles, with their
+// polling frequency overridden by the profile one if set.
+const selectScalarMeasures = `SELECT m.description,
+                                     m.id,
+                                     m.name,
+                                     COALESCE(pm.polling_frequency, m.polling_frequency) AS polling_frequency,
+                                     m.use_alternate_community,
+                                     m.to_influx,
+                                     m.to_kafka,
+                                     m.to_prometheus,
+                                     m.to_nats
+                                FROM profile_measures pm
+                                JOIN measures m ON (m.id = pm.measure_id AND m.is_indexed = FALSE)`
+
+// selectIndexedMeasures selects the indexed measures of the profiles like
+// selectScalarMeasures.
+const selectIndexedMeasures = `SELECT m.description,
+                                      m.filter_metric_id,
+                                      m.filter_pattern,
+                                      m.filter_refresh_interval,
+                                      m.id,
+                                      m.index_metric_id,
+                                      m.invert_filter_match,
+                                      m.label_change_oid,
+                                      m.label_refresh_polls,
+                                      m.name,
+                                      COALESCE(pm.polling_frequency, m.polling_frequency) AS polling_frequency,
+                                      m.use_alternate_community,
+                                      m.walk_strategy,
+                                      m.to_influx,
+                                      m.to_kafka,
+                                      m.to_prometheus,
+                                      m.to_nats
+                                 FROM profile_measures pm
+                                 JOIN measures m ON (m.id = pm.measure_id AND m.is_indexed = TRUE)`
+
+// dueDeviceMeasures restricts the measure selection to the measures of the device
+// $1 due for polling, or to all of them if $2 is true.
+const dueDeviceMeasures = `
+                                 JOIN devices d ON d.profile_id = pm.profile_id
+                            LEFT JOIN measure_poll_times t ON (t.device_id = d.id AND t.measure_id = m.id)
+                                WHERE d.id = $1
+                                  AND ($2::BOOLEAN OR t.last_polled_at IS NULL OR EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - t.last_polled_at) >= COALESCE(pm.polling_frequency, m.polling_frequency))
+                             ORDER BY m.id`
+
+// RequestFromDB returns the request with the given device id from db. The device
+// credential set, if any, overrides its communities and snmpv3 user and passwords,
+// which are decrypted here.
 func RequestFromDB(devID int) (model.SnmpRequest, error) {
+	return requestFromDB(devID, false)
+}
+
+// requestFromDB builds the request of the device like RequestFromDB. Only the
+// measures due on the device are selected, those with no polling frequency or not
+// polled since, unless force is set. The polling frequency of a measure can be
+// overridden by the device profile.
+func requestFromDB(devID int, force bool) (model.SnmpRequest, error) {
 	var req model.SnmpRequest
-	err := db.Get(&req.Device, `SELECT active,
-                                       d.id,
-                                       hostname,
-                                       COALESCE(ip_address, '') AS ip_address,
-                                       p.category,
-                                       p.vendor,
-                                       p.model,
-                                       polling_frequency,
-                                       snmp_alternate_community,
-                                       snmp_community,
-                                       snmp_connection_count,
-                                       snmp_disable_bulk,
-                                       snmp_port,
-                                       snmp_retries,
-                                       snmp_timeout,
-                                       snmp_version,
-                                       snmpv3_auth_passwd,
-                                       snmpv3_auth_proto,
-                                       snmpv3_auth_user,
-                                       snmpv3_privacy_passwd,
-                                       snmpv3_privacy_proto,
-                                       snmpv3_security_level,
-                                       tags
-                                  FROM devices d,
-                                       profiles p
-                                 WHERE d.profile_id = p.id
-                                   AND d.id = $1`, devID)
+	err := db.Get(&req.Device, selectSnmpDevices+` WHERE d.id = $1`, devID)
 	if err != nil {
 		return req, fmt.Errorf("request: %v", err)
 	}
-
-	if req.Device.SnmpParams.IPAddress == "" {
-		addrs, err := net.LookupHost(req.Device.Hostname)
-		if err != nil {
-			return req, fmt.Errorf("snmp request: lookup %s: %v", req.Device.Hostname, err)
-		}
-		log.Debug2f("host %s resolved to %s", req.Device.Hostname, addrs[0])
-		req.Device.SnmpParams.IPAddress = addrs[0]
+	s := &req.Device.SnmpParams
+	if err := openSecrets(&s.Community, &s.AlternateCommunity, &s.AuthPasswd, &s.PrivPasswd); err != nil {
+		return req, fmt.Errorf("request: device #%d: %v", devID, err)
+	}
+	if err := resolveAddress(&req.Device); err != nil {
+		return req, err
 	}
 
 	var scalarMeasures []model.ScalarMeasure
-	err = db.Select(&scalarMeasures, `SELECT m.description,
-                                             m.id,
-                                             m.name,
-                                             m.use_alternate_community,
-                                             m.to_influx,
-                                             m.to_kafka,
-                                             m.to_prometheus,
-                                             m.to_nats
-                                        FROM devices d,
-                                             measures m,
-                                             profile_measures pm
-                                       WHERE d.id = $1
-                                         AND d.profile_id = pm.profile_id
-                                         AND m.id = pm.measure_id
-                                         AND m.is_indexed = FALSE
-                                    ORDER BY m.id`, devID)
-	if err != nil {
+	if err := db.Select(&scalarMeasures, selectScalarMeasures+dueDeviceMeasures, devID, force); err != nil {
 		return req, fmt.Errorf("select scalar measures: %v", err)
 	}
 	var indexedMeasures []model.IndexedMeasure
-	err = db.Select(&indexedMeasures, `SELECT m.description,
-                                              m.filter_metric_id,
-                                              m.filter_pattern,
-                                              m.id,
-                                              m.index_metric_id,
-                                              m.invert_filter_match,
-                                              m.name,
-                                              m.use_alternate_community,
-                                              m.to_influx,
-                                              m.to_kafka,
-                                              m.to_prometheus,
-                                              m.to_nats
-                                         FROM devices d,
-                                              measures m,
-                                              profile_measures pm
-                                        WHERE d.id = $1
-                                          AND d.profile_id = pm.profile_id
-                                          AND m.id = pm.measure_id
-                                          AND m.is_indexed = TRUE
-                                     ORDER BY m.id`, devID)
-	if err != nil {
+	if err := db.Select(&indexedMeasures, selectIndexedMeasures+dueDeviceMeasures, devID, force); err != nil {
 		return req, fmt.Errorf("select indexed measures: %v", err)
 	}
+	if err := loadMeasures(&req, scalarMeasures, indexedMeasures); err != nil {
+		return req, err
+	}
+	return req, initRequest(&req)
+}
+
+// resolveAddress sets the ip address of the device from its hostname if empty.
+func resolveAddress(dev *model.Device) error {
+	if dev.SnmpParams.IPAddress != "" {
+		return nil
+	}
+	addrs, err := net.LookupHost(dev.Hostname)
+	if err != nil {
+		return fmt.Errorf("snmp request: lookup %s: %v", dev.Hostname, err)
+	}
+	log.Debug2f("host %s resolved to %s", dev.Hostname, addrs[0])
+	dev.SnmpParams.IPAddress = addrs[0]
+	return nil
+}
+
+// loadMeasures loads from db the metrics, index joins and derived metrics of the
+// measures, and adds to the request the ones with metrics to poll along with
+// their lookup tables.
+func loadMeasures(req *model.SnmpRequest, scalarMeasures []model.ScalarMeasure, indexedMeasures []model.IndexedMeasure) error {
+	var err error
 	for _, scalar := range scalarMeasures {
 		err = db.Select(&scalar.Metrics, `SELECT m.active,
                                                  m.description,
@@ -141,19 +200,19 @@ func RequestFromDB(devID int) (model.SnmpRequest, error) {
                                                  m.id,
                                                  m.name,
                                                  m.oid,
-                                                 m.polling_frequency,
-                                                 m.post_processors,
-                                                 t.last_polled_at
+                                                 m.post_processors
                                             FROM measure_metrics mm,
                                                  metrics m
-                                       LEFT JOIN metric_poll_times t ON (t.metric_id = m.id AND t.device_id = $1)
                                            WHERE m.active = TRUE
                                              AND m.id = mm.metric_id
-                                             AND mm.measure_id = $2
-                                             AND (t.last_polled_at IS NULL OR EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - t.last_polled_at) >= m.polling_frequency)
-                                        ORDER BY m.id`, devID, scalar.ID)
+                                             AND mm.measure_id = $1
+                                        ORDER BY m.id`, scalar.ID)
 		if err != nil {
-			return req, fmt.Errorf("select scalar metrics: %v", err)
+			return fmt.Errorf("select scalar metrics: %v", err)
+		}
+		scalar.Metrics = resolveOids(req, scalar.Name, scalar.Metrics)
+		if scalar.DerivedMetrics, err = derivedMetrics(scalar.ID, scalar.Metrics); err != nil {
+			return err
 		}
 		if len(scalar.Metrics) > 0 {
 			req.ScalarMeasures = append(req.ScalarMeasures, scalar)
@@ -168,19 +227,61 @@ func RequestFromDB(devID int) (model.SnmpRequest, error) {
                                                   m.index_pattern,
                                                   m.name,
                                                   m.oid,
-                                                  m.polling_frequency,
-                                                  m.post_processors,
-                                                  t.last_polled_at
+                                                  m.post_processors
                                              FROM measure_metrics mm,
                                                   metrics m
-                                        LEFT JOIN metric_poll_times t ON (t.metric_id = m.id AND t.device_id = $1)
                                             WHERE m.active = TRUE
                                               AND m.id = mm.metric_id
-                                              AND mm.measure_id = $2
-                                              AND (t.last_polled_at IS NULL OR EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - t.last_polled_at) >= m.polling_frequency)
-                                         ORDER BY m.id`, devID, indexed.ID)
+                                              AND mm.measure_id = $1
+                                         ORDER BY m.id`, indexed.ID)
 		if err != nil {
-			return req, fmt.Errorf("select indexed metrics: %v", err)
+			return fmt.Errorf("select indexed metrics: %v", err)
+		}
+		indexed.Metrics = resolveOids(req, indexed.Name, indexed.Metrics)
+		if indexed.LabelChangeOid.IsSymbolic() {
+			oid, err := indexed.LabelChangeOid.Resolve(OIDResolver)
+			if err != nil {
+				log.Warningf("measure %s: label change oid: %v, ignoring", indexed.Name, err)
+				oid = ""
+			} else {
+				addResolvedOid(req, indexed.LabelChangeOid, oid)
+			}
+			indexed.LabelChangeOid = oid
+		}
+
+		err = db.Select(&indexed.IndexJoins, `SELECT id,
+                                                     key_pattern,
+                                                     mapping_metric_id
+                                                FROM measure_joins
+                                               WHERE measure_id = $1
+                                            ORDER BY id`, indexed.ID)
+		if err != nil {
+			return fmt.Errorf("select index joins: %v", err)
+		}
+		for i, join := range indexed.IndexJoins {
+			err = db.Select(&indexed.IndexJoins[i].Metrics, `SELECT m.active,
+                                                                     m.description,
+                                                                     m.export_as_label,
+                                                                     COALESCE(m.exported_name, m.name) AS exported_name,
+                                                                     m.id,
+                                                                     m.index_pattern,
+                                                                     m.name,
+                                                                     m.oid,
+                                                                     m.post_processors
+                                                                FROM measure_join_metrics jm,
+                                                                     metrics m
+                                                               WHERE m.active = TRUE
+                                                                 AND m.id = jm.metric_id
+                                                                 AND jm.join_id = $1
+                                                            ORDER BY m.id`, join.ID)
+			if err != nil {
+				return fmt.Errorf("select index join metrics: %v", err)
+			}
+			indexed.IndexJoins[i].Metrics = resolveOids(req, indexed.Name, indexed.IndexJoins[i].Metrics)
+		}
+
+		if indexed.DerivedMetrics, err = derivedMetrics(indexed.ID, indexed.Metrics); err != nil {
+			return err
 		}
 
 		var labelCount int
@@ -189,7 +290,7 @@ func RequestFromDB(devID int) (model.SnmpRequest, error) {
 				labelCount++
 			}
 		}
-		indexed.LabelsOnly = (labelCount == len(indexed.Metrics))
+		indexed.LabelsOnly = (labelCount == len(indexed.Metrics) && len(indexed.DerivedMetrics) == 0)
 
 		hasIndex := true
 		if indexed.IndexMetricID.Valid {
@@ -210,73 +311,160 @@ func RequestFromDB(devID int) (model.SnmpRequest, error) {
 			req.IndexedMeasures = append(req.IndexedMeasures, indexed)
 		}
 	}
+	req.LookupTables, err = lookupTables(*req)
+	return err
+}
+
+// initRequest sets the report url of the request and a new uid.
+func initRequest(req *model.SnmpRequest) error {
 	if LocalIP != "" && Port != 0 {
-		req.ReportURL = fmt.Sprintf("http://%s:%d%s", LocalIP, Port, model.ReportURI)
+		req.ReportURL = fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), LocalIP, Port, model.ReportURI)
 	}
 	uid, err := sid.Generate()
 	if err != nil {
-		return req, fmt.Errorf("shortid: %v", err)
+		return fmt.Errorf("shortid: %v", err)
 	}
 	req.UID = fmt.Sprintf("%s@%d", uid, req.Device.ID)
-	return req, nil
+	return nil
 }
 
-// SnmpJobs returns a list of pollable device ids. A device is pollable if there
-// is no ongoing polling job and was last polled past its polling frequency.
-func SnmpJobs() ([]int, error) {
-	var devs []int
-	log.Debug("retrieving available snmp jobs")
-	err := db.Select(&devs, `SELECT id
-                               FROM devices
-                              WHERE active = true
-                                AND polling_frequency > 0
-                                AND is_polling = false
-                                AND (last_polled_at IS NULL OR EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - last_polled_at) >= polling_frequency)
-                           ORDER BY last_polled_at,id`)
-	if err == sql.ErrNoRows {
-		return nil, nil
+// resolveOids resolves the symbolic oids of the metrics with OIDResolver and records
+// the mapping in the request. The metrics whose oid cannot be resolved are skipped.
+func resolveOids(req *model.SnmpRequest, measure string, metrics []model.Metric) []model.Metric {
+	resolved := metrics[:0]
+	for _, m := range metrics {
+		name := m.Oid
+		if err := m.ResolveOid(OIDResolver); err != nil {
+			log.Warningf("measure %s: %v, skipping", measure, err)
+			continue
+		}
+		addResolvedOid(req, name, m.Oid)
+		resolved = append(resolved, m)
 	}
-	if err != nil {
-		return nil, err
+	return resolved
+}
+
+// addResolvedOid adds a symbolic oid and its resolved oid to the request mapping.
+func addResolvedOid(req *model.SnmpRequest, name, oid model.OID) {
+	if name == oid {
+		return
 	}
-	log.Debugf("got %d snmp jobs", len(devs))
-	return devs, nil
+	if req.ResolvedOids == nil {
+		req.ResolvedOids = make(map[string]string)
+	}
+	req.ResolvedOids[string(name)] = string(oid)
 }
 
-// RequestWithLock builds a model.Request from the given
-// device id and locks the device if there is no error.
-func RequestWithLock(id int) (model.SnmpRequest, error) {
-	log.Debug2f("retrieving request for device #%d", id)
-	req, err := RequestFromDB(id)
+// derivedMetrics returns the derived metrics of the measure. The ones whose expression
+// is invalid or references a metric not polled this time are skipped.
+func derivedMetrics(measureID int, metrics []model.Metric) ([]model.DerivedMetric, error) {
+	var derived []model.DerivedMetric
+	err := db.Select(&derived, `SELECT description,
+                                       COALESCE(exported_name, name) AS exported_name,
+                                       expression,
+                                       id,
+                                       name
+                                  FROM derived_metrics
+                                 WHERE active = TRUE
+                                   AND measure_id = $1
+                              ORDER BY id`, measureID)
 	if err != nil {
-		return req, fmt.Errorf("request from db: %v", err)
+		return nil, fmt.Errorf("select derived metrics: %v", err)
+	}
+	var valid []model.DerivedMetric
+	for _, d := range derived {
+		if d.Expr, err = model.ParseExpr(d.Expression); err != nil {
+			log.Warningf("measure #%d: derived metric %s: %v, skipping", measureID, d.Name, err)
+			continue
+		}
+		if err := model.CheckDerived(append(valid, d), metrics); err != nil {
+			log.Debugf("measure #%d: %v, skipping", measureID, err)
+			continue
+		}
+		valid = append(valid, d)
+	}
+	return valid, nil
+}
+
+// lookupTables returns the lookup tables used by the `map` and `bits` post-processors
+// of all the request metrics.
+func lookupTables(req model.SnmpRequest) (map[string]map[string]string, error) {
+	var names []string
+	addNames := func(metrics []model.Metric) {
+		for _, m := range metrics {
+			if name := m.LookupTableName(); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, scalar := range req.ScalarMeasures {
+		addNames(scalar.Metrics)
 	}
-	log.Debug2f("%s - locking device #%d", req.UID, id)
-	_, err = lockDevStmt.Exec(req.Device.ID)
+	for _, indexed := range req.IndexedMeasures {
+		addNames(indexed.Metrics)
+		for _, join := range indexed.IndexJoins {
+			addNames(join.Metrics)
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var entries []struct {
+		Table string `db:"table_name"`
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	err := db.Select(&entries, `SELECT t.name AS table_name,
+                                       e.key,
+                                       e.value
+                                  FROM lookup_tables t,
+                                       lookup_table_entries e
+                                 WHERE e.table_id = t.id
+                                   AND t.name = ANY($1)`, pq.Array(names))
 	if err != nil {
-		return req, fmt.Errorf("lock device: %v", err)
+		return nil, fmt.Errorf("select lookup tables: %v", err)
+	}
+	tables := make(map[string]map[string]string)
+	for _, name := range names {
+		// unknown or empty tables are sent empty
+		tables[name] = make(map[string]string)
+	}
+	for _, e := range entries {
+		tables[e.Table][e.Key] = e.Value
 	}
-	return req, nil
+	return tables, nil
 }
 
-// updateLastPolledAt updates device and measure with last request time. For the measures,
-// a new entry is added to measure_poll_times tables if the measure's polling frequency is non-zero.
-func updateLastPolledAt(req model.SnmpRequest) {
-	sqlExec(req.UID, "setDevLastPolledAt", setDevLastPolledAt, req.Device.ID)
+// updateLastPolledAt updates device and measure with the request poll time t. For
+// the measures, only those having a polling frequency are updated.
+func updateLastPolledAt(req model.SnmpRequest, t time.Time) {
+	sqlExec(req.UID, "setDevLastPolledAt", setDevLastPolledAt, req.Device.ID, t)
+	updateMeasuresLastPolledAt(req, t)
+}
+
+// updateMeasuresLastPolledAt updates in a single statement the poll time t of the
+// request measures having a polling frequency, leaving the device one unchanged.
+func updateMeasuresLastPolledAt(req model.SnmpRequest, t time.Time) {
+	if ids := scheduledMeasureIDs(req); len(ids) > 0 {
+		sqlExec(req.UID, "setMeasuresLastPolledAt", setMeasuresLastPolledAt, req.Device.ID, ids, t)
+	}
+}
+
+// scheduledMeasureIDs returns the ids of the request measures having a polling frequency.
+func scheduledMeasureIDs(req model.SnmpRequest) pq.Int64Array {
+	var ids pq.Int64Array
 	for _, scalar := range req.ScalarMeasures {
-		for _, m := range scalar.Metrics {
-			if m.PollingFrequency > 0 {
-				sqlExec(req.UID, "insertMetricLastPolledAt", insertMetricLastPolledAt, req.Device.ID, m.ID)
-			}
+		if scalar.PollingFrequency > 0 {
+			ids = append(ids, int64(scalar.ID))
 		}
 	}
 	for _, indexed := range req.IndexedMeasures {
-		for _, m := range indexed.Metrics {
-			if m.PollingFrequency > 0 {
-				sqlExec(req.UID, "insertMetricLastPolledAt", insertMetricLastPolledAt, req.Device.ID, m.ID)
-			}
+		if indexed.PollingFrequency > 0 {
+			ids = append(ids, int64(indexed.ID))
 		}
 	}
+	return ids
 }
 
 // SendRequest sends the given request to the given agent. Returns the http status code, the agent's current load
@@ -296,7 +484,7 @@ func SendRequest(ctx context.Context, req model.SnmpRequest, agent Agent) (stCod
 	}
 	htReq = htReq.WithContext(ctx)
 	htReq.Header.Set("Content-Type", "application/json")
-	client := &http.Client{Timeout: time.Duration(HTTPTimeout) * time.Second}
+	client := auth.NewClient(time.Duration(HTTPTimeout) * time.Second)
 	log.Debug2f("%s - posting request to agent #%d (%s:%d)", req.UID, agent.ID, agent.Host, agent.Port)
 	resp, err := client.Do(htReq)
 	if err != nil {
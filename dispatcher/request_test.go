@@ -16,8 +16,12 @@ package dispatcher
 
 import (
 	"os/exec"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/kosctelecom/horus/mib"
+	"github.com/kosctelecom/horus/model"
 )
 
 func TestGetLocalIP(t *testing.T) {
@@ -38,3 +42,42 @@ func TestGetLocalIP(t *testing.T) {
 		t.Errorf("getLocalIP: expected %s, got %s", sysIP, localIP)
 	}
 }
+
+func TestResolveOids(t *testing.T) {
+	metrics := []model.Metric{
+		{ID: 1, Name: "sysUpTime", Oid: "SNMPv2-SMI::mib-2.1.3.0"},
+		{ID: 2, Name: "ifNumber", Oid: ".1.3.6.1.2.1.2.1.0"},
+		{ID: 3, Name: "ifDescr", Oid: "IF-MIB::ifDescr"},
+	}
+	defer func(r model.OIDResolver) { OIDResolver = r }(OIDResolver)
+
+	OIDResolver = nil
+	var req model.SnmpRequest
+	if got := resolveOids(&req, "test", append([]model.Metric(nil), metrics...)); len(got) != 1 || got[0].ID != 2 {
+		t.Errorf("resolveOids without mib: expected only numeric metric, got %+v", got)
+	}
+
+	OIDResolver = mib.New()
+	req = model.SnmpRequest{}
+	got := resolveOids(&req, "test", append([]model.Metric(nil), metrics...))
+	if len(got) != 2 || got[0].Oid != ".1.3.6.1.2.1.1.3.0" || got[1].Oid != ".1.3.6.1.2.1.2.1.0" {
+		t.Errorf("resolveOids: unexpected metrics %+v", got)
+	}
+	expected := map[string]string{"SNMPv2-SMI::mib-2.1.3.0": ".1.3.6.1.2.1.1.3.0"}
+	if !reflect.DeepEqual(req.ResolvedOids, expected) {
+		t.Errorf("resolveOids: expected mapping %v, got %v", expected, req.ResolvedOids)
+	}
+}
+
+func TestScheduledMeasureIDs(t *testing.T) {
+	req := model.SnmpRequest{
+		ScalarMeasures:  []model.ScalarMeasure{{ID: 1}, {ID: 2, PollingFrequency: 3600}},
+		IndexedMeasures: []model.IndexedMeasure{{ID: 3, PollingFrequency: 60}, {ID: 4}},
+	}
+	if ids := scheduledMeasureIDs(req); !reflect.DeepEqual([]int64(ids), []int64{2, 3}) {
+		t.Errorf("scheduledMeasureIDs: expected [2 3], got %v", ids)
+	}
+	if ids := scheduledMeasureIDs(model.SnmpRequest{ScalarMeasures: []model.ScalarMeasure{{ID: 1}}}); ids != nil {
+		t.Errorf("scheduledMeasureIDs: expected no id, got %v", ids)
+	}
+}
@@ -0,0 +1,572 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+	"github.com/lib/pq"
+)
+
+// schedule is the in-memory polling schedule of the devices.
+var schedule = newScheduler()
+
+// scheduler keeps in memory the devices to poll and the measures of their profile,
+// and orders the devices by their next polling slot.
+type scheduler struct {
+	sync.Mutex
+
+	// devices maps the device ids to their schedule entry.
+	devices map[int]*schedDevice
+
+	// profiles maps the profile ids to their request template, with all their
+	// measures and without device.
+	profiles map[int]model.SnmpRequest
+
+	// queue is the min-heap of the devices by next polling slot.
+	queue schedQueue
+
+	// polling maps the request uids of the ongoing polls to their device id.
+	polling map[string]int
+
+	// pendingDevices and pendingMeasures are the poll times of the scheduled jobs
+	// not yet saved in db, by device id and by device and measure ids.
+	pendingDevices  map[int]time.Time
+	pendingMeasures map[pollKey]time.Time
+
+	// wake signals the scheduling loop that the queue has changed.
+	wake chan struct{}
+}
+
+// schedDevice is a device of the polling schedule.
+type schedDevice struct {
+	device    model.Device
+	profileID int
+
+	// next is the time of the next polling slot of the device.
+	next time.Time
+
+	// polledAt maps the ids of the device measures having a polling frequency
+	// to their last poll time.
+	polledAt map[int]time.Time
+
+	// pollingUID is the request uid of the ongoing poll of the device, empty if
+	// the device is idle.
+	pollingUID string
+
+	// pollingSince is the start time of the ongoing poll.
+	pollingSince time.Time
+
+	// index is the position of the device in the queue.
+	index int
+}
+
+// pollKey is the key of a measure poll time of a device.
+type pollKey struct {
+	deviceID  int
+	measureID int
+}
+
+// schedJob is a polling job of the schedule.
+type schedJob struct {
+	req  model.SnmpRequest
+	slot time.Time
+}
+
+// schedQueue implements heap.Interface for the scheduled devices.
+type schedQueue []*schedDevice
+
+func (q schedQueue) Len() int { return len(q) }
+
+func (q schedQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q schedQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+
+func (q *schedQueue) Push(x interface{}) {
+	d := x.(*schedDevice)
+	d.index = len(*q)
+	*q = append(*q, d)
+}
+
+func (q *schedQueue) Pop() interface{} {
+	old := *q
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	d.index = -1
+	return d
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		devices:         make(map[int]*schedDevice),
+		profiles:        make(map[int]model.SnmpRequest),
+		wake:            make(chan struct{}, 1),
+		polling:         make(map[string]int),
+		pendingDevices:  make(map[int]time.Time),
+		pendingMeasures: make(map[pollKey]time.Time),
+	}
+}
+
+// freq returns the polling frequency of the device.
+func (d *schedDevice) freq() time.Duration {
+	return time.Duration(d.device.PollingFrequency) * time.Second
+}
+
+// nextSlot returns the first polling slot of the device after t. The slots are
+// spaced by the polling frequency and shifted by a phase taken from the golden
+// ratio sequence of the device id, which spreads evenly the devices over the
+// polling interval and keeps their slots across dispatcher restarts.
+func nextSlot(devID int, freq time.Duration, t time.Time) time.Time {
+	_, frac := math.Modf(float64(devID) * (math.Sqrt(5) - 1) / 2)
+	slot := t.Truncate(freq).Add(time.Duration(frac * float64(freq)))
+	if !slot.After(t) {
+		slot = slot.Add(freq)
+	}
+	return slot
+}
+
+// LoadSchedule loads from db the active devices with a polling frequency and the
+// measures of their profiles, and updates the polling schedule with them: the new
+// devices are added, the ones removed or deactivated are dropped, and the ones
+// whose polling frequency changed are rescheduled. A profile that fails to load
+// keeps its previous measures, or its devices are skipped if it has none. The
+// poll times of the scheduled jobs are saved to db beforehand. It is called at
+// startup and then periodically to follow the db changes.
+func LoadSchedule() error {
+	if err := flushPollTimes(); err != nil {
+		log.Warningf("schedule: %v", err)
+	}
+	var devices []model.Device
+	err := db.Select(&devices, selectSnmpDevices+` WHERE d.active = true AND d.polling_frequency > 0 ORDER BY d.id`)
+	if err != nil {
+		return fmt.Errorf("select devices: %v", err)
+	}
+
+	profiles := make(map[int]model.SnmpRequest)
+	failed := make(map[int]bool)
+	var devs []*schedDevice
+	var newIDs []int
+	for _, dev := range devices {
+		profileID := dev.Profile.ID
+		if failed[profileID] {
+			continue
+		}
+		if _, ok := profiles[profileID]; !ok {
+			req, err := profileRequest(profileID)
+			if err != nil {
+				var ok bool
+				if req, ok = schedule.profile(profileID); !ok {
+					log.Warningf("schedule: profile #%d: %v, skipping its devices", profileID, err)
+					failed[profileID] = true
+					continue
+				}
+				log.Warningf("schedule: profile #%d: %v, keeping its previous measures", profileID, err)
+			}
+			profiles[profileID] = req
+		}
+		devs = append(devs, &schedDevice{device: dev, profileID: profileID})
+		if !schedule.has(dev.ID) {
+			newIDs = append(newIDs, dev.ID)
+		}
+	}
+
+	polledAt, err := measurePollTimes(newIDs)
+	if err != nil {
+		return err
+	}
+	for _, d := range devs {
+		d.polledAt = polledAt[d.device.ID]
+	}
+	schedule.update(devs, profiles, time.Now())
+	log.Debugf("schedule: %d devices loaded (%d new) with %d profiles", len(devs), len(newIDs), len(profiles))
+	return nil
+}
+
+// profileRequest builds the request template of the profile, with all its measures
+// and no device.
+func profileRequest(profileID int) (model.SnmpRequest, error) {
+	var req model.SnmpRequest
+	var scalarMeasures []model.ScalarMeasure
+	if err := db.Select(&scalarMeasures, selectScalarMeasures+` WHERE pm.profile_id = $1 ORDER BY m.id`, profileID); err != nil {
+		return req, fmt.Errorf("select scalar measures: %v", err)
+	}
+	var indexedMeasures []model.IndexedMeasure
+	if err := db.Select(&indexedMeasures, selectIndexedMeasures+` WHERE pm.profile_id = $1 ORDER BY m.id`, profileID); err != nil {
+		return req, fmt.Errorf("select indexed measures: %v", err)
+	}
+	err := loadMeasures(&req, scalarMeasures, indexedMeasures)
+	return req, err
+}
+
+// measurePollTimes returns the last poll time of the measures of the given devices,
+// by device and measure id.
+func measurePollTimes(devIDs []int) (map[int]map[int]time.Time, error) {
+	polledAt := make(map[int]map[int]time.Time)
+	if len(devIDs) == 0 {
+		return polledAt, nil
+	}
+	var times []struct {
+		DeviceID     int       `db:"device_id"`
+		MeasureID    int       `db:"measure_id"`
+		LastPolledAt time.Time `db:"last_polled_at"`
+	}
+	err := db.Select(&times, `SELECT device_id,
+                                     measure_id,
+                                     last_polled_at
+                                FROM measure_poll_times
+                               WHERE device_id = ANY($1)`, pq.Array(devIDs))
+	if err != nil {
+		return nil, fmt.Errorf("select measure poll times: %v", err)
+	}
+	for _, t := range times {
+		if polledAt[t.DeviceID] == nil {
+			polledAt[t.DeviceID] = make(map[int]time.Time)
+		}
+		polledAt[t.DeviceID][t.MeasureID] = t.LastPolledAt
+	}
+	return polledAt, nil
+}
+
+// profile returns the request template of the profile in the schedule.
+func (s *scheduler) profile(profileID int) (model.SnmpRequest, bool) {
+	s.Lock()
+	defer s.Unlock()
+	req, ok := s.profiles[profileID]
+	return req, ok
+}
+
+// has tells if the device is in the schedule.
+func (s *scheduler) has(devID int) bool {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.devices[devID]
+	return ok
+}
+
+// update replaces the scheduled devices and the profile templates. The new devices
+// are scheduled at their first slot after now with their given measure poll times,
+// while the known ones keep their poll times and their slot unless their polling
+// frequency changed.
+func (s *scheduler) update(devices []*schedDevice, profiles map[int]model.SnmpRequest, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	seen := make(map[int]bool)
+	for _, d := range devices {
+		seen[d.device.ID] = true
+		cur, ok := s.devices[d.device.ID]
+		if !ok {
+			if d.polledAt == nil {
+				d.polledAt = make(map[int]time.Time)
+			}
+			d.next = nextSlot(d.device.ID, d.freq(), now)
+			s.devices[d.device.ID] = d
+			heap.Push(&s.queue, d)
+			continue
+		}
+		rescheduled := cur.device.PollingFrequency != d.device.PollingFrequency
+		cur.device, cur.profileID = d.device, d.profileID
+		if rescheduled {
+			cur.next = nextSlot(cur.device.ID, cur.freq(), now)
+			heap.Fix(&s.queue, cur.index)
+		}
+	}
+	for id, d := range s.devices {
+		if !seen[id] {
+			heap.Remove(&s.queue, d.index)
+			delete(s.devices, id)
+		}
+	}
+	s.profiles = profiles
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wait returns the duration until the next polling slot.
+func (s *scheduler) wait(now time.Time) time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queue) == 0 {
+		return time.Minute
+	}
+	if d := s.queue[0].next.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// due returns the jobs of the devices whose polling slot is past and schedules
+// their next slot. Missed slots are skipped, as well as the devices with no
+// measure due.
+func (s *scheduler) due(now time.Time) []schedJob {
+	s.Lock()
+	defer s.Unlock()
+	var jobs []schedJob
+	for len(s.queue) > 0 && !s.queue[0].next.After(now) {
+		d := s.queue[0]
+		slot := d.next
+		d.next = nextSlot(d.device.ID, d.freq(), now)
+		heap.Fix(&s.queue, 0)
+		req := d.dueRequest(s.profiles[d.profileID], slot)
+		if req.ScalarMeasures == nil && req.IndexedMeasures == nil {
+			log.Debug2f("schedule: no measure due for device #%d", d.device.ID)
+			continue
+		}
+		jobs = append(jobs, schedJob{req: req, slot: slot})
+	}
+	return jobs
+}
+
+// dueRequest builds the device request from its profile template with the measures
+// due at the slot: those without polling frequency or not polled since.
+func (d *schedDevice) dueRequest(tmpl model.SnmpRequest, slot time.Time) model.SnmpRequest {
+	isDue := func(measureID, freq int) bool {
+		last, ok := d.polledAt[measureID]
+		return freq == 0 || !ok || slot.Sub(last) >= time.Duration(freq)*time.Second
+	}
+	req := model.SnmpRequest{
+		Device:       d.device,
+		ResolvedOids: tmpl.ResolvedOids,
+		LookupTables: tmpl.LookupTables,
+	}
+	for _, m := range tmpl.ScalarMeasures {
+		if isDue(m.ID, m.PollingFrequency) {
+			req.ScalarMeasures = append(req.ScalarMeasures, m)
+		}
+	}
+	for _, m := range tmpl.IndexedMeasures {
+		if isDue(m.ID, m.PollingFrequency) {
+			req.IndexedMeasures = append(req.IndexedMeasures, m)
+		}
+	}
+	return req
+}
+
+// setPolled records the poll time of the request measures having a polling
+// frequency.
+func (s *scheduler) setPolled(req model.SnmpRequest, t time.Time) {
+	ids := scheduledMeasureIDs(req)
+	if len(ids) == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.devices[req.Device.ID]
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		d.polledAt[int(id)] = t
+	}
+}
+
+// addPending queues the poll time of the device and of its measures having a
+// polling frequency, to be saved to db by flushPollTimes.
+func (s *scheduler) addPending(req model.SnmpRequest, t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.pendingDevices[req.Device.ID] = t
+	for _, id := range scheduledMeasureIDs(req) {
+		s.pendingMeasures[pollKey{req.Device.ID, int(id)}] = t
+	}
+}
+
+// takePending returns the queued poll times and empties the queue.
+func (s *scheduler) takePending() (map[int]time.Time, map[pollKey]time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	devices, measures := s.pendingDevices, s.pendingMeasures
+	s.pendingDevices, s.pendingMeasures = make(map[int]time.Time), make(map[pollKey]time.Time)
+	return devices, measures
+}
+
+// restorePending queues back the poll times that could not be saved, unless
+// more recent ones were queued since.
+func (s *scheduler) restorePending(devices map[int]time.Time, measures map[pollKey]time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for id, t := range devices {
+		if cur, ok := s.pendingDevices[id]; !ok || cur.Before(t) {
+			s.pendingDevices[id] = t
+		}
+	}
+	for k, t := range measures {
+		if cur, ok := s.pendingMeasures[k]; !ok || cur.Before(t) {
+			s.pendingMeasures[k] = t
+		}
+	}
+}
+
+// flushPollTimes saves to db the poll times of the scheduled jobs queued since
+// the last flush, with one statement for the devices and one for the measures.
+// They are queued back on error.
+func flushPollTimes() error {
+	devices, measures := schedule.takePending()
+	if len(devices) > 0 {
+		var ids pq.Int64Array
+		var times pq.Float64Array
+		for id, t := range devices {
+			ids = append(ids, int64(id))
+			times = append(times, float64(t.UnixNano())/1e9)
+		}
+		if _, err := setDevsPollTimesStmt.Exec(ids, times); err != nil {
+			schedule.restorePending(devices, measures)
+			return fmt.Errorf("save device poll times: %v", err)
+		}
+	}
+	if len(measures) > 0 {
+		var devIDs, measureIDs pq.Int64Array
+		var times pq.Float64Array
+		for k, t := range measures {
+			devIDs = append(devIDs, int64(k.deviceID))
+			measureIDs = append(measureIDs, int64(k.measureID))
+			times = append(times, float64(t.UnixNano())/1e9)
+		}
+		if _, err := setMeasuresPollTimesStmt.Exec(devIDs, measureIDs, times); err != nil {
+			schedule.restorePending(nil, measures)
+			return fmt.Errorf("save measure poll times: %v", err)
+		}
+	}
+	log.Debug2f("schedule: saved the poll times of %d devices and %d measures", len(devices), len(measures))
+	return nil
+}
+
+// lock marks the device as polled by the request with the given uid. Returns
+// false if the device is already being polled. Devices out of the schedule are
+// not tracked and always locked.
+func (s *scheduler) lock(devID int, uid string) bool {
+	s.Lock()
+	defer s.Unlock()
+	d, ok := s.devices[devID]
+	if !ok {
+		return true
+	}
+	if d.pollingUID != "" {
+		return false
+	}
+	d.pollingUID, d.pollingSince = uid, time.Now()
+	s.polling[uid] = devID
+	return true
+}
+
+// unlock marks the device polled by the request with the given uid as idle.
+func (s *scheduler) unlock(uid string) {
+	s.Lock()
+	defer s.Unlock()
+	s.unlockLocked(uid)
+}
+
+// unlockLocked is unlock with the scheduler lock held.
+func (s *scheduler) unlockLocked(uid string) {
+	devID, ok := s.polling[uid]
+	if !ok {
+		return
+	}
+	delete(s.polling, uid)
+	if d, ok := s.devices[devID]; ok && d.pollingUID == uid {
+		d.pollingUID = ""
+	}
+}
+
+// unlockIdle unlocks the devices whose poll is not in the ongoing requests of
+// the agents and started more than their polling frequency ago, as their report
+// was lost.
+func (s *scheduler) unlockIdle(ongoing []string, now time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+	isOngoing := make(map[string]bool)
+	for _, uid := range ongoing {
+		isOngoing[uid] = true
+	}
+	var count int
+	for uid, devID := range s.polling {
+		if isOngoing[uid] {
+			continue
+		}
+		if d, ok := s.devices[devID]; ok && now.Sub(d.pollingSince) < d.freq() {
+			continue
+		}
+		s.unlockLocked(uid)
+		count++
+	}
+	return count
+}
+
+// SchedulePollingJobs sends the polling job of each scheduled device at its polling
+// slot, until ctx is cancelled. The schedule is loaded by LoadSchedule.
+func SchedulePollingJobs(ctx context.Context) {
+	for {
+		timer := time.NewTimer(schedule.wait(time.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-schedule.wake:
+			timer.Stop()
+		case now := <-timer.C:
+			for _, job := range schedule.due(now) {
+				go sendScheduledJob(ctx, job)
+			}
+		}
+	}
+}
+
+// sendScheduledJob locks the device of the job in memory and sends its request
+// to an agent. The job is skipped if the device is still polling from a previous
+// slot. The device secrets are kept encrypted in the schedule and only decrypted
+// here. The poll times are saved to db on the next schedule reload.
+func sendScheduledJob(ctx context.Context, job schedJob) {
+	req := job.req
+	if ActiveAgentCount() == 0 {
+		log.Debugf("dev #%d: no active agent, skipping slot", req.Device.ID)
+		return
+	}
+	s := &req.Device.SnmpParams
+	if err := openSecrets(&s.Community, &s.AlternateCommunity, &s.AuthPasswd, &s.PrivPasswd); err != nil {
+		log.Errorf("dev #%d: %v", req.Device.ID, err)
+		return
+	}
+	if err := resolveAddress(&req.Device); err != nil {
+		log.Errorf("dev #%d: %v", req.Device.ID, err)
+		return
+	}
+	if err := initRequest(&req); err != nil {
+		log.Errorf("dev #%d: %v", req.Device.ID, err)
+		return
+	}
+	if !schedule.lock(req.Device.ID, req.UID) {
+		log.Debugf("%s - device #%d still polling, skipping slot", req.UID, req.Device.ID)
+		return
+	}
+	log.Debugf("%s - new scheduled job for device #%d", req.UID, req.Device.ID)
+	if dispatchRequest(ctx, req) == 0 {
+		schedule.unlock(req.UID)
+		return
+	}
+	schedule.setPolled(req, job.slot)
+	schedule.addPending(req, job.slot)
+}
@@ -0,0 +1,179 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestNextSlot(t *testing.T) {
+	freq := 5 * time.Minute
+	now := time.Date(2020, 3, 12, 10, 2, 17, 0, time.UTC)
+	var buckets [10]int
+	for id := 1; id <= 1000; id++ {
+		slot := nextSlot(id, freq, now)
+		if !slot.After(now) || slot.Sub(now) > freq {
+			t.Fatalf("device #%d: slot %v not in (%v, %v]", id, slot, now, now.Add(freq))
+		}
+		if next := nextSlot(id, freq, slot); !next.Equal(slot.Add(freq)) {
+			t.Errorf("device #%d: expected slot after %v at %v, got %v", id, slot, slot.Add(freq), next)
+		}
+		buckets[slot.Sub(slot.Truncate(freq))*10/freq]++
+	}
+	for i, count := range buckets {
+		if count < 90 || count > 110 {
+			t.Errorf("uneven slot spread: %d devices in bucket #%d: %v", count, i, buckets)
+		}
+	}
+}
+
+func TestSchedulerUpdate(t *testing.T) {
+	now := time.Date(2020, 3, 12, 10, 0, 0, 0, time.UTC)
+	dev := func(id, freq int) *schedDevice {
+		return &schedDevice{device: model.Device{ID: id, PollingFrequency: freq}, profileID: 1}
+	}
+	s := newScheduler()
+	s.update([]*schedDevice{dev(1, 60), dev(2, 60), dev(3, 300)}, nil, now)
+	if len(s.devices) != 3 || len(s.queue) != 3 {
+		t.Fatalf("expected 3 scheduled devices, got %d (queue: %d)", len(s.devices), len(s.queue))
+	}
+	for _, d := range s.queue[1:] {
+		if d.next.Before(s.queue[0].next) {
+			t.Errorf("queue head at %v after device #%d at %v", s.queue[0].next, d.device.ID, d.next)
+		}
+	}
+	select {
+	case <-s.wake:
+	default:
+		t.Errorf("update did not wake the scheduler")
+	}
+
+	slot2 := s.devices[2].next
+	s.devices[2].polledAt[10] = now
+	s.update([]*schedDevice{dev(1, 120), dev(2, 60)}, nil, now.Add(time.Second))
+	if len(s.devices) != 2 || len(s.queue) != 2 {
+		t.Fatalf("expected 2 scheduled devices, got %d (queue: %d)", len(s.devices), len(s.queue))
+	}
+	if _, ok := s.devices[3]; ok {
+		t.Errorf("removed device #3 still scheduled")
+	}
+	if expected := nextSlot(1, 2*time.Minute, now.Add(time.Second)); !s.devices[1].next.Equal(expected) {
+		t.Errorf("device #1: expected rescheduling at %v, got %v", expected, s.devices[1].next)
+	}
+	if !s.devices[2].next.Equal(slot2) || !s.devices[2].polledAt[10].Equal(now) {
+		t.Errorf("device #2: slot or poll times changed on update")
+	}
+}
+
+func TestSchedulerDue(t *testing.T) {
+	now := time.Date(2020, 3, 12, 10, 0, 0, 0, time.UTC)
+	tmpl := model.SnmpRequest{
+		ScalarMeasures: []model.ScalarMeasure{
+			{ID: 1, Name: "sysInfo", PollingFrequency: 3600},
+			{ID: 2, Name: "sysUptime"},
+		},
+		IndexedMeasures: []model.IndexedMeasure{
+			{ID: 3, Name: "ifStats"},
+			{ID: 4, Name: "entity", PollingFrequency: 3600},
+		},
+	}
+	s := newScheduler()
+	s.update([]*schedDevice{
+		{device: model.Device{ID: 1, PollingFrequency: 60}, profileID: 1},
+		{device: model.Device{ID: 2, PollingFrequency: 60}, profileID: 2, polledAt: map[int]time.Time{1: now.Add(-30 * time.Minute)}},
+		{device: model.Device{ID: 3, PollingFrequency: 300}, profileID: 1},
+	}, map[int]model.SnmpRequest{1: tmpl, 2: {ScalarMeasures: tmpl.ScalarMeasures[:1]}}, now)
+	s.devices[1].polledAt[4] = now.Add(-2 * time.Hour)
+
+	at := now.Add(time.Minute)
+	jobs := s.due(at)
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(jobs))
+	}
+	req := jobs[0].req
+	if req.Device.ID != 1 || len(req.ScalarMeasures) != 2 || len(req.IndexedMeasures) != 2 {
+		t.Errorf("device #1: expected all measures due, got %+v", req)
+	}
+	s.setPolled(req, jobs[0].slot)
+	for id := 1; id <= 2; id++ {
+		if next := s.devices[id].next; !next.After(at) {
+			t.Errorf("device #%d: not rescheduled after %v: %v", id, at, next)
+		}
+	}
+	if _, ok := s.devices[1].polledAt[2]; ok {
+		t.Errorf("device #1: poll time recorded for measure with no polling frequency")
+	}
+
+	jobs = s.due(s.devices[1].next)
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job on next slot, got %d", len(jobs))
+	}
+	req = jobs[0].req
+	if len(req.ScalarMeasures) != 1 || req.ScalarMeasures[0].ID != 2 || len(req.IndexedMeasures) != 1 || req.IndexedMeasures[0].ID != 3 {
+		t.Errorf("device #1: expected only measures #2 and #3 due on next slot, got %+v", req)
+	}
+
+	s.addPending(req, jobs[0].slot)
+	s.addPending(model.SnmpRequest{Device: model.Device{ID: 2}, ScalarMeasures: tmpl.ScalarMeasures[:1]}, at)
+	devices, measures := s.takePending()
+	if len(devices) != 2 || !devices[1].Equal(jobs[0].slot) || !devices[2].Equal(at) {
+		t.Errorf("expected pending poll times of devices #1 and #2, got %v", devices)
+	}
+	if len(measures) != 1 || !measures[pollKey{2, 1}].Equal(at) {
+		t.Errorf("expected pending poll time of device #2 measure #1 only, got %v", measures)
+	}
+	s.addPending(model.SnmpRequest{Device: model.Device{ID: 2}}, at.Add(time.Minute))
+	s.restorePending(devices, measures)
+	if devices, measures = s.takePending(); len(devices) != 2 || !devices[2].Equal(at.Add(time.Minute)) || len(measures) != 1 {
+		t.Errorf("restore: expected the newer poll time of device #2 kept, got %v %v", devices, measures)
+	}
+}
+
+func TestSchedulerLock(t *testing.T) {
+	now := time.Date(2020, 3, 12, 10, 0, 0, 0, time.UTC)
+	s := newScheduler()
+	s.update([]*schedDevice{
+		{device: model.Device{ID: 1, PollingFrequency: 60}, profileID: 1},
+		{device: model.Device{ID: 2, PollingFrequency: 60}, profileID: 1},
+	}, map[int]model.SnmpRequest{1: {}}, now)
+
+	if !s.lock(1, "a@1") || s.lock(1, "b@1") {
+		t.Fatal("device #1: expected a single lock")
+	}
+	if !s.lock(3, "c@3") || !s.lock(3, "d@3") {
+		t.Error("device #3: expected unscheduled device to be always locked")
+	}
+	s.unlock("a@1")
+	if !s.lock(1, "b@1") {
+		t.Fatal("device #1: expected lock after unlock")
+	}
+	if !s.lock(2, "e@2") {
+		t.Fatal("device #2: expected lock")
+	}
+
+	at := time.Now()
+	if count := s.unlockIdle(nil, at); count != 0 {
+		t.Errorf("expected no unlock before the polling frequency, got %d", count)
+	}
+	if count := s.unlockIdle([]string{"b@1"}, at.Add(2*time.Minute)); count != 1 {
+		t.Errorf("expected 1 unlock, got %d", count)
+	}
+	if s.lock(1, "f@1") || !s.lock(2, "f@2") {
+		t.Error("expected device #1 still locked by its ongoing poll and device #2 unlocked")
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+// encryptedPrefix marks the encrypted secrets in db, followed by the base64
+// encoded nonce and ciphertext.
+const encryptedPrefix = "enc:"
+
+// secretColumns are the db columns of the snmp secrets, in devices and credentials
+// tables. The secrets are always given in this order.
+var secretColumns = []string{"snmp_community", "snmp_alternate_community", "snmpv3_auth_passwd", "snmpv3_privacy_passwd"}
+
+// credentialsAEAD encrypts the snmp secrets stored in db. Secrets are stored in
+// clear if nil.
+var credentialsAEAD cipher.AEAD
+
+// LoadCredentialsKey reads the AES-256 key of the snmp secrets from the given
+// file, as 64 hex digits.
+func LoadCredentialsKey(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("read credentials key: %v", err)
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return fmt.Errorf("credentials key: %v", err)
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("credentials key must be 32 bytes long, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("credentials key: %v", err)
+	}
+	credentialsAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealSecret encrypts a secret for db storage. Empty secrets and secrets already
+// encrypted with the current key are returned as is, as all secrets when there
+// is no key. A clear secret starting with encryptedPrefix is encrypted like any
+// other, or rejected without key as it could not be told apart from an encrypted
+// one when read back.
+func sealSecret(secret string) (string, error) {
+	if secret == "" {
+		return secret, nil
+	}
+	if strings.HasPrefix(secret, encryptedPrefix) {
+		if credentialsAEAD == nil {
+			return "", fmt.Errorf("a clear secret cannot start with `%s`", encryptedPrefix)
+		}
+		if _, err := openSecret(secret); err == nil {
+			return secret, nil
+		}
+	}
+	if credentialsAEAD == nil {
+		return secret, nil
+	}
+	nonce := make([]byte, credentialsAEAD.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("nonce: %v", err)
+	}
+	sealed := credentialsAEAD.Seal(nonce, nonce, []byte(secret), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a secret read from db. Clear secrets are returned as is.
+func openSecret(secret string) (string, error) {
+	if !strings.HasPrefix(secret, encryptedPrefix) {
+		return secret, nil
+	}
+	if credentialsAEAD == nil {
+		return "", errors.New("encrypted secret but no credentials key")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decode secret: %v", err)
+	}
+	size := credentialsAEAD.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("decode secret: too short")
+	}
+	clear, err := credentialsAEAD.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypt secret: %v", err)
+	}
+	return string(clear), nil
+}
+
+// openSecrets decrypts in place the given secrets.
+func openSecrets(secrets ...*string) error {
+	for _, s := range secrets {
+		clear, err := openSecret(*s)
+		if err != nil {
+			return err
+		}
+		*s = clear
+	}
+	return nil
+}
+
+// storeSecrets prepares the secrets of the table row with the given id for their
+// storage: masked ones are replaced by the stored values, the others are encrypted.
+// The secrets must be given in secretColumns order.
+func storeSecrets(table string, id int, secrets ...*string) error {
+	var stored []string
+	for i, s := range secrets {
+		if *s != model.SecretMask {
+			sealed, err := sealSecret(*s)
+			if err != nil {
+				return err
+			}
+			*s = sealed
+			continue
+		}
+		if stored == nil {
+			stored = make([]string, len(secretColumns))
+			dest := make([]interface{}, len(stored))
+			for j := range stored {
+				dest[j] = &stored[j]
+			}
+			query := fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1`, strings.Join(secretColumns, ", "), table)
+			err := db.QueryRow(query, id).Scan(dest...)
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%s: masked value for a new entry", secretColumns[i])
+			}
+			if err != nil {
+				return fmt.Errorf("select stored secrets: %v", err)
+			}
+		}
+		*s = stored[i]
+	}
+	return nil
+}
+
+// EncryptStoredSecrets encrypts the secrets still stored in clear in the devices
+// and credentials tables. Does nothing if no credentials key is loaded.
+func EncryptStoredSecrets() error {
+	if credentialsAEAD == nil {
+		return nil
+	}
+	for _, table := range []string{"devices", "credentials"} {
+		var rows []struct {
+			ID                 int    `db:"id"`
+			Community          string `db:"snmp_community"`
+			AlternateCommunity string `db:"snmp_alternate_community"`
+			AuthPasswd         string `db:"snmpv3_auth_passwd"`
+			PrivPasswd         string `db:"snmpv3_privacy_passwd"`
+		}
+		var clear []string
+		for _, col := range secretColumns {
+			clear = append(clear, fmt.Sprintf(`(%s <> '' AND %s NOT LIKE '%s%%')`, col, col, encryptedPrefix))
+		}
+		query := fmt.Sprintf(`SELECT id, %s FROM %s WHERE %s`, strings.Join(secretColumns, ", "), table, strings.Join(clear, " OR "))
+		if err := db.Select(&rows, query); err != nil {
+			return fmt.Errorf("select %s secrets: %v", table, err)
+		}
+		for _, row := range rows {
+			secrets := []*string{&row.Community, &row.AlternateCommunity, &row.AuthPasswd, &row.PrivPasswd}
+			for _, s := range secrets {
+				sealed, err := sealSecret(*s)
+				if err != nil {
+					return err
+				}
+				*s = sealed
+			}
+			_, err := db.Exec(fmt.Sprintf(`UPDATE %s SET %s = $2, %s = $3, %s = $4, %s = $5 WHERE id = $1`, table,
+				secretColumns[0], secretColumns[1], secretColumns[2], secretColumns[3]),
+				row.ID, row.Community, row.AlternateCommunity, row.AuthPasswd, row.PrivPasswd)
+			if err != nil {
+				return fmt.Errorf("update %s #%d secrets: %v", table, row.ID, err)
+			}
+		}
+		if len(rows) > 0 {
+			log.Infof("encrypted the clear secrets of %d %s", len(rows), table)
+		}
+	}
+	return nil
+}
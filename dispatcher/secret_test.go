@@ -0,0 +1,121 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadCredentialsKey(t *testing.T) {
+	defer func() { credentialsAEAD = nil }()
+
+	tests := []struct {
+		content string
+		valid   bool
+	}{
+		{"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n", true},
+		{"000102030405060708090a0b0c0d0e0f", false},
+		{"not an hex key", false},
+		{"", false},
+	}
+	for i, tt := range tests {
+		f, err := ioutil.TempFile("", "horus-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt.content)
+		f.Close()
+		err = LoadCredentialsKey(f.Name())
+		os.Remove(f.Name())
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("LoadCredentialsKey#%d: expected validity %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+	}
+	if err := LoadCredentialsKey("/nonexistent/horus.key"); err == nil {
+		t.Errorf("LoadCredentialsKey: expected error on missing file")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	defer func() { credentialsAEAD = nil }()
+
+	// no key: secrets are stored in clear
+	credentialsAEAD = nil
+	if s, err := sealSecret("public"); err != nil || s != "public" {
+		t.Errorf("seal without key: expected clear secret, got %q (err: %v)", s, err)
+	}
+	if _, err := sealSecret(encryptedPrefix + "public"); err == nil {
+		t.Errorf("seal without key: expected error on clear secret with encrypted prefix")
+	}
+
+	loadKey(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	sealed, err := sealSecret("public")
+	if err != nil || !strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, "public") {
+		t.Fatalf("seal: expected encrypted secret, got %q (err: %v)", sealed, err)
+	}
+	if again, _ := sealSecret("public"); again == sealed {
+		t.Errorf("seal: expected a new nonce on each call")
+	}
+	if resealed, _ := sealSecret(sealed); resealed != sealed {
+		t.Errorf("seal: expected encrypted secret unchanged, got %q", resealed)
+	}
+	if empty, _ := sealSecret(""); empty != "" {
+		t.Errorf("seal: expected empty secret unchanged, got %q", empty)
+	}
+	prefixed, err := sealSecret(encryptedPrefix + "public")
+	if err != nil || prefixed == encryptedPrefix+"public" {
+		t.Errorf("seal: expected clear secret with encrypted prefix to be encrypted, got %q (err: %v)", prefixed, err)
+	}
+	if clear, err := openSecret(prefixed); err != nil || clear != encryptedPrefix+"public" {
+		t.Errorf("open: expected %q, got %q (err: %v)", encryptedPrefix+"public", clear, err)
+	}
+
+	community, clear := sealed, "private"
+	if err := openSecrets(&community, &clear); err != nil || community != "public" || clear != "private" {
+		t.Errorf("open: expected public/private, got %q/%q (err: %v)", community, clear, err)
+	}
+	b, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, encryptedPrefix))
+	b[len(b)-1] ^= 1
+	if _, err := openSecret(encryptedPrefix + base64.StdEncoding.EncodeToString(b)); err == nil {
+		t.Errorf("open: expected error on tampered secret")
+	}
+
+	loadKey(t, "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100")
+	if _, err := openSecret(sealed); err == nil {
+		t.Errorf("open: expected error with another key")
+	}
+	credentialsAEAD = nil
+	if _, err := openSecret(sealed); err == nil {
+		t.Errorf("open: expected error without key")
+	}
+}
+
+// loadKey loads the given hex key from a temp file.
+func loadKey(t *testing.T, key string) {
+	f, err := ioutil.TempFile("", "horus-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(key)
+	f.Close()
+	if err := LoadCredentialsKey(f.Name()); err != nil {
+		t.Fatalf("load key: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kosctelecom/horus/auth"
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+// TrapDevices returns the active devices for the agent trap receivers, which map
+// the trap source address to the device. Only their id, address, version and tags
+// are given, with the hashes of the communities of the v1 and v2c devices: the
+// snmpv3 users are added by PushTrapDevices. The address of devices without ip is
+// resolved from their hostname. The snmp params of the snmpv3 devices, with
+// encrypted secrets, are also returned by device id.
+func TrapDevices() ([]model.TrapDevice, map[int]model.SnmpParams, error) {
+	var devices []model.Device
+	if err := db.Select(&devices, selectSnmpDevices+` WHERE d.active = true ORDER BY d.id`); err != nil {
+		return nil, nil, fmt.Errorf("trap devices: %v", err)
+	}
+	trapDevices := make([]model.TrapDevice, 0, len(devices))
+	v3Params := make(map[int]model.SnmpParams)
+	for _, dev := range devices {
+		addr := dev.IPAddress
+		if addr == "" {
+			addrs, err := net.LookupHost(dev.Hostname)
+			if err != nil {
+				log.Debugf("trap devices: lookup %s: %v", dev.Hostname, err)
+				continue
+			}
+			addr = addrs[0]
+		}
+		trapDev := model.TrapDevice{
+			ID:        dev.ID,
+			IPAddress: addr,
+			Version:   dev.Version,
+			Tags:      dev.ResultTags(),
+		}
+		if dev.Version == model.Version3 {
+			v3Params[dev.ID] = dev.SnmpParams
+		} else {
+			hashes, err := communityHashes(dev.ID, dev.SnmpParams)
+			if err != nil {
+				log.Warningf("trap devices: device #%d: %v", dev.ID, err)
+				continue
+			}
+			trapDev.CommunityHashes = hashes
+		}
+		trapDevices = append(trapDevices, trapDev)
+	}
+	return trapDevices, v3Params, nil
+}
+
+// communityHashes returns the hashes of the decrypted community and alternate
+// community of a device.
+func communityHashes(devID int, s model.SnmpParams) ([]string, error) {
+	if err := openSecrets(&s.Community, &s.AlternateCommunity); err != nil {
+		return nil, err
+	}
+	hashes := []string{model.CommunityHash(devID, s.Community)}
+	if s.AlternateCommunity != "" {
+		hashes = append(hashes, model.CommunityHash(devID, s.AlternateCommunity))
+	}
+	return hashes, nil
+}
+
+// withTrapUsers sets the decrypted snmpv3 user of the devices having one in v3Params.
+// The devices whose secrets cannot be decrypted are left without user.
+func withTrapUsers(devices []model.TrapDevice, v3Params map[int]model.SnmpParams) {
+	for i, dev := range devices {
+		s, ok := v3Params[dev.ID]
+		if !ok {
+			continue
+		}
+		user := &model.TrapUser{
+			SecLevel:   s.SecLevel,
+			AuthUser:   s.AuthUser,
+			AuthProto:  s.AuthProto,
+			AuthPasswd: s.AuthPasswd,
+			PrivProto:  s.PrivProto,
+			PrivPasswd: s.PrivPasswd,
+		}
+		if err := openSecrets(&user.AuthPasswd, &user.PrivPasswd); err != nil {
+			log.Warningf("trap devices: device #%d: %v", dev.ID, err)
+			continue
+		}
+		devices[i].User = user
+	}
+}
+
+// PushTrapDevices sends the trap devices with their snmpv3 users to all alive agents,
+// as a device sends its notifications to a fixed agent, whichever polls it.
+func PushTrapDevices(ctx context.Context) {
+	devices, v3Params, err := TrapDevices()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	withTrapUsers(devices, v3Params)
+	sendTrapDevices(ctx, devices)
+}
+
+// sendTrapDevices posts the trap devices to all alive agents. Agents without trap
+// receiver reply with a status 501 and are skipped.
+func sendTrapDevices(ctx context.Context, devices []model.TrapDevice) {
+	buf, err := json.Marshal(devices)
+	if err != nil {
+		log.Errorf("trap devices: marshal: %v", err)
+		return
+	}
+	client := auth.NewClient(time.Duration(HTTPTimeout) * time.Second)
+	for _, agent := range currentAgentsCopy() {
+		if !agent.Alive {
+			continue
+		}
+		req, err := http.NewRequest("POST", agent.trapDevicesURL, bytes.NewReader(buf))
+		if err != nil {
+			log.Errorf("trap devices: http request: %v", err)
+			return
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Warningf("trap devices: post to agent #%d: %v", agent.ID, err)
+			continue
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			log.Debugf("trap devices: %d devices sent to agent #%d", len(devices), agent.ID)
+		case http.StatusNotImplemented:
+			log.Debug2f("trap devices: agent #%d has no trap receiver", agent.ID)
+		default:
+			log.Warningf("trap devices: agent #%d replied with %s", agent.ID, resp.Status)
+		}
+	}
+}
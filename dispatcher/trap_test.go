@@ -0,0 +1,93 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestPushTrapDevices(t *testing.T) {
+	defer func() { currentAgents = make(Agents) }()
+	received := make(map[int][]model.TrapDevice)
+	agentServer := func(id int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var devices []model.TrapDevice
+			if err := json.NewDecoder(r.Body).Decode(&devices); err != nil {
+				t.Errorf("agent #%d: decode trap devices: %v", id, err)
+			}
+			received[id] = devices
+		}))
+	}
+	srv1, srv2 := agentServer(1), agentServer(2)
+	defer srv1.Close()
+	defer srv2.Close()
+	currentAgents = Agents{
+		"a1": {ID: 1, Alive: true, name: "a1", trapDevicesURL: srv1.URL},
+		"a2": {ID: 2, Alive: true, name: "a2", trapDevicesURL: srv2.URL},
+		"a3": {ID: 3, Alive: false, name: "a3", trapDevicesURL: srv2.URL},
+	}
+	devices := []model.TrapDevice{
+		{ID: 42, IPAddress: "10.0.0.42", Version: model.Version3},
+		{ID: 43, IPAddress: "10.0.0.43", Version: model.Version2c},
+		{ID: 44, IPAddress: "10.0.0.44", Version: model.Version3},
+	}
+	v3Params := map[int]model.SnmpParams{
+		42: {SecLevel: "AuthPriv", AuthUser: "horus", AuthPasswd: "auth-passwd", PrivPasswd: "priv-passwd"},
+		44: {SecLevel: "AuthNoPriv", AuthUser: "sealed", AuthPasswd: encryptedPrefix + "AAAA"},
+	}
+
+	withTrapUsers(devices, v3Params)
+	sendTrapDevices(context.Background(), devices)
+	if len(received) != 2 {
+		t.Fatalf("expected trap devices sent to the 2 alive agents, got %+v", received)
+	}
+	for id, devs := range received {
+		if len(devs) != 3 {
+			t.Errorf("agent #%d: expected 3 devices, got %+v", id, devs)
+			continue
+		}
+		if u := devs[0].User; u == nil || u.AuthUser != "horus" || u.AuthPasswd != "auth-passwd" || u.PrivPasswd != "priv-passwd" {
+			t.Errorf("agent #%d: device #42: expected user horus, got %+v", id, u)
+		}
+		if devs[1].User != nil || devs[2].User != nil {
+			t.Errorf("agent #%d: expected no user for devices #43 and #44, got %+v and %+v", id, devs[1].User, devs[2].User)
+		}
+	}
+}
+
+func TestCommunityHashes(t *testing.T) {
+	hashes, err := communityHashes(42, model.SnmpParams{Community: "public", AlternateCommunity: "private"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 || hashes[0] != model.CommunityHash(42, "public") || hashes[1] != model.CommunityHash(42, "private") {
+		t.Errorf("expected the hashes of public and private, got %v", hashes)
+	}
+	if hashes[0] == model.CommunityHash(43, "public") {
+		t.Errorf("expected the hash to depend on the device id")
+	}
+	if hashes, _ := communityHashes(42, model.SnmpParams{Community: "public"}); len(hashes) != 1 {
+		t.Errorf("expected a single hash without alternate community, got %v", hashes)
+	}
+	if _, err := communityHashes(42, model.SnmpParams{Community: encryptedPrefix + "AAAA"}); err == nil {
+		t.Errorf("expected error on sealed community without key")
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/kosctelecom/horus/auth"
 	"github.com/kosctelecom/horus/log"
 	"github.com/kosctelecom/horus/model"
 	"github.com/lib/pq"
@@ -43,8 +44,8 @@ func UnlockDevices() {
 		}
 
 		log.Debug2f("unlock dev: get ongoing from agent #%d (%s:%d)", agent.ID, agent.Host, agent.Port)
-		client := &http.Client{Timeout: time.Duration(HTTPTimeout) * time.Second}
-		resp, err := client.Get(fmt.Sprintf("http://%s:%d%s", agent.Host, agent.Port, model.OngoingURI))
+		client := auth.NewClient(time.Duration(HTTPTimeout) * time.Second)
+		resp, err := client.Get(fmt.Sprintf("%s://%s:%d%s", auth.Scheme(), agent.Host, agent.Port, model.OngoingURI))
 		if err != nil {
 			log.Debug2f("agent #%d: get ongoing: %v", agent.ID, err)
 			continue
@@ -70,4 +71,7 @@ func UnlockDevices() {
 	}
 	log.Debugf("unlocking %d devices without ongoing poll", len(currentReqs))
 	sqlExec("", "unlockFromOngoing", unlockFromOngoingStmt, pq.Array(currentReqs))
+	if count := schedule.unlockIdle(currentReqs, time.Now()); count > 0 {
+		log.Debugf("unlocked %d scheduled devices without ongoing poll", count)
+	}
 }
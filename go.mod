@@ -3,7 +3,7 @@ module github.com/kosctelecom/horus
 go 1.14
 
 require (
-	github.com/golang/mock v1.3.1 // indirect
+	github.com/gosnmp/gosnmp v1.29.0
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/lib/pq v1.2.0
 	github.com/mitchellh/copystructure v1.0.0
@@ -13,8 +13,8 @@ require (
 	github.com/teris-io/shortid v0.0.0-20171029131806-771a37caa5cf
 	github.com/vma/getopt v1.0.0
 	github.com/vma/glog v1.5.1
-	github.com/vma/gosnmp v1.22.4
 	github.com/vma/httplogger v1.0.0
 	github.com/vma/influxclient v1.0.0
 	google.golang.org/appengine v1.6.5 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
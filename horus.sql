@@ -17,9 +17,20 @@ CREATE TABLE profiles (
     UNIQUE(category, vendor, model)
 );
 
+CREATE TABLE credentials (
+    id serial PRIMARY KEY,
+    name character varying NOT NULL UNIQUE,
+    snmp_community character varying NOT NULL DEFAULT '',
+    snmp_alternate_community character varying NOT NULL DEFAULT '',
+    snmpv3_auth_user character varying NOT NULL DEFAULT '',
+    snmpv3_auth_passwd character varying NOT NULL DEFAULT '',
+    snmpv3_privacy_passwd character varying NOT NULL DEFAULT ''
+);
+
 CREATE TABLE devices (
     id serial PRIMARY KEY,
     active boolean NOT NULL DEFAULT true,
+    credential_id integer REFERENCES credentials(id) ON UPDATE CASCADE ON DELETE RESTRICT,
     hostname character varying NOT NULL,
     ip_address character varying,
     is_polling boolean NOT NULL DEFAULT false,
@@ -28,19 +39,25 @@ CREATE TABLE devices (
     ping_frequency integer NOT NULL DEFAULT 0,
     polling_frequency integer NOT NULL DEFAULT 300,
     profile_id integer NOT NULL REFERENCES profiles(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    snmp_adaptive_repetitions boolean NOT NULL DEFAULT false,
     snmp_alternate_community character varying NOT NULL DEFAULT '',
-    snmp_community character varying NOT NULL,
+    snmp_batch_get boolean NOT NULL DEFAULT false,
+    snmp_community character varying NOT NULL DEFAULT '',
     snmp_connection_count integer NOT NULL DEFAULT 1,
     snmp_disable_bulk boolean NOT NULL DEFAULT false,
+    snmp_max_oids_per_get integer NOT NULL DEFAULT 0 CHECK (snmp_max_oids_per_get >= 0),
+    snmp_max_repetitions integer NOT NULL DEFAULT 0 CHECK (snmp_max_repetitions BETWEEN 0 AND 255),
     snmp_port integer NOT NULL DEFAULT 161,
     snmp_retries integer NOT NULL DEFAULT 1,
     snmp_timeout integer NOT NULL DEFAULT 10,
     snmp_version character varying NOT NULL DEFAULT '2c',
     snmpv3_auth_passwd character varying NOT NULL DEFAULT '',
-    snmpv3_auth_proto character varying NOT NULL DEFAULT '',
+    snmpv3_auth_proto character varying NOT NULL DEFAULT '' CHECK (snmpv3_auth_proto IN ('', 'MD5', 'SHA', 'SHA224', 'SHA256', 'SHA384', 'SHA512')),
     snmpv3_auth_user character varying NOT NULL DEFAULT '',
+    snmpv3_context_engine_id character varying NOT NULL DEFAULT '',
+    snmpv3_context_name character varying NOT NULL DEFAULT '',
     snmpv3_privacy_passwd character varying NOT NULL DEFAULT '',
-    snmpv3_privacy_proto character varying NOT NULL DEFAULT '',
+    snmpv3_privacy_proto character varying NOT NULL DEFAULT '' CHECK (snmpv3_privacy_proto IN ('', 'DES', 'AES', 'AES192', 'AES256', 'AES192C', 'AES256C')),
     snmpv3_security_level character varying NOT NULL DEFAULT '',
     tags json NOT NULL DEFAULT '{}'::json,
     UNIQUE (hostname, ip_address)
@@ -55,7 +72,6 @@ CREATE TABLE metrics (
     index_pattern character varying NOT NULL DEFAULT '',
     name character varying NOT NULL,
     oid character varying NOT NULL,
-    polling_frequency integer NOT NULL DEFAULT 0,
     post_processors character varying[] DEFAULT '{}' NOT NULL,
     UNIQUE (oid, index_pattern)
 );
@@ -65,15 +81,20 @@ CREATE TABLE measures (
     description text NOT NULL,
     filter_metric_id integer REFERENCES metrics(id),
     filter_pattern character varying NOT NULL DEFAULT '',
+    filter_refresh_interval integer NOT NULL DEFAULT 0 CHECK (filter_refresh_interval >= 0),
     index_metric_id integer REFERENCES metrics(id),
     invert_filter_match boolean NOT NULL DEFAULT false,
     is_indexed boolean NOT NULL DEFAULT false,
+    label_change_oid character varying NOT NULL DEFAULT '',
+    label_refresh_polls integer NOT NULL DEFAULT 0 CHECK (label_refresh_polls >= 0),
     name character varying NOT NULL,
+    polling_frequency integer NOT NULL DEFAULT 0 CHECK (polling_frequency >= 0),
     to_influx boolean NOT NULL DEFAULT false,
     to_kafka boolean NOT NULL DEFAULT true,
     to_prometheus boolean NOT NULL DEFAULT true,
     to_nats boolean NOT NULL DEFAULT true,
     use_alternate_community boolean NOT NULL DEFAULT false,
+    walk_strategy character varying NOT NULL DEFAULT 'column' CHECK (walk_strategy IN ('column', 'table', 'targeted')),
     UNIQUE (name)
 );
 
@@ -84,21 +105,62 @@ CREATE TABLE measure_metrics (
     UNIQUE (measure_id, metric_id)
 );
 
-CREATE TABLE metric_poll_times (
+CREATE TABLE derived_metrics (
     id serial PRIMARY KEY,
-    device_id integer NOT NULL REFERENCES devices(id) ON UPDATE CASCADE ON DELETE CASCADE,
-    metric_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
-    last_polled_at timestamp with time zone NOT NULL,
-    UNIQUE (device_id, metric_id)
+    measure_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    active boolean NOT NULL DEFAULT true,
+    description text NOT NULL DEFAULT '',
+    exported_name character varying,
+    expression character varying NOT NULL,
+    name character varying NOT NULL,
+    UNIQUE (measure_id, name)
+);
+
+CREATE TABLE lookup_tables (
+    id serial PRIMARY KEY,
+    name character varying NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE lookup_table_entries (
+    id serial PRIMARY KEY,
+    table_id integer NOT NULL REFERENCES lookup_tables(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    key character varying NOT NULL,
+    value character varying NOT NULL,
+    UNIQUE (table_id, key)
+);
+
+CREATE TABLE measure_joins (
+    id serial PRIMARY KEY,
+    measure_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    mapping_metric_id integer NOT NULL REFERENCES metrics(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    key_pattern character varying NOT NULL DEFAULT '',
+    UNIQUE (measure_id, mapping_metric_id, key_pattern)
+);
+
+CREATE TABLE measure_join_metrics (
+    id serial PRIMARY KEY,
+    join_id integer NOT NULL REFERENCES measure_joins(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    metric_id integer NOT NULL REFERENCES metrics(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    UNIQUE (join_id, metric_id)
 );
 
 CREATE TABLE profile_measures (
     id serial PRIMARY KEY,
     profile_id integer NOT NULL REFERENCES profiles(id) ON UPDATE CASCADE ON DELETE CASCADE,
     measure_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    polling_frequency integer CHECK (polling_frequency >= 0),
     UNIQUE (profile_id, measure_id)
 );
 
+CREATE TABLE measure_poll_times (
+    id serial PRIMARY KEY,
+    device_id integer NOT NULL REFERENCES devices(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    measure_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    last_polled_at timestamp with time zone NOT NULL,
+    UNIQUE (device_id, measure_id)
+);
+
 CREATE TABLE reports (
     id serial PRIMARY KEY,
     uuid character varying NOT NULL UNIQUE,
@@ -113,10 +175,16 @@ CREATE TABLE reports (
 
 ALTER TABLE agents OWNER TO horus;
 ALTER TABLE profiles OWNER TO horus;
+ALTER TABLE credentials OWNER TO horus;
 ALTER TABLE devices OWNER TO horus;
 ALTER TABLE metrics OWNER TO horus;
 ALTER TABLE measures OWNER TO horus;
 ALTER TABLE measure_metrics OWNER TO horus;
-ALTER TABLE metric_poll_times OWNER TO horus;
+ALTER TABLE derived_metrics OWNER TO horus;
+ALTER TABLE lookup_tables OWNER TO horus;
+ALTER TABLE lookup_table_entries OWNER TO horus;
+ALTER TABLE measure_joins OWNER TO horus;
+ALTER TABLE measure_join_metrics OWNER TO horus;
 ALTER TABLE profile_measures OWNER TO horus;
+ALTER TABLE measure_poll_times OWNER TO horus;
 ALTER TABLE reports OWNER TO horus;
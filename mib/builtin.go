@@ -0,0 +1,118 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mib
+
+// builtinModules are minimal versions of the base SMI modules, so that the MIB
+// directory doesn't need to contain them. They are replaced by the modules of
+// the same name found in the MIB directory.
+var builtinModules = []string{`
+SNMPv2-SMI DEFINITIONS ::= BEGIN
+
+org            OBJECT IDENTIFIER ::= { iso 3 }
+dod            OBJECT IDENTIFIER ::= { org 6 }
+internet       OBJECT IDENTIFIER ::= { dod 1 }
+directory      OBJECT IDENTIFIER ::= { internet 1 }
+mgmt           OBJECT IDENTIFIER ::= { internet 2 }
+mib-2          OBJECT IDENTIFIER ::= { mgmt 1 }
+transmission   OBJECT IDENTIFIER ::= { mib-2 10 }
+experimental   OBJECT IDENTIFIER ::= { internet 3 }
+private        OBJECT IDENTIFIER ::= { internet 4 }
+enterprises    OBJECT IDENTIFIER ::= { private 1 }
+security       OBJECT IDENTIFIER ::= { internet 5 }
+snmpV2         OBJECT IDENTIFIER ::= { internet 6 }
+snmpDomains    OBJECT IDENTIFIER ::= { snmpV2 1 }
+snmpProxys     OBJECT IDENTIFIER ::= { snmpV2 2 }
+snmpModules    OBJECT IDENTIFIER ::= { snmpV2 3 }
+zeroDotZero    OBJECT IDENTIFIER ::= { 0 0 }
+
+Integer32  ::= INTEGER (-2147483648..2147483647)
+IpAddress  ::= [APPLICATION 0] IMPLICIT OCTET STRING (SIZE (4))
+Counter32  ::= [APPLICATION 1] IMPLICIT INTEGER (0..4294967295)
+Gauge32    ::= [APPLICATION 2] IMPLICIT INTEGER (0..4294967295)
+Unsigned32 ::= [APPLICATION 2] IMPLICIT INTEGER (0..4294967295)
+TimeTicks  ::= [APPLICATION 3] IMPLICIT INTEGER (0..4294967295)
+Opaque     ::= [APPLICATION 4] IMPLICIT OCTET STRING
+Counter64  ::= [APPLICATION 6] IMPLICIT INTEGER (0..18446744073709551615)
+
+END
+`, `
+RFC1155-SMI DEFINITIONS ::= BEGIN
+
+NetworkAddress ::= CHOICE { internet IpAddress }
+Counter        ::= [APPLICATION 1] IMPLICIT INTEGER (0..4294967295)
+Gauge          ::= [APPLICATION 2] IMPLICIT INTEGER (0..4294967295)
+
+END
+`, `
+SNMPv2-TC DEFINITIONS ::= BEGIN
+
+DisplayString ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "255a"
+    STATUS       current
+    SYNTAX       OCTET STRING (SIZE (0..255))
+
+PhysAddress ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "1x:"
+    STATUS       current
+    SYNTAX       OCTET STRING
+
+MacAddress ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "1x:"
+    STATUS       current
+    SYNTAX       OCTET STRING (SIZE (6))
+
+TruthValue ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       INTEGER { true(1), false(2) }
+
+TimeStamp ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       TimeTicks
+
+TimeInterval ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       INTEGER (0..2147483647)
+
+DateAndTime ::= TEXTUAL-CONVENTION
+    DISPLAY-HINT "2d-1d-1d,1d:1d:1d.1d,1a1d:1d"
+    STATUS       current
+    SYNTAX       OCTET STRING (SIZE (8 | 11))
+
+AutonomousType ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       OBJECT IDENTIFIER
+
+VariablePointer ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       OBJECT IDENTIFIER
+
+RowPointer ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       OBJECT IDENTIFIER
+
+TestAndIncr ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       INTEGER (0..2147483647)
+
+RowStatus ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       INTEGER { active(1), notInService(2), notReady(3), createAndGo(4), createAndWait(5), destroy(6) }
+
+StorageType ::= TEXTUAL-CONVENTION
+    STATUS       current
+    SYNTAX       INTEGER { other(1), volatile(2), nonVolatile(3), permanent(4), readOnly(5) }
+
+END
+`}
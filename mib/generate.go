@@ -0,0 +1,364 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mib
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/kosctelecom/horus/log"
+	"github.com/kosctelecom/horus/model"
+)
+
+// Definitions is the list of measures generated from MIB objects.
+type Definitions struct {
+	// ScalarMeasures is the list of scalar measures, one per group of scalar objects.
+	ScalarMeasures []model.ScalarMeasure
+
+	// IndexedMeasures is the list of indexed measures, one per table.
+	IndexedMeasures []model.IndexedMeasure
+}
+
+// Generate builds the measures of the readable objects of the named modules
+// or subtrees (like `IF-MIB` or `ifXTable`). The metric and measure ids are
+// numbered from startID.
+func (m *Mib) Generate(names []string, startID int) (*Definitions, error) {
+	seen := make(map[string]bool)
+	var nodes []*Node
+	for _, name := range names {
+		var candidates []*Node
+		if mod := m.modules[name]; mod != nil {
+			candidates = mod.Nodes
+		} else if node := m.Node(name); node != nil && node.Oid != "" {
+			candidates = m.Subtree(node)
+		} else {
+			return nil, fmt.Errorf("unknown module or object %s", name)
+		}
+		for _, node := range candidates {
+			if node.Oid != "" && !seen[node.Oid] {
+				seen[node.Oid] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return oidLess(nodes[i].Oid, nodes[j].Oid) })
+
+	defs := new(Definitions)
+	scalarPos, indexedPos := make(map[string]int), make(map[string]int)
+	keyIndexed := make(map[string]bool)
+	addrTypes := make(map[string]string)
+	metricID, measureID := startID, startID
+	for _, node := range nodes {
+		if node.Macro != "OBJECT-TYPE" || !readable(node) || node.Status == "obsolete" {
+			continue
+		}
+		parent := m.Parent(node)
+		if parent == nil {
+			log.Warningf("mib: %s::%s: parent node not found, skipping", node.Module, node.Name)
+			continue
+		}
+		isColumn := parent.Macro == "OBJECT-TYPE" && (len(parent.Index) > 0 || parent.Augments != "")
+		var pattern string
+		if isColumn {
+			var err error
+			if pattern, err = m.indexPattern(node, parent); err != nil {
+				log.Warningf("mib: %s::%s: %v, skipping", node.Module, node.Name, err)
+				continue
+			}
+		}
+		metric, ok := m.metric(node, isColumn, pattern)
+		if !ok {
+			continue
+		}
+		metric.ID = metricID
+		metricID++
+		// an InetAddress is decoded with the preceding InetAddressType object of its parent
+		switch ti := m.resolveType(node.Module, node.Syntax); {
+		case ti.is("InetAddressType"):
+			addrTypes[parent.Oid] = metric.Name
+		case ti.is("InetAddress") && addrTypes[parent.Oid] != "":
+			metric.PostProcessors = []string{model.InetAddressPostProcessor + addrTypes[parent.Oid]}
+		}
+
+		if !isColumn {
+			pos, ok := scalarPos[parent.Oid]
+			if !ok {
+				pos = len(defs.ScalarMeasures)
+				scalarPos[parent.Oid] = pos
+				defs.ScalarMeasures = append(defs.ScalarMeasures, model.ScalarMeasure{
+					ID:          measureID,
+					Name:        parent.Name,
+					Description: measureDescription(parent, "scalar objects of "+parent.Name),
+					ToKafka:     true,
+					ToProm:      true,
+					ToNats:      true,
+				})
+				measureID++
+			}
+			defs.ScalarMeasures[pos].Metrics = append(defs.ScalarMeasures[pos].Metrics, metric)
+			continue
+		}
+
+		table := m.Parent(parent)
+		if table == nil {
+			log.Warningf("mib: %s::%s: table not found, skipping", node.Module, node.Name)
+			continue
+		}
+		pos, ok := indexedPos[table.Oid]
+		if !ok {
+			pos = len(defs.IndexedMeasures)
+			indexedPos[table.Oid] = pos
+			defs.IndexedMeasures = append(defs.IndexedMeasures, model.IndexedMeasure{
+				ID:          measureID,
+				Name:        table.Name,
+				Description: measureDescription(table, "columns of "+table.Name),
+				ToKafka:     true,
+				ToProm:      true,
+				ToNats:      true,
+			})
+			measureID++
+		}
+		// the index metric is the first readable index object of the row, or the first column
+		meas := &defs.IndexedMeasures[pos]
+		if !meas.IndexMetricID.Valid || (!keyIndexed[table.Oid] && isIndexOf(node, parent)) {
+			meas.IndexMetricID = model.NullInt64{Int64: int64(metric.ID), Valid: true}
+			meas.IndexPos = len(meas.Metrics)
+			keyIndexed[table.Oid] = isIndexOf(node, parent)
+		}
+		meas.Metrics = append(meas.Metrics, metric)
+	}
+	return defs, nil
+}
+
+// isIndexOf tells whether node is an INDEX component of row.
+func isIndexOf(node, row *Node) bool {
+	for _, part := range row.Index {
+		if part.Name == node.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// readable tells whether the object value can be read.
+func readable(node *Node) bool {
+	switch node.Access {
+	case "read-only", "read-write", "read-create":
+		return true
+	}
+	return false
+}
+
+// metric builds the metric of an object. The post-processors and label flag are
+// deduced from the object syntax. Returns false for unsupported syntaxes.
+func (m *Mib) metric(node *Node, isColumn bool, pattern string) (model.Metric, bool) {
+	metric := model.Metric{
+		Name:         node.Name,
+		Oid:          model.OID(node.Oid),
+		Active:       true,
+		ExportedName: node.Name,
+		IndexPattern: pattern,
+	}
+	if !isColumn {
+		metric.Oid += ".0"
+	}
+	ti := m.resolveType(node.Module, node.Syntax)
+	switch {
+	case ti.is("IpAddress", "NetworkAddress"):
+		metric.ExportAsLabel = true
+	case ti.is("MacAddress"):
+		metric.ExportAsLabel = true
+		metric.PostProcessors = []string{"mac"}
+	case ti.is("PhysAddress"):
+		metric.ExportAsLabel = true
+		metric.PostProcessors = []string{"hex"}
+	case ti.is("InetAddressDNS"):
+		metric.ExportAsLabel = true
+	case ti.is("InetAddress", "InetAddressIPv4", "InetAddressIPv6", "InetAddressIPv4z", "InetAddressIPv6z"):
+		metric.ExportAsLabel = true
+		metric.PostProcessors = []string{"inet-address"}
+	case ti.is("DateAndTime"):
+		metric.PostProcessors = []string{"date-and-time-epoch"}
+	case ti.is("Opaque"):
+		log.Debugf("mib: %s::%s: opaque syntax not supported, skipping", node.Module, node.Name)
+		return metric, false
+	case ti.is("TimeTicks", "TimeStamp", "TimeInterval"):
+		metric.PostProcessors = []string{"div:100"}
+	case ti.base == typeBits:
+		metric.PostProcessors = []string{"bits"}
+	case ti.base == typeOctets, ti.base == typeOID:
+		metric.ExportAsLabel = true
+	case ti.base == typeInteger:
+	default:
+		log.Warningf("mib: %s::%s: unsupported syntax %v, skipping", node.Module, node.Name, ti.names)
+		return metric, false
+	}
+
+	desc := strings.Join(strings.Fields(node.Description), " ")
+	if len(ti.enums) > 0 {
+		values := make([]string, len(ti.enums))
+		for i, e := range ti.enums {
+			values[i] = fmt.Sprintf("%s(%d)", e.Name, e.Value)
+		}
+		label := "Possible values"
+		if ti.base == typeBits {
+			label = "Bits"
+		}
+		desc = strings.TrimSpace(fmt.Sprintf("%s %s: %s.", desc, label, strings.Join(values, ", ")))
+	}
+	if node.Units != "" {
+		desc = strings.TrimSpace(fmt.Sprintf("%s Units: %s.", desc, node.Units))
+	}
+	metric.Description = desc
+	return metric, true
+}
+
+// measureDescription returns the node description or def if empty.
+func measureDescription(node *Node, def string) string {
+	if desc := strings.Join(strings.Fields(node.Description), " "); desc != "" {
+		return desc
+	}
+	return def
+}
+
+// groupNamePat matches the chars not allowed in a regexp group name.
+var groupNamePat = regexp.MustCompile(`\W`)
+
+// indexPattern builds the index pattern of a column from the INDEX clause of its
+// row, with a named capture group per index object. The pattern is only needed
+// (and returned non-empty) when the index has multiple components or contains
+// a length prefixed string whose length must be stripped from the index.
+func (m *Mib) indexPattern(column, row *Node) (string, error) {
+	index := row.Index
+	if row.Augments != "" {
+		_, augmented := m.lookup(m.modules[row.Module], row.Augments)
+		if augmented == nil {
+			return "", fmt.Errorf("augmented row %s not found", row.Augments)
+		}
+		index = augmented.Index
+	}
+	if len(index) == 0 {
+		return "", fmt.Errorf("row %s has no index", row.Name)
+	}
+	var needed bool
+	parts := make([]string, len(index))
+	for i, part := range index {
+		_, obj := m.lookup(m.modules[row.Module], part.Name)
+		if obj == nil {
+			return "", fmt.Errorf("index object %s not found", part.Name)
+		}
+		ti := m.resolveType(obj.Module, obj.Syntax)
+		var expr, prefix string
+		switch {
+		case ti.is("IpAddress"):
+			expr = `\d+.\d+.\d+.\d+`
+		case ti.base == typeOctets || ti.base == typeOID:
+			switch {
+			case ti.size > 0:
+				expr = strings.Repeat(`\d+.`, ti.size-1) + `\d+`
+			case i < len(index)-1:
+				expr = `\d+(?:.\d+)*?`
+			default:
+				expr = `\d+(?:.\d+)*`
+			}
+			if ti.size == 0 && !part.Implied {
+				prefix = `\d+.`
+				needed = true
+			}
+		default:
+			expr = `\d+`
+		}
+		parts[i] = fmt.Sprintf("%s(?P<%s>%s)", prefix, groupNamePat.ReplaceAllString(part.Name, "_"), expr)
+	}
+	if !needed && len(index) == 1 {
+		return "", nil
+	}
+	return column.Oid + "." + strings.Join(parts, ".") + "$", nil
+}
+
+// WriteSQL writes the definitions as SQL insert statements for the metrics,
+// measures and measure_metrics tables and, if profileID is not 0, for the
+// profile_measures table. The id sequences are updated at the end.
+func (defs *Definitions) WriteSQL(w io.Writer, profileID int) error {
+	type measure struct {
+		id         int
+		name, desc string
+		indexed    bool
+		indexID    model.NullInt64
+		metrics    []model.Metric
+	}
+	var measures []measure
+	for _, sm := range defs.ScalarMeasures {
+		measures = append(measures, measure{sm.ID, sm.Name, sm.Description, false, model.NullInt64{}, sm.Metrics})
+	}
+	for _, im := range defs.IndexedMeasures {
+		measures = append(measures, measure{im.ID, im.Name, im.Description, true, im.IndexMetricID, im.Metrics})
+	}
+	if len(measures) == 0 {
+		return fmt.Errorf("no measure to write")
+	}
+	sort.Slice(measures, func(i, j int) bool { return measures[i].id < measures[j].id })
+
+	var metrics []model.Metric
+	var measureRows, linkRows, profileRows []string
+	for _, meas := range measures {
+		indexID := "NULL"
+		if meas.indexID.Valid {
+			indexID = fmt.Sprint(meas.indexID.Int64)
+		}
+		measureRows = append(measureRows, fmt.Sprintf("(%d, %s, %s, %t, %s, true, true, false, true)",
+			meas.id, quote(meas.name), quote(meas.desc), meas.indexed, indexID))
+		for _, metric := range meas.metrics {
+			metrics = append(metrics, metric)
+			linkRows = append(linkRows, fmt.Sprintf("(%d, %d)", meas.id, metric.ID))
+		}
+		if profileID != 0 {
+			profileRows = append(profileRows, fmt.Sprintf("(%d, %d)", profileID, meas.id))
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	metricRows := make([]string, len(metrics))
+	for i, metric := range metrics {
+		metricRows[i] = fmt.Sprintf("(%d, true, %s, %s, %s, %t, %s, %s, %s)",
+			metric.ID, quote(metric.Name), quote(string(metric.Oid)), quote(metric.Description), metric.ExportAsLabel,
+			quote("{"+strings.Join(metric.PostProcessors, ",")+"}"), quote(metric.ExportedName), quote(metric.IndexPattern))
+	}
+
+	var b strings.Builder
+	b.WriteString("BEGIN;\n\n")
+	b.WriteString("INSERT INTO metrics (id, active, name, oid, description, export_as_label, post_processors, exported_name, index_pattern) VALUES\n")
+	b.WriteString(strings.Join(metricRows, ",\n") + ";\n\n")
+	b.WriteString("INSERT INTO measures (id, name, description, is_indexed, index_metric_id, to_kafka, to_prometheus, to_influx, to_nats) VALUES\n")
+	b.WriteString(strings.Join(measureRows, ",\n") + ";\n\n")
+	b.WriteString("INSERT INTO measure_metrics (measure_id, metric_id) VALUES\n")
+	b.WriteString(strings.Join(linkRows, ",\n") + ";\n\n")
+	if len(profileRows) > 0 {
+		b.WriteString("INSERT INTO profile_measures (profile_id, measure_id) VALUES\n")
+		b.WriteString(strings.Join(profileRows, ",\n") + ";\n\n")
+	}
+	b.WriteString("SELECT setval('metrics_id_seq', (SELECT max(id) FROM metrics));\n")
+	b.WriteString("SELECT setval('measures_id_seq', (SELECT max(id) FROM measures));\n\n")
+	b.WriteString("COMMIT;\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// quote returns s as an SQL string literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
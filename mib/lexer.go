@@ -0,0 +1,130 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokenKind is the kind of a lexical token.
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokBinString
+	tokSymbol
+)
+
+// token is a lexical token of a MIB file.
+type token struct {
+	kind tokenKind
+	val  string
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokString:
+		return fmt.Sprintf("string at line %d", t.line)
+	default:
+		return fmt.Sprintf("`%s` at line %d", t.val, t.line)
+	}
+}
+
+// symbols lists the multi-char symbols, longest first.
+var symbols = []string{"::=", "..", "{", "}", "(", ")", "[", "]", ",", ";", "|", ".", "<", ">", "-", "@"}
+
+// tokenize splits the content of a MIB file into tokens. The comments starting
+// with `--` and ending at the end of line or at the next `--` are dropped.
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+		switch {
+		case c == '\n':
+			line++
+			pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			pos++
+		case strings.HasPrefix(src[pos:], "--"):
+			pos += 2
+			for pos < len(src) && src[pos] != '\n' {
+				if strings.HasPrefix(src[pos:], "--") {
+					pos += 2
+					break
+				}
+				pos++
+			}
+		case c == '"':
+			end := strings.IndexByte(src[pos+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			str := src[pos+1 : pos+1+end]
+			tokens = append(tokens, token{tokString, str, line})
+			line += strings.Count(str, "\n")
+			pos += end + 2
+		case c == '\'':
+			end := strings.IndexByte(src[pos+1:], '\'')
+			if end < 0 || pos+end+2 >= len(src) {
+				return nil, fmt.Errorf("line %d: unterminated binary string", line)
+			}
+			tokens = append(tokens, token{tokBinString, src[pos : pos+end+3], line})
+			pos += end + 3
+		case isDigit(c):
+			start := pos
+			for pos < len(src) && isDigit(src[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:pos], line})
+		case isLetter(c):
+			start := pos
+			for pos < len(src) && (isLetter(src[pos]) || isDigit(src[pos]) || src[pos] == '_' ||
+				(src[pos] == '-' && !strings.HasPrefix(src[pos:], "--"))) {
+				pos++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:pos], line})
+		default:
+			var sym string
+			for _, s := range symbols {
+				if strings.HasPrefix(src[pos:], s) {
+					sym = s
+					break
+				}
+			}
+			if sym == "" {
+				return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+			}
+			tokens = append(tokens, token{tokSymbol, sym, line})
+			pos += len(sym)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, line: line}), nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
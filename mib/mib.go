@@ -0,0 +1,470 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mib is a minimal SMIv1/SMIv2 MIB parser. It resolves the object
+// names of a set of MIB modules to their OIDs and builds the horus metric and
+// measure definitions of their objects.
+package mib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kosctelecom/horus/log"
+)
+
+// Primitive type names.
+const (
+	typeInteger    = "INTEGER"
+	typeOctets     = "OCTET STRING"
+	typeOID        = "OBJECT IDENTIFIER"
+	typeBits       = "BITS"
+	typeSequenceOf = "SEQUENCE OF"
+)
+
+// Module is a parsed MIB module.
+type Module struct {
+	// Name is the module name like IF-MIB.
+	Name string
+
+	// File is the file the module was loaded from, empty for the builtin modules.
+	File string
+
+	// Nodes is the list of oid definitions of the module, in definition order.
+	Nodes []*Node
+
+	imports map[string]string
+	nodes   map[string]*Node
+	types   map[string]*Type
+}
+
+func (mod *Module) addNode(node *Node) {
+	node.Module = mod.Name
+	if _, ok := mod.nodes[node.Name]; !ok {
+		mod.Nodes = append(mod.Nodes, node)
+	}
+	mod.nodes[node.Name] = node
+}
+
+// Node is an oid definition: an OBJECT IDENTIFIER value or a macro invocation
+// like OBJECT-TYPE or MODULE-IDENTITY.
+type Node struct {
+	// Name is the object name.
+	Name string
+
+	// Module is the name of the module defining the object.
+	Module string
+
+	// Macro is the macro defining the node: OBJECT-TYPE, MODULE-IDENTITY...
+	// or `OBJECT IDENTIFIER` for a value assignment.
+	Macro string
+
+	// Oid is the resolved node OID, empty if unresolved.
+	Oid string
+
+	// Syntax is the object type syntax.
+	Syntax *Type
+
+	// Units is the object UNITS clause.
+	Units string
+
+	// Access is the object MAX-ACCESS (or SMIv1 ACCESS) clause.
+	Access string
+
+	// Status is the object status: current, deprecated, obsolete (or SMIv1 mandatory, optional).
+	Status string
+
+	// Description is the object description.
+	Description string
+
+	// Index is the INDEX clause of a row.
+	Index []IndexPart
+
+	// Augments is the augmented row name of a row with an AUGMENTS clause.
+	Augments string
+
+	oidValue []oidComponent
+}
+
+// IndexPart is a component of the INDEX clause of a row.
+type IndexPart struct {
+	// Name is the index object name.
+	Name string
+
+	// Implied tells if the index object has the IMPLIED keyword (no length prefix).
+	Implied bool
+}
+
+// Type is an object syntax or a type definition.
+type Type struct {
+	// Name is the primitive type name (INTEGER, OCTET STRING, OBJECT IDENTIFIER,
+	// BITS, SEQUENCE OF...) or the referenced type name.
+	Name string
+
+	// Elem is the row type name of a SEQUENCE OF.
+	Elem string
+
+	// Enums is the list of named numbers of an INTEGER or named bits of BITS.
+	Enums []Enum
+
+	// Size is the fixed size of a string, 0 if not fixed.
+	Size int
+
+	// TC tells if the type is defined as a TEXTUAL-CONVENTION.
+	TC bool
+
+	// DisplayHint is the DISPLAY-HINT of a textual convention.
+	DisplayHint string
+}
+
+// Enum is a named number or a named bit.
+type Enum struct {
+	Name  string
+	Value int
+}
+
+// oidComponent is a component of an oid value: a name, a number or both.
+type oidComponent struct {
+	name   string
+	num    int
+	hasNum bool
+}
+
+// Mib is a set of loaded MIB modules with their resolved OIDs.
+type Mib struct {
+	modules map[string]*Module
+	order   []string
+	byOid   map[string]*Node
+}
+
+// rootOids are the top level arcs of the oid tree.
+var rootOids = map[string]string{
+	"ccitt":           ".0",
+	"iso":             ".1",
+	"joint-iso-ccitt": ".2",
+}
+
+// New returns a Mib with only the builtin modules loaded.
+func New() *Mib {
+	m := &Mib{modules: make(map[string]*Module)}
+	for _, src := range builtinModules {
+		modules, err := parseModules(src)
+		if err != nil {
+			panic(fmt.Sprintf("builtin mib: %v", err))
+		}
+		for _, mod := range modules {
+			m.add(mod)
+		}
+	}
+	m.resolve()
+	return m
+}
+
+// Load parses all the MIB files of dir and resolves their OIDs. Files that
+// cannot be parsed are skipped with a warning.
+func Load(dir string) (*Mib, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read mib dir: %v", err)
+	}
+	m := New()
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		if err := m.LoadFile(path); err != nil {
+			log.Warningf("mib: %v, skipping", err)
+		}
+	}
+	m.resolve()
+	return m, nil
+}
+
+// LoadFile parses the modules of a MIB file. The OIDs are only resolved on
+// the next Load or Resolve call.
+func (m *Mib) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	modules, err := parseModules(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, mod := range modules {
+		mod.File = path
+		m.add(mod)
+	}
+	return nil
+}
+
+// add adds a module, replacing any previous module with the same name.
+func (m *Mib) add(mod *Module) {
+	if _, ok := m.modules[mod.Name]; !ok {
+		m.order = append(m.order, mod.Name)
+	}
+	m.modules[mod.Name] = mod
+}
+
+// Module returns the module with the given name or nil if not loaded.
+func (m *Mib) Module(name string) *Module {
+	return m.modules[name]
+}
+
+// Modules returns the list of the loaded modules, builtin ones included.
+func (m *Mib) Modules() []*Module {
+	res := make([]*Module, len(m.order))
+	for i, name := range m.order {
+		res[i] = m.modules[name]
+	}
+	return res
+}
+
+// Node returns the node with the given name, which can be qualified by its
+// module like `IF-MIB::ifDescr`. Returns nil if not found.
+func (m *Mib) Node(name string) *Node {
+	if i := strings.Index(name, "::"); i > 0 {
+		mod := m.modules[name[:i]]
+		if mod == nil {
+			return nil
+		}
+		return mod.nodes[name[i+2:]]
+	}
+	for i := len(m.order) - 1; i >= 0; i-- {
+		if node, ok := m.modules[m.order[i]].nodes[name]; ok {
+			return node
+		}
+	}
+	return nil
+}
+
+// ResolveOID returns the numeric oid of a symbolic oid name, optionally qualified
+// by its module and followed by a numeric suffix, like `IF-MIB::ifDescr`
+// or `sysUpTime.0`.
+func (m *Mib) ResolveOID(name string) (string, error) {
+	obj, suffix := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		obj, suffix = name[:i], name[i:]
+	}
+	node := m.Node(obj)
+	if node == nil {
+		return "", fmt.Errorf("unknown object %s", obj)
+	}
+	if node.Oid == "" {
+		return "", fmt.Errorf("object %s has no resolved oid", obj)
+	}
+	return node.Oid + suffix, nil
+}
+
+// NodeByOid returns the node with the given oid or nil if not found.
+func (m *Mib) NodeByOid(oid string) *Node {
+	return m.byOid[oid]
+}
+
+// Subtree returns the nodes with a resolved oid under (and including) node,
+// sorted by oid.
+func (m *Mib) Subtree(node *Node) []*Node {
+	var res []*Node
+	for oid, n := range m.byOid {
+		if oid == node.Oid || strings.HasPrefix(oid, node.Oid+".") {
+			res = append(res, n)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return oidLess(res[i].Oid, res[j].Oid) })
+	return res
+}
+
+// Parent returns the node whose oid is the parent of node's oid, or nil.
+func (m *Mib) Parent(node *Node) *Node {
+	if i := strings.LastIndex(node.Oid, "."); i > 0 {
+		return m.byOid[node.Oid[:i]]
+	}
+	return nil
+}
+
+// Resolve resolves the OIDs of all the nodes of the loaded modules. Nodes
+// depending on undefined symbols are left unresolved with a warning.
+func (m *Mib) Resolve() {
+	m.resolve()
+}
+
+func (m *Mib) resolve() {
+	m.byOid = make(map[string]*Node)
+	for _, name := range m.order {
+		for _, node := range m.modules[name].Nodes {
+			node.Oid = ""
+		}
+	}
+	for _, name := range m.order {
+		mod := m.modules[name]
+		for _, node := range mod.Nodes {
+			if err := m.resolveNode(mod, node, 0); err != nil {
+				if mod.File != "" {
+					log.Warningf("mib: %s::%s: %v", mod.Name, node.Name, err)
+				}
+				continue
+			}
+			if prev, ok := m.byOid[node.Oid]; !ok || prev.Macro == "OBJECT IDENTIFIER" {
+				m.byOid[node.Oid] = node
+			}
+		}
+	}
+}
+
+// resolveNode computes the node oid from its oid value.
+func (m *Mib) resolveNode(mod *Module, node *Node, depth int) error {
+	if node.Oid != "" {
+		return nil
+	}
+	if depth > 64 {
+		return fmt.Errorf("oid definition loop")
+	}
+	var oid string
+	for i, comp := range node.oidValue {
+		switch {
+		case i > 0 && comp.hasNum:
+			oid += "." + strconv.Itoa(comp.num)
+		case i > 0:
+			return fmt.Errorf("invalid oid component %s", comp.name)
+		case comp.hasNum && comp.name == "":
+			oid = "." + strconv.Itoa(comp.num)
+		default:
+			if root, ok := rootOids[comp.name]; ok {
+				oid = root
+				continue
+			}
+			parentMod, parent := m.lookup(mod, comp.name)
+			if parent == nil {
+				return fmt.Errorf("undefined symbol %s", comp.name)
+			}
+			if err := m.resolveNode(parentMod, parent, depth+1); err != nil {
+				return err
+			}
+			oid = parent.Oid
+		}
+	}
+	node.Oid = oid
+	return nil
+}
+
+// lookup finds a node referenced from mod: defined in the module itself,
+// imported from another module or, if the imported module is not loaded, defined
+// in any other module.
+func (m *Mib) lookup(mod *Module, name string) (*Module, *Node) {
+	if node, ok := mod.nodes[name]; ok {
+		return mod, node
+	}
+	if from, ok := mod.imports[name]; ok {
+		if imported := m.modules[from]; imported != nil {
+			if node, ok := imported.nodes[name]; ok {
+				return imported, node
+			}
+		}
+	}
+	for i := len(m.order) - 1; i >= 0; i-- {
+		other := m.modules[m.order[i]]
+		if node, ok := other.nodes[name]; ok {
+			return other, node
+		}
+	}
+	return nil, nil
+}
+
+// lookupType finds a type referenced from mod, like lookup does for nodes.
+func (m *Mib) lookupType(mod *Module, name string) (*Module, *Type) {
+	if typ, ok := mod.types[name]; ok {
+		return mod, typ
+	}
+	if from, ok := mod.imports[name]; ok {
+		if imported := m.modules[from]; imported != nil {
+			if typ, ok := imported.types[name]; ok {
+				return imported, typ
+			}
+		}
+	}
+	for i := len(m.order) - 1; i >= 0; i-- {
+		other := m.modules[m.order[i]]
+		if typ, ok := other.types[name]; ok {
+			return other, typ
+		}
+	}
+	return nil, nil
+}
+
+// typeInfo is a type resolved down to its primitive type.
+type typeInfo struct {
+	// base is the primitive type, empty if unknown.
+	base string
+
+	// names is the chain of the type names, from the syntax to the primitive.
+	names []string
+
+	enums []Enum
+	size  int
+}
+
+// is tells if the type is or derives from the named type.
+func (ti typeInfo) is(names ...string) bool {
+	for _, n := range ti.names {
+		for _, name := range names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveType follows the type references of a node syntax down to the primitive type.
+func (m *Mib) resolveType(modName string, typ *Type) typeInfo {
+	var ti typeInfo
+	mod := m.modules[modName]
+	for depth := 0; typ != nil && depth < 32; depth++ {
+		ti.names = append(ti.names, typ.Name)
+		if ti.enums == nil {
+			ti.enums = typ.Enums
+		}
+		if ti.size == 0 {
+			ti.size = typ.Size
+		}
+		switch typ.Name {
+		case typeInteger, typeOctets, typeOID, typeBits, typeSequenceOf, "SEQUENCE", "CHOICE":
+			ti.base = typ.Name
+			return ti
+		}
+		if mod == nil {
+			break
+		}
+		mod, typ = m.lookupType(mod, typ.Name)
+	}
+	return ti
+}
+
+// oidLess compares 2 dotted oids numerically.
+func oidLess(a, b string) bool {
+	as, bs := strings.Split(strings.TrimPrefix(a, "."), "."), strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,164 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mib
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kosctelecom/horus/model"
+)
+
+func TestResolve(t *testing.T) {
+	m, err := Load("testdata")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if m.Module("BROKEN-MIB") != nil {
+		t.Errorf("BROKEN-MIB should not be loaded")
+	}
+	tests := []struct {
+		name string
+		oid  string
+	}{
+		{"iso", ""},
+		{"enterprises", ".1.3.6.1.4.1"},
+		{"horusTestMIB", ".1.3.6.1.4.1.99999"},
+		{"testName", ".1.3.6.1.4.1.99999.1.1.1"},
+		{"HORUS-TEST-MIB::testPortState", ".1.3.6.1.4.1.99999.1.2.1.3"},
+		{"IF-MIB::ifDescr", ""},
+		{"testPortDown", ".1.3.6.1.4.1.99999.0.1"},
+		{"unknownObject", ""},
+	}
+	for _, tt := range tests {
+		var oid string
+		if node := m.Node(tt.name); node != nil {
+			oid = node.Oid
+		}
+		if oid != tt.oid {
+			t.Errorf("resolve %s: expected oid `%s`, got `%s`", tt.name, tt.oid, oid)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	m, err := Load("testdata")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := m.Generate([]string{"NO-SUCH-MIB"}, 1); err == nil {
+		t.Errorf("generate unknown module: expected error")
+	}
+	defs, err := m.Generate([]string{"HORUS-TEST-MIB"}, 100)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	type metricDef struct {
+		ID      int
+		Oid     string
+		Label   bool
+		PPs     string
+		Pattern string
+	}
+	metrics := make(map[string]metricDef)
+	measures := make(map[string][]string)
+	for _, sm := range defs.ScalarMeasures {
+		for _, metric := range sm.Metrics {
+			measures[sm.Name] = append(measures[sm.Name], metric.Name)
+			metrics[metric.Name] = metricDef{metric.ID, string(metric.Oid), metric.ExportAsLabel, strings.Join(metric.PostProcessors, ","), metric.IndexPattern}
+		}
+	}
+	indexes := make(map[string]int64)
+	for _, im := range defs.IndexedMeasures {
+		indexes[im.Name] = im.IndexMetricID.Int64
+		for _, metric := range im.Metrics {
+			measures[im.Name] = append(measures[im.Name], metric.Name)
+			metrics[metric.Name] = metricDef{metric.ID, string(metric.Oid), metric.ExportAsLabel, strings.Join(metric.PostProcessors, ","), metric.IndexPattern}
+		}
+	}
+
+	expectedMeasures := map[string][]string{
+		"testSystem":        {"testName", "testUpTime", "testClock"},
+		"testPortTable":     {"testPortName", "testPortState", "testPortMac", "testPortAlarms", "testPortInBytes"},
+		"testPortExtTable":  {"testPortPromisc"},
+		"testNeighborTable": {"testNeighborAddr", "testNeighborName"},
+		"testPeerTable":     {"testPeerAddrType", "testPeerAddr"},
+	}
+	if !reflect.DeepEqual(measures, expectedMeasures) {
+		t.Errorf("generate: expected measures %v, got %v", expectedMeasures, measures)
+	}
+	expectedMetrics := map[string]metricDef{
+		"testName":         {100, ".1.3.6.1.4.1.99999.1.1.1.0", true, "", ""},
+		"testUpTime":       {101, ".1.3.6.1.4.1.99999.1.1.2.0", false, "div:100", ""},
+		"testClock":        {102, ".1.3.6.1.4.1.99999.1.1.3.0", false, "date-and-time-epoch", ""},
+		"testPortName":     {103, ".1.3.6.1.4.1.99999.1.2.1.2", true, "", ""},
+		"testPortState":    {104, ".1.3.6.1.4.1.99999.1.2.1.3", false, "", ""},
+		"testPortMac":      {105, ".1.3.6.1.4.1.99999.1.2.1.4", true, "mac", ""},
+		"testPortAlarms":   {106, ".1.3.6.1.4.1.99999.1.2.1.5", false, "bits", ""},
+		"testPortInBytes":  {107, ".1.3.6.1.4.1.99999.1.2.1.6", false, "", ""},
+		"testPortPromisc":  {108, ".1.3.6.1.4.1.99999.1.3.1.1", false, "", ""},
+		"testNeighborAddr": {109, ".1.3.6.1.4.1.99999.1.4.1.1", true, "", `.1.3.6.1.4.1.99999.1.4.1.1.(?P<testPortIndex>\d+).(?P<testNeighborAddr>\d+.\d+.\d+.\d+).(?P<testNeighborName>\d+(?:.\d+)*)$`},
+		"testNeighborName": {110, ".1.3.6.1.4.1.99999.1.4.1.2", true, "", `.1.3.6.1.4.1.99999.1.4.1.2.(?P<testPortIndex>\d+).(?P<testNeighborAddr>\d+.\d+.\d+.\d+).(?P<testNeighborName>\d+(?:.\d+)*)$`},
+		"testPeerAddrType": {111, ".1.3.6.1.4.1.99999.1.5.1.1", false, "", ""},
+		"testPeerAddr":     {112, ".1.3.6.1.4.1.99999.1.5.1.2", true, "inet-address:testPeerAddrType", ""},
+	}
+	for name, expected := range expectedMetrics {
+		if metrics[name] != expected {
+			t.Errorf("generate %s: expected %+v, got %+v", name, expected, metrics[name])
+		}
+	}
+	if indexes["testPortTable"] != 103 || indexes["testNeighborTable"] != 109 {
+		t.Errorf("generate: unexpected index metrics %v", indexes)
+	}
+
+	// the generated definitions must be valid requests for the agent
+	data, err := json.Marshal(defs)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var req struct {
+		ScalarMeasures  []model.ScalarMeasure
+		IndexedMeasures []model.IndexedMeasure
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("unmarshal generated definitions: %v", err)
+	}
+	re := req.IndexedMeasures[2].Metrics[1].IndexRegex
+	if re == nil {
+		t.Fatalf("testNeighborName: nil index regex")
+	}
+	sub := re.FindStringSubmatch(".1.3.6.1.4.1.99999.1.4.1.2.7.10.0.0.1.114.49")
+	if strings.Join(sub[1:], ".") != "7.10.0.0.1.114.49" {
+		t.Errorf("testNeighborName: unexpected index submatches %v", sub)
+	}
+
+	var buf bytes.Buffer
+	if err := defs.WriteSQL(&buf, 3); err != nil {
+		t.Fatalf("write sql: %v", err)
+	}
+	for _, expected := range []string{
+		"(101, true, 'testUpTime', '.1.3.6.1.4.1.99999.1.1.2.0', 'The uptime.', false, '{div:100}', 'testUpTime', '')",
+		"(101, 'testPortTable', 'The port table.', true, 103, true, true, false, true)",
+		"(3, 103)",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("write sql: `%s` not found in:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,478 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// parser is a recursive descent parser of SMI modules. It only keeps the
+// definitions needed to build metrics: the oid assignments, the object types
+// and the type assignments. The macro definitions are skipped.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parseModules parses all the modules defined in src.
+func parseModules(src string) ([]*Module, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	var modules []*Module
+	for p.peek().kind != tokEOF {
+		mod, err := p.parseModule()
+		if err != nil {
+			return modules, err
+		}
+		modules = append(modules, mod)
+	}
+	return modules, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(val string) error {
+	if t := p.next(); t.val != val || t.kind == tokString {
+		return fmt.Errorf("expected `%s`, got %s", val, t)
+	}
+	return nil
+}
+
+func (p *parser) expectKind(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s, got %s", what, t)
+	}
+	return t, nil
+}
+
+// skipBalanced skips a block enclosed in braces or parentheses and returns
+// the tokens inside.
+func (p *parser) skipBalanced() ([]token, error) {
+	open := p.next()
+	if open.val != "{" && open.val != "(" {
+		return nil, fmt.Errorf("expected `{` or `(`, got %s", open)
+	}
+	var inner []token
+	depth := 1
+	for {
+		t := p.next()
+		switch {
+		case t.kind == tokEOF:
+			return nil, fmt.Errorf("unbalanced %s", open)
+		case t.kind == tokSymbol && (t.val == "{" || t.val == "("):
+			depth++
+		case t.kind == tokSymbol && (t.val == "}" || t.val == ")"):
+			depth--
+		}
+		if depth == 0 {
+			return inner, nil
+		}
+		inner = append(inner, t)
+	}
+}
+
+// skipTo skips all tokens up to the given value, included.
+func (p *parser) skipTo(val string) error {
+	for {
+		t := p.next()
+		if t.kind == tokEOF {
+			return fmt.Errorf("expected `%s` before end of file", val)
+		}
+		if t.val == val && t.kind != tokString {
+			return nil
+		}
+	}
+}
+
+func (p *parser) parseModule() (*Module, error) {
+	name, err := p.expectKind(tokIdent, "module name")
+	if err != nil {
+		return nil, err
+	}
+	mod := &Module{
+		Name:    name.val,
+		imports: make(map[string]string),
+		nodes:   make(map[string]*Node),
+		types:   make(map[string]*Type),
+	}
+	if p.peek().val == "{" {
+		// module oid (ASN.1 modules)
+		if _, err := p.skipBalanced(); err != nil {
+			return nil, fmt.Errorf("module %s: %v", mod.Name, err)
+		}
+	}
+	if err := p.expect("DEFINITIONS"); err != nil {
+		return nil, fmt.Errorf("module %s: %v", mod.Name, err)
+	}
+	if err := p.skipTo("::="); err != nil {
+		return nil, fmt.Errorf("module %s: %v", mod.Name, err)
+	}
+	if err := p.expect("BEGIN"); err != nil {
+		return nil, fmt.Errorf("module %s: %v", mod.Name, err)
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokEOF:
+			return nil, fmt.Errorf("module %s: missing END", mod.Name)
+		case t.val == "END":
+			p.next()
+			return mod, nil
+		case t.val == "IMPORTS":
+			p.next()
+			err = p.parseImports(mod)
+		case t.val == "EXPORTS":
+			err = p.skipTo(";")
+		default:
+			err = p.parseAssignment(mod)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %v", mod.Name, err)
+		}
+	}
+}
+
+// parseImports parses the import list up to the final semicolon.
+func (p *parser) parseImports(mod *Module) error {
+	var symbols []string
+	for {
+		t := p.next()
+		switch {
+		case t.kind == tokEOF:
+			return fmt.Errorf("unterminated IMPORTS")
+		case t.val == ";":
+			return nil
+		case t.val == ",":
+		case t.val == "FROM":
+			from, err := p.expectKind(tokIdent, "module name")
+			if err != nil {
+				return err
+			}
+			for _, sym := range symbols {
+				mod.imports[sym] = from.val
+			}
+			symbols = nil
+		case t.kind == tokIdent:
+			symbols = append(symbols, t.val)
+		default:
+			return fmt.Errorf("unexpected %s in IMPORTS", t)
+		}
+	}
+}
+
+// parseAssignment parses a value, type or macro assignment.
+func (p *parser) parseAssignment(mod *Module) error {
+	name, err := p.expectKind(tokIdent, "identifier")
+	if err != nil {
+		return err
+	}
+	t := p.peek()
+	switch {
+	case t.val == "MACRO":
+		p.next()
+		if err := p.expect("::="); err != nil {
+			return err
+		}
+		return p.skipTo("END")
+	case t.val == "::=":
+		p.next()
+		typ, err := p.parseTypeAssignment()
+		if err != nil {
+			return fmt.Errorf("type %s: %v", name.val, err)
+		}
+		mod.types[name.val] = typ
+		return nil
+	case t.val == "OBJECT" && p.peekN(1).val == "IDENTIFIER":
+		p.next()
+		p.next()
+		if err := p.expect("::="); err != nil {
+			return fmt.Errorf("%s: %v", name.val, err)
+		}
+		oid, err := p.parseOidValue()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name.val, err)
+		}
+		mod.addNode(&Node{Name: name.val, Macro: "OBJECT IDENTIFIER", oidValue: oid})
+		return nil
+	case t.kind == tokIdent:
+		p.next()
+		node := &Node{Name: name.val, Macro: t.val}
+		if err := p.parseClauses(node); err != nil {
+			return fmt.Errorf("%s: %v", name.val, err)
+		}
+		if p.peek().val != "{" {
+			// SMIv1 TRAP-TYPE with a trap number
+			p.next()
+			return nil
+		}
+		oid, err := p.parseOidValue()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name.val, err)
+		}
+		node.oidValue = oid
+		mod.addNode(node)
+		return nil
+	default:
+		return fmt.Errorf("unexpected %s after %s", t, name.val)
+	}
+}
+
+// parseClauses parses the clauses of a macro invocation like OBJECT-TYPE up to
+// the `::=`, included. Only the clauses describing an object are kept.
+func (p *parser) parseClauses(node *Node) error {
+	for {
+		t := p.next()
+		if t.kind == tokEOF {
+			return fmt.Errorf("missing `::=`")
+		}
+		if t.kind == tokString {
+			continue
+		}
+		var err error
+		switch t.val {
+		case "::=":
+			return nil
+		case "SYNTAX":
+			node.Syntax, err = p.parseType()
+		case "UNITS":
+			node.Units, err = p.parseString()
+		case "MAX-ACCESS", "ACCESS":
+			node.Access = p.next().val
+		case "STATUS":
+			node.Status = p.next().val
+		case "DESCRIPTION":
+			node.Description, err = p.parseString()
+		case "INDEX":
+			node.Index, err = p.parseIndex()
+		case "AUGMENTS":
+			var inner []token
+			if inner, err = p.skipBalanced(); err == nil && len(inner) > 0 {
+				node.Augments = inner[0].val
+			}
+		case "{", "(":
+			p.pos--
+			_, err = p.skipBalanced()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.val, err)
+		}
+	}
+}
+
+func (p *parser) parseString() (string, error) {
+	t, err := p.expectKind(tokString, "string")
+	return t.val, err
+}
+
+// parseTypeAssignment parses a textual convention or a type definition.
+func (p *parser) parseTypeAssignment() (*Type, error) {
+	if p.peek().val != "TEXTUAL-CONVENTION" {
+		return p.parseType()
+	}
+	p.next()
+	var hint string
+	for {
+		t := p.next()
+		switch {
+		case t.kind == tokEOF:
+			return nil, fmt.Errorf("missing SYNTAX")
+		case t.val == "DISPLAY-HINT" && t.kind == tokIdent:
+			var err error
+			if hint, err = p.parseString(); err != nil {
+				return nil, err
+			}
+		case t.val == "SYNTAX" && t.kind == tokIdent:
+			typ, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			typ.DisplayHint = hint
+			typ.TC = true
+			return typ, nil
+		}
+	}
+}
+
+// parseType parses a type with its optional enumeration and constraints.
+func (p *parser) parseType() (*Type, error) {
+	t := p.next()
+	typ := new(Type)
+	switch {
+	case t.val == "[":
+		if err := p.skipTo("]"); err != nil {
+			return nil, err
+		}
+		if v := p.peek().val; v == "IMPLICIT" || v == "EXPLICIT" {
+			p.next()
+		}
+		return p.parseType()
+	case t.val == "OBJECT":
+		if err := p.expect("IDENTIFIER"); err != nil {
+			return nil, err
+		}
+		typ.Name = typeOID
+	case t.val == "OCTET":
+		if err := p.expect("STRING"); err != nil {
+			return nil, err
+		}
+		typ.Name = typeOctets
+	case t.val == "SEQUENCE" && p.peek().val == "OF":
+		p.next()
+		elem, err := p.expectKind(tokIdent, "type name")
+		if err != nil {
+			return nil, err
+		}
+		typ.Name, typ.Elem = typeSequenceOf, elem.val
+	case t.val == "SEQUENCE" || t.val == "CHOICE":
+		if _, err := p.skipBalanced(); err != nil {
+			return nil, err
+		}
+		typ.Name = t.val
+		return typ, nil
+	case t.kind == tokIdent:
+		typ.Name = t.val
+	default:
+		return nil, fmt.Errorf("unexpected %s in type", t)
+	}
+	if p.peek().val == "{" {
+		enums, err := p.parseEnums()
+		if err != nil {
+			return nil, err
+		}
+		typ.Enums = enums
+	}
+	if p.peek().val == "(" {
+		inner, err := p.skipBalanced()
+		if err != nil {
+			return nil, err
+		}
+		// fixed size like `(SIZE (6))`
+		if len(inner) == 4 && inner[0].val == "SIZE" && inner[2].kind == tokNumber {
+			typ.Size, _ = strconv.Atoi(inner[2].val)
+		}
+	}
+	return typ, nil
+}
+
+// parseEnums parses the named numbers of an INTEGER or the named bits of BITS.
+func (p *parser) parseEnums() ([]Enum, error) {
+	inner, err := p.skipBalanced()
+	if err != nil {
+		return nil, err
+	}
+	var enums []Enum
+	for i := 0; i+3 < len(inner); {
+		name, open := inner[i], inner[i+1]
+		if name.kind != tokIdent || open.val != "(" {
+			return nil, fmt.Errorf("invalid named number at %s", name)
+		}
+		j, sign := i+2, 1
+		if inner[j].val == "-" {
+			sign, j = -1, j+1
+		}
+		val, err := strconv.Atoi(inner[j].val)
+		if err != nil || j+1 >= len(inner) || inner[j+1].val != ")" {
+			return nil, fmt.Errorf("invalid named number at %s", name)
+		}
+		enums = append(enums, Enum{Name: name.val, Value: sign * val})
+		i = j + 2
+		if i < len(inner) && inner[i].val == "," {
+			i++
+		}
+	}
+	return enums, nil
+}
+
+// parseOidValue parses an oid value like `{ ifEntry 2 }` or `{ iso org(3) 6 }`.
+func (p *parser) parseOidValue() ([]oidComponent, error) {
+	inner, err := p.skipBalanced()
+	if err != nil {
+		return nil, err
+	}
+	var comps []oidComponent
+	for i := 0; i < len(inner); i++ {
+		t := inner[i]
+		switch t.kind {
+		case tokNumber:
+			n, err := strconv.ParseUint(t.val, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid oid component %s", t)
+			}
+			comps = append(comps, oidComponent{num: int(n), hasNum: true})
+		case tokIdent:
+			comp := oidComponent{name: t.val}
+			if i+1 < len(inner) && inner[i+1].val == "(" {
+				if i+3 >= len(inner) || inner[i+3].val != ")" {
+					return nil, fmt.Errorf("invalid oid component %s", t)
+				}
+				n, err := strconv.ParseUint(inner[i+2].val, 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid oid component %s", t)
+				}
+				comp.num, comp.hasNum = int(n), true
+				i += 3
+			}
+			comps = append(comps, comp)
+		default:
+			return nil, fmt.Errorf("unexpected %s in oid value", t)
+		}
+	}
+	if len(comps) == 0 {
+		return nil, fmt.Errorf("empty oid value")
+	}
+	return comps, nil
+}
+
+// parseIndex parses the INDEX clause of a row.
+func (p *parser) parseIndex() ([]IndexPart, error) {
+	inner, err := p.skipBalanced()
+	if err != nil {
+		return nil, err
+	}
+	var index []IndexPart
+	var implied bool
+	for _, t := range inner {
+		switch {
+		case t.val == "IMPLIED":
+			implied = true
+		case t.kind == tokIdent:
+			index = append(index, IndexPart{Name: t.val, Implied: implied})
+			implied = false
+		}
+	}
+	return index, nil
+}
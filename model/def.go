@@ -0,0 +1,364 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// AgentDef is the definition of an agent, as stored in db and handled by the
+// dispatcher CRUD api.
+type AgentDef struct {
+	// ID is the agent db id.
+	ID int `db:"id" json:"id"`
+
+	// IPAddress is the agent web server IP address.
+	IPAddress string `db:"ip_address" json:"ip_address"`
+
+	// Port is the agent web server port.
+	Port int `db:"port" json:"port"`
+
+	// Active tells whether the agent can receive jobs.
+	Active bool `db:"active" json:"active"`
+
+	// Alive is the result of the last keep-alive check (read only).
+	Alive bool `db:"is_alive" json:"is_alive"`
+
+	// Load is the agent load at the last check (read only).
+	Load float64 `db:"load" json:"load"`
+
+	// LastCheckedAt is the time of the last keep-alive check (read only).
+	LastCheckedAt NullTime `db:"last_checked_at" json:"last_checked_at"`
+}
+
+// ProfileDef is the definition of a profile with its measures.
+type ProfileDef struct {
+	// ID is the profile db id.
+	ID int `db:"id" json:"id"`
+
+	// Category is the device category.
+	Category string `db:"category" json:"category"`
+
+	// Vendor is the device vendor.
+	Vendor string `db:"vendor" json:"vendor"`
+
+	// Model is the device model.
+	Model string `db:"model" json:"model"`
+
+	// MeasureIDs is the id list of the measures of this profile.
+	// It is left unchanged by an update if null.
+	MeasureIDs []int `db:"-" json:"measure_ids"`
+
+	// PollingFrequencies overrides the polling frequency of some measures of
+	// this profile, by measure id. It is left unchanged by an update if null.
+	PollingFrequencies map[int]int `db:"-" json:"polling_frequencies"`
+}
+
+// MetricDef is the definition of a metric, as stored in db.
+type MetricDef struct {
+	// ID is the metric db id.
+	ID int `db:"id" json:"id"`
+
+	// Name is the metric name.
+	Name string `db:"name" json:"name"`
+
+	// Oid is the metric oid, numeric or symbolic.
+	Oid OID `db:"oid" json:"oid"`
+
+	// Description is the metric description.
+	Description string `db:"description" json:"description"`
+
+	// Active tells whether the metric is polled.
+	Active bool `db:"active" json:"active"`
+
+	// ExportAsLabel tells if the metric is exported as a label.
+	ExportAsLabel bool `db:"export_as_label" json:"export_as_label"`
+
+	// ExportedName is the exported name of the metric, its name if empty.
+	ExportedName string `db:"exported_name" json:"exported_name"`
+
+	// IndexPattern is the regex extracting the index from the tabular oids.
+	IndexPattern string `db:"index_pattern" json:"index_pattern"`
+
+	// PostProcessors is the list of post processors applied to the metric value.
+	PostProcessors pq.StringArray `db:"post_processors" json:"post_processors"`
+}
+
+// MeasureDef is the definition of a scalar or indexed measure, as stored in db.
+type MeasureDef struct {
+	// ID is the measure db id.
+	ID int `db:"id" json:"id"`
+
+	// Name is the measure name.
+	Name string `db:"name" json:"name"`
+
+	// Description is the measure description.
+	Description string `db:"description" json:"description"`
+
+	// IsIndexed tells whether this is an indexed measure.
+	IsIndexed bool `db:"is_indexed" json:"is_indexed"`
+
+	// IndexMetricID is the id of the index metric of an indexed measure.
+	IndexMetricID NullInt64 `db:"index_metric_id" json:"index_metric_id"`
+
+	// FilterMetricID is the id of the filter metric of an indexed measure.
+	FilterMetricID NullInt64 `db:"filter_metric_id" json:"filter_metric_id"`
+
+	// FilterPattern is the regex filtering the rows on the filter metric value.
+	FilterPattern string `db:"filter_pattern" json:"filter_pattern"`
+
+	// InvertFilterMatch negates the filter match.
+	InvertFilterMatch bool `db:"invert_filter_match" json:"invert_filter_match"`
+
+	// FilterRefreshInterval is the filter refresh interval with the targeted walk strategy.
+	FilterRefreshInterval int `db:"filter_refresh_interval" json:"filter_refresh_interval"`
+
+	// LabelRefreshPolls is the number of polls the cached labels are reused.
+	LabelRefreshPolls int `db:"label_refresh_polls" json:"label_refresh_polls"`
+
+	// LabelChangeOid is the scalar oid whose change forces the label refresh.
+	LabelChangeOid string `db:"label_change_oid" json:"label_change_oid"`
+
+	// WalkStrategy is the walk strategy of an indexed measure.
+	WalkStrategy string `db:"walk_strategy" json:"walk_strategy"`
+
+	// UseAlternateCommunity tells whether to use the device alternate community.
+	UseAlternateCommunity bool `db:"use_alternate_community" json:"use_alternate_community"`
+
+	// PollingFrequency is the measure polling frequency in seconds, the device
+	// one if 0.
+	PollingFrequency int `db:"polling_frequency" json:"polling_frequency"`
+
+	// ToKafka tells if the results are exported to Kafka.
+	ToKafka bool `db:"to_kafka" json:"to_kafka"`
+
+	// ToProm tells if the results are exported to Prometheus.
+	ToProm bool `db:"to_prometheus" json:"to_prometheus"`
+
+	// ToInflux tells if the results are exported to InfluxDB.
+	ToInflux bool `db:"to_influx" json:"to_influx"`
+
+	// ToNats tells if the results are exported to NATS.
+	ToNats bool `db:"to_nats" json:"to_nats"`
+
+	// MetricIDs is the id list of the measure metrics.
+	// It is left unchanged by an update if null.
+	MetricIDs []int `db:"-" json:"metric_ids"`
+}
+
+// CredentialDef is a named set of snmp credentials shared by devices. The
+// communities and passwords are encrypted in db and masked in the api listings.
+type CredentialDef struct {
+	// ID is the credential set db id.
+	ID int `db:"id" json:"id"`
+
+	// Name is the unique name of the credential set.
+	Name string `db:"name" json:"name"`
+
+	// Community is the snmp community.
+	Community string `db:"snmp_community" json:"snmp_community"`
+
+	// AlternateCommunity is the alternate snmp community.
+	AlternateCommunity string `db:"snmp_alternate_community" json:"snmp_alternate_community"`
+
+	// AuthUser is the authentication username for snmpv3.
+	AuthUser string `db:"snmpv3_auth_user" json:"snmpv3_auth_user"`
+
+	// AuthPasswd is the authentication password for snmpv3.
+	AuthPasswd string `db:"snmpv3_auth_passwd" json:"snmpv3_auth_passwd"`
+
+	// PrivPasswd is the privacy passphrase for snmpv3.
+	PrivPasswd string `db:"snmpv3_privacy_passwd" json:"snmpv3_privacy_passwd"`
+}
+
+// UnmarshalJSON unserializes an AgentDef and checks its address and port.
+func (a *AgentDef) UnmarshalJSON(data []byte) error {
+	type A AgentDef
+	agent := A{Active: true}
+
+	if err := json.Unmarshal(data, &agent); err != nil {
+		return err
+	}
+	if strings.TrimSpace(agent.IPAddress) == "" {
+		return errors.New("invalid agent: ip_address cannot be empty")
+	}
+	if agent.Port <= 0 || agent.Port > 65535 {
+		return fmt.Errorf("invalid agent: invalid port %d", agent.Port)
+	}
+	*a = AgentDef(agent)
+	return nil
+}
+
+// UnmarshalJSON unserializes a CredentialDef and checks its name.
+func (c *CredentialDef) UnmarshalJSON(data []byte) error {
+	type C CredentialDef
+	var cred C
+
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return err
+	}
+	if strings.TrimSpace(cred.Name) == "" {
+		return errors.New("invalid credential set: name cannot be empty")
+	}
+	if cred.Community == "" && cred.AuthUser == "" {
+		return errors.New("invalid credential set: snmp_community or snmpv3_auth_user must be defined")
+	}
+	*c = CredentialDef(cred)
+	return nil
+}
+
+// MaskSecrets replaces the non empty communities and passwords by SecretMask.
+func (c *CredentialDef) MaskSecrets() {
+	maskSecrets(&c.Community, &c.AlternateCommunity, &c.AuthPasswd, &c.PrivPasswd)
+}
+
+// UnmarshalJSON unserializes a ProfileDef with the same rules as a Profile.
+func (p *ProfileDef) UnmarshalJSON(data []byte) error {
+	type P ProfileDef
+	var prof P
+
+	if err := json.Unmarshal(data, &prof); err != nil {
+		return err
+	}
+	var base Profile
+	if err := json.Unmarshal(data, &base); err != nil {
+		return err
+	}
+	prof.Category, prof.Vendor, prof.Model = base.Category, base.Vendor, base.Model
+	for id, freq := range prof.PollingFrequencies {
+		if freq < 0 {
+			return fmt.Errorf("invalid profile: negative polling frequency for measure #%d", id)
+		}
+	}
+	*p = ProfileDef(prof)
+	return nil
+}
+
+// UnmarshalJSON unserializes a MetricDef. The metric is checked with the same
+// rules as a request Metric.
+func (m *MetricDef) UnmarshalJSON(data []byte) error {
+	type M MetricDef
+	metric := M{Active: true}
+
+	if err := json.Unmarshal(data, &metric); err != nil {
+		return err
+	}
+	if strings.TrimSpace(metric.Name) == "" {
+		return errors.New("invalid metric: name cannot be empty")
+	}
+	if metric.PostProcessors == nil {
+		metric.PostProcessors = pq.StringArray{}
+	}
+	def := MetricDef(metric)
+	valid, err := def.Metric()
+	if err != nil {
+		return err
+	}
+	def.PostProcessors = valid.PostProcessors
+	*m = def
+	return nil
+}
+
+// Metric converts the definition to a request Metric, validated by its json
+// unserializer.
+func (m MetricDef) Metric() (Metric, error) {
+	metric := Metric{
+		ID:             m.ID,
+		Name:           m.Name,
+		Oid:            m.Oid,
+		Description:    m.Description,
+		Active:         m.Active,
+		ExportAsLabel:  m.ExportAsLabel,
+		ExportedName:   m.ExportedName,
+		PostProcessors: append(pq.StringArray{}, m.PostProcessors...),
+		IndexPattern:   m.IndexPattern,
+	}
+	if metric.ExportedName == "" {
+		metric.ExportedName = m.Name
+	}
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return metric, fmt.Errorf("metric %s: %v", m.Name, err)
+	}
+	if err := json.Unmarshal(data, &metric); err != nil {
+		return metric, err
+	}
+	return metric, nil
+}
+
+// UnmarshalJSON unserializes a MeasureDef. Its consistency with its metrics is
+// checked separately with Check.
+func (m *MeasureDef) UnmarshalJSON(data []byte) error {
+	type M MeasureDef
+	meas := M{ToKafka: true, ToProm: true, ToNats: true, WalkStrategy: WalkColumns}
+
+	if err := json.Unmarshal(data, &meas); err != nil {
+		return err
+	}
+	if strings.TrimSpace(meas.Name) == "" {
+		return errors.New("invalid measure: name cannot be empty")
+	}
+	if meas.WalkStrategy == "" {
+		meas.WalkStrategy = WalkColumns
+	}
+	if meas.PollingFrequency < 0 {
+		return errors.New("invalid measure: polling_frequency cannot be negative")
+	}
+	*m = MeasureDef(meas)
+	return nil
+}
+
+// Check validates the measure with its metrics and derived metrics with the
+// same rules as a request ScalarMeasure or IndexedMeasure.
+func (m MeasureDef) Check(metrics []Metric, derived []DerivedMetric) error {
+	if !m.IsIndexed {
+		if m.IndexMetricID.Valid || m.FilterMetricID.Valid || m.FilterPattern != "" {
+			return fmt.Errorf("scalar measure %s: index and filter metrics are only allowed on indexed measures", m.Name)
+		}
+		data, err := json.Marshal(ScalarMeasure{
+			ID:             m.ID,
+			Name:           m.Name,
+			Metrics:        metrics,
+			DerivedMetrics: derived,
+		})
+		if err != nil {
+			return fmt.Errorf("scalar measure %s: %v", m.Name, err)
+		}
+		return json.Unmarshal(data, &ScalarMeasure{})
+	}
+	data, err := json.Marshal(IndexedMeasure{
+		ID:                    m.ID,
+		Name:                  m.Name,
+		Metrics:               metrics,
+		IndexMetricID:         m.IndexMetricID,
+		FilterMetricID:        m.FilterMetricID,
+		FilterPattern:         m.FilterPattern,
+		InvertFilterMatch:     m.InvertFilterMatch,
+		FilterRefreshInterval: m.FilterRefreshInterval,
+		LabelRefreshPolls:     m.LabelRefreshPolls,
+		LabelChangeOid:        OID(m.LabelChangeOid),
+		WalkStrategy:          m.WalkStrategy,
+		DerivedMetrics:        derived,
+	})
+	if err != nil {
+		return fmt.Errorf("indexed measure %s: %v", m.Name, err)
+	}
+	return json.Unmarshal(data, &IndexedMeasure{})
+}
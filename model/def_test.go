@@ -0,0 +1,112 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDefUnmarshal(t *testing.T) {
+	tests := []struct {
+		in    string
+		out   interface{}
+		valid bool
+	}{
+		{`{"ip_address": "10.0.0.1", "port": 8000}`, &AgentDef{}, true},
+		{`{"ip_address": "", "port": 8000}`, &AgentDef{}, false},
+		{`{"ip_address": "10.0.0.1", "port": 0}`, &AgentDef{}, false},
+		{`{"name": "core", "snmp_community": "public"}`, &CredentialDef{}, true},
+		{`{"name": "core-v3", "snmpv3_auth_user": "horus", "snmpv3_auth_passwd": "secret"}`, &CredentialDef{}, true},
+		{`{"name": " ", "snmp_community": "public"}`, &CredentialDef{}, false},
+		{`{"name": "empty"}`, &CredentialDef{}, false},
+		{`{"category": "switch", "vendor": "cisco", "model": "c2960", "measure_ids": [1, 2]}`, &ProfileDef{}, true},
+		{`{"category": "switch", "vendor": " ", "model": "c2960"}`, &ProfileDef{}, false},
+		{`{"category": "switch", "vendor": "cisco", "model": "c2960", "measure_ids": [1, 2], "polling_frequencies": {"2": 3600}}`, &ProfileDef{}, true},
+		{`{"category": "switch", "vendor": "cisco", "model": "c2960", "polling_frequencies": {"2": -1}}`, &ProfileDef{}, false},
+		{`{"name": "ifDescr", "oid": ".1.3.6.1.2.1.2.2.1.2", "export_as_label": true}`, &MetricDef{}, true},
+		{`{"name": "ifDescr", "oid": "IF-MIB::ifDescr", "index_pattern": "IF-MIB::ifDescr.(\\d+)"}`, &MetricDef{}, true},
+		{`{"name": "", "oid": ".1.3.6.1.2.1.2.2.1.2"}`, &MetricDef{}, false},
+		{`{"name": "ifDescr", "oid": ""}`, &MetricDef{}, false},
+		{`{"name": "ifDescr", "oid": ".1.3.6.1.2.1.2.2.1.2", "post_processors": ["foo"]}`, &MetricDef{}, false},
+		{`{"name": "ifDescr", "oid": ".1.3.6.1.2.1.2.2.1.2", "index_pattern": ".1.3.6.1.2.1.2.2.1.3.(\\d+)"}`, &MetricDef{}, false},
+		{`{"name": "ifInOctets", "oid": ".1.3.6.1.2.1.2.2.1.10", "export_as_label": true, "post_processors": ["rate"]}`, &MetricDef{}, false},
+		{`{"name": "ifStats", "is_indexed": true, "metric_ids": [1, 2]}`, &MeasureDef{}, true},
+		{`{"name": "", "is_indexed": true}`, &MeasureDef{}, false},
+		{`{"name": "inventory", "polling_frequency": 3600}`, &MeasureDef{}, true},
+		{`{"name": "inventory", "polling_frequency": -60}`, &MeasureDef{}, false},
+	}
+	for i, tt := range tests {
+		err := json.Unmarshal([]byte(tt.in), tt.out)
+		valid := err == nil
+		if !valid && testing.Verbose() {
+			t.Logf("Def#%d: unmarshal: %v", i, err)
+		}
+		if valid != tt.valid {
+			t.Errorf("Def#%d: expected validity: %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+	}
+
+	var agent AgentDef
+	json.Unmarshal([]byte(`{"ip_address": "10.0.0.1", "port": 8000}`), &agent)
+	if !agent.Active {
+		t.Errorf("agent: expected active by default")
+	}
+	var meas MeasureDef
+	json.Unmarshal([]byte(`{"name": "ifStats"}`), &meas)
+	if !meas.ToKafka || !meas.ToProm || !meas.ToNats || meas.ToInflux || meas.WalkStrategy != WalkColumns {
+		t.Errorf("measure: invalid defaults %+v", meas)
+	}
+	var metric MetricDef
+	json.Unmarshal([]byte(`{"name": "ifDescr", "oid": ".1.3.6.1.2.1.2.2.1.2", "post_processors": [" trim "]}`), &metric)
+	if !metric.Active || len(metric.PostProcessors) != 1 || metric.PostProcessors[0] != "trim" {
+		t.Errorf("metric: invalid defaults %+v", metric)
+	}
+}
+
+func TestMeasureDefCheck(t *testing.T) {
+	metrics := []Metric{
+		{ID: 1, Name: "ifName", Oid: ".1.3.6.1.2.1.31.1.1.1.1", Active: true, ExportAsLabel: true},
+		{ID: 2, Name: "ifHCInOctets", Oid: ".1.3.6.1.2.1.31.1.1.1.6", Active: true, PostProcessors: []string{"rate"}},
+	}
+	derived := []DerivedMetric{{ID: 1, Name: "ifInBps", Expression: "ifHCInOctets * 8"}}
+	index := NullInt64{Int64: 1, Valid: true}
+	tests := []struct {
+		meas    MeasureDef
+		derived []DerivedMetric
+		valid   bool
+	}{
+		{MeasureDef{Name: "sys"}, nil, true},
+		{MeasureDef{Name: "sys"}, derived, true},
+		{MeasureDef{Name: "sys"}, []DerivedMetric{{ID: 1, Name: "d", Expression: "ifHCOutOctets * 8"}}, false},
+		{MeasureDef{Name: "sys", IndexMetricID: index}, nil, false},
+		{MeasureDef{Name: "if", IsIndexed: true, IndexMetricID: index, FilterMetricID: index, FilterPattern: "^Gi", WalkStrategy: WalkTargeted}, derived, true},
+		{MeasureDef{Name: "if", IsIndexed: true, IndexMetricID: NullInt64{Int64: 3, Valid: true}}, nil, false},
+		{MeasureDef{Name: "if", IsIndexed: true, FilterPattern: "^Gi"}, nil, false},
+		{MeasureDef{Name: "if", IsIndexed: true, WalkStrategy: "row"}, nil, false},
+		{MeasureDef{Name: "if", IsIndexed: true, LabelChangeOid: ".1.3.6.1.2.1.31.1.5.0"}, nil, true},
+		{MeasureDef{Name: "if", IsIndexed: true, LabelChangeOid: "1..2"}, nil, false},
+	}
+	for i, tt := range tests {
+		err := tt.meas.Check(metrics, tt.derived)
+		valid := err == nil
+		if !valid && testing.Verbose() {
+			t.Logf("MeasureDef#%d: check: %v", i, err)
+		}
+		if valid != tt.valid {
+			t.Errorf("MeasureDef#%d: expected validity: %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+	}
+}
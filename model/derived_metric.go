@@ -0,0 +1,102 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DerivedMetric is a metric computed from an arithmetic expression over the other
+// metrics of the same measure (and the same row for an indexed measure).
+type DerivedMetric struct {
+	// ID is the derived metric db ID.
+	ID int `db:"id"`
+
+	// Name is the derived metric name.
+	Name string `db:"name"`
+
+	// Description is the derived metric description.
+	Description string `db:"description"`
+
+	// ExportedName is the name to use for the exported metric (different from the metric name).
+	ExportedName string `db:"exported_name"`
+
+	// Expression is the arithmetic expression computing the metric value,
+	// like `rate(ifHCInOctets) * 8 / (ifHighSpeed * 1e6)`.
+	Expression string `db:"expression"`
+
+	// Expr is the parsed Expression.
+	Expr *Expr `db:"-" json:"-"`
+}
+
+// UnmarshalJSON unserializes a DerivedMetric and parses its expression.
+func (d *DerivedMetric) UnmarshalJSON(data []byte) error {
+	type DM DerivedMetric
+	var dm DM
+
+	if err := json.Unmarshal(data, &dm); err != nil {
+		return err
+	}
+	if dm.Name == "" {
+		return fmt.Errorf("derived metric #%d: name cannot be empty", dm.ID)
+	}
+	var err error
+	if dm.Expr, err = ParseExpr(dm.Expression); err != nil {
+		return fmt.Errorf("derived metric %s: %v", dm.Name, err)
+	}
+	*d = DerivedMetric(dm)
+	return nil
+}
+
+// CheckDerived checks that the expressions of the derived metrics only reference
+// the given metrics or the previous derived metrics, and that the counter
+// references are made on metrics with the corresponding post-processor.
+func CheckDerived(derived []DerivedMetric, metrics []Metric) error {
+	byName := make(map[string]Metric)
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+	known := make(map[string]bool)
+	for _, d := range derived {
+		if _, ok := byName[d.Name]; ok || known[d.Name] {
+			return fmt.Errorf("derived metric %s: name already used", d.Name)
+		}
+		for _, ref := range d.Expr.Refs() {
+			m, ok := byName[ref.Name]
+			if !ok {
+				if known[ref.Name] && ref.Mode == "" {
+					continue
+				}
+				return fmt.Errorf("derived metric %s: unknown metric %s", d.Name, ref.Name)
+			}
+			if ref.Mode == "" {
+				continue
+			}
+			found := false
+			for _, pp := range m.PostProcessors {
+				if pp == ref.Mode {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("derived metric %s: metric %s has no %s post-processor", d.Name, ref.Name, ref.Mode)
+			}
+		}
+		known[d.Name] = true
+	}
+	return nil
+}
@@ -15,8 +15,14 @@
 package model
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/kosctelecom/horus/log"
 )
 
 // Device represents an snmp device.
@@ -40,6 +46,10 @@ type Device struct {
 	// each measurement of this device.
 	Tags string `db:"tags" json:"tags,omitempty"`
 
+	// CredentialID is the id of the device credential set. When not null, its
+	// communities and snmpv3 user and passwords replace the device ones.
+	CredentialID NullInt64 `db:"credential_id" json:"credential_id"`
+
 	// SnmpParams is the device snmp config.
 	SnmpParams
 
@@ -47,6 +57,51 @@ type Device struct {
 	Profile
 }
 
+// TrapDevice is a device known by the agent trap receivers. It has no community:
+// the snmpv1 and v2c notifications are checked by their source address and by the
+// hash of their community.
+type TrapDevice struct {
+	// ID is the device id.
+	ID int `json:"id"`
+
+	// IPAddress is the source address of the device notifications.
+	IPAddress string `json:"ip_address"`
+
+	// Version is the device snmp version.
+	Version string `json:"snmp_version"`
+
+	// Tags is the tag map of the device notifications, as given by ResultTags.
+	Tags map[string]string `json:"tags"`
+
+	// CommunityHashes are the hashes of the device community and alternate
+	// community, as given by CommunityHash, for the snmpv1 and v2c devices.
+	CommunityHashes []string `json:"community_hashes,omitempty"`
+
+	// User is the device snmpv3 user, given to every agent.
+	User *TrapUser `json:"snmpv3_user,omitempty"`
+}
+
+// TrapUser is the snmpv3 user authenticating the notifications of a device.
+type TrapUser struct {
+	// SecLevel is the snmpv3 security level.
+	SecLevel string `json:"snmpv3_security_level"`
+
+	// AuthUser is the snmpv3 user name.
+	AuthUser string `json:"snmpv3_auth_user"`
+
+	// AuthProto is the snmpv3 authentication protocol.
+	AuthProto string `json:"snmpv3_auth_proto,omitempty"`
+
+	// AuthPasswd is the snmpv3 authentication passphrase.
+	AuthPasswd string `json:"snmpv3_auth_passwd,omitempty"`
+
+	// PrivProto is the snmpv3 privacy protocol.
+	PrivProto string `json:"snmpv3_privacy_proto,omitempty"`
+
+	// PrivPasswd is the snmpv3 privacy passphrase.
+	PrivPasswd string `json:"snmpv3_privacy_passwd,omitempty"`
+}
+
 // UnmarshalJSON implements the json Unmarshaler interface for Device type.
 // Takes a flat json and builds a Device with embedded Profile and SnmpParams.
 // Note: the standard Marshaler also outputs a flat json document.
@@ -74,9 +129,56 @@ func (dev *Device) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &d.Profile); err != nil {
 		return err
 	}
-	if err := json.Unmarshal(data, &d.SnmpParams); err != nil {
+	if err := d.SnmpParams.unmarshalJSON(data, !d.CredentialID.Valid); err != nil {
 		return err
 	}
 	*dev = Device(d)
 	return nil
 }
+
+// ResultTags returns the tags of the device results: its id, host, vendor,
+// model and category, completed with its json tags.
+func (dev Device) ResultTags() map[string]string {
+	tags := make(map[string]string)
+	tags["id"] = strconv.Itoa(dev.ID)
+	tags["host"] = dev.Hostname
+	tags["vendor"] = dev.Vendor
+	tags["model"] = dev.Model
+	tags["category"] = dev.Category
+	if dev.Tags != "" {
+		var devTags map[string]interface{}
+		if err := json.Unmarshal([]byte(dev.Tags), &devTags); err != nil {
+			log.Errorf("json tag unmarshal: %v", err)
+		} else {
+			for k, v := range devTags {
+				tags[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	return tags
+}
+
+// UnmarshalJSON unserializes a TrapDevice and checks its id and address.
+// CommunityHash returns the hex encoded sha256 hash of a device community,
+// salted with the device id.
+func CommunityHash(devID int, community string) string {
+	sum := sha256.Sum256([]byte(strconv.Itoa(devID) + ":" + community))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *TrapDevice) UnmarshalJSON(data []byte) error {
+	type T TrapDevice
+	var dev T
+
+	if err := json.Unmarshal(data, &dev); err != nil {
+		return err
+	}
+	if dev.ID == 0 {
+		return errors.New("invalid trap device: id cannot be empty")
+	}
+	if dev.IPAddress == "" {
+		return errors.New("invalid trap device: ip_address cannot be empty")
+	}
+	*d = TrapDevice(dev)
+	return nil
+}
@@ -94,6 +94,53 @@ func TestDevice(t *testing.T) {
 			Device{},
 			false, // no profile & snmp fields
 		},
+		{
+			`{
+				"id": 4,
+				"hostname": "4.kosc.net",
+				"category": "c1",
+				"vendor": "v1",
+				"model": "m1",
+				"ip_address": "10.2.0.4",
+				"snmp_version": "3",
+				"snmpv3_security_level": "AuthPriv",
+				"credential_id": 2
+			}`,
+			Device{
+				ID:           4,
+				Hostname:     "4.kosc.net",
+				Tags:         "{}",
+				CredentialID: NullInt64{Int64: 2, Valid: true},
+				SnmpParams: SnmpParams{
+					IPAddress:       "10.2.0.4",
+					Port:            161,
+					Version:         Version3,
+					Timeout:         10,
+					Retries:         1,
+					ConnectionCount: 1,
+					SecLevel:        "AuthPriv",
+				},
+				Profile: Profile{
+					Category: "c1",
+					Vendor:   "v1",
+					Model:    "m1",
+				},
+			},
+			true, // community and auth user from credential set
+		},
+		{
+			`{
+				"id": 5,
+				"hostname": "5.kosc.net",
+				"category": "c1",
+				"vendor": "v1",
+				"model": "m1",
+				"ip_address": "10.2.0.5",
+				"credential_id": null
+			}`,
+			Device{},
+			false, // no community nor credential set
+		},
 	}
 
 	for i, tt := range tests {
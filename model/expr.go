@@ -0,0 +1,352 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ExprRef is a metric referenced by an expression.
+type ExprRef struct {
+	// Name is the referenced metric name.
+	Name string
+
+	// Mode is the referenced counter value: `rate`, `delta`
+	// or empty for the metric value itself.
+	Mode string
+}
+
+// ExprEnv returns the value of a referenced metric when evaluating an expression.
+// Returns false if the value is not available.
+type ExprEnv func(ref ExprRef) (float64, bool)
+
+// Expr is a parsed arithmetic expression. It supports the +, -, *, / operators,
+// parentheses, float constants like 1e6, metric names, the `rate(name)` and
+// `delta(name)` counter references and the ln, log10, abs, min and max functions.
+type Expr struct {
+	root exprNode
+	refs []ExprRef
+}
+
+// exprNode is a node of the expression tree.
+type exprNode interface {
+	eval(env ExprEnv) (float64, error)
+}
+
+type (
+	numNode float64
+	refNode ExprRef
+	negNode struct{ x exprNode }
+	binNode struct {
+		op   byte
+		l, r exprNode
+	}
+	funcNode struct {
+		name string
+		args []exprNode
+	}
+)
+
+func (n numNode) eval(env ExprEnv) (float64, error) {
+	return float64(n), nil
+}
+
+func (n refNode) eval(env ExprEnv) (float64, error) {
+	v, ok := env(ExprRef(n))
+	if !ok {
+		if n.Mode != "" {
+			return 0, fmt.Errorf("no %s value for %s", n.Mode, n.Name)
+		}
+		return 0, fmt.Errorf("no value for %s", n.Name)
+	}
+	return v, nil
+}
+
+func (n negNode) eval(env ExprEnv) (float64, error) {
+	v, err := n.x.eval(env)
+	return -v, err
+}
+
+func (n binNode) eval(env ExprEnv) (float64, error) {
+	l, err := n.l.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.r.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return l / r, nil
+	}
+}
+
+func (n funcNode) eval(env ExprEnv) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	switch n.name {
+	case "ln", "log10":
+		if args[0] <= 0 {
+			return 0, fmt.Errorf("%s of non-positive value %v", n.name, args[0])
+		}
+		if n.name == "ln" {
+			return math.Log(args[0]), nil
+		}
+		return math.Log10(args[0]), nil
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "min":
+		res := args[0]
+		for _, v := range args[1:] {
+			res = math.Min(res, v)
+		}
+		return res, nil
+	default:
+		res := args[0]
+		for _, v := range args[1:] {
+			res = math.Max(res, v)
+		}
+		return res, nil
+	}
+}
+
+// exprFuncs lists the available functions with their argument count, -1 for 1 or more.
+var exprFuncs = map[string]int{
+	"ln":    1,
+	"log10": 1,
+	"abs":   1,
+	"min":   -1,
+	"max":   -1,
+}
+
+// ParseExpr parses an arithmetic expression.
+func ParseExpr(s string) (*Expr, error) {
+	p := &exprParser{src: s}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, fmt.Errorf("expression `%s`: %v", s, err)
+	}
+	if p.skipSpaces(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("expression `%s`: unexpected `%c` at %d", s, p.src[p.pos], p.pos)
+	}
+	return &Expr{root: root, refs: p.refs}, nil
+}
+
+// Refs returns the list of metrics referenced by the expression.
+func (e *Expr) Refs() []ExprRef {
+	return e.refs
+}
+
+// Eval evaluates the expression with the referenced metric values returned by env.
+func (e *Expr) Eval(env ExprEnv) (float64, error) {
+	v, err := e.root.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid result %v", v)
+	}
+	return v, nil
+}
+
+// exprParser is a recursive descent parser of arithmetic expressions.
+type exprParser struct {
+	src  string
+	pos  int
+	refs []ExprRef
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space char or 0 at the end of the expression.
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// parseSum parses a list of terms separated by + or -.
+func (p *exprParser) parseSum() (exprNode, error) {
+	l, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		l = binNode{op, l, r}
+	}
+	return l, nil
+}
+
+// parseTerm parses a list of factors separated by * or /.
+func (p *exprParser) parseTerm() (exprNode, error) {
+	l, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		l = binNode{op, l, r}
+	}
+	return l, nil
+}
+
+// parseFactor parses a negation, a parenthesized expression, a number,
+// a metric reference or a function call.
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '-':
+		p.pos++
+		x, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing `)` at %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case isIdentChar(c, true):
+		return p.parseIdent()
+	default:
+		return nil, fmt.Errorf("unexpected `%c` at %d", c, p.pos)
+	}
+}
+
+func (p *exprParser) parseNumber() (exprNode, error) {
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+		p.pos++
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number `%s` at %d", p.src[start:p.pos], start)
+	}
+	return numNode(v), nil
+}
+
+func (p *exprParser) parseIdent() (exprNode, error) {
+	start := p.pos
+	for p.pos < len(p.src) && isIdentChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if p.peek() != '(' {
+		p.refs = append(p.refs, ExprRef{Name: name})
+		return refNode{Name: name}, nil
+	}
+	p.pos++
+
+	if name == "rate" || name == "delta" {
+		p.skipSpaces()
+		argStart := p.pos
+		for p.pos < len(p.src) && isIdentChar(p.src[p.pos], p.pos == argStart) {
+			p.pos++
+		}
+		arg := p.src[argStart:p.pos]
+		if arg == "" || p.peek() != ')' {
+			return nil, fmt.Errorf("%s() expects a metric name at %d", name, argStart)
+		}
+		p.pos++
+		ref := ExprRef{Name: arg, Mode: name}
+		p.refs = append(p.refs, ref)
+		return refNode(ref), nil
+	}
+
+	argCount, ok := exprFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function `%s` at %d", name, start)
+	}
+	var args []exprNode
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing `)` at %d", p.pos)
+	}
+	p.pos++
+	if argCount > 0 && len(args) != argCount {
+		return nil, fmt.Errorf("%s() expects %d argument(s), got %d", name, argCount, len(args))
+	}
+	return funcNode{name, args}, nil
+}
+
+// isIdentChar tells whether c is valid in a metric name, digits being
+// forbidden in first position.
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
@@ -0,0 +1,115 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	env := func(ref ExprRef) (float64, bool) {
+		switch ref {
+		case ExprRef{"a", ""}:
+			return 10, true
+		case ExprRef{"b", ""}:
+			return 4, true
+		case ExprRef{"zero", ""}:
+			return 0, true
+		case ExprRef{"in", "rate"}:
+			return 1e6, true
+		}
+		return 0, false
+	}
+	tests := []struct {
+		expr     string
+		valid    bool
+		expected float64
+		evalOK   bool
+	}{
+		{"a + b * 2", true, 18, true},
+		{"(a + b) * 2", true, 28, true},
+		{"a - b - 1", true, 5, true},
+		{"a / b / 2", true, 1.25, true},
+		{"-a + -(b)", true, -14, true},
+		{"rate(in) * 8 / (a * 1e6)", true, 0.8, true},
+		{"10 * log10(a)", true, 10, true},
+		{"min(a, b, 7) + max(a, b) + abs(-2)", true, 16, true},
+		{"1.5e-1 * a", true, 1.5, true},
+		{"a / zero", true, 0, false},
+		{"ln(zero)", true, 0, false},
+		{"unknown + 1", true, 0, false},
+		{"delta(in)", true, 0, false},
+		{"", false, 0, false},
+		{"a +", false, 0, false},
+		{"(a + b", false, 0, false},
+		{"a b", false, 0, false},
+		{"foo(a)", false, 0, false},
+		{"ln(a, b)", false, 0, false},
+		{"rate(a + b)", false, 0, false},
+		{"1.2.3", false, 0, false},
+		{"a % b", false, 0, false},
+	}
+	for i, tt := range tests {
+		e, err := ParseExpr(tt.expr)
+		if (err == nil) != tt.valid {
+			t.Errorf("expr#%d `%s`: expected validity %v, got err %v", i, tt.expr, tt.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		v, err := e.Eval(env)
+		if (err == nil) != tt.evalOK {
+			t.Errorf("expr#%d `%s`: expected eval ok %v, got err %v", i, tt.expr, tt.evalOK, err)
+			continue
+		}
+		if err == nil && math.Abs(v-tt.expected) > 1e-9 {
+			t.Errorf("expr#%d `%s`: expected %v, got %v", i, tt.expr, tt.expected, v)
+		}
+	}
+}
+
+func TestCheckDerived(t *testing.T) {
+	metrics := []Metric{
+		{Name: "in", PostProcessors: []string{"rate"}},
+		{Name: "speed"},
+	}
+	tests := []struct {
+		exprs []string
+		valid bool
+	}{
+		{[]string{"rate(in) * 8 / speed"}, true},
+		{[]string{"in + speed", "d0 * 2"}, true},
+		{[]string{"d1 * 2", "in"}, false},
+		{[]string{"rate(speed)"}, false},
+		{[]string{"delta(in)"}, false},
+		{[]string{"out"}, false},
+	}
+	for i, tt := range tests {
+		var derived []DerivedMetric
+		for j, expr := range tt.exprs {
+			e, err := ParseExpr(expr)
+			if err != nil {
+				t.Fatalf("derived#%d: parse %s: %v", i, expr, err)
+			}
+			derived = append(derived, DerivedMetric{Name: fmt.Sprintf("d%d", j), Expression: expr, Expr: e})
+		}
+		if err := CheckDerived(derived, metrics); (err == nil) != tt.valid {
+			t.Errorf("derived#%d: expected validity %v, got err %v", i, tt.valid, err)
+		}
+	}
+}
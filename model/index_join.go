@@ -0,0 +1,80 @@
+// Copyright 2019-2020 Kosc Telecom.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// IndexJoin joins the rows of another snmp table to the rows of an indexed measure:
+// the value of the mapping metric of each measure row is the index of the joined
+// table row, whose metrics are added to the measure row. For example, the
+// ipAdEntIfIndex value of an ipAddrTable row is the ifIndex of its ifTable row.
+type IndexJoin struct {
+	// ID is the join db id.
+	ID int `db:"id"`
+
+	// MappingMetricID is the id of the measure metric whose value is the join key.
+	MappingMetricID int `db:"mapping_metric_id"`
+
+	// KeyPattern is an optional regex with subexpressions extracting the join key
+	// from the mapping metric value, like `\.1\.3\.6\.1\.2\.1\.2\.2\.1\.1\.(\d+)$`
+	// for the ifIndex oid of entAliasMappingIdentifier. The whole value is used if empty.
+	KeyPattern string `db:"key_pattern"`
+
+	// KeyRegex is the compiled KeyPattern regexp.
+	KeyRegex *regexp.Regexp `db:"-" json:"-"`
+
+	// Metrics is the list of metrics of the joined table.
+	Metrics []Metric
+}
+
+// UnmarshalJSON unserializes data into an IndexJoin.
+// Checks specifically if the key pattern is valid.
+func (j *IndexJoin) UnmarshalJSON(data []byte) error {
+	type IJ IndexJoin
+	var ij IJ
+
+	if err := json.Unmarshal(data, &ij); err != nil {
+		return err
+	}
+	if len(ij.Metrics) == 0 {
+		return fmt.Errorf("index join #%d: metric list cannot be empty", ij.ID)
+	}
+	if ij.KeyPattern != "" {
+		var err error
+		if ij.KeyRegex, err = regexp.Compile(ij.KeyPattern); err != nil {
+			return fmt.Errorf("index join #%d: invalid key pattern: %v", ij.ID, err)
+		}
+		if ij.KeyRegex.NumSubexp() < 1 {
+			return fmt.Errorf("index join #%d: key pattern `%s` must contain at least one capture group", ij.ID, ij.KeyPattern)
+		}
+	}
+	*j = IndexJoin(ij)
+	return nil
+}
+
+// RemoveInactive filters out all joined metrics marked as inactive.
+func (j *IndexJoin) RemoveInactive() {
+	filtered := j.Metrics[:0]
+	for _, metric := range j.Metrics {
+		if metric.Active {
+			filtered = append(filtered, metric)
+		}
+	}
+	j.Metrics = filtered
+}
@@ -22,6 +22,21 @@ import (
 	"github.com/kosctelecom/horus/log"
 )
 
+const (
+	// WalkColumns is the walk strategy where each column oid of an indexed
+	// measure is walked separately (default).
+	WalkColumns = "column"
+
+	// WalkTable is the walk strategy where all the column oids of an indexed
+	// measure are requested together in the same pdu, like snmptable.
+	WalkTable = "table"
+
+	// WalkTargeted is the walk strategy where only the filter and index metrics
+	// are walked, the other ones being fetched with batched gets on the indexes
+	// matching the filter.
+	WalkTargeted = "targeted"
+)
+
 // IndexedMeasure is a group of tabular metrics indexed by the first one.
 type IndexedMeasure struct {
 	// ID is the measure db id.
@@ -33,6 +48,10 @@ type IndexedMeasure struct {
 	// Description is the description of the indexed measure.
 	Description string `db:"description"`
 
+	// PollingFrequency is the measure polling frequency on the device, the device
+	// one if 0. It is only used by the dispatcher.
+	PollingFrequency int `db:"polling_frequency" json:"-"`
+
 	// Metrics is the list of metrics forming this measure.
 	Metrics []Metric
 
@@ -55,12 +74,35 @@ type IndexedMeasure struct {
 	// InvertFilterMatch negates the match result of the FilterPattern.
 	InvertFilterMatch bool `db:"invert_filter_match"`
 
+	// FilterRefreshInterval is the max time in seconds the indexes matching the filter
+	// are reused before walking the filter metric again, with the targeted walk strategy.
+	// The filter metric is walked at each poll if 0.
+	FilterRefreshInterval int `db:"filter_refresh_interval"`
+
+	// LabelRefreshPolls is the number of polls during which the label metrics of this
+	// measure are reused from the agent cache instead of being walked. Disabled if 0.
+	LabelRefreshPolls int `db:"label_refresh_polls"`
+
+	// LabelChangeOid is an optional scalar oid (like ifTableLastChanged) whose
+	// value change forces the refresh of the cached labels.
+	LabelChangeOid OID `json:",omitempty" db:"label_change_oid"`
+
 	// FilterRegex is the compiled FilterPattern pattern.
 	FilterRegex *regexp.Regexp `db:"-" json:"-"`
 
 	// UseAlternateCommunity tells wether to use the alternate community for all metrics of this measure.
 	UseAlternateCommunity bool `db:"use_alternate_community"`
 
+	// WalkStrategy is the way the metrics of this measure are walked:
+	// WalkColumns (default if empty), WalkTable or WalkTargeted.
+	WalkStrategy string `db:"walk_strategy"`
+
+	// DerivedMetrics is the list of metrics computed from the other metrics of each row.
+	DerivedMetrics []DerivedMetric
+
+	// IndexJoins is the list of tables joined to the rows of this measure.
+	IndexJoins []IndexJoin
+
 	// ToKafka is a flag telling if the results are exported to Kafka.
 	ToKafka bool `db:"to_kafka"`
 
@@ -104,6 +146,36 @@ func (x *IndexedMeasure) UnmarshalJSON(data []byte) error {
 	if im.FilterPattern == "" && im.FilterMetricID.Valid {
 		return fmt.Errorf("indexed measure %s: FilterPattern cannot be empty when FilterMetricID is defined", im.Name)
 	}
+	if im.WalkStrategy != "" && im.WalkStrategy != WalkColumns && im.WalkStrategy != WalkTable && im.WalkStrategy != WalkTargeted {
+		return fmt.Errorf("indexed measure %s: invalid walk strategy %q", im.Name, im.WalkStrategy)
+	}
+	if im.WalkStrategy == WalkTargeted && im.FilterPattern == "" {
+		return fmt.Errorf("indexed measure %s: FilterPattern cannot be empty with targeted walk strategy", im.Name)
+	}
+	if im.FilterRefreshInterval < 0 {
+		return fmt.Errorf("indexed measure %s: FilterRefreshInterval cannot be negative", im.Name)
+	}
+	if im.LabelRefreshPolls < 0 {
+		return fmt.Errorf("indexed measure %s: LabelRefreshPolls cannot be negative", im.Name)
+	}
+	if err := CheckDerived(im.DerivedMetrics, im.Metrics); err != nil {
+		return fmt.Errorf("indexed measure %s: %v", im.Name, err)
+	}
+	for _, join := range im.IndexJoins {
+		if !im.IndexMetricID.Valid {
+			return fmt.Errorf("indexed measure %s: IndexMetricID cannot be null with index joins", im.Name)
+		}
+		found := false
+		for _, metric := range im.Metrics {
+			if metric.ID == join.MappingMetricID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("indexed measure %s: join mapping metric %d not in metric list", im.Name, join.MappingMetricID)
+		}
+	}
 	im.FilterPos = -1
 	if im.FilterPattern != "" {
 		for i, metric := range im.Metrics {
@@ -141,6 +213,9 @@ func (x *IndexedMeasure) RemoveInactive() {
 			}
 		}
 	}
+	for i := range x.IndexJoins {
+		x.IndexJoins[i].RemoveInactive()
+	}
 	log.Debug3f("metrics before filter: %v", Names(x.Metrics))
 	x.Metrics = filtered
 	log.Debug3f("metrics after inactive filter: %v", Names(filtered))
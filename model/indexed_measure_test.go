@@ -136,6 +136,192 @@ func TestIndexedMeas(t *testing.T) {
 			IndexedMeasure{},
 			false, // invalid FilterMetricID
 		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true}
+				],
+				"IndexMetricID": 8,
+				"WalkStrategy": "table"
+			}`,
+			IndexedMeasure{
+				Name:          "ifStatus",
+				IndexMetricID: NullInt64{8, true},
+				IndexPos:      0,
+				FilterPos:     -1,
+				WalkStrategy:  WalkTable,
+				Metrics: []Metric{
+					Metric{
+						ID:            8,
+						Name:          "ifIndex",
+						Oid:           ".1.3.6.1.2.1.2.2.1.1",
+						Active:        true,
+						ExportAsLabel: true,
+					},
+				},
+			},
+			true,
+		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true}
+				],
+				"WalkStrategy": "row"
+			}`,
+			IndexedMeasure{},
+			false, // invalid WalkStrategy
+		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true}
+				],
+				"IndexMetricID": 8,
+				"WalkStrategy": "targeted"
+			}`,
+			IndexedMeasure{},
+			false, // targeted without FilterPattern
+		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true},
+					{"ID":9, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true, "ExportAsLabel":false}
+				],
+				"IndexMetricID": 8,
+				"FilterMetricID": 9,
+				"FilterPattern": "DSL",
+				"FilterRefreshInterval": 300,
+				"WalkStrategy": "targeted"
+			}`,
+			IndexedMeasure{
+				Name:                  "ifStatus",
+				IndexMetricID:         NullInt64{8, true},
+				FilterMetricID:        NullInt64{9, true},
+				FilterPattern:         "DSL",
+				FilterRegex:           regexp.MustCompile("DSL"),
+				FilterRefreshInterval: 300,
+				IndexPos:              0,
+				FilterPos:             1,
+				WalkStrategy:          WalkTargeted,
+				Metrics: []Metric{
+					Metric{
+						ID:            8,
+						Name:          "ifIndex",
+						Oid:           ".1.3.6.1.2.1.2.2.1.1",
+						Active:        true,
+						ExportAsLabel: true,
+					},
+					Metric{
+						ID:            9,
+						Name:          "ifDescr",
+						Oid:           ".1.3.6.1.2.1.2.2.1.2",
+						Active:        true,
+						ExportAsLabel: false,
+					},
+				},
+			},
+			true,
+		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true}
+				],
+				"FilterRefreshInterval": -1
+			}`,
+			IndexedMeasure{},
+			false, // negative FilterRefreshInterval
+		},
+		{
+			`{
+				"Name":"ifStatus",
+				"Metrics": [
+					{"ID":8, "Name":"ifIndex", "Oid":".1.3.6.1.2.1.2.2.1.1", "Active":true, "ExportAsLabel":true}
+				],
+				"LabelRefreshPolls": -1
+			}`,
+			IndexedMeasure{},
+			false, // negative LabelRefreshPolls
+		},
+		{
+			`{
+				"Name":"ipAddr",
+				"Metrics": [
+					{"ID":8, "Name":"ipAdEntIfIndex", "Oid":".1.3.6.1.2.1.4.20.1.2", "Active":true}
+				],
+				"IndexMetricID": 8,
+				"IndexJoins": [{"ID":1, "MappingMetricID":8, "KeyPattern":"^(\\d+)$", "Metrics":[
+					{"ID":9, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true, "ExportAsLabel":true}
+				]}]
+			}`,
+			IndexedMeasure{
+				Name:          "ipAddr",
+				IndexMetricID: NullInt64{8, true},
+				IndexPos:      0,
+				FilterPos:     -1,
+				Metrics: []Metric{
+					Metric{
+						ID:     8,
+						Name:   "ipAdEntIfIndex",
+						Oid:    ".1.3.6.1.2.1.4.20.1.2",
+						Active: true,
+					},
+				},
+				IndexJoins: []IndexJoin{
+					IndexJoin{
+						ID:              1,
+						MappingMetricID: 8,
+						KeyPattern:      `^(\d+)$`,
+						KeyRegex:        regexp.MustCompile(`^(\d+)$`),
+						Metrics: []Metric{
+							Metric{
+								ID:            9,
+								Name:          "ifDescr",
+								Oid:           ".1.3.6.1.2.1.2.2.1.2",
+								Active:        true,
+								ExportAsLabel: true,
+							},
+						},
+					},
+				},
+			},
+			true,
+		},
+		{
+			`{
+				"Name":"ipAddr",
+				"Metrics": [
+					{"ID":8, "Name":"ipAdEntIfIndex", "Oid":".1.3.6.1.2.1.4.20.1.2", "Active":true}
+				],
+				"IndexMetricID": 8,
+				"IndexJoins": [{"ID":1, "MappingMetricID":7, "Metrics":[
+					{"ID":9, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true}
+				]}]
+			}`,
+			IndexedMeasure{},
+			false, // join mapping metric not in metric list
+		},
+		{
+			`{
+				"Name":"ipAddr",
+				"Metrics": [
+					{"ID":8, "Name":"ipAdEntIfIndex", "Oid":".1.3.6.1.2.1.4.20.1.2", "Active":true}
+				],
+				"IndexMetricID": 8,
+				"IndexJoins": [{"ID":1, "MappingMetricID":8, "KeyPattern":"\\d+", "Metrics":[
+					{"ID":9, "Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2", "Active":true}
+				]}]
+			}`,
+			IndexedMeasure{},
+			false, // join key pattern without capture group
+		},
 	}
 
 	for i, tt := range tests {
@@ -151,5 +337,17 @@ func TestIndexedMeas(t *testing.T) {
 		if valid && !reflect.DeepEqual(im, tt.out) {
 			t.Errorf("IndexedMeasure#%d: expected:\n%+v\ngot:\n%+v\n", i, tt.out, im)
 		}
+		if !valid {
+			continue
+		}
+		data, err := json.Marshal(im)
+		if err != nil {
+			t.Errorf("IndexedMeasure#%d: marshal: %v", i, err)
+			continue
+		}
+		var rt IndexedMeasure
+		if err := json.Unmarshal(data, &rt); err != nil {
+			t.Errorf("IndexedMeasure#%d: unmarshal marshaled measure: %v", i, err)
+		}
 	}
 }
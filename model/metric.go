@@ -37,13 +37,6 @@ type Metric struct {
 	// Description is the metric description.
 	Description string `db:"description"`
 
-	// PollingFrequency is the metric polling frequency.
-	// Must be a multiple of the device polling frequency.
-	PollingFrequency int `db:"polling_frequency"`
-
-	// LastPolledAt is the metric's last poll time (on this device).
-	LastPolledAt NullTime `db:"last_polled_at"`
-
 	// Active indicates if this metric is actually polled (all inactive metrics are ignored).
 	Active bool `db:"active"`
 
@@ -61,10 +54,26 @@ type Metric struct {
 
 	// IndexRegex is the compiled IndexPattern regexp.
 	IndexRegex *regexp.Regexp `json:"-" db:"-"`
+
+	// LookupTable is the lookup table of the `map` or `bits` post-processor, set from
+	// the request lookup tables.
+	LookupTable map[string]string `json:"-" db:"-"`
 }
 
+const (
+	// MapPostProcessor is the prefix of the `map:<table>` post-processor.
+	MapPostProcessor = "map:"
+
+	// BitsPostProcessor is the prefix of the `bits:<table>` post-processor.
+	BitsPostProcessor = "bits:"
+
+	// InetAddressPostProcessor is the prefix of the `inet-address:<metric>`
+	// post-processor, whose address type is given by a metric of the same row.
+	InetAddressPostProcessor = "inet-address:"
+)
+
 // PostProcessorPat is a pattern listing all valid transformations available.
-var PostProcessorPat = regexp.MustCompile(`^parse-hex-[bl]e|parse-int|trim|(div|mul)[:-]\d+$`)
+var PostProcessorPat = regexp.MustCompile(`^parse-hex-[bl]e|parse-int|trim|(div|mul)[:-]\d+$|^(rate|delta)$|^(map|bits|inet-address):[\w.-]+$|^(mac|inet-address|date-and-time|date-and-time-epoch|bits|hex)$|^charset:(latin1|iso-8859-1|utf-16be|utf-16le|utf-8)$`)
 
 // UnmarshalJSON unserializes a Metric. Checks specifically if the index pattern
 // is valid and contains at least one sub-expression.
@@ -89,17 +98,75 @@ func (m *Metric) UnmarshalJSON(data []byte) error {
 			return fmt.Errorf("index_pattern `%s` must contain at least one capture group for the index", metr.IndexPattern)
 		}
 	}
+	var counterPP, mapPP int
 	for i, pp := range metr.PostProcessors {
 		trimmed := strings.TrimSpace(pp)
 		if !PostProcessorPat.MatchString(trimmed) {
 			return fmt.Errorf("invalid post processor `%s` for metric %s", pp, metr.Name)
 		}
+		if trimmed == "rate" || trimmed == "delta" {
+			counterPP++
+		}
+		if strings.HasPrefix(trimmed, MapPostProcessor) || strings.HasPrefix(trimmed, BitsPostProcessor) {
+			mapPP++
+		}
 		metr.PostProcessors[i] = trimmed
 	}
+	if counterPP > 1 {
+		return fmt.Errorf("metric %s: only one of `rate` or `delta` post processor allowed", metr.Name)
+	}
+	if mapPP > 1 {
+		return fmt.Errorf("metric %s: only one `map` or `bits` post processor with lookup table allowed", metr.Name)
+	}
+	if counterPP > 0 && metr.ExportAsLabel {
+		return fmt.Errorf("metric %s: `rate` and `delta` post processors cannot be used on a label", metr.Name)
+	}
 	*m = Metric(metr)
 	return nil
 }
 
+// ResolveOid resolves the symbolic oid of the metric with r. The oid prefix
+// of the index pattern is replaced by the resolved oid.
+func (m *Metric) ResolveOid(r OIDResolver) error {
+	if !m.Oid.IsSymbolic() {
+		return nil
+	}
+	oid, err := m.Oid.Resolve(r)
+	if err != nil {
+		return fmt.Errorf("metric %s: %v", m.Name, err)
+	}
+	if m.IndexPattern != "" {
+		escaped := strings.Replace(string(m.Oid), `.`, `\.`, -1)
+		switch {
+		case strings.HasPrefix(m.IndexPattern, escaped):
+			m.IndexPattern = strings.Replace(string(oid), `.`, `\.`, -1) + m.IndexPattern[len(escaped):]
+		case strings.HasPrefix(m.IndexPattern, string(m.Oid)):
+			m.IndexPattern = string(oid) + m.IndexPattern[len(m.Oid):]
+		}
+		if m.IndexRegex != nil {
+			if m.IndexRegex, err = regexp.Compile(m.IndexPattern); err != nil {
+				return fmt.Errorf("metric %s: invalid index pattern: %v", m.Name, err)
+			}
+		}
+	}
+	m.Oid = oid
+	return nil
+}
+
+// LookupTableName returns the lookup table name of the metric's `map` or
+// `bits` post-processor, or an empty string if there is none.
+func (m Metric) LookupTableName() string {
+	for _, pp := range m.PostProcessors {
+		if strings.HasPrefix(pp, MapPostProcessor) {
+			return strings.TrimPrefix(pp, MapPostProcessor)
+		}
+		if strings.HasPrefix(pp, BitsPostProcessor) {
+			return strings.TrimPrefix(pp, BitsPostProcessor)
+		}
+	}
+	return ""
+}
+
 // Names returns the names of the metric list in an array.
 func Names(metrics []Metric) []string {
 	res := make([]string, len(metrics))
@@ -29,6 +29,19 @@ func TestUnmarshalMetric(t *testing.T) {
 		{`{"Name":"sdslUpstreamAttenuation", "Oid":".1.3.6.1.2.1.10.48.1.5.1.1", "IndexPattern":".1.3.6.1.2.1.10.48.1.5.1.1.\\d+.2.1.\\d"}`, false, false},
 		{`{"Name":"multiSubexps", "Oid":".1.3.6.1.4.1.6527.3.1.2.4.3.2.1.1", "IndexPattern":".1.3.6.1.4.1.6527.3.1.2.4.3.2.1.1.\\d+.(\\d+).(\\d+)"}`, true, false},
 		{`{"Name":"namedSubexps", "Oid":".1.3.6.1.4.1.6527.3.1.2.4.3.2.1.1", "IndexPattern":".1.3.6.1.4.1.6527.3.1.2.4.3.2.1.1.\\d+.(?P<idx1>\\d+).(?P<idx2>\\d+)"}`, true, false},
+		{`{"Name":"ifHCInOctets", "Oid":".1.3.6.1.2.1.31.1.1.1.6", "PostProcessors":["rate"]}`, true, true},
+		{`{"Name":"ifHCInOctets", "Oid":".1.3.6.1.2.1.31.1.1.1.6", "PostProcessors":["rate", "delta"]}`, false, true},
+		{`{"Name":"ifName", "Oid":".1.3.6.1.2.1.31.1.1.1.1", "ExportAsLabel":true, "PostProcessors":["delta"]}`, false, true},
+		{`{"Name":"ifOperStatus", "Oid":".1.3.6.1.2.1.2.2.1.8", "ExportAsLabel":true, "PostProcessors":["map:if-status"]}`, true, true},
+		{`{"Name":"ifOperStatus", "Oid":".1.3.6.1.2.1.2.2.1.8", "PostProcessors":["map:"]}`, false, true},
+		{`{"Name":"ifOperStatus", "Oid":".1.3.6.1.2.1.2.2.1.8", "PostProcessors":["map:a", "map:b"]}`, false, true},
+		{`{"Name":"ifPhysAddress", "Oid":".1.3.6.1.2.1.2.2.1.6", "ExportAsLabel":true, "PostProcessors":["mac"]}`, true, true},
+		{`{"Name":"ifAlias", "Oid":".1.3.6.1.2.1.31.1.1.1.18", "ExportAsLabel":true, "PostProcessors":["charset:latin1"]}`, true, true},
+		{`{"Name":"ifAlias", "Oid":".1.3.6.1.2.1.31.1.1.1.18", "ExportAsLabel":true, "PostProcessors":["charset:ebcdic"]}`, false, true},
+		{`{"Name":"alarmFlags", "Oid":".1.3.6.1.4.1.9999.1.1", "ExportAsLabel":true, "PostProcessors":["bits:alarm-flags"]}`, true, true},
+		{`{"Name":"alarmFlags", "Oid":".1.3.6.1.4.1.9999.1.1", "PostProcessors":["bits:a", "map:b"]}`, false, true},
+		{`{"Name":"peerAddr", "Oid":".1.3.6.1.4.1.9999.1.2", "ExportAsLabel":true, "PostProcessors":["inet-address:peerAddrType"]}`, true, true},
+		{`{"Name":"peerAddr", "Oid":".1.3.6.1.4.1.9999.1.2", "PostProcessors":["inet-address:"]}`, false, true},
 	}
 	for i, tt := range tests {
 		var m Metric
@@ -70,3 +83,34 @@ func TestGroupByOid(t *testing.T) {
 		t.Fatalf("GroupByOid: expected 3 entries, got %d", len(grouped))
 	}
 }
+
+func TestMetricResolveOid(t *testing.T) {
+	r := mapResolver{"ifDescr": ".1.3.6.1.2.1.2.2.1.2", "sysUpTime.0": ".1.3.6.1.2.1.1.3.0"}
+	tests := []struct {
+		in      string
+		oid     OID
+		pattern string
+		valid   bool
+	}{
+		{`{"Name":"sysUpTime", "Oid":"sysUpTime.0"}`, ".1.3.6.1.2.1.1.3.0", "", true},
+		{`{"Name":"ifDescr", "Oid":"ifDescr", "IndexPattern":"ifDescr.(\\d+)"}`, ".1.3.6.1.2.1.2.2.1.2", `\.1\.3\.6\.1\.2\.1\.2\.2\.1\.2\.(\d+)`, true},
+		{`{"Name":"ifDescr", "Oid":".1.3.6.1.2.1.2.2.1.2"}`, ".1.3.6.1.2.1.2.2.1.2", "", true},
+		{`{"Name":"ifAlias", "Oid":"IF-MIB::ifAlias"}`, "IF-MIB::ifAlias", "", false},
+	}
+	for i, tt := range tests {
+		var m Metric
+		if err := m.UnmarshalJSON([]byte(tt.in)); err != nil {
+			t.Fatalf("metric#%d: unmarshal: %v", i, err)
+		}
+		err := m.ResolveOid(r)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("metric#%d: resolve: valid? expected %v, got %v (err: %v)", i, tt.valid, valid, err)
+		}
+		if m.Oid != tt.oid || m.IndexPattern != tt.pattern {
+			t.Errorf("metric#%d: resolve: expected %s `%s`, got %s `%s`", i, tt.oid, tt.pattern, m.Oid, m.IndexPattern)
+		}
+		if m.IndexRegex != nil && !m.IndexRegex.MatchString(".1.3.6.1.2.1.2.2.1.2.12") {
+			t.Errorf("metric#%d: resolved index regex %s doesn't match", i, m.IndexRegex)
+		}
+	}
+}
@@ -26,9 +26,47 @@ type OID string
 // oidPattern is the regexp pattern of a valid OID.
 var oidPattern = regexp.MustCompile(`^\.?(\d+\.)+\d+$`)
 
+// symbolicOidPattern is the regexp pattern of a symbolic OID name, optionally
+// qualified by its MIB module and followed by a numeric suffix, like
+// `IF-MIB::ifHCInOctets` or `sysUpTime.0`.
+var symbolicOidPattern = regexp.MustCompile(`^([A-Za-z][\w-]*::)?[A-Za-z][\w-]*(\.\d+)*$`)
+
+// StrictOIDs makes the json unmarshaling of OIDs reject the symbolic names. It is
+// set by the agents, which only poll the numeric OIDs resolved by the dispatcher.
+var StrictOIDs bool
+
+// OIDResolver resolves the symbolic OID names to numeric OIDs.
+type OIDResolver interface {
+	// ResolveOID returns the numeric OID of a symbolic name.
+	ResolveOID(name string) (string, error)
+}
+
+// IsSymbolic tells whether the OID is a symbolic name to resolve.
+func (o OID) IsSymbolic() bool {
+	return symbolicOidPattern.MatchString(string(o))
+}
+
+// Resolve returns the numeric form of a symbolic OID. Numeric OIDs are returned as is.
+func (o OID) Resolve(r OIDResolver) (OID, error) {
+	if !o.IsSymbolic() {
+		return o, nil
+	}
+	if r == nil {
+		return o, fmt.Errorf("cannot resolve oid %s: no mib loaded", o)
+	}
+	oid, err := r.ResolveOID(string(o))
+	if err != nil {
+		return o, fmt.Errorf("resolve oid %s: %v", o, err)
+	}
+	if !oidPattern.MatchString(oid) {
+		return o, fmt.Errorf("resolve oid %s: bad OID format `%s`", o, oid)
+	}
+	return OID(oid), nil
+}
+
 // MarshalJSON implements the json Marshaler interface for the OID.
 func (o OID) MarshalJSON() ([]byte, error) {
-	if !oidPattern.MatchString(string(o)) {
+	if !oidPattern.MatchString(string(o)) && !o.IsSymbolic() {
 		return nil, fmt.Errorf("MarshalJSON: bad OID format `%s`", o)
 	}
 	return []byte(`"` + o + `"`), nil
@@ -36,11 +74,19 @@ func (o OID) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON implements the json Unmarshaler interface for the OID
 // Validates the correct oid format and adds leading dot if needed.
+// Symbolic names are kept as is, unless StrictOIDs is set.
 func (o *OID) UnmarshalJSON(value []byte) error {
 	if len(value) < 2 {
 		return errors.New("UnmarshalJSON: bad OID")
 	}
 	sval := string(value)[1 : len(value)-1] // strip quotes
+	if symbolicOidPattern.MatchString(sval) {
+		if StrictOIDs {
+			return fmt.Errorf("UnmarshalJSON: unresolved symbolic OID `%s`", sval)
+		}
+		*o = OID(sval)
+		return nil
+	}
 	if !oidPattern.MatchString(sval) {
 		return fmt.Errorf("UnmarshalJSON: bad OID `%s`", sval)
 	}
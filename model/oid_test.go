@@ -14,7 +14,10 @@
 
 package model
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestUnmarshalOID(t *testing.T) {
 	tests := []struct {
@@ -24,6 +27,12 @@ func TestUnmarshalOID(t *testing.T) {
 	}{
 		{`".1.3.6.1.2.1.1.1.0"`, OID(".1.3.6.1.2.1.1.1.0"), true},
 		{`"1.3.6.1.2.1.1.3.0"`, OID(".1.3.6.1.2.1.1.3.0"), true},
+		{`"IF-MIB::ifHCInOctets"`, OID("IF-MIB::ifHCInOctets"), true},
+		{`"sysUpTime.0"`, OID("sysUpTime.0"), true},
+		{`"ifDescr.1.2"`, OID("ifDescr.1.2"), true},
+		{`"IF-MIB::"`, OID(""), false},
+		{`"1.3.6.x"`, OID(""), false},
+		{`"ifDescr..1"`, OID(""), false},
 	}
 
 	for _, tt := range tests {
@@ -38,3 +47,49 @@ func TestUnmarshalOID(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalStrictOID(t *testing.T) {
+	defer func() { StrictOIDs = false }()
+	StrictOIDs = true
+	var o OID
+	if err := o.UnmarshalJSON([]byte(`"IF-MIB::ifHCInOctets"`)); err == nil {
+		t.Errorf("UnmarshalJSON: symbolic OID accepted in strict mode")
+	}
+	if err := o.UnmarshalJSON([]byte(`"1.3.6.1.2.1.1.3.0"`)); err != nil || o != ".1.3.6.1.2.1.1.3.0" {
+		t.Errorf("UnmarshalJSON: numeric OID in strict mode: got %v (err: %v)", o, err)
+	}
+}
+
+type mapResolver map[string]string
+
+func (r mapResolver) ResolveOID(name string) (string, error) {
+	if oid, ok := r[name]; ok {
+		return oid, nil
+	}
+	return "", fmt.Errorf("unknown object %s", name)
+}
+
+func TestResolveOID(t *testing.T) {
+	r := mapResolver{"sysUpTime.0": ".1.3.6.1.2.1.1.3.0", "badObject": "foo"}
+	tests := []struct {
+		in       OID
+		resolver OIDResolver
+		out      OID
+		valid    bool
+	}{
+		{".1.3.6.1.2.1.1.3.0", nil, ".1.3.6.1.2.1.1.3.0", true},
+		{"sysUpTime.0", r, ".1.3.6.1.2.1.1.3.0", true},
+		{"sysUpTime.0", nil, "sysUpTime.0", false},
+		{"ifDescr", r, "ifDescr", false},
+		{"badObject", r, "badObject", false},
+	}
+	for _, tt := range tests {
+		out, err := tt.in.Resolve(tt.resolver)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("Resolve %s: valid? expected %v, got %v (err: %v)", tt.in, tt.valid, valid, err)
+		}
+		if out != tt.out {
+			t.Errorf("Resolve %s: expected %s, got %s", tt.in, tt.out, out)
+		}
+	}
+}
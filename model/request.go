@@ -17,6 +17,7 @@ package model
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 )
@@ -40,6 +41,14 @@ type SnmpRequest struct {
 
 	// Device is the network device to poll.
 	Device Device `json:"device"`
+
+	// LookupTables is the list of lookup tables used by the `map` and `bits` post-processors
+	// of the request metrics, by name.
+	LookupTables map[string]map[string]string `json:"lookup_tables,omitempty"`
+
+	// ResolvedOids maps the symbolic oid names of the request metrics to the
+	// numeric oids they were resolved to.
+	ResolvedOids map[string]string `json:"resolved_oids,omitempty"`
 }
 
 // OngoingPolls is the result to the OngoingURI api request.
@@ -51,6 +60,18 @@ type OngoingPolls struct {
 	Load float64 `json:"load"`
 }
 
+// PollJob is a polling job sent to an agent outside of the polling schedule.
+type PollJob struct {
+	// RequestID is the polling request uid, also the id of its report.
+	RequestID string `json:"request_id"`
+
+	// DeviceID is the polled device id.
+	DeviceID int `json:"device_id"`
+
+	// AgentID is the id of the agent polling the device.
+	AgentID int `json:"agent_id"`
+}
+
 // PingHost is a host to ping.
 type PingHost struct {
 	// ID is the target db id
@@ -88,6 +109,9 @@ const (
 	// SnmpJobURI is the agent uri for snmp poll requests
 	SnmpJobURI = "/r/poll"
 
+	// SnmpQueryURI is the agent uri for on-demand snmp poll requests, replying with the result
+	SnmpQueryURI = "/r/query"
+
 	// CheckURI is the agent keep-alive uri
 	CheckURI = "/r/check"
 
@@ -97,6 +121,9 @@ const (
 	// OngoingURI is the agent current ongoing request list uri endpoint
 	OngoingURI = "/r/ongoing"
 
+	// TrapDevicesURI is the agent uri setting the devices of the trap receiver
+	TrapDevicesURI = "/r/trap-devices"
+
 	// ReportURI is the controller report callback uri
 	ReportURI = "/r/report"
 )
@@ -119,6 +146,75 @@ func (r *SnmpRequest) UnmarshalJSON(data []byte) error {
 		return errors.New("invalid request: missing device")
 	}
 	*r = SnmpRequest(req)
+	if err := r.checkOids(); err != nil {
+		return err
+	}
+	return r.setLookupTables()
+}
+
+// checkOids checks that all symbolic oids of the request were resolved.
+func (r *SnmpRequest) checkOids() error {
+	check := func(metrics []Metric) error {
+		for _, m := range metrics {
+			if m.Oid.IsSymbolic() {
+				return fmt.Errorf("invalid request: metric %s: unresolved oid %s", m.Name, m.Oid)
+			}
+		}
+		return nil
+	}
+	for _, scalar := range r.ScalarMeasures {
+		if err := check(scalar.Metrics); err != nil {
+			return err
+		}
+	}
+	for _, indexed := range r.IndexedMeasures {
+		if err := check(indexed.Metrics); err != nil {
+			return err
+		}
+		if indexed.LabelChangeOid.IsSymbolic() {
+			return fmt.Errorf("invalid request: measure %s: unresolved label change oid %s", indexed.Name, indexed.LabelChangeOid)
+		}
+		for _, join := range indexed.IndexJoins {
+			if err := check(join.Metrics); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setLookupTables sets its lookup table on each metric with a `map` or `bits` post-processor.
+// Returns an error if a table is missing from the request.
+func (r *SnmpRequest) setLookupTables() error {
+	set := func(metrics []Metric) error {
+		for i, m := range metrics {
+			name := m.LookupTableName()
+			if name == "" {
+				continue
+			}
+			table, ok := r.LookupTables[name]
+			if !ok {
+				return fmt.Errorf("invalid request: metric %s: lookup table %s not found", m.Name, name)
+			}
+			metrics[i].LookupTable = table
+		}
+		return nil
+	}
+	for _, scalar := range r.ScalarMeasures {
+		if err := set(scalar.Metrics); err != nil {
+			return err
+		}
+	}
+	for _, indexed := range r.IndexedMeasures {
+		if err := set(indexed.Metrics); err != nil {
+			return err
+		}
+		for _, join := range indexed.IndexJoins {
+			if err := set(join.Metrics); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
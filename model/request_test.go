@@ -16,6 +16,7 @@ package model
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -150,7 +151,7 @@ func TestRequest(t *testing.T) {
 				},
 				"ScalarMeasures": [
 					{"Name": "sysUsage", "Metrics":[
-						{"Name":"sysName", "Oid":".1.3.6.1.2.1.1.5.0", "Active":true, "PollingFrequency": 300}
+						{"Name":"sysName", "Oid":".1.3.6.1.2.1.1.5.0", "Active":true}
 					]
 				}],
 				"IndexedMeasures": [{
@@ -188,11 +189,10 @@ func TestRequest(t *testing.T) {
 						Name: "sysUsage",
 						Metrics: []Metric{
 							Metric{
-								Name:             "sysName",
-								Oid:              ".1.3.6.1.2.1.1.5.0",
-								Active:           true,
-								ExportAsLabel:    false,
-								PollingFrequency: 300,
+								Name:          "sysName",
+								Oid:           ".1.3.6.1.2.1.1.5.0",
+								Active:        true,
+								ExportAsLabel: false,
 							},
 						},
 					},
@@ -202,12 +202,11 @@ func TestRequest(t *testing.T) {
 						Name: "ifStatus",
 						Metrics: []Metric{
 							Metric{
-								ID:               8,
-								Name:             "ifIndex",
-								Oid:              ".1.3.6.1.2.1.2.2.1.1",
-								Active:           true,
-								ExportAsLabel:    true,
-								PollingFrequency: 0,
+								ID:            8,
+								Name:          "ifIndex",
+								Oid:           ".1.3.6.1.2.1.2.2.1.1",
+								Active:        true,
+								ExportAsLabel: true,
 							},
 						},
 						IndexMetricID: NullInt64{8, true},
@@ -235,3 +234,86 @@ func TestRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestRequestLookupTables(t *testing.T) {
+	const req = `{
+		"uid": "003",
+		"device": {
+			"id": 1,
+			"hostname": "10.2.0.9",
+			"category": "c",
+			"vendor": "v",
+			"model": "m",
+			"ip_address": "10.2.0.9",
+			"snmp_version": "2c",
+			"snmp_community": "public"
+		},
+		"IndexedMeasures": [{
+			"Name": "ifStatus",
+			"Metrics": [
+				{"ID":8, "Name":"ifOperStatus", "Oid":".1.3.6.1.2.1.2.2.1.8", "Active":true, "PostProcessors":["map:%s"]}
+			]
+		}],
+		"lookup_tables": {"if-status": {"1": "up", "2": "down"}}
+	}`
+	tests := []struct {
+		table string
+		valid bool
+	}{
+		{"if-status", true},
+		{"unknown", false},
+	}
+	for i, tt := range tests {
+		var r SnmpRequest
+		err := json.Unmarshal([]byte(fmt.Sprintf(req, tt.table)), &r)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("request#%d: expected validity: %v, got %v (%v)", i, tt.valid, valid, err)
+		}
+		if err != nil {
+			continue
+		}
+		expected := map[string]string{"1": "up", "2": "down"}
+		if got := r.IndexedMeasures[0].Metrics[0].LookupTable; !reflect.DeepEqual(got, expected) {
+			t.Errorf("request#%d: expected lookup table %v, got %v", i, expected, got)
+		}
+	}
+}
+
+func TestRequestUnresolvedOids(t *testing.T) {
+	const req = `{
+		"uid": "004",
+		"device": {
+			"id": 1,
+			"hostname": "10.2.0.9",
+			"category": "c",
+			"vendor": "v",
+			"model": "m",
+			"ip_address": "10.2.0.9",
+			"snmp_version": "2c",
+			"snmp_community": "public"
+		},
+		"ScalarMeasures": [{
+			"Name": "sysInfo",
+			"Metrics": [{"ID":1, "Name":"sysUpTime", "Oid":"%s", "Active":true}]
+		}],
+		"resolved_oids": {"sysUpTime.0": ".1.3.6.1.2.1.1.3.0"}
+	}`
+	tests := []struct {
+		oid   string
+		valid bool
+	}{
+		{".1.3.6.1.2.1.1.3.0", true},
+		{"sysUpTime.0", false},
+		{"SNMPv2-MIB::sysUpTime.0", false},
+	}
+	for i, tt := range tests {
+		var r SnmpRequest
+		err := json.Unmarshal([]byte(fmt.Sprintf(req, tt.oid)), &r)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("request#%d: expected validity: %v, got %v (%v)", i, tt.valid, valid, err)
+		}
+		if err == nil && r.ResolvedOids["sysUpTime.0"] != tt.oid {
+			t.Errorf("request#%d: unexpected resolved oids %v", i, r.ResolvedOids)
+		}
+	}
+}
@@ -14,7 +14,12 @@
 
 package model
 
-import "github.com/kosctelecom/horus/log"
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/kosctelecom/horus/log"
+)
 
 // ScalarMeasure is a scalar measure with its list
 // of scalar metrics like sysInfo, sysUsage...
@@ -28,9 +33,16 @@ type ScalarMeasure struct {
 	// Description is the description of the scalar metric
 	Description string `db:"description"`
 
+	// PollingFrequency is the measure polling frequency on the device, the device
+	// one if 0. It is only used by the dispatcher.
+	PollingFrequency int `db:"polling_frequency" json:"-"`
+
 	// Metrics is the list of metrics of this scalar measure
 	Metrics []Metric
 
+	// DerivedMetrics is the list of metrics computed from the other metrics of this measure
+	DerivedMetrics []DerivedMetric
+
 	// UseAlternateCommunity tells wether to use the alternate community for all metrics of this measure.
 	UseAlternateCommunity bool `db:"use_alternate_community"`
 
@@ -47,6 +59,22 @@ type ScalarMeasure struct {
 	ToNats bool `db:"to_nats"`
 }
 
+// UnmarshalJSON unserializes data into a ScalarMeasure.
+// Checks specifically if the derived metric expressions are valid.
+func (scalar *ScalarMeasure) UnmarshalJSON(data []byte) error {
+	type SM ScalarMeasure
+	var sm SM
+
+	if err := json.Unmarshal(data, &sm); err != nil {
+		return err
+	}
+	if err := CheckDerived(sm.DerivedMetrics, sm.Metrics); err != nil {
+		return fmt.Errorf("scalar measure %s: %v", sm.Name, err)
+	}
+	*scalar = ScalarMeasure(sm)
+	return nil
+}
+
 // RemoveInactive filters out all metrics of this scalar measure marked as inactive.
 func (scalar *ScalarMeasure) RemoveInactive() {
 	var filtered []Metric
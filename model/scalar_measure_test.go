@@ -20,6 +20,14 @@ import (
 	"testing"
 )
 
+func mustParseExpr(s string) *Expr {
+	e, err := ParseExpr(s)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
 func TestScalarMeasure(t *testing.T) {
 	tests := []struct {
 		in    string
@@ -30,22 +38,76 @@ func TestScalarMeasure(t *testing.T) {
 			`{
 			"Name": "sysUsage",
 			"Metrics": [
-				{"Name":"sysName", "Oid":".1.3.6.1.2.1.1.5.0", "Active":true, "PollingFrequency": 300}
+				{"Name":"sysName", "Oid":".1.3.6.1.2.1.1.5.0", "Active":true}
+			]
+		}`,
+			ScalarMeasure{
+				Name: "sysUsage",
+				Metrics: []Metric{
+					Metric{
+						Name:   "sysName",
+						Oid:    ".1.3.6.1.2.1.1.5.0",
+						Active: true,
+					},
+				},
+			},
+			true,
+		},
+		{
+			`{
+			"Name": "sysUsage",
+			"Metrics": [
+				{"Name":"sysUpTime", "Oid":".1.3.6.1.2.1.1.3.0", "Active":true}
+			],
+			"DerivedMetrics": [
+				{"Name":"upDays", "Expression":"sysUpTime / 8640000"}
 			]
 		}`,
 			ScalarMeasure{
 				Name: "sysUsage",
 				Metrics: []Metric{
 					Metric{
-						Name:             "sysName",
-						Oid:              ".1.3.6.1.2.1.1.5.0",
-						Active:           true,
-						PollingFrequency: 300,
+						Name:   "sysUpTime",
+						Oid:    ".1.3.6.1.2.1.1.3.0",
+						Active: true,
+					},
+				},
+				DerivedMetrics: []DerivedMetric{
+					DerivedMetric{
+						Name:       "upDays",
+						Expression: "sysUpTime / 8640000",
+						Expr:       mustParseExpr("sysUpTime / 8640000"),
 					},
 				},
 			},
 			true,
 		},
+		{
+			`{
+			"Name": "sysUsage",
+			"Metrics": [
+				{"Name":"sysUpTime", "Oid":".1.3.6.1.2.1.1.3.0", "Active":true}
+			],
+			"DerivedMetrics": [
+				{"Name":"upDays", "Expression":"sysUptime / 8640000"}
+			]
+		}`,
+			ScalarMeasure{},
+			false, // unknown metric in expression
+		},
+		{
+			`{
+			"Name": "sysUsage",
+			"Metrics": [
+				{"Name":"sysUpTime", "Oid":".1.3.6.1.2.1.1.3.0", "Active":true}
+			],
+			"DerivedMetrics": [
+				{"Name":"upDays", "Expression":"sysUpTime / "}
+			]
+		}`,
+			ScalarMeasure{},
+			false, // invalid expression
+		},
 	}
 
 	for i, tt := range tests {
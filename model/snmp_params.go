@@ -15,10 +15,12 @@
 package model
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 
-	"github.com/vma/gosnmp"
+	"github.com/gosnmp/gosnmp"
 )
 
 const (
@@ -30,6 +32,18 @@ const (
 
 	// Version3 is for snmp v3
 	Version3 = "3"
+
+	// SecretMask replaces the snmp communities and passwords in the api listings.
+	// A masked secret sent back in an update keeps the stored value.
+	SecretMask = "********"
+)
+
+var (
+	// AuthProtocols is the list of valid snmpv3 authentication protocols.
+	AuthProtocols = []string{"", "MD5", "SHA", "SHA224", "SHA256", "SHA384", "SHA512"}
+
+	// PrivProtocols is the list of valid snmpv3 privacy protocols.
+	PrivProtocols = []string{"", "DES", "AES", "AES192", "AES256", "AES192C", "AES256C"}
 )
 
 // SnmpParams represents the snmp config params.
@@ -58,6 +72,22 @@ type SnmpParams struct {
 	// DisableBulk is a flag that disables snmp bulk requests (automatic for snmp v1).
 	DisableBulk bool `db:"snmp_disable_bulk" json:"snmp_disable_bulk,omitempty"`
 
+	// MaxRepetitions is the max-repetitions value of bulk requests, from 0 to 255
+	// (gosnmp default of 50 if 0).
+	MaxRepetitions int `db:"snmp_max_repetitions" json:"snmp_max_repetitions,omitempty"`
+
+	// MaxOidsPerGet is the max number of oids in a single get request
+	// (gosnmp default of 60 if 0).
+	MaxOidsPerGet int `db:"snmp_max_oids_per_get" json:"snmp_max_oids_per_get,omitempty"`
+
+	// BatchGet is a flag that packs the scalar metrics of a measure in get requests
+	// of up to MaxOidsPerGet oids, instead of one request per oid.
+	BatchGet bool `db:"snmp_batch_get" json:"snmp_batch_get,omitempty"`
+
+	// AdaptiveRepetitions is a flag that lets the agent tune the bulk max-repetitions
+	// according to the device responses, starting from MaxRepetitions.
+	AdaptiveRepetitions bool `db:"snmp_adaptive_repetitions" json:"snmp_adaptive_repetitions,omitempty"`
+
 	// ConnectionCount is the number of possible simultaneous snmp queries
 	// to the device (defaults to 1).
 	ConnectionCount int `db:"snmp_connection_count" json:"snmp_connection_count"`
@@ -68,22 +98,38 @@ type SnmpParams struct {
 	// AuthUser is the authentication username for snmpv3.
 	AuthUser string `db:"snmpv3_auth_user" json:"snmpv3_auth_user,omitempty"`
 
-	// AuthProto is the authentication protocol for snmpv3: "MD5" or "SHA".
+	// AuthProto is the authentication protocol for snmpv3: "MD5", "SHA",
+	// "SHA224", "SHA256", "SHA384" or "SHA512".
 	AuthProto string `db:"snmpv3_auth_proto" json:"snmpv3_auth_proto,omitempty"`
 
 	// AuthPasswd is the authentication password for snmpv3.
 	AuthPasswd string `db:"snmpv3_auth_passwd" json:"snmpv3_auth_passwd,omitempty"`
 
-	// PrivProto is the privacy protocol for snmpv3: "DES" or "AES".
+	// PrivProto is the privacy protocol for snmpv3: "DES", "AES", "AES192", "AES256"
+	// (Blumenthal key extension) or "AES192C", "AES256C" (Reeder key extension).
 	PrivProto string `db:"snmpv3_privacy_proto" json:"snmpv3_privacy_proto,omitempty"`
 
 	// PrivPasswd is the privacy passphrase for snmpv3.
 	PrivPasswd string `db:"snmpv3_privacy_passwd" json:"snmpv3_privacy_passwd,omitempty"`
+
+	// ContextName is the snmpv3 context name, used to query per-VRF or per-instance MIBs.
+	ContextName string `db:"snmpv3_context_name" json:"snmpv3_context_name,omitempty"`
+
+	// ContextEngineID is the snmpv3 context engine id as an hex string.
+	// Defaults to the authoritative engine id of the device when empty.
+	ContextEngineID string `db:"snmpv3_context_engine_id" json:"snmpv3_context_engine_id,omitempty"`
 }
 
 // UnmarshalJSON implements the json Unmarshaler interface.
 // Does some additional checks and sets default values for fields.
 func (s *SnmpParams) UnmarshalJSON(data []byte) error {
+	return s.unmarshalJSON(data, true)
+}
+
+// unmarshalJSON does the json unmarshaling and checks. The community and the
+// snmpv3 user are only required if withCredentials is true, otherwise they are
+// given by a credential set.
+func (s *SnmpParams) unmarshalJSON(data []byte, withCredentials bool) error {
 	type S SnmpParams
 	var params S
 
@@ -93,7 +139,7 @@ func (s *SnmpParams) UnmarshalJSON(data []byte) error {
 	if params.IPAddress == "" {
 		return errors.New("invalid snmp params: ip_address cannot be empty")
 	}
-	if params.Community == "" {
+	if params.Community == "" && withCredentials {
 		return errors.New("invalid snmp params: community cannot be empty")
 	}
 	if params.Port == 0 {
@@ -117,24 +163,38 @@ func (s *SnmpParams) UnmarshalJSON(data []byte) error {
 	if params.ConnectionCount == 0 {
 		params.ConnectionCount = 1
 	}
+	if params.MaxRepetitions < 0 || params.MaxRepetitions > 255 {
+		return errors.New("invalid snmp params: snmp_max_repetitions must be between 0 and 255")
+	}
+	if params.MaxOidsPerGet < 0 {
+		return errors.New("invalid snmp params: snmp_max_oids_per_get cannot be negative")
+	}
 	if params.Version == Version3 {
 		if !strInList(params.SecLevel, "NoAuthNoPriv", "AuthNoPriv", "AuthPriv") {
 			return errors.New("invalid snmp params: snmpv3_security_level must be either NoAuthNoPriv, AuthNoPriv or AuthPriv")
 		}
-		if params.SecLevel != "NoAuthNoPriv" && params.AuthUser == "" {
+		if params.SecLevel != "NoAuthNoPriv" && params.AuthUser == "" && withCredentials {
 			return errors.New("invalid snmp params: snmpv3_auth_user cannot be empty with this v3_security_level")
 		}
-		if !strInList(params.AuthProto, "", "MD5", "SHA") {
-			return errors.New("invalid inmp params: snmpv3_auth_proto must be either empty, MD5 or SHA")
+		if !strInList(params.AuthProto, AuthProtocols...) {
+			return errors.New("invalid snmp params: snmpv3_auth_proto must be either empty, MD5, SHA, SHA224, SHA256, SHA384 or SHA512")
 		}
-		if !strInList(params.PrivProto, "", "DES", "AES") {
-			return errors.New("invalid snmp params: snmpv3_privacy_proto must be either empty, DES or AES")
+		if !strInList(params.PrivProto, PrivProtocols...) {
+			return errors.New("invalid snmp params: snmpv3_privacy_proto must be either empty, DES, AES, AES192, AES256, AES192C or AES256C")
+		}
+		if _, err := hex.DecodeString(params.ContextEngineID); err != nil {
+			return fmt.Errorf("invalid snmp params: snmpv3_context_engine_id must be an hex string: %v", err)
 		}
 	}
 	*s = SnmpParams(params)
 	return nil
 }
 
+// MaskSecrets replaces the non empty communities and snmpv3 passwords by SecretMask.
+func (s *SnmpParams) MaskSecrets() {
+	maskSecrets(&s.Community, &s.AlternateCommunity, &s.AuthPasswd, &s.PrivPasswd)
+}
+
 // GoSnmpVersion converts the snmp version to a gosnmp version.
 func (s SnmpParams) GoSnmpVersion() gosnmp.SnmpVersion {
 	switch s.Version {
@@ -147,6 +207,62 @@ func (s SnmpParams) GoSnmpVersion() gosnmp.SnmpVersion {
 	}
 }
 
+// GoSnmpAuthProto converts the snmpv3 authentication protocol to a gosnmp auth protocol.
+func (s SnmpParams) GoSnmpAuthProto() gosnmp.SnmpV3AuthProtocol {
+	switch s.AuthProto {
+	case "MD5":
+		return gosnmp.MD5
+	case "SHA":
+		return gosnmp.SHA
+	case "SHA224":
+		return gosnmp.SHA224
+	case "SHA256":
+		return gosnmp.SHA256
+	case "SHA384":
+		return gosnmp.SHA384
+	case "SHA512":
+		return gosnmp.SHA512
+	default:
+		return gosnmp.NoAuth
+	}
+}
+
+// GoSnmpPrivProto converts the snmpv3 privacy protocol to a gosnmp privacy protocol.
+func (s SnmpParams) GoSnmpPrivProto() gosnmp.SnmpV3PrivProtocol {
+	switch s.PrivProto {
+	case "DES":
+		return gosnmp.DES
+	case "AES":
+		return gosnmp.AES
+	case "AES192":
+		return gosnmp.AES192
+	case "AES256":
+		return gosnmp.AES256
+	case "AES192C":
+		return gosnmp.AES192C
+	case "AES256C":
+		return gosnmp.AES256C
+	default:
+		return gosnmp.NoPriv
+	}
+}
+
+// GoSnmpContextEngineID returns the binary snmpv3 context engine id
+// as expected by gosnmp.
+func (s SnmpParams) GoSnmpContextEngineID() string {
+	id, _ := hex.DecodeString(s.ContextEngineID)
+	return string(id)
+}
+
+// maskSecrets replaces the non empty secrets by SecretMask.
+func maskSecrets(secrets ...*string) {
+	for _, s := range secrets {
+		if *s != "" {
+			*s = SecretMask
+		}
+	}
+}
+
 // strInList tells wether elem is part of list.
 func strInList(elem string, list ...string) bool {
 	for _, s := range list {
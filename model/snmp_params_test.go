@@ -73,6 +73,125 @@ func TestSnmpParams(t *testing.T) {
 			SnmpParams{},
 			false, // no snmp community
 		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_version": "3",
+				"snmp_community": "snmpxxx79",
+				"snmpv3_security_level": "AuthPriv",
+				"snmpv3_auth_user": "horus",
+				"snmpv3_auth_proto": "SHA512",
+				"snmpv3_auth_passwd": "authpass",
+				"snmpv3_privacy_proto": "AES256C",
+				"snmpv3_privacy_passwd": "privpass"
+			}`,
+			SnmpParams{
+				IPAddress:       "10.2.6.79",
+				Port:            161,
+				Version:         Version3,
+				Community:       "snmpxxx79",
+				Timeout:         10,
+				Retries:         1,
+				ConnectionCount: 1,
+				SecLevel:        "AuthPriv",
+				AuthUser:        "horus",
+				AuthProto:       "SHA512",
+				AuthPasswd:      "authpass",
+				PrivProto:       "AES256C",
+				PrivPasswd:      "privpass",
+			},
+			true,
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_version": "3",
+				"snmp_community": "snmpxxx79",
+				"snmpv3_security_level": "AuthNoPriv",
+				"snmpv3_auth_user": "horus",
+				"snmpv3_auth_proto": "SHA1"
+			}`,
+			SnmpParams{},
+			false, // invalid auth proto
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_version": "3",
+				"snmp_community": "snmpxxx79",
+				"snmpv3_security_level": "AuthPriv",
+				"snmpv3_auth_user": "horus",
+				"snmpv3_auth_proto": "SHA256",
+				"snmpv3_privacy_proto": "AES128"
+			}`,
+			SnmpParams{},
+			false, // invalid privacy proto
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_version": "3",
+				"snmp_community": "snmpxxx79",
+				"snmpv3_security_level": "NoAuthNoPriv",
+				"snmpv3_context_name": "vlan-100",
+				"snmpv3_context_engine_id": "80001f8880"
+			}`,
+			SnmpParams{
+				IPAddress:       "10.2.6.79",
+				Port:            161,
+				Version:         Version3,
+				Community:       "snmpxxx79",
+				Timeout:         10,
+				Retries:         1,
+				ConnectionCount: 1,
+				SecLevel:        "NoAuthNoPriv",
+				ContextName:     "vlan-100",
+				ContextEngineID: "80001f8880",
+			},
+			true,
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_version": "3",
+				"snmp_community": "snmpxxx79",
+				"snmpv3_security_level": "NoAuthNoPriv",
+				"snmpv3_context_engine_id": "0x80001f8880"
+			}`,
+			SnmpParams{},
+			false, // context engine id not hex
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_community": "snmpxxx79",
+				"snmp_max_repetitions": 20,
+				"snmp_max_oids_per_get": 10,
+				"snmp_adaptive_repetitions": true
+			}`,
+			SnmpParams{
+				IPAddress:           "10.2.6.79",
+				Port:                161,
+				Version:             Version2c,
+				Community:           "snmpxxx79",
+				Timeout:             10,
+				Retries:             1,
+				ConnectionCount:     1,
+				MaxRepetitions:      20,
+				MaxOidsPerGet:       10,
+				AdaptiveRepetitions: true,
+			},
+			true,
+		},
+		{
+			`{
+				"ip_address": "10.2.6.79",
+				"snmp_community": "snmpxxx79",
+				"snmp_max_repetitions": 300
+			}`,
+			SnmpParams{},
+			false, // max repetitions out of range
+		},
 	}
 	for i, tt := range tests {
 		var s SnmpParams
@@ -89,3 +208,12 @@ func TestSnmpParams(t *testing.T) {
 		}
 	}
 }
+
+func TestMaskSecrets(t *testing.T) {
+	s := SnmpParams{IPAddress: "10.2.0.9", Community: "public", AuthUser: "user", PrivPasswd: "priv"}
+	s.MaskSecrets()
+	expected := SnmpParams{IPAddress: "10.2.0.9", Community: SecretMask, AuthUser: "user", PrivPasswd: SecretMask}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("MaskSecrets: expected:\n%+v\ngot:\n%+v\n", expected, s)
+	}
+}
@@ -0,0 +1,62 @@
+-- Upgrades a db created before the polling frequency was moved from the metrics
+-- to the measures and profile measures:
+--
+--   $ sudo -u postgres psql -d horus < upgrade-polling-frequency.sql
+--
+-- Each measure gets the lowest polling frequency of its metrics, so that they are
+-- all polled at least as often as before: 0 (on each device poll) if one of them
+-- had none. The profile measures keep a null polling frequency, which uses the
+-- measure one. The last poll time of a measure on a device is the oldest one of
+-- its metrics. The script is run in a single transaction, the db is left unchanged
+-- if it fails.
+
+BEGIN;
+
+-- the measures whose metrics had different polling frequencies, to be reviewed
+-- (or split in several measures) after the upgrade.
+SELECT ms.id,
+       ms.name,
+       array_agg(DISTINCT mt.polling_frequency ORDER BY mt.polling_frequency) AS metric_polling_frequencies
+  FROM measures ms
+  JOIN measure_metrics mm ON mm.measure_id = ms.id
+  JOIN metrics mt ON mt.id = mm.metric_id
+ GROUP BY ms.id, ms.name
+HAVING COUNT(DISTINCT mt.polling_frequency) > 1
+ ORDER BY ms.id;
+
+ALTER TABLE measures ADD COLUMN polling_frequency integer NOT NULL DEFAULT 0 CHECK (polling_frequency >= 0);
+
+UPDATE measures ms
+   SET polling_frequency = f.polling_frequency
+  FROM (SELECT mm.measure_id,
+               MIN(mt.polling_frequency) AS polling_frequency
+          FROM measure_metrics mm
+          JOIN metrics mt ON mt.id = mm.metric_id
+      GROUP BY mm.measure_id) f
+ WHERE f.measure_id = ms.id;
+
+ALTER TABLE profile_measures ADD COLUMN polling_frequency integer CHECK (polling_frequency >= 0);
+
+CREATE TABLE measure_poll_times (
+    id serial PRIMARY KEY,
+    device_id integer NOT NULL REFERENCES devices(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    measure_id integer NOT NULL REFERENCES measures(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    last_polled_at timestamp with time zone NOT NULL,
+    UNIQUE (device_id, measure_id)
+);
+
+INSERT INTO measure_poll_times (device_id, measure_id, last_polled_at)
+     SELECT t.device_id,
+            mm.measure_id,
+            MIN(t.last_polled_at)
+       FROM metric_poll_times t
+       JOIN measure_metrics mm ON mm.metric_id = t.metric_id
+       JOIN measures ms ON (ms.id = mm.measure_id AND ms.polling_frequency > 0)
+   GROUP BY t.device_id, mm.measure_id;
+
+DROP TABLE metric_poll_times;
+ALTER TABLE metrics DROP COLUMN polling_frequency;
+
+ALTER TABLE measure_poll_times OWNER TO horus;
+
+COMMIT;